@@ -19,7 +19,7 @@
 #![allow(non_snake_case)]
 #![allow(unused)]
 
-use clap::Args;
+use clap::{Args, Subcommand};
 use log::info;
 use serde::{Deserialize, Serialize};
 use std::{ffi::{c_char, c_void, CString}, fmt::Debug, process::ExitCode};
@@ -38,6 +38,26 @@ pub struct ServerArgs {
     /// Config file path
     #[arg(short, long)]
     pub config: Option<String>,
+
+    #[command(subcommand)]
+    pub command: Option<ServerCommands>,
+}
+
+#[derive(Subcommand, Debug, PartialEq, Eq, Hash, Clone, Serialize, Deserialize)]
+pub enum ServerCommands {
+    /// Hash a secret for the users config
+    HashSecret(HashSecretArgs),
+}
+
+#[derive(Args, Debug, PartialEq, Eq, Hash, Clone, Serialize, Deserialize)]
+pub struct HashSecretArgs {
+    /// Hash algorithm: storedkey, bcrypt, argon2id or scrypt.
+    /// Only storedkey works with the challenge-response authentication,
+    /// the others need -plaintextAuth
+    #[arg(short, long, default_value = "storedkey")]
+    pub algorithm: String,
+    /// The secret to hash, read from stdin if not given
+    pub secret: Option<String>,
 }
 
 #[derive(Args, Debug, PartialEq, Eq, Hash, Clone, Serialize, Deserialize)]
@@ -169,6 +189,26 @@ pub fn run_client(client_args: ClientArgs) {
     }
 }
 
+pub fn hash_secret(hash_secret_args: HashSecretArgs) {
+    let mut args = vec![
+        "hash-secret".to_owned(),
+        "-algorithm".to_owned(),
+        hash_secret_args.algorithm,
+    ];
+    if let Some(secret) = hash_secret_args.secret {
+        args.push(secret);
+    }
+    let (args, go_str) = convert_to_go_slices(&args);
+    unsafe {
+        #[cfg(target_os = "windows")]
+        {
+            _rt0_amd64_windows_lib();
+        }
+
+        HashSecret(args);
+    }
+}
+
 pub fn run_server(server_args: ServerArgs) {
     let args = if let Some(config) = server_args.config {
         vec!["server".to_owned(), "-config".to_owned(), config]
@@ -192,6 +192,10 @@ extern "C" {
     pub fn RunServer(args: GoSlice);
 }
 
+extern "C" {
+    pub fn HashSecret(args: GoSlice);
+}
+
 extern "C" {
     pub fn RunClient(args: GoSlice);
 }
\ No newline at end of file
@@ -25,7 +25,7 @@ use log::{error, info};
 use gt::*;
 use gt::manager::Signal;
 
-use crate::cs::{ClientArgs, ServerArgs};
+use crate::cs::{ClientArgs, ServerArgs, ServerCommands};
 use crate::manager::ManagerArgs;
 
 #[derive(Parser, Debug)]
@@ -85,6 +85,10 @@ fn main() {
     if let Some(command) = cli.command {
         match command {
             Commands::Server(args) => {
+                if let Some(ServerCommands::HashSecret(hash_secret_args)) = args.command {
+                    cs::hash_secret(hash_secret_args);
+                    return;
+                }
                 manager_args.server_args = Some(args);
             }
             Commands::Client(args) => {
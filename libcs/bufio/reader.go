@@ -89,6 +89,11 @@ func (w *WriteErr) Error() string {
 	return w.err.Error()
 }
 
+// Unwrap returns the underlying error of the writer
+func (w *WriteErr) Unwrap() error {
+	return w.err
+}
+
 // writeBuf writes the Reader's buffer to the writer.
 func (b *LimitedReader) writeBuf(w io.Writer) (n int64, err error) {
 	l := int64(b.w)
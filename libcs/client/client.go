@@ -99,6 +99,7 @@ func New(args []string, out io.Writer) (c *Client, err error) {
 		peers:   make(map[uint32]PeerTask),
 	}
 	c.config.Store(&conf)
+	c.metrics = newClientMetrics(c)
 	c.tunnelsCond = sync.NewCond(c.tunnelsRWMtx.RLocker())
 	c.apiServer = api.NewServer(l.With().Str("scope", "api").Logger())
 	c.apiServer.ReadTimeout = 30 * time.Second
@@ -364,6 +365,11 @@ func (d *dialer) msquicDial() (conn net.Conn, err error) {
 	return msquic.MsquicDial(d.quic, d.tlsConfig)
 }
 
+// secure tells whether dial uses TLS or QUIC
+func (d *dialer) secure() bool {
+	return !d.preferQuic && len(d.tls) > 0 || len(d.quic) > 0
+}
+
 func (d *dialer) dial() (conn net.Conn, err error) {
 	if !d.preferQuic && len(d.tls) > 0 {
 		return d.tlsDial()
@@ -510,6 +516,13 @@ func (c *Client) Start() (err error) {
 	}
 	c.idleManager = newIdleManager(c.Config().RemoteIdleConnections)
 
+	if len(c.Config().MetricsAddr) > 0 {
+		err = c.startMetricsServer()
+		if err != nil {
+			return
+		}
+	}
+
 	conf4Log := *c.Config()
 	conf4Log.Secret = "******"
 	conf4Log.Password = "******"
@@ -560,8 +573,10 @@ func (c *Client) GetConnectionPoolNetInfo() (pools []PoolInfo) {
 	defer c.tunnelsRWMtx.RUnlock()
 	for conn := range c.tunnels {
 		pools = append(pools, PoolInfo{
-			LocalAddr:  conn.LocalAddr(),
-			RemoteAddr: conn.RemoteAddr(),
+			LocalAddr:       conn.LocalAddr(),
+			RemoteAddr:      conn.RemoteAddr(),
+			ProtocolVersion: uint16(conn.version.Load()),
+			Features:        predef.FeatureNames(conn.features.Load()),
 		})
 	}
 	return
@@ -588,6 +603,7 @@ func (c *Client) Close() {
 		c.idleManager.Close()
 	}
 	c.Logger.Info().Err(c.apiServer.Close()).Msg("api server close")
+	c.Logger.Info().Err(c.metrics.close()).Msg("metrics server close")
 	if c.tcpForwardListener != nil {
 		_ = c.tcpForwardListener.Close()
 	}
@@ -622,6 +638,7 @@ func (c *Client) ShutdownWithoutClosingLogger() {
 	c.waitTunnelsShutdown.Wait()
 
 	c.Logger.Info().Err(c.apiServer.Close()).Msg("api server close")
+	c.Logger.Info().Err(c.metrics.close()).Msg("metrics server close")
 	if c.tcpForwardListener != nil {
 		_ = c.tcpForwardListener.Close()
 	}
@@ -637,6 +654,7 @@ func (c *Client) initConn(d dialer, connID uint) (result *conn, err error) {
 		return
 	}
 	result = newConn(conn, c)
+	result.secure = d.secure() && !c.Config().RemoteCertInsecure
 	result.stuns = append(result.stuns, d.stuns...)
 	result.Logger = c.Logger.With().Uint("connID", connID).Logger()
 	err = result.init()
@@ -701,6 +719,7 @@ func (c *Client) connectLoop(d dialer, connID uint) {
 		if c.connect(d, connID) {
 			break
 		}
+		c.metrics.reconnected()
 	}
 	c.Logger.Info().Msg("connect loop exited")
 	c.waitTunnelsShutdown.Done()
@@ -792,6 +811,20 @@ func parseServices(config *Config) (result services, err error) {
 				configServices[i].RemoteTCPRandom = &x.Value
 			}
 		}
+		for _, x := range config.RemoteUDPPort {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].RemoteUDPPort = x.Value
+			}
+		}
+		for _, x := range config.RemoteUDPRandom {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].RemoteUDPRandom = &x.Value
+			}
+		}
 		for _, x := range config.LocalTimeout {
 			if configServicesLen == 1 ||
 				(x.Position > config.Local[i].Position &&
@@ -806,6 +839,20 @@ func parseServices(config *Config) (result services, err error) {
 				configServices[i].UseLocalAsHTTPHost = x.Value
 			}
 		}
+		for _, x := range config.ProxyProtocol {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].ProxyProtocol = x.Value
+			}
+		}
+		for _, x := range config.ForwardedHeaders {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].ForwardedHeaders = x.Value
+			}
+		}
 		for _, x := range config.HostPrefix {
 			if configServicesLen == 1 ||
 				(x.Position > config.Local[i].Position &&
@@ -813,10 +860,109 @@ func parseServices(config *Config) (result services, err error) {
 				configServices[i].HostPrefix = x.Value
 			}
 		}
+		for _, x := range config.Domain {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].Domain = x.Value
+			}
+		}
+		for _, x := range config.PathPrefix {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].PathPrefix = x.Value
+			}
+		}
+		for _, x := range config.StripPathPrefix {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].StripPathPrefix = x.Value
+			}
+		}
+		for _, x := range config.AuthBasic {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].AuthBasic = append(configServices[i].AuthBasic, x.Value)
+			}
+		}
+		for _, x := range config.AuthHtpasswd {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].AuthHtpasswd = x.Value
+			}
+		}
+		for _, x := range config.AuthBearer {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].AuthBearer = append(configServices[i].AuthBearer, x.Value)
+			}
+		}
+		for _, x := range config.AuthLogin {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].AuthLogin = x.Value
+			}
+		}
+		for _, x := range config.AllowIPs {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].AllowIPs = append(configServices[i].AllowIPs, x.Value)
+			}
+		}
+		for _, x := range config.DenyIPs {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].DenyIPs = append(configServices[i].DenyIPs, x.Value)
+			}
+		}
+		for _, x := range config.UploadSpeed {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].UploadSpeed = x.Value
+			}
+		}
+		for _, x := range config.DownloadSpeed {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].DownloadSpeed = x.Value
+			}
+		}
+		for _, x := range config.Group {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].Group = x.Value
+			}
+		}
+		for _, x := range config.GroupSecret {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].GroupSecret = x.Value
+			}
+		}
+		for _, x := range config.Standby {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].Standby = x.Value
+			}
+		}
 	}
 	result = append(configServices, config.Services...)
 
-	usedIDASHostPrefix := false
+	// 同一 host 前缀下可以有多个路径不同的服务
+	usedIDASHostPrefix := make(map[string]bool)
 	for i := 0; i < len(result); i++ {
 		if result[i].LocalURL.URL == nil {
 			err = errors.New("local url (-local option) cannot be empty")
@@ -830,11 +976,51 @@ func parseServices(config *Config) (result services, err error) {
 			result[i].RemoteTCPRandom = new(bool)
 			*result[i].RemoteTCPRandom = result[i].LocalURL.Scheme == "tcp" && result[i].RemoteTCPPort == 0
 		}
+		if result[i].RemoteUDPRandom == nil {
+			result[i].RemoteUDPRandom = new(bool)
+			*result[i].RemoteUDPRandom = result[i].LocalURL.Scheme == "udp" && result[i].RemoteUDPPort == 0
+		}
+		// 处理 PathPrefix
+		if len(result[i].PathPrefix) > 0 {
+			if result[i].LocalURL.Scheme != "http" {
+				err = errors.New("-pathPrefix option is only supported when local url (-local option) begin with http://")
+				return
+			}
+			p := result[i].PathPrefix
+			if p[0] != '/' || len(p) > predef.MaxRoutePathSize ||
+				strings.ContainsAny(p, "?# \t\r\n") || strings.Contains(p, "//") {
+				err = fmt.Errorf("path prefix (-pathPrefix option) '%s' is invalid", p)
+				return
+			}
+			result[i].PathPrefix = strings.TrimRight(p, "/")
+		}
+		if result[i].StripPathPrefix && len(result[i].PathPrefix) == 0 {
+			err = errors.New("-stripPathPrefix option needs a -pathPrefix option other than '/'")
+			return
+		}
+		// 处理 Domain
+		if len(result[i].Domain) > 0 {
+			if result[i].LocalURL.Scheme != "http" && result[i].LocalURL.Scheme != "https" {
+				err = errors.New("-domain option is only supported when local url (-local option) begin with http:// or https://")
+				return
+			}
+			if len(result[i].HostPrefix) > 0 {
+				err = errors.New("-domain option and -hostPrefix option can not be used together")
+				return
+			}
+			d := strings.ToLower(strings.TrimSuffix(result[i].Domain, "."))
+			if len(d) > predef.MaxDomainSize || !strings.Contains(d, ".") ||
+				strings.Contains(strings.TrimPrefix(d, "*."), "*") || strings.ContainsAny(d, "/:?# \t\r\n") {
+				err = fmt.Errorf("domain (-domain option) '%s' is invalid", result[i].Domain)
+				return
+			}
+			result[i].Domain = d
+		}
 		if (result[i].LocalURL.Scheme == "http" || result[i].LocalURL.Scheme == "https") &&
-			result[i].HostPrefix == "" {
-			if !usedIDASHostPrefix {
+			result[i].HostPrefix == "" && result[i].Domain == "" {
+			if !usedIDASHostPrefix[result[i].PathPrefix] {
 				result[i].HostPrefix = config.ID
-				usedIDASHostPrefix = true
+				usedIDASHostPrefix[result[i].PathPrefix] = true
 			} else {
 				err = errors.New("multi-services needs multiple hostPrefix")
 				return
@@ -860,8 +1046,44 @@ func parseServices(config *Config) (result services, err error) {
 				err = errors.New("-remoteTCPPort or -remoteTCPRandom option should be set when local url (-local option) begin with tcp://")
 				return
 			}
+		case "udp":
+			if result[i].LocalURL.Port() == "" {
+				err = errors.New("-local option should contain port when local url (-local option) begin with udp://")
+				return
+			}
+			if result[i].RemoteUDPPort == 0 && !*result[i].RemoteUDPRandom {
+				err = errors.New("-remoteUDPPort or -remoteUDPRandom option should be set when local url (-local option) begin with udp://")
+				return
+			}
 		default:
-			err = fmt.Errorf("local url (-local option) '%s' must begin with http://, https:// or tcp://", result[i].LocalURL.String())
+			err = fmt.Errorf("local url (-local option) '%s' must begin with http://, https://, tcp:// or udp://", result[i].LocalURL.String())
+			return
+		}
+
+		switch result[i].ProxyProtocol {
+		case "", connection.ProxyProtocolV1, connection.ProxyProtocolV2:
+		default:
+			err = fmt.Errorf("proxy protocol (-proxyProtocol option) '%s' is invalid, supported: v1, v2", result[i].ProxyProtocol)
+			return
+		}
+		if len(result[i].ProxyProtocol) > 0 && result[i].LocalURL.Scheme == "udp" {
+			err = errors.New("-proxyProtocol option is not supported when local url (-local option) begin with udp://")
+			return
+		}
+		if result[i].ForwardedHeaders && result[i].LocalURL.Scheme != "http" {
+			err = errors.New("-forwardedHeaders option is only supported when local url (-local option) begin with http://")
+			return
+		}
+		err = parseServiceAuth(&result[i], config.Secret)
+		if err != nil {
+			return
+		}
+		err = parseServiceIPFilter(&result[i])
+		if err != nil {
+			return
+		}
+		err = checkServiceGroup(&result[i])
+		if err != nil {
 			return
 		}
 
@@ -876,8 +1098,19 @@ func parseServices(config *Config) (result services, err error) {
 	// HostPrefix 不能重复
 	for i := 0; i < len(result); i++ {
 		for j := i + 1; j < len(result); j++ {
+			if len(result[i].Domain) > 0 &&
+				result[i].Domain == result[j].Domain &&
+				result[i].PathPrefix == result[j].PathPrefix {
+				err = fmt.Errorf("duplicated domain: %v%v", result[i].Domain, result[i].PathPrefix)
+				return
+			}
 			if len(result[i].HostPrefix) > 0 &&
-				result[i].HostPrefix == result[j].HostPrefix {
+				result[i].HostPrefix == result[j].HostPrefix &&
+				result[i].PathPrefix == result[j].PathPrefix {
+				if len(result[i].PathPrefix) > 0 {
+					err = fmt.Errorf("duplicated path-prefix: %v%v", result[i].HostPrefix, result[i].PathPrefix)
+					return
+				}
 				err = fmt.Errorf("duplicated host-prefix: %v", result[i].HostPrefix)
 				return
 			}
@@ -959,12 +1192,20 @@ func (c *Client) ReloadServices(args []string) (err error) {
 	buf := pool.BytesPool.Get().([]byte)
 	defer pool.BytesPool.Put(buf)
 	i := copy(buf, connection.ServicesBytes)
-	n := gen(conf, services, buf[i:])
 
 	conf4Log := conf
 	conf4Log.Secret = "******"
 	c.Logger.Info().Str("config", "reloading").Msg(spew.Sdump(conf4Log))
 
+	if c.legacyHandshake.Load() && services.hasUDP() {
+		err = errUDPNotSupported
+		return
+	}
+	if !conf.PlaintextAuth && services.hasGroup() && c.hasInsecureTunnel() {
+		err = errGroupNotSecure
+		return
+	}
+
 	c.initConnMtx.Lock()
 	defer c.initConnMtx.Unlock()
 	c.config.Store(&conf)
@@ -974,7 +1215,8 @@ func (c *Client) ReloadServices(args []string) (err error) {
 	c.tunnelsRWMtx.RLock()
 	defer c.tunnelsRWMtx.RUnlock()
 	for t := range c.tunnels {
-		_, err = t.Write(buf[:n+i])
+		// 质询应答认证时每个 tunnel 的随机数不同
+		_, err = t.Write(gen(conf, services, t.nonce, t.secure, !t.legacy, buf[:i]))
 		if err != nil {
 			return
 		}
@@ -15,8 +15,14 @@
 package client
 
 import (
+	"bytes"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/isrc-cas/gt/config"
+	"github.com/isrc-cas/gt/pool"
 )
 
 func TestClientWaitUntilReady(t *testing.T) {
@@ -37,3 +43,37 @@ func TestClientWaitUntilReady(t *testing.T) {
 		t.Fatal("err == timeout")
 	}
 }
+
+func TestGenLargeEdgeAuth(t *testing.T) {
+	args := []string{"client", "-id", "id1", "-secret", "secret1", "-remote", "tcp://127.0.0.1:1"}
+	for i := 0; i < 8; i++ {
+		args = append(args, "-local", "http://127.0.0.1:80", "-hostPrefix", fmt.Sprintf("id%d", i))
+		for j := 0; j < 4; j++ {
+			args = append(args, "-authBearer", fmt.Sprintf("%d-%d-", i, j)+strings.Repeat("t", 240))
+		}
+	}
+	conf := getDefaultConfig(args)
+	err := config.ParseFlags(args, &conf, &conf.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err := parseServices(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 所有服务的访问策略加起来超过了缓冲区的大小
+	buf := pool.BytesPool.Get().([]byte)
+	defer pool.BytesPool.Put(buf)
+	b := gen(conf, services, nil, false, true, buf[:0])
+	if len(b) <= len(buf) {
+		t.Fatalf("handshake is only %d bytes", len(b))
+	}
+	for i := range services {
+		for _, token := range services[i].AuthBearer {
+			if !bytes.Contains(b, []byte(token)) {
+				t.Fatalf("token %q of service %d is missing", token, i)
+			}
+		}
+	}
+}
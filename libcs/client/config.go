@@ -42,6 +42,7 @@ type Options struct {
 	Config                string               `arg:"config" yaml:"-" json:"-" usage:"The config file path to load"`
 	ID                    string               `yaml:"id,omitempty" json:",omitempty" usage:"The unique id used to connect to server. Now it's the prefix of the domain."`
 	Secret                string               `yaml:"secret,omitempty" json:",omitempty" usage:"The secret used to verify the id"`
+	PlaintextAuth         bool                 `yaml:"plaintextAuth,omitempty" json:",omitempty" usage:"Send the secret in cleartext for servers that do not support the challenge-response authentication"`
 	ReconnectDelay        config.Duration      `yaml:"reconnectDelay,omitempty" json:",omitempty" usage:"The delay before reconnect. Supports values like '30s', '5m'"`
 	Remote                config.Slice[string] `yaml:"remote,omitempty" json:",omitempty" usage:"The remote server url. Supports tcp:// and tls:// and quic://, default tcp://"`
 	RemoteSTUN            config.Slice[string] `yaml:"remoteSTUN,omitempty" json:",omitempty" usage:"The remote STUN server address"`
@@ -53,11 +54,31 @@ type Options struct {
 	RemoteTimeout         config.Duration      `yaml:"remoteTimeout,omitempty" json:",omitempty" usage:"The timeout of remote connections. Supports values like '30s', '5m'"`
 
 	HostPrefix         config.PositionSlice[string]        `yaml:"-" json:"-" arg:"hostPrefix"  usage:"The server will recognize this host prefix and forward data to local"`
+	Domain             config.PositionSlice[string]        `yaml:"-" json:"-" arg:"domain" usage:"The full domain like 'shop.example.com' or wildcard domain like '*.example.com' that the server will forward to local, instead of a host prefix"`
+	PathPrefix         config.PositionSlice[string]        `yaml:"-" json:"-" arg:"pathPrefix" usage:"The server will forward requests under this path of the host prefix to local, the longest matching path prefix wins"`
+	StripPathPrefix    config.PositionSlice[bool]          `yaml:"-" json:"-" arg:"stripPathPrefix" usage:"Remove the path prefix from the request path before forwarding it to local"`
 	RemoteTCPPort      config.PositionSlice[uint16]        `yaml:"-" json:"-" arg:"remoteTCPPort" usage:"The TCP port that the remote server will open"`
 	RemoteTCPRandom    config.PositionSlice[bool]          `yaml:"-" json:"-" arg:"remoteTCPRandom" usage:"Whether to choose a random tcp port by the remote server"`
+	RemoteUDPPort      config.PositionSlice[uint16]        `yaml:"-" json:"-" arg:"remoteUDPPort" usage:"The UDP port that the remote server will open"`
+	RemoteUDPRandom    config.PositionSlice[bool]          `yaml:"-" json:"-" arg:"remoteUDPRandom" usage:"Whether to choose a random udp port by the remote server"`
 	Local              config.PositionSlice[string]        `yaml:"-" json:"-" arg:"local" usage:"The local service url"`
 	LocalTimeout       config.PositionSlice[time.Duration] `yaml:"-" json:"-" arg:"localTimeout" usage:"The timeout of local connections. Supports values like '30s', '5m'"`
 	UseLocalAsHTTPHost config.PositionSlice[bool]          `yaml:"-" json:"-" arg:"useLocalAsHTTPHost" usage:"Use the local address as host"`
+	ProxyProtocol      config.PositionSlice[string]        `yaml:"-" json:"-" arg:"proxyProtocol" usage:"Send PROXY protocol header with the visitor address to the local service. Supports values: v1, v2"`
+	ForwardedHeaders   config.PositionSlice[bool]          `yaml:"-" json:"-" arg:"forwardedHeaders" usage:"Add X-Forwarded-For, X-Forwarded-Host, X-Forwarded-Proto, X-Real-IP and Forwarded headers to every request sent to the local http service"`
+	AuthBasic          config.PositionSlice[string]        `yaml:"-" json:"-" arg:"authBasic" usage:"The user allowed to visit the http service, like 'user:password' or 'user:hash'. Passwords are hashed with bcrypt before they are sent to the server"`
+	AuthHtpasswd       config.PositionSlice[string]        `yaml:"-" json:"-" arg:"authHtpasswd" usage:"The htpasswd file with the users allowed to visit the http service"`
+	AuthBearer         config.PositionSlice[string]        `yaml:"-" json:"-" arg:"authBearer" usage:"The bearer token allowed to visit the http service"`
+	AuthLogin          config.PositionSlice[bool]          `yaml:"-" json:"-" arg:"authLogin" usage:"Show a login page to browsers and keep them logged in with a signed cookie instead of asking for HTTP basic auth"`
+	AllowIPs           config.PositionSlice[string]        `yaml:"-" json:"-" arg:"allowIP" usage:"The CIDR or IP allowed to visit the service, like 10.0.0.0/8. Visitors from other addresses are rejected by the server"`
+	DenyIPs            config.PositionSlice[string]        `yaml:"-" json:"-" arg:"denyIP" usage:"The CIDR or IP denied to visit the service, like 192.168.1.0/24"`
+	UploadSpeed        config.PositionSlice[uint32]        `yaml:"-" json:"-" arg:"uploadSpeed" usage:"The max number of bytes per second the service can send to all its visitors, limited by the server"`
+	DownloadSpeed      config.PositionSlice[uint32]        `yaml:"-" json:"-" arg:"downloadSpeed" usage:"The max number of bytes per second all visitors can send to the service, limited by the server"`
+	Group              config.PositionSlice[string]        `yaml:"-" json:"-" arg:"group" usage:"The group of the http, https or tcp service. Clients with the same group and group secret share one host prefix or tcp port, and the server balances visitors across them. Use 'id/name' to join the group of another id"`
+	GroupSecret        config.PositionSlice[string]        `yaml:"-" json:"-" arg:"groupSecret" usage:"The secret of the group, which all members of the group must present"`
+	Standby            config.PositionSlice[bool]          `yaml:"-" json:"-" arg:"standby" usage:"Join the group as a standby member, which only receives visitors when no primary member of the group is online"`
+
+	MetricsAddr string `yaml:"metricsAddr,omitempty" json:",omitempty" usage:"The address to listen on for Prometheus metrics at '/metrics'. Supports values like: '9101', ':9101' or '127.0.0.1:9101'"`
 
 	SentryDSN         string               `yaml:"sentryDSN,omitempty" json:",omitempty" usage:"Sentry DSN to use"`
 	SentryLevel       config.Slice[string] `yaml:"sentryLevel,omitempty" json:",omitempty" usage:"Sentry levels: trace, debug, info, warn, error, fatal, panic (default [\"error\", \"fatal\", \"panic\"])"`
@@ -167,13 +188,34 @@ func (c clientURL) MarshalJSON() ([]byte, error) {
 
 type service struct {
 	HostPrefix         string          `yaml:"hostPrefix,omitempty" json:",omitempty"`
+	Domain             string          `yaml:"domain,omitempty" json:",omitempty"`
+	PathPrefix         string          `yaml:"pathPrefix,omitempty" json:",omitempty"`
+	StripPathPrefix    bool            `yaml:"stripPathPrefix,omitempty" json:",omitempty"`
 	RemoteTCPPort      uint16          `yaml:"remoteTCPPort,omitempty" json:",omitempty"`
 	RemoteTCPRandom    *bool           `yaml:"remoteTCPRandom,omitempty" json:",omitempty"`
+	RemoteUDPPort      uint16          `yaml:"remoteUDPPort,omitempty" json:",omitempty"`
+	RemoteUDPRandom    *bool           `yaml:"remoteUDPRandom,omitempty" json:",omitempty"`
 	LocalURL           clientURL       `yaml:"local,omitempty" json:",omitempty"`
 	LocalTimeout       config.Duration `yaml:"localTimeout,omitempty" json:",omitempty"`
 	UseLocalAsHTTPHost bool            `yaml:"useLocalAsHTTPHost,omitempty" json:",omitempty"`
+	ProxyProtocol      string          `yaml:"proxyProtocol,omitempty" json:",omitempty"`
+	ForwardedHeaders   bool            `yaml:"forwardedHeaders,omitempty" json:",omitempty"`
+	AuthBasic          []string        `yaml:"authBasic,omitempty" json:",omitempty"`
+	AuthHtpasswd       string          `yaml:"authHtpasswd,omitempty" json:",omitempty"`
+	AuthBearer         []string        `yaml:"authBearer,omitempty" json:",omitempty"`
+	AuthLogin          bool            `yaml:"authLogin,omitempty" json:",omitempty"`
+	AllowIPs           []string        `yaml:"allowIPs,omitempty" json:",omitempty"`
+	DenyIPs            []string        `yaml:"denyIPs,omitempty" json:",omitempty"`
+	UploadSpeed        uint32          `yaml:"uploadSpeed,omitempty" json:",omitempty"`
+	DownloadSpeed      uint32          `yaml:"downloadSpeed,omitempty" json:",omitempty"`
+	Group              string          `yaml:"group,omitempty" json:",omitempty"`
+	GroupSecret        string          `yaml:"groupSecret,omitempty" json:",omitempty"`
+	Standby            bool            `yaml:"standby,omitempty" json:",omitempty"`
 
 	remoteTCPPort uint32
+	remoteUDPPort uint32
+	authBasic     []string // 密码哈希后的 user:hash
+	authDigest    string   // 访问策略的摘要，用于判断配置是否变化
 }
 
 func (s *service) String() string {
@@ -181,6 +223,17 @@ func (s *service) String() string {
 	sb.WriteString("service {")
 	sb.WriteString("hostPrefix: ")
 	sb.WriteString(s.HostPrefix)
+	if len(s.Domain) > 0 {
+		sb.WriteString(", domain: ")
+		sb.WriteString(s.Domain)
+	}
+	if len(s.PathPrefix) > 0 {
+		sb.WriteString(", pathPrefix: ")
+		sb.WriteString(s.PathPrefix)
+		if s.StripPathPrefix {
+			sb.WriteString(", stripPathPrefix: true")
+		}
+	}
 	sb.WriteString(", local: ")
 	sb.WriteString(s.LocalURL.String())
 	sb.WriteString(", remoteTCPPort: ")
@@ -189,6 +242,51 @@ func (s *service) String() string {
 		sb.WriteString(", remoteTCPRandom: ")
 		sb.WriteString(fmt.Sprintf("%t", *s.RemoteTCPRandom))
 	}
+	if s.LocalURL.URL != nil && s.LocalURL.Scheme == "udp" {
+		sb.WriteString(", remoteUDPPort: ")
+		sb.WriteString(strconv.Itoa(int(s.RemoteUDPPort)))
+		if s.RemoteUDPRandom != nil {
+			sb.WriteString(", remoteUDPRandom: ")
+			sb.WriteString(fmt.Sprintf("%t", *s.RemoteUDPRandom))
+		}
+	}
+	if len(s.ProxyProtocol) > 0 {
+		sb.WriteString(", proxyProtocol: ")
+		sb.WriteString(s.ProxyProtocol)
+	}
+	if s.ForwardedHeaders {
+		sb.WriteString(", forwardedHeaders: true")
+	}
+	if len(s.authDigest) > 0 {
+		sb.WriteString(", auth: ")
+		sb.WriteString(s.authDigest)
+		if s.AuthLogin {
+			sb.WriteString(", authLogin: true")
+		}
+	}
+	if len(s.AllowIPs) > 0 {
+		sb.WriteString(", allowIPs: ")
+		sb.WriteString(strings.Join(s.AllowIPs, " "))
+	}
+	if len(s.DenyIPs) > 0 {
+		sb.WriteString(", denyIPs: ")
+		sb.WriteString(strings.Join(s.DenyIPs, " "))
+	}
+	if s.UploadSpeed > 0 {
+		sb.WriteString(", uploadSpeed: ")
+		sb.WriteString(strconv.FormatUint(uint64(s.UploadSpeed), 10))
+	}
+	if s.DownloadSpeed > 0 {
+		sb.WriteString(", downloadSpeed: ")
+		sb.WriteString(strconv.FormatUint(uint64(s.DownloadSpeed), 10))
+	}
+	if len(s.Group) > 0 {
+		sb.WriteString(", group: ")
+		sb.WriteString(s.Group)
+		if s.Standby {
+			sb.WriteString(", standby: true")
+		}
+	}
 	sb.WriteString("}")
 	return sb.String()
 }
@@ -207,3 +305,23 @@ func (ss services) String() string {
 	sb.WriteByte(']')
 	return sb.String()
 }
+
+// hasGroup tells whether there is any service joining a service group
+func (ss services) hasGroup() bool {
+	for i := range ss {
+		if ss[i].hasGroup() {
+			return true
+		}
+	}
+	return false
+}
+
+// hasUDP tells whether there is any udp service
+func (ss services) hasUDP() bool {
+	for _, s := range ss {
+		if s.LocalURL.Scheme == "udp" {
+			return true
+		}
+	}
+	return false
+}
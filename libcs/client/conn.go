@@ -15,11 +15,14 @@
 package client
 
 import (
+	"encoding/binary"
 	"errors"
 	"github.com/isrc-cas/gt/util"
+	"io"
 	"net"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/isrc-cas/gt/bufio"
@@ -37,11 +40,18 @@ type conn struct {
 	tasksRWMtx    sync.RWMutex
 	stuns         []string
 	services      atomic.Pointer[services]
+	nonce         []byte        // 服务端质询应答认证的随机数，nil 表示明文认证
+	legacy        bool          // 使用不带 Capabilities option 的老版本握手
+	secure        bool          // 连接经过 TLS 或 QUIC 加密并且验证了服务端证书
+	version       atomic.Uint32 // 服务端的协议版本
+	features      atomic.Uint32 // 与服务端协商的协议特性
 }
 
 type PoolInfo struct {
-	LocalAddr  net.Addr
-	RemoteAddr net.Addr
+	LocalAddr       net.Addr
+	RemoteAddr      net.Addr
+	ProtocolVersion uint16
+	Features        []string
 }
 
 func newConn(c net.Conn, client *Client) *conn {
@@ -62,77 +72,196 @@ func (c *conn) init() (err error) {
 	var n int
 	buf[n] = predef.MagicNumber
 	n++
-	buf[n] = 0x01 // version
-	n++
+	config := c.client.config.Load()
+	if config.PlaintextAuth {
+		buf[n] = 0x01 // version
+		n++
+	} else {
+		buf[n] = 0x03 // version，质询应答认证
+		n++
+		_, err = c.Conn.Write(buf[:n])
+		if err != nil {
+			return
+		}
+		err = c.readChallenge()
+		if err != nil {
+			return
+		}
+		n = 0
+	}
 
-	bufIndex := gen(*c.client.config.Load(), *c.client.services.Load(), buf[n:])
-	_, err = c.Conn.Write(buf[:bufIndex+n])
+	services := *c.client.services.Load()
+	// 老版本的服务端只支持明文认证
+	c.legacy = c.nonce == nil && c.client.legacyHandshake.Load()
+	if c.legacy && services.hasUDP() {
+		err = errUDPNotSupported
+		return
+	}
+	if !c.secure && !config.PlaintextAuth && services.hasGroup() {
+		err = errGroupNotSecure
+		return
+	}
+	_, err = c.Conn.Write(gen(*config, services, c.nonce, c.secure, !c.legacy, buf[:n]))
+	return
+}
+
+var errUDPNotSupported = errors.New("the server does not support udp services")
+
+// readChallenge 读取服务端质询应答认证的随机数
+func (c *conn) readChallenge() (err error) {
+	if timeout := c.client.Config().RemoteTimeout.Duration; timeout > 0 {
+		err = c.Conn.SetReadDeadline(time.Now().Add(timeout))
+		if err != nil {
+			return
+		}
+	}
+	header, err := c.Reader.Peek(2)
+	if err != nil {
+		return
+	}
+	if header[0] != predef.MagicNumber || header[1] != 0x03 {
+		err = errors.New("server does not support challenge-response authentication, try the plaintextAuth option")
+		return
+	}
+	_, err = c.Reader.Discard(2)
+	if err != nil {
+		return
+	}
+	nonce, err := c.Reader.Peek(connection.NonceSize)
+	if err != nil {
+		return
+	}
+	c.nonce = make([]byte, connection.NonceSize)
+	copy(c.nonce, nonce)
+	_, err = c.Reader.Discard(connection.NonceSize)
 	return
 }
 
-func gen(config Config, services services, buf []byte) (n int) {
+// gen 将握手的 id、secret 与 options 追加到 buf 之后，enroll 为 true 时质询应答附带 stored key，
+// capabilities 为 false 时不发送老版本服务端不支持的 Capabilities option。
+// 服务的访问策略与 IP 过滤等 option 可能使握手超过 buf 的容量，此时 append 会分配更大的内存
+func gen(config Config, services services, nonce []byte, enroll bool, capabilities bool, buf []byte) []byte {
 	// id
-	buf[n] = byte(len(config.ID))
-	n++
-	idLen := copy(buf[n:], config.ID)
-	n += idLen
+	buf = append(buf, byte(len(config.ID)))
+	buf = append(buf, config.ID...)
 
 	// secret
-	buf[n] = byte(len(config.Secret))
-	n++
-	secretLen := copy(buf[n:], config.Secret)
-	n += secretLen
+	if nonce == nil {
+		buf = append(buf, byte(len(config.Secret)))
+		buf = append(buf, config.Secret...)
+	} else if enroll {
+		// 加密连接上附带 stored key，allowAnyClient 模式的服务端用它登记新的 id
+		buf = append(buf, connection.EnrollmentSize)
+		buf = append(buf, connection.GenEnrollment(config.ID, config.Secret, nonce)...)
+	} else {
+		buf = append(buf, connection.ProofSize)
+		buf = append(buf, connection.GenProof(config.ID, config.Secret, nonce)...)
+	}
+
+	// capabilities
+	if capabilities {
+		buf = append(buf, predef.OptionAndNextOption...)
+		buf = append(buf, predef.Capabilities...)
+		buf = append(buf,
+			byte(predef.ProtocolVersion>>8), byte(predef.ProtocolVersion),
+			byte(predef.Features>>24), byte(predef.Features>>16), byte(predef.Features>>8), byte(predef.Features),
+		)
+	}
 
 	// services
 	for i, service := range services {
 		if i != len(services)-1 {
-			optionLen := copy(buf[n:], predef.OptionAndNextOption)
-			n += optionLen
+			buf = append(buf, predef.OptionAndNextOption...)
+		}
+		if service.hasAuth() {
+			// 服务之后还有一个 EdgeAuth option
+			buf = append(buf, predef.OptionAndNextOption...)
+		}
+		if service.hasIPFilter() {
+			// 服务之后还有一个 IPFilter option
+			buf = append(buf, predef.OptionAndNextOption...)
+		}
+		if service.hasSpeedLimit() {
+			// 服务之后还有一个 SpeedLimit option
+			buf = append(buf, predef.OptionAndNextOption...)
+		}
+		if service.hasGroup() {
+			// 服务之后还有一个 Group option
+			buf = append(buf, predef.OptionAndNextOption...)
+			if service.Standby {
+				// Group option 之后还有一个 Standby option
+				buf = append(buf, predef.OptionAndNextOption...)
+			}
 		}
 		switch service.LocalURL.Scheme {
 		case "tcp":
-			optionLen := copy(buf[n:], predef.OpenTCPPort)
-			n += optionLen
-
-			if *service.RemoteTCPRandom {
-				buf[n] = 1
-			} else {
-				buf[n] = 0
-			}
-			n++
-
-			buf[n] = byte(service.RemoteTCPPort >> 8)
-			buf[n+1] = byte(service.RemoteTCPPort)
-			n += 2
+			buf = append(buf, predef.OpenTCPPort...)
+			buf = appendBool(buf, *service.RemoteTCPRandom)
+			buf = append(buf, byte(service.RemoteTCPPort>>8), byte(service.RemoteTCPPort))
+		case "udp":
+			buf = append(buf, predef.OpenUDPPort...)
+			buf = appendBool(buf, *service.RemoteUDPRandom)
+			buf = append(buf, byte(service.RemoteUDPPort>>8), byte(service.RemoteUDPPort))
 		case "http":
-			if service.HostPrefix == config.ID {
-				optionLen := copy(buf[n:], predef.IDAsHostPrefix)
-				n += optionLen
+			if len(service.Domain) > 0 {
+				buf = append(buf, predef.OpenDomain...)
+				buf = appendString(buf, service.Domain)
+				buf = appendString(buf, service.PathPrefix)
+				buf = appendBool(buf, service.StripPathPrefix)
+			} else if len(service.PathPrefix) > 0 {
+				buf = append(buf, predef.OpenHostPath...)
+				// host 前缀长度为 0 时服务端使用 id
+				if service.HostPrefix == config.ID {
+					buf = append(buf, 0)
+				} else {
+					buf = appendString(buf, service.HostPrefix)
+				}
+				buf = appendString(buf, service.PathPrefix)
+				buf = appendBool(buf, service.StripPathPrefix)
+			} else if service.HostPrefix == config.ID {
+				buf = append(buf, predef.IDAsHostPrefix...)
 			} else {
-				optionLen := copy(buf[n:], predef.OpenHost)
-				n += optionLen
-
-				buf[n] = byte(len(service.HostPrefix))
-				n++
-				hostPrefixLen := copy(buf[n:], service.HostPrefix)
-				n += hostPrefixLen
+				buf = append(buf, predef.OpenHost...)
+				buf = appendString(buf, service.HostPrefix)
 			}
 		case "https":
-			if service.HostPrefix == config.ID {
-				optionLen := copy(buf[n:], predef.IDAsTLSHostPrefix)
-				n += optionLen
+			if len(service.Domain) > 0 {
+				buf = append(buf, predef.OpenTLSDomain...)
+				buf = appendString(buf, service.Domain)
+			} else if service.HostPrefix == config.ID {
+				buf = append(buf, predef.IDAsTLSHostPrefix...)
 			} else {
-				optionLen := copy(buf[n:], predef.OpenTLSHost)
-				n += optionLen
-
-				buf[n] = byte(len(service.HostPrefix))
-				n++
-				hostPrefixLen := copy(buf[n:], service.HostPrefix)
-				n += hostPrefixLen
+				buf = append(buf, predef.OpenTLSHost...)
+				buf = appendString(buf, service.HostPrefix)
 			}
 		}
+		if service.hasAuth() {
+			buf = genEdgeAuth(&service, buf)
+		}
+		if service.hasIPFilter() {
+			buf = genIPFilter(&service, buf)
+		}
+		if service.hasSpeedLimit() {
+			buf = genSpeedLimit(&service, buf)
+		}
+		if service.hasGroup() {
+			buf = genGroup(&service, buf)
+		}
 	}
-	return
+	return buf
+}
+
+// appendString 追加一个字节的长度与字符串
+func appendString(buf []byte, s string) []byte {
+	buf = append(buf, byte(len(s)))
+	return append(buf, s...)
+}
+
+func appendBool(buf []byte, b bool) []byte {
+	if b {
+		return append(buf, 1)
+	}
+	return append(buf, 0)
 }
 
 func (c *conn) IsTimeout(e error) (result bool) {
@@ -159,6 +288,16 @@ func (c *conn) Close() {
 	c.Connection.CloseOnce()
 }
 
+// flowControl tells whether the tasks of the tunnel use window based flow control
+func (c *conn) flowControl() bool {
+	return c.features.Load()&predef.FeatureFlowControl != 0
+}
+
+// closedByPeer 判断 err 是否由对端关闭连接导致
+func closedByPeer(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
 func (c *conn) tasksLen() (n int) {
 	c.tasksRWMtx.RLock()
 	n = len(c.tasks)
@@ -171,11 +310,25 @@ func (c *conn) readLoop(connID uint) {
 	var pings int
 	var lastPing int
 	var isClosing bool
+	var received bool
 	defer func() {
 		c.client.removeTunnel(c)
 		c.Close()
 		c.Logger.Info().Err(err).Bool("isClosing", isClosing).Uint64("finishedTasks", c.finishedTasks.Load()).
 			Int("tasksCount", c.tasksLen()).Int("pings", pings).Msg("tunnel closed")
+		switch {
+		case c.legacy:
+			// 服务端可能已经升级，老版本握手的 tunnel 出错关闭后，下次重连重新尝试 Capabilities option
+			if err != nil && c.client.legacyHandshake.CompareAndSwap(true, false) {
+				c.Logger.Info().Msg("retry the capabilities handshake on the next reconnect")
+			}
+		case c.nonce == nil && !received && pings == 0 && closedByPeer(err):
+			// 老版本的服务端收到 Capabilities option 后直接关闭连接，不会发送任何信号；
+			// 超时等其他错误不能说明服务端不支持 Capabilities option
+			if c.client.legacyHandshake.CompareAndSwap(false, true) {
+				c.Logger.Warn().Msg("server closed the tunnel without any response, fall back to the legacy handshake")
+			}
+		}
 		c.onTunnelClose()
 		pool.PutReader(c.Reader)
 	}()
@@ -208,6 +361,7 @@ func (c *conn) readLoop(connID uint) {
 			}
 			return
 		}
+		received = true
 		signal := uint32(peekBytes[3]) | uint32(peekBytes[2])<<8 | uint32(peekBytes[1])<<16 | uint32(peekBytes[0])<<24
 		_, err = c.Reader.Discard(4)
 		if err != nil {
@@ -257,10 +411,15 @@ func (c *conn) readLoop(connID uint) {
 			c.Logger.Info().Msg("client reload wait group done")
 			continue
 		case connection.ErrorSignal:
-			err = handleError(c)
+			var code connection.Error
+			code, err = handleError(c)
 			if err != nil {
 				return
 			}
+			if code == connection.ErrQuotaExceeded {
+				// 流量配额用尽时服务端只拒绝新的任务，tunnel 仍然可用；登录时被拒绝则服务端会关闭连接
+				continue
+			}
 			if c.client.reloading.Load() {
 				c.client.reloadWaitGroup.Done()
 			}
@@ -301,6 +460,14 @@ func (c *conn) readLoop(connID uint) {
 			}
 			service := &(*c.services.Load())[serviceIndex]
 
+			var v visitor
+			if c.features.Load()&predef.FeatureVisitorAddr != 0 {
+				v.src, v.dst, v.tls, err = connection.ReadAddrs(c.Reader)
+				if err != nil {
+					return
+				}
+			}
+
 			peekBytes, err = c.Reader.Peek(4)
 			if err != nil {
 				return
@@ -311,7 +478,7 @@ func (c *conn) readLoop(connID uint) {
 				return
 			}
 			r.N = int64(l)
-			rErr, wErr := c.processServiceData(connID, taskID, service, r)
+			rErr, wErr := c.processServiceData(connID, taskID, service, v, r)
 			if rErr != nil {
 				err = wErr
 				if !errors.Is(rErr, net.ErrClosed) {
@@ -367,26 +534,80 @@ func (c *conn) readLoop(connID uint) {
 			t, ok := c.tasks[taskID]
 			c.tasksRWMtx.RUnlock()
 			if ok {
-				t.CloseByRemote()
+				if t.recvBuffer != nil {
+					// 等待缓冲的数据写完后再关闭
+					t.recvBuffer.Finish()
+				} else {
+					t.CloseByRemote()
+				}
+			}
+		case predef.WindowUpdate:
+			peekBytes, err = c.Reader.Peek(4)
+			if err != nil {
+				return
+			}
+			n := uint32(peekBytes[3]) | uint32(peekBytes[2])<<8 | uint32(peekBytes[1])<<16 | uint32(peekBytes[0])<<24
+			_, err = c.Reader.Discard(4)
+			if err != nil {
+				return
+			}
+			c.tasksRWMtx.RLock()
+			t, ok := c.tasks[taskID]
+			c.tasksRWMtx.RUnlock()
+			if ok && t.window != nil {
+				t.window.Release(n)
 			}
 		}
 	}
 }
 
-func (c *conn) dial(s *service) (task *httpTask, err error) {
+// visitor 是服务端告知的访问者信息，服务端不支持时为零值
+type visitor struct {
+	src net.Addr // 访问者的地址
+	dst net.Addr // 访问者连接的服务端地址
+	tls bool     // 访问者是否通过 TLS 连接服务端
+}
+
+// dial 连接本地服务，访问者信息用于生成 PROXY protocol 头部与转发头部
+func (c *conn) dial(s *service, v visitor) (task *httpTask, err error) {
+	if s.LocalURL.Scheme == "udp" {
+		if c.features.Load()&predef.FeatureUDPPort == 0 {
+			err = errUDPNotSupported
+			return
+		}
+		var conn net.Conn
+		conn, err = net.Dial("udp", s.LocalURL.Host)
+		if err != nil {
+			return
+		}
+		task = newHTTPTask(connection.NewDatagramConn(conn))
+		task.service = s
+		return
+	}
 	conn, err := net.Dial("tcp", s.LocalURL.Host)
 	if err != nil {
 		return
 	}
+	if len(s.ProxyProtocol) > 0 {
+		var header []byte
+		header, err = connection.ProxyHeader(s.ProxyProtocol, v.src, v.dst)
+		if err == nil {
+			_, err = conn.Write(header)
+		}
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+	}
 	task = newHTTPTask(conn)
 	task.service = s
-	if s.UseLocalAsHTTPHost {
-		err = task.setHost(s.LocalURL.Host)
+	if s.ForwardedHeaders || s.UseLocalAsHTTPHost {
+		task.setRewrite(v)
 	}
 	return
 }
 
-func (c *conn) processServiceData(connID uint, taskID uint32, s *service, r *bufio.LimitedReader) (readErr, writeErr error) {
+func (c *conn) processServiceData(connID uint, taskID uint32, s *service, v visitor, r *bufio.LimitedReader) (readErr, writeErr error) {
 	if r.N > 0 {
 		var peekBytes []byte
 		peekBytes, readErr = r.Peek(2)
@@ -409,18 +630,28 @@ func (c *conn) processServiceData(connID uint, taskID uint32, s *service, r *buf
 
 	var task *httpTask
 	for i := 0; i < 3; i++ {
-		task, writeErr = c.dial(s)
+		task, writeErr = c.dial(s, v)
 		if writeErr == nil {
 			break
 		}
 	}
 	if writeErr != nil {
+		// 告知服务端无法连接本地服务，服务端据此立即响应访问者而不是等到超时
+		var buf [6]byte
+		binary.BigEndian.PutUint32(buf[0:], taskID)
+		binary.BigEndian.PutUint16(buf[4:], predef.Close)
+		_, _ = c.Write(buf[:])
 		return
 	}
 	task.Logger = c.Logger.With().
 		Uint32("task", taskID).
 		Logger()
 	task.Logger.Info().Msg("task started")
+	task.metrics = c.client.metrics.newTask(s)
+	if c.flowControl() {
+		task.window = connection.NewSendWindow(predef.TaskWindowSize)
+		task.recvBuffer = connection.NewReceiveBuffer(predef.TaskWindowSize)
+	}
 	c.tasksRWMtx.Lock()
 	ot, ok := c.tasks[taskID]
 	if ok && ot != nil {
@@ -430,9 +661,13 @@ func (c *conn) processServiceData(connID uint, taskID uint32, s *service, r *buf
 	c.tasks[taskID] = task
 	c.tasksRWMtx.Unlock()
 	go task.process(connID, taskID, c)
+	if task.recvBuffer != nil {
+		go task.writeLoop(taskID, c)
+	}
 
 	if r.N > 0 {
-		_, err := r.WriteTo(task)
+		n, err := r.WriteTo(task.writer())
+		task.metrics.received(n)
 		if err != nil {
 			switch e := err.(type) {
 			case *net.OpError:
@@ -442,6 +677,9 @@ func (c *conn) processServiceData(connID uint, taskID uint32, s *service, r *buf
 				}
 			case *bufio.WriteErr:
 				writeErr = err
+				if errors.Is(err, connection.ErrWindowExceeded) {
+					task.Close()
+				}
 			default:
 				readErr = err
 			}
@@ -472,7 +710,10 @@ func (c *conn) processData(taskID uint32, r *bufio.LimitedReader) (readErr, writ
 				})
 				return
 			}
-			_, err := r.WriteTo(pt.APIWriter())
+			n, err := r.WriteTo(pt.APIWriter())
+			if n > 0 && c.flowControl() {
+				writeErr = c.SendWindowUpdate(taskID, uint32(n))
+			}
 			if err != nil {
 				c.Logger.Info().
 					Uint32("peerTask", taskID).Msg("got closed because task with same id is received")
@@ -481,7 +722,8 @@ func (c *conn) processData(taskID uint32, r *bufio.LimitedReader) (readErr, writ
 		}
 		return nil, errors.New("task not exists")
 	}
-	_, err := r.WriteTo(task)
+	n, err := r.WriteTo(task.writer())
+	task.metrics.received(n)
 	if err != nil {
 		switch e := err.(type) {
 		case *net.OpError:
@@ -491,6 +733,9 @@ func (c *conn) processData(taskID uint32, r *bufio.LimitedReader) (readErr, writ
 			}
 		case *bufio.WriteErr:
 			writeErr = err
+			if errors.Is(err, connection.ErrWindowExceeded) {
+				task.Close()
+			}
 		default:
 			readErr = err
 		}
@@ -523,7 +768,12 @@ func (c *conn) processP2P(id uint32, r *bufio.LimitedReader) {
 	c.client.apiServer.Listener.AcceptCh() <- t.APIConn()
 	c.Logger.Info().
 		Uint32("peerTask", id).Msg("peer task started")
-	_, err := r.WriteTo(t.APIWriter())
+	n, err := r.WriteTo(t.APIWriter())
+	if n > 0 && c.flowControl() {
+		if e := c.SendWindowUpdate(id, uint32(n)); e != nil {
+			c.Logger.Error().Uint32("peerTask", id).Err(e).Msg("processP2P SendWindowUpdate failed")
+		}
+	}
 	if err != nil {
 		c.Logger.Error().
 			Uint32("peerTask", id).Err(err).Msg("processP2P WriteTo failed")
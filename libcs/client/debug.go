@@ -46,6 +46,8 @@ type Client struct {
 	configChecksum      atomic.Pointer[[32]byte]
 	reloadWaitGroup     sync.WaitGroup
 	reloading           atomic.Bool
+	legacyHandshake     atomic.Bool // 服务端不支持 Capabilities option，使用老版本的握手
+	metrics             *clientMetrics
 
 	// test purpose only
 	OnTunnelClose atomic.Value
@@ -0,0 +1,145 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/isrc-cas/gt/predef"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// hasAuth 判断服务是否声明了访问策略
+func (s *service) hasAuth() bool {
+	return len(s.authBasic) > 0 || len(s.AuthBearer) > 0
+}
+
+// isPasswordHash 判断密码是否已经是 htpasswd 风格的哈希，服务端负责校验哈希的格式
+func isPasswordHash(password string) bool {
+	return strings.HasPrefix(password, "$") || strings.HasPrefix(password, "{SHA}")
+}
+
+// parseServiceAuth 校验服务的访问策略，使用 bcrypt 哈希明文密码，明文密码不会发送到服务端
+func parseServiceAuth(s *service, secret string) (err error) {
+	s.authBasic = nil
+	s.authDigest = ""
+	entries := append([]string(nil), s.AuthBasic...)
+	if len(s.AuthHtpasswd) > 0 {
+		var lines []string
+		lines, err = readHtpasswd(s.AuthHtpasswd)
+		if err != nil {
+			return
+		}
+		entries = append(entries, lines...)
+	}
+	if s.AuthLogin && len(entries) == 0 {
+		err = errors.New("-authLogin option needs -authBasic or -authHtpasswd option")
+		return
+	}
+	if len(entries) == 0 && len(s.AuthBearer) == 0 {
+		return
+	}
+	if s.LocalURL.Scheme != "http" {
+		err = errors.New("-authBasic, -authHtpasswd and -authBearer options are only supported when local url (-local option) begin with http://")
+		return
+	}
+	if len(entries) > predef.MaxEdgeAuthEntries || len(s.AuthBearer) > predef.MaxEdgeAuthEntries {
+		err = fmt.Errorf("a service can have at most %d basic users and %d bearer tokens", predef.MaxEdgeAuthEntries, predef.MaxEdgeAuthEntries)
+		return
+	}
+
+	// 摘要使用 secret 作为密钥，可以写入日志
+	h := hmac.New(sha256.New, []byte(secret))
+	size := 3
+	for _, entry := range entries {
+		user, password, ok := strings.Cut(entry, ":")
+		if !ok || len(user) == 0 || len(password) == 0 {
+			err = fmt.Errorf("basic user (-authBasic option) '%s' should be in the form of user:password", user)
+			return
+		}
+		h.Write([]byte(entry))
+		h.Write([]byte{'\n'})
+		if !isPasswordHash(password) {
+			var hash []byte
+			hash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+			if err != nil {
+				return
+			}
+			entry = user + ":" + string(hash)
+		}
+		if len(entry) > 255 {
+			err = fmt.Errorf("basic user (-authBasic option) '%s' is too long", user)
+			return
+		}
+		size += 1 + len(entry)
+		s.authBasic = append(s.authBasic, entry)
+	}
+	h.Write([]byte{0})
+	for _, token := range s.AuthBearer {
+		if len(token) == 0 || len(token) > 255 {
+			err = errors.New("bearer token (-authBearer option) should be 1 to 255 bytes")
+			return
+		}
+		h.Write([]byte(token))
+		h.Write([]byte{'\n'})
+		size += 1 + len(token)
+	}
+	if size > predef.MaxEdgeAuthSize {
+		err = fmt.Errorf("auth options of a service should be less than %d bytes", predef.MaxEdgeAuthSize)
+		return
+	}
+	s.authDigest = hex.EncodeToString(h.Sum(nil)[:8])
+	return
+}
+
+// readHtpasswd 读取 htpasswd 文件，忽略空行与 # 开头的注释
+func readHtpasswd(path string) (entries []string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		err = fmt.Errorf("can not read htpasswd file (-authHtpasswd option), cause %s", err.Error())
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	err = scanner.Err()
+	return
+}
+
+// genEdgeAuth 将服务的访问策略编码为 EdgeAuth option
+func genEdgeAuth(s *service, buf []byte) []byte {
+	buf = append(buf, predef.EdgeAuth...)
+	buf = appendBool(buf, s.AuthLogin)
+	for _, list := range [][]string{s.authBasic, s.AuthBearer} {
+		buf = append(buf, byte(len(list)))
+		for _, v := range list {
+			buf = appendString(buf, v)
+		}
+	}
+	return buf
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/isrc-cas/gt/predef"
+)
+
+// errGroupNotSecure 表示组密钥不能在未加密的 tunnel 上发送
+var errGroupNotSecure = errors.New("-group option needs a tls:// or quic:// remote with a verified cert, or the -plaintextAuth option")
+
+// hasGroup 判断服务是否加入了服务组
+func (s *service) hasGroup() bool {
+	return len(s.Group) > 0
+}
+
+// checkServiceGroup 校验服务组，服务组只支持 http、https 与指定了远程端口的 tcp 服务
+func checkServiceGroup(s *service) error {
+	if !s.hasGroup() {
+		if len(s.GroupSecret) > 0 {
+			return errors.New("-groupSecret option needs a -group option")
+		}
+		if s.Standby {
+			return errors.New("-standby option needs a -group option")
+		}
+		return nil
+	}
+	// 组属于创建它的 id，加入其它 id 的组时使用 'owner/name' 的形式
+	owner, name, qualified := strings.Cut(s.Group, "/")
+	if len(s.Group) > predef.MaxGroupNameSize || qualified && (len(owner) == 0 || len(name) == 0 || strings.Contains(name, "/")) {
+		return fmt.Errorf("group (-group option) '%s' is invalid", s.Group)
+	}
+	if len(s.GroupSecret) == 0 || len(s.GroupSecret) > 255 {
+		return errors.New("group secret (-groupSecret option) should be 1 to 255 bytes")
+	}
+	switch s.LocalURL.Scheme {
+	case "http", "https":
+	case "tcp":
+		if s.RemoteTCPPort == 0 || *s.RemoteTCPRandom {
+			return errors.New("-group option needs a -remoteTCPPort option without -remoteTCPRandom when local url (-local option) begin with tcp://")
+		}
+	default:
+		return errors.New("-group option is only supported when local url (-local option) begin with http://, https:// or tcp://")
+	}
+	return nil
+}
+
+// genGroup 将服务组编码为 Group option，备用成员之后还有一个 Standby option
+func genGroup(s *service, buf []byte) []byte {
+	buf = append(buf, predef.Group...)
+	for _, v := range []string{s.Group, s.GroupSecret} {
+		buf = appendString(buf, v)
+	}
+	if s.Standby {
+		buf = append(buf, predef.Standby...)
+	}
+	return buf
+}
+
+// hasInsecureTunnel 判断是否有未加密或没有验证服务端证书的 tunnel
+func (c *Client) hasInsecureTunnel() bool {
+	c.tunnelsRWMtx.RLock()
+	defer c.tunnelsRWMtx.RUnlock()
+	for t := range c.tunnels {
+		if !t.secure {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+
+	"github.com/isrc-cas/gt/predef"
+	"github.com/isrc-cas/gt/util"
+)
+
+// hasIPFilter 判断服务是否声明了允许或拒绝访问的 CIDR
+func (s *service) hasIPFilter() bool {
+	return len(s.AllowIPs) > 0 || len(s.DenyIPs) > 0
+}
+
+// parseServiceIPFilter 校验服务允许与拒绝访问的 CIDR，单个 IP 转换为 CIDR
+func parseServiceIPFilter(s *service) (err error) {
+	if len(s.AllowIPs) > predef.MaxIPFilterEntries || len(s.DenyIPs) > predef.MaxIPFilterEntries {
+		err = fmt.Errorf("a service can have at most %d allowed and %d denied CIDRs", predef.MaxIPFilterEntries, predef.MaxIPFilterEntries)
+		return
+	}
+	for _, list := range []*[]string{&s.AllowIPs, &s.DenyIPs} {
+		cidrs := make([]string, 0, len(*list))
+		for _, cidr := range *list {
+			ipNet, e := util.ParseCIDR(cidr)
+			if e != nil {
+				err = fmt.Errorf("invalid CIDR (-allowIP or -denyIP option) '%s', cause %s", cidr, e.Error())
+				return
+			}
+			cidrs = append(cidrs, ipNet.String())
+		}
+		*list = cidrs
+	}
+	return
+}
+
+// genIPFilter 将服务允许与拒绝访问的 CIDR 编码为 IPFilter option
+func genIPFilter(s *service, buf []byte) []byte {
+	buf = append(buf, predef.IPFilter...)
+	for _, list := range [][]string{s.AllowIPs, s.DenyIPs} {
+		buf = append(buf, byte(len(list)))
+		for _, v := range list {
+			buf = appendString(buf, v)
+		}
+	}
+	return buf
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	connection "github.com/isrc-cas/gt/conn"
+	"github.com/isrc-cas/gt/metrics"
+	"github.com/libp2p/go-reuseport"
+)
+
+// clientMetrics 客户端以 Prometheus 文本格式导出的指标
+type clientMetrics struct {
+	registry     *metrics.Registry
+	bytes        *metrics.CounterVec
+	tasks        *metrics.GaugeVec
+	taskLatency  *metrics.HistogramVec
+	reconnects   *metrics.Counter
+	errorSignals *metrics.CounterVec
+
+	listener   net.Listener
+	httpServer *http.Server
+}
+
+func newClientMetrics(c *Client) *clientMetrics {
+	r := metrics.NewRegistry()
+	m := &clientMetrics{
+		registry: r,
+		bytes: r.NewCounter("gt_client_bytes_total",
+			"Bytes transferred by tasks. Upload is from local services to the server, download is from the server to local services.",
+			"service", "direction"),
+		tasks: r.NewGauge("gt_client_active_tasks",
+			"Tasks that are being forwarded to local services.",
+			"service"),
+		taskLatency: r.NewHistogram("gt_client_task_latency_seconds",
+			"Time from a task being received until the first data is read from the local service.",
+			nil, "service"),
+		reconnects: r.NewCounter("gt_client_reconnects_total",
+			"Reconnections to the server after a tunnel is closed or failed to be established.").With(),
+		errorSignals: r.NewCounter("gt_client_error_signals_total",
+			"Error signals received from the server.",
+			"code", "error"),
+	}
+	r.NewGaugeFunc("gt_client_tunnels", "Tunnels established with the server.", nil,
+		func(emit func(float64, ...string)) {
+			c.tunnelsRWMtx.RLock()
+			n := len(c.tunnels)
+			c.tunnelsRWMtx.RUnlock()
+			emit(float64(n))
+		})
+	r.NewGaugeFunc("gt_client_webrtc_peers", "WebRTC peer connections.", nil,
+		func(emit func(float64, ...string)) {
+			c.peersRWMtx.RLock()
+			n := len(c.peers)
+			c.peersRWMtx.RUnlock()
+			emit(float64(n))
+		})
+	return m
+}
+
+func (m *clientMetrics) reconnected() {
+	if m == nil {
+		return
+	}
+	m.reconnects.Inc()
+}
+
+// errorSignal 统计从服务端收到的错误信号
+func (m *clientMetrics) errorSignal(code connection.Error) {
+	if m == nil {
+		return
+	}
+	m.errorSignals.With(strconv.Itoa(int(code)), code.Error()).Inc()
+}
+
+// taskMetrics task 使用的指标
+type taskMetrics struct {
+	upload    *metrics.Counter
+	download  *metrics.Counter
+	active    *metrics.Gauge
+	latency   *metrics.Histogram
+	start     time.Time
+	responded atomic.Bool
+}
+
+// newTask 返回 task 使用的指标并将活跃 task 数加 1，task 结束时需要调用 done
+func (m *clientMetrics) newTask(s *service) *taskMetrics {
+	if m == nil {
+		return nil
+	}
+	name := s.LocalURL.String()
+	t := &taskMetrics{
+		upload:   m.bytes.With(name, "upload"),
+		download: m.bytes.With(name, "download"),
+		active:   m.tasks.With(name),
+		latency:  m.taskLatency.With(name),
+		start:    time.Now(),
+	}
+	t.active.Inc()
+	return t
+}
+
+// sent 统计从本地服务读到并发往服务端的数据，第一次读到数据时记录延迟
+func (t *taskMetrics) sent(n int) {
+	if t == nil {
+		return
+	}
+	if t.responded.CompareAndSwap(false, true) {
+		t.latency.Observe(time.Since(t.start).Seconds())
+	}
+	t.upload.Add(float64(n))
+}
+
+// received 统计从服务端收到并写往本地服务的数据
+func (t *taskMetrics) received(n int64) {
+	if t == nil {
+		return
+	}
+	t.download.Add(float64(n))
+}
+
+func (t *taskMetrics) done() {
+	if t == nil {
+		return
+	}
+	t.active.Dec()
+}
+
+func (c *Client) startMetricsServer() (err error) {
+	addr := c.Config().MetricsAddr
+	if strings.IndexByte(addr, ':') == -1 {
+		addr = ":" + addr
+	}
+	c.metrics.listener, err = reuseport.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", c.metrics.registry)
+	c.metrics.httpServer = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	c.Logger.Info().Str("addr", c.metrics.listener.Addr().String()).Msg("Listening metrics")
+	go func() {
+		err := c.metrics.httpServer.Serve(c.metrics.listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			c.Logger.Error().Err(err).Msg("metrics server stopped")
+		}
+	}()
+	return
+}
+
+func (m *clientMetrics) close() error {
+	if m == nil || m.httpServer == nil {
+		return nil
+	}
+	return m.httpServer.Close()
+}
+
+// GetMetricsListenerAddrPort 获取 metrics listener 地址，返回值可能为空
+func (c *Client) GetMetricsListenerAddrPort() (addrPort netip.AddrPort) {
+	if c.metrics == nil || c.metrics.listener == nil {
+		return
+	}
+	addrPort = c.metrics.listener.Addr().(*net.TCPAddr).AddrPort()
+	return
+}
@@ -548,7 +548,7 @@ func (dco *dataChannelObserver) OnOpen() {
 
 	tunnel := dco.peerTask.tunnel
 	service := (*tunnel.services.Load())[0]
-	task, err := dco.peerTask.tunnel.dial(&service)
+	task, err := dco.peerTask.tunnel.dial(&service, visitor{})
 	if err != nil {
 		return
 	}
@@ -46,6 +46,8 @@ type Client struct {
 	configChecksum      atomic.Pointer[[32]byte]
 	reloadWaitGroup     sync.WaitGroup
 	reloading           atomic.Bool
+	legacyHandshake     atomic.Bool // 服务端不支持 Capabilities option，使用老版本的握手
+	metrics             *clientMetrics
 
 	// indicate which remote is chosen to establish tunnel
 	chosenRemoteLabel int
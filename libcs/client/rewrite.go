@@ -0,0 +1,92 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net"
+	"strings"
+
+	connection "github.com/isrc-cas/gt/conn"
+)
+
+// setRewrite 逐个请求修改发往本地服务的 HTTP 请求：按需添加转发头部，替换 Host
+func (t *httpTask) setRewrite(v visitor) {
+	var ip string
+	switch a := v.src.(type) {
+	case *net.TCPAddr:
+		ip = a.IP.String()
+	case *net.UDPAddr:
+		ip = a.IP.String()
+	}
+	proto := "http"
+	if v.tls {
+		proto = "https"
+	}
+	t.httpWriter = connection.NewHTTPRequestWriter(t.conn, func(req *connection.HTTPRequest) error {
+		if t.service.ForwardedHeaders {
+			addForwardedHeaders(req, ip, proto)
+		}
+		if t.service.UseLocalAsHTTPHost {
+			req.Header.Set("Host", t.service.LocalURL.Host)
+		}
+		return nil
+	})
+}
+
+// addForwardedHeaders 添加 X-Forwarded-*、X-Real-IP 与 RFC 7239 Forwarded 头部。
+// X-Forwarded-For 与 Forwarded 追加到访问者发送的值之后，其他头部被替换。
+// 服务端没有发送访问者地址时无法确认访问者发送的地址链，删除这些头部防止伪造。
+func addForwardedHeaders(req *connection.HTTPRequest, ip string, proto string) {
+	host := req.Header.Get("Host")
+	if len(ip) > 0 {
+		xff := append(req.Header.Values("X-Forwarded-For"), ip)
+		req.Header.Set("X-Forwarded-For", strings.Join(xff, ", "))
+		req.Header.Set("X-Real-IP", ip)
+	} else {
+		req.Header.Del("X-Forwarded-For")
+		req.Header.Del("X-Real-IP")
+		req.Header.Del("Forwarded")
+	}
+	if len(host) > 0 {
+		req.Header.Set("X-Forwarded-Host", host)
+	}
+	req.Header.Set("X-Forwarded-Proto", proto)
+
+	var pairs []string
+	if len(ip) > 0 {
+		node := ip
+		if strings.IndexByte(ip, ':') >= 0 {
+			node = "[" + ip + "]"
+		}
+		pairs = append(pairs, "for="+forwardedValue(node))
+	}
+	if len(host) > 0 {
+		pairs = append(pairs, "host="+forwardedValue(host))
+	}
+	pairs = append(pairs, "proto="+proto)
+	forwarded := append(req.Header.Values("Forwarded"), strings.Join(pairs, ";"))
+	req.Header.Set("Forwarded", strings.Join(forwarded, ", "))
+}
+
+// forwardedValue 在值不是 token 时加上引号
+func forwardedValue(v string) string {
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
@@ -2,21 +2,23 @@ package client
 
 import (
 	connection "github.com/isrc-cas/gt/conn"
+	"github.com/isrc-cas/gt/predef"
 	"sync/atomic"
 )
 
-func handleError(tunnel *conn) (err error) {
+func handleError(tunnel *conn) (code connection.Error, err error) {
 	var peekBytes []byte
 	peekBytes, err = tunnel.Reader.Peek(2)
 	if err != nil {
 		return
 	}
-	code := uint16(peekBytes[1]) | uint16(peekBytes[0])<<8
+	code = connection.Error(uint16(peekBytes[1]) | uint16(peekBytes[0])<<8)
 	_, err = tunnel.Reader.Discard(2)
 	if err != nil {
 		return
 	}
-	switch connection.Error(code) {
+	tunnel.client.metrics.errorSignal(code)
+	switch code {
 	case connection.ErrInvalidIDAndSecret:
 		tunnel.Logger.Error().Str("err", "invalid id and secret").Msg("read error signal")
 	case connection.ErrFailedToOpenTCPPort:
@@ -38,6 +40,44 @@ func handleError(tunnel *conn) (err error) {
 			Str("local", local).
 			Str("err", "failed to open tcp port").
 			Msg("read error signal")
+	case connection.ErrFailedToOpenUDPPort:
+		var peekBytes []byte
+		peekBytes, err = tunnel.Reader.Peek(2)
+		if err != nil {
+			return
+		}
+		serviceIndex := uint16(peekBytes[1]) | uint16(peekBytes[0])<<8
+		_, err = tunnel.Reader.Discard(2)
+		if err != nil {
+			return
+		}
+		var local string
+		if s := tunnel.client.services.Load(); s != nil && serviceIndex < uint16(len(*s)) {
+			local = (*s)[serviceIndex].LocalURL.String()
+		}
+		tunnel.Logger.Error().
+			Str("local", local).
+			Str("err", "failed to open udp port").
+			Msg("read error signal")
+	case connection.ErrVersionTooLow:
+		peekBytes, err = tunnel.Reader.Peek(2)
+		if err != nil {
+			return
+		}
+		minVersion := uint16(peekBytes[1]) | uint16(peekBytes[0])<<8
+		_, err = tunnel.Reader.Discard(2)
+		if err != nil {
+			return
+		}
+		tunnel.Logger.Error().
+			Uint16("version", predef.ProtocolVersion).
+			Uint16("minVersion", minVersion).
+			Str("err", "protocol version is lower than the server required").
+			Msg("read error signal")
+		// 服务端支持 Capabilities option，回退到老版本的握手是误判
+		if tunnel.legacy && tunnel.client.legacyHandshake.CompareAndSwap(true, false) {
+			tunnel.Logger.Info().Msg("server supports capabilities, stop using the legacy handshake")
+		}
 	case connection.ErrReachedMaxConnections:
 		tunnel.Logger.Error().Str("err", "reached the max connections").Msg("read error signal")
 	case connection.ErrHostNumberLimited:
@@ -46,6 +86,16 @@ func handleError(tunnel *conn) (err error) {
 		tunnel.Logger.Error().Str("err", "host conflict").Msg("read error signal")
 	case connection.ErrHostRegexMismatch:
 		tunnel.Logger.Error().Str("err", "host regex mismatch").Msg("read error signal")
+	case connection.ErrDomainNotAllowed:
+		tunnel.Logger.Error().Str("err", "domain is not in the allowed domains").Msg("read error signal")
+	case connection.ErrEdgeAuthNotAllowed:
+		tunnel.Logger.Error().Str("err", "server does not allow clients to declare auth policies").Msg("read error signal")
+	case connection.ErrIPNotAllowed:
+		tunnel.Logger.Error().Str("err", "the ip of the client is not allowed to log in").Msg("read error signal")
+	case connection.ErrQuotaExceeded:
+		tunnel.Logger.Error().Str("err", "the traffic quota is exhausted, new tasks are rejected").Msg("read error signal")
+	case connection.ErrBanned:
+		tunnel.Logger.Error().Str("err", "the id or ip of the client is banned").Msg("read error signal")
 	case connection.ErrDifferentConfigClientConnected:
 		tunnel.Logger.Error().Str("err", "another client that with different config already connected").Msg("read error signal")
 	case connection.ErrReachedMaxOptions:
@@ -98,6 +148,56 @@ func handleInfo(tunnel *conn) (err error) {
 			Str("local", local).
 			Uint16("tcp port", tcpPort).
 			Msg("tcp port opened")
+	case connection.InfoUDPPortOpened:
+		peekBytes, err = tunnel.Reader.Peek(2)
+		if err != nil {
+			return
+		}
+		serviceIndex := uint16(peekBytes[1]) | uint16(peekBytes[0])<<8
+		_, err = tunnel.Reader.Discard(2)
+		if err != nil {
+			return
+		}
+		peekBytes, err = tunnel.Reader.Peek(2)
+		if err != nil {
+			return
+		}
+		udpPort := uint16(peekBytes[1]) | uint16(peekBytes[0])<<8
+		_, err = tunnel.Reader.Discard(2)
+		if err != nil {
+			return
+		}
+		var local string
+		if s := tunnel.client.services.Load(); s != nil && serviceIndex < uint16(len(*s)) {
+			local = (*s)[serviceIndex].LocalURL.String()
+			atomic.StoreUint32(&(*s)[serviceIndex].remoteUDPPort, uint32(udpPort))
+		}
+		tunnel.Logger.Info().Uint16("serviceIndex", serviceIndex).
+			Str("local", local).
+			Uint16("udp port", udpPort).
+			Msg("udp port opened")
+	case connection.InfoCapabilities:
+		peekBytes, err = tunnel.Reader.Peek(6)
+		if err != nil {
+			return
+		}
+		version := uint16(peekBytes[1]) | uint16(peekBytes[0])<<8
+		features := uint32(peekBytes[5]) | uint32(peekBytes[4])<<8 | uint32(peekBytes[3])<<16 | uint32(peekBytes[2])<<24
+		_, err = tunnel.Reader.Discard(6)
+		if err != nil {
+			return
+		}
+		features &= predef.Features
+		tunnel.version.Store(uint32(version))
+		tunnel.features.Store(features)
+		// 服务端支持 Capabilities option，其他 tunnel 也不再使用老版本的握手
+		if tunnel.client.legacyHandshake.CompareAndSwap(true, false) {
+			tunnel.Logger.Info().Msg("server supports capabilities, stop using the legacy handshake")
+		}
+		tunnel.Logger.Info().
+			Uint16("version", version).
+			Strs("features", predef.FeatureNames(features)).
+			Msg("capabilities negotiated")
 	default:
 		tunnel.Logger.Info().Msg("read unknown info signal")
 	}
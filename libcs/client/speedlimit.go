@@ -0,0 +1,33 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"github.com/isrc-cas/gt/predef"
+)
+
+// hasSpeedLimit 判断服务是否声明了上下行速度
+func (s *service) hasSpeedLimit() bool {
+	return s.UploadSpeed > 0 || s.DownloadSpeed > 0
+}
+
+// genSpeedLimit 将服务的上下行速度编码为 SpeedLimit option
+func genSpeedLimit(s *service, buf []byte) []byte {
+	buf = append(buf, predef.SpeedLimit...)
+	for _, v := range []uint32{s.UploadSpeed, s.DownloadSpeed} {
+		buf = append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+	return buf
+}
@@ -15,8 +15,8 @@
 package client
 
 import (
-	"bytes"
 	"errors"
+	"io"
 	"net"
 	"sync/atomic"
 	"time"
@@ -27,22 +27,19 @@ import (
 	"github.com/rs/zerolog"
 )
 
-var (
-	// ErrHostIsTooLong is an error returned when host is too long
-	ErrHostIsTooLong = errors.New("host is too long")
+type httpTask struct {
+	conn    net.Conn
+	Logger  zerolog.Logger
+	closing uint32
+	service *service
 
-	host = []byte("Host:")
-)
+	// httpWriter 逐个请求修改发往本地服务的 HTTP 请求，为 nil 时原样写入
+	httpWriter *connection.HTTPRequestWriter
 
-type httpTask struct {
-	conn     net.Conn
-	buf      []byte
-	tempBuf  *bytes.Buffer
-	Logger   zerolog.Logger
-	skipping bool
-	passing  bool
-	closing  uint32
-	service  *service
+	window     *connection.SendWindow
+	recvBuffer *connection.ReceiveBuffer
+
+	metrics *taskMetrics
 }
 
 func newHTTPTask(c net.Conn) (t *httpTask) {
@@ -52,170 +49,11 @@ func newHTTPTask(c net.Conn) (t *httpTask) {
 	return
 }
 
-func (t *httpTask) setHost(host string) (err error) {
-	if len(host) > 200 {
-		return ErrHostIsTooLong
-	}
-	t.buf = pool.BytesPool.Get().([]byte)
-	n := copy(t.buf, "Host: ")
-	n += copy(t.buf[n:], host)
-	n += copy(t.buf[n:], "\r\n")
-	t.tempBuf = bytes.NewBuffer(t.buf[n:][:0])
-	t.buf = t.buf[:n]
-	return
-}
-
 func (t *httpTask) Write(p []byte) (n int, err error) {
-	if t.tempBuf == nil {
-		return t.conn.Write(p)
-	} else if t.skipping {
-		i := bytes.IndexByte(p, '\n')
-		if i < 0 {
-			return len(p), nil
-		}
-		t.skipping = false
-		t.tempBuf = nil
-		if len(p) <= i+1 {
-			return len(p), nil
-		}
-		if predef.Debug {
-			t.Logger.Debug().Bytes("data", p[i+1:]).Msg("write")
-		}
-		n, err = t.conn.Write(p[i+1:])
-		n += i + 1
-		return
-	} else if t.passing {
-		i := bytes.IndexByte(p, '\n')
-		if i < 0 {
-			if predef.Debug {
-				t.Logger.Debug().Bytes("data", p).Msg("write")
-			}
-			return t.conn.Write(p)
-		}
-		t.passing = false
-		if predef.Debug {
-			t.Logger.Debug().Bytes("data", p[:i+1]).Msg("write")
-		}
-		n, err = t.conn.Write(p[:i+1])
-		if err != nil {
-			return
-		}
-		p = p[i+1:]
-		if len(p) <= 0 {
-			return
-		}
-	}
-
-	var nw int
-	var updated bool
-	if t.tempBuf != nil {
-		if len(p)+t.tempBuf.Len() < 5 {
-			nw, err = t.tempBuf.Write(p)
-			n += nw
-			return
-		}
-
-		if t.tempBuf.Len() > 0 {
-			nw, err = t.tempBuf.Write(p)
-			n += nw
-			if err != nil {
-				return
-			}
-			p = t.tempBuf.Bytes()
-			t.tempBuf.Reset()
-			updated = true
-		}
-	}
-
-	s := 0
-	for len(p[s:]) >= 1 {
-		switch t.isGoodToWrite(p[s:]) {
-		case good:
-			i := bytes.IndexByte(p[s:], '\n')
-			if i < 0 {
-				t.passing = true
-				if predef.Debug {
-					t.Logger.Debug().Bytes("data", p[s:]).Msg("write")
-				}
-				nw, err = t.conn.Write(p[s:])
-				if !updated {
-					n += nw
-				}
-				return
-			}
-			if predef.Debug {
-				t.Logger.Debug().Bytes("data", p[s:s+i+1]).Msg("write")
-			}
-			nw, err = t.conn.Write(p[s : s+i+1])
-			if !updated {
-				n += nw
-			}
-			if err != nil {
-				return
-			}
-			s += i + 1
-		case unsure:
-			nw, err = t.tempBuf.Write(p[s:])
-			if !updated {
-				n += nw
-			}
-			return
-		case replace:
-			if predef.Debug {
-				t.Logger.Debug().Bytes("data", t.buf).Msg("write")
-			}
-			_, err = t.conn.Write(t.buf)
-			if err != nil {
-				return
-			}
-			i := bytes.IndexByte(p[s:], '\n')
-			if i < 0 {
-				t.skipping = true
-				nw = len(p[s:])
-				if !updated {
-					n += nw
-				}
-				return
-			}
-			s += i + 1
-			if !updated {
-				n += i + 1
-			}
-			t.tempBuf = nil
-			pool.BytesPool.Put(t.buf[:cap(t.buf)])
-			if len(p[s:]) > 0 {
-				if predef.Debug {
-					t.Logger.Debug().Bytes("data", p[s:]).Msg("write")
-				}
-				nw, err = t.conn.Write(p[s:])
-				if !updated {
-					n += nw
-				}
-			}
-			return
-		}
-	}
-	return
-}
-
-const (
-	good = iota
-	unsure
-	replace
-)
-
-func (t *httpTask) isGoodToWrite(p []byte) int {
-	l := len(p)
-	if l > 5 {
-		l = 5
-	}
-	if bytes.Equal(p[:l], host[:l]) {
-		if l < 5 {
-			return unsure
-		}
-		return replace
+	if t.httpWriter != nil {
+		return t.httpWriter.Write(p)
 	}
-	return good
+	return t.conn.Write(p)
 }
 
 func (t *httpTask) Close() {
@@ -230,6 +68,12 @@ func (t *httpTask) CloseWithValue(value uint32) {
 	if !atomic.CompareAndSwapUint32(&t.closing, 0, value) {
 		return
 	}
+	if t.window != nil {
+		t.window.Close()
+	}
+	if t.recvBuffer != nil {
+		t.recvBuffer.Close()
+	}
 	var err error
 	if t.conn != nil {
 		err = t.conn.Close()
@@ -260,6 +104,7 @@ func (t *httpTask) process(connID uint, taskID uint32, c *conn) {
 		delete(c.tasks, taskID)
 		c.tasksRWMtx.Unlock()
 		c.finishedTasks.Add(1)
+		t.metrics.done()
 		t.Close()
 		if c.TasksCount.Add(^uint32(0)) == 0 {
 			c.client.idleManager.SetIdle(connID)
@@ -287,9 +132,22 @@ func (t *httpTask) process(connID uint, taskID uint32, c *conn) {
 				return
 			}
 		}
+		p := buf[10:]
+		if t.window != nil {
+			granted, ok := t.window.Acquire(len(p))
+			if !ok {
+				rErr = net.ErrClosed
+				return
+			}
+			p = p[:granted]
+		}
 		var l int
-		l, rErr = t.conn.Read(buf[10:])
+		l, rErr = t.conn.Read(p)
+		if t.window != nil {
+			t.window.Release(uint32(len(p) - l))
+		}
 		if l > 0 {
+			t.metrics.sent(l)
 			buf[6] = byte(l >> 24)
 			buf[7] = byte(l >> 16)
 			buf[8] = byte(l >> 8)
@@ -316,3 +174,26 @@ func (t *httpTask) process(connID uint, taskID uint32, c *conn) {
 		}
 	}
 }
+
+// writer returns where the data of the task received from the tunnel is written to
+func (t *httpTask) writer() io.Writer {
+	if t.recvBuffer != nil {
+		return t.recvBuffer
+	}
+	return t
+}
+
+// writeLoop 将缓冲的数据写入本地服务，并向服务端更新窗口
+func (t *httpTask) writeLoop(taskID uint32, c *conn) {
+	err := t.recvBuffer.WriteLoop(t, func(n uint32) error {
+		return c.SendWindowUpdate(taskID, n)
+	})
+	if errors.Is(err, io.EOF) {
+		t.CloseByRemote()
+		return
+	}
+	if !errors.Is(err, net.ErrClosed) {
+		t.Logger.Debug().Err(err).Msg("failed to write data to local")
+	}
+	t.Close()
+}
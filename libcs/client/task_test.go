@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"io"
 	"net"
+	"net/url"
 	"testing"
 	"time"
 )
@@ -65,10 +66,15 @@ func Test_task_Write(t1 *testing.T) {
 	type args struct {
 		p []byte
 	}
+	// keep-alive 连接上的每个请求都要替换 Host
 	data := []byte("GET / HTTP/1.1\r\n" +
 		"Host: www.baidu.com\r\n" +
 		"User-Agent: curl/7.64.1\r\n" +
-		"Accept: */*")
+		"Accept: */*\r\n" +
+		"\r\n" +
+		"GET /2 HTTP/1.1\r\n" +
+		"host: www.baidu.com\r\n" +
+		"\r\n")
 	tests := []struct {
 		name    string
 		fields  fields
@@ -88,7 +94,11 @@ func Test_task_Write(t1 *testing.T) {
 			result: []byte("GET / HTTP/1.1\r\n" +
 				"Host: localhost\r\n" +
 				"User-Agent: curl/7.64.1\r\n" +
-				"Accept: */*"),
+				"Accept: */*\r\n" +
+				"\r\n" +
+				"GET /2 HTTP/1.1\r\n" +
+				"host: localhost\r\n" +
+				"\r\n"),
 		},
 	}
 	for _, tt := range tests {
@@ -98,10 +108,9 @@ func Test_task_Write(t1 *testing.T) {
 				var err error
 				buffer := bytes.NewBuffer(nil)
 				t := newHTTPTask(&fakeConn{buffer})
-				err = t.setHost(tt.fields.host)
-				if err != nil {
-					t1.Fatal(err)
-				}
+				t.service = &service{UseLocalAsHTTPHost: true}
+				t.service.LocalURL.URL = &url.URL{Host: tt.fields.host}
+				t.setRewrite(visitor{})
 				buf := make([]byte, i)
 				in := bytes.NewReader(tt.args.p)
 				for {
@@ -130,3 +139,125 @@ func Test_task_Write(t1 *testing.T) {
 		})
 	}
 }
+
+func Test_task_WriteForwarded(t1 *testing.T) {
+	data := []byte("POST /a HTTP/1.1\r\n" +
+		"Host: id1.example.com\r\n" +
+		"X-Forwarded-For: 10.0.0.1\r\n" +
+		"Content-Length: 5\r\n" +
+		"\r\n" +
+		"hello" +
+		"POST /b HTTP/1.1\r\n" +
+		"Host: id1.example.com:8080\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"\r\n" +
+		"3;ext=1\r\nabc\r\n0\r\nTrailer: x\r\n\r\n" +
+		"GET /ws HTTP/1.1\r\n" +
+		"Host: id1.example.com\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Upgrade: websocket\r\n" +
+		"\r\n" +
+		"GET / HTTP/1.1\r\n\r\n")
+	result := []byte("POST /a HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"X-Forwarded-For: 10.0.0.1, 192.0.2.1\r\n" +
+		"Content-Length: 5\r\n" +
+		"X-Real-IP: 192.0.2.1\r\n" +
+		"X-Forwarded-Host: id1.example.com\r\n" +
+		"X-Forwarded-Proto: https\r\n" +
+		"Forwarded: for=192.0.2.1;host=id1.example.com;proto=https\r\n" +
+		"\r\n" +
+		"hello" +
+		"POST /b HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"X-Forwarded-For: 192.0.2.1\r\n" +
+		"X-Real-IP: 192.0.2.1\r\n" +
+		"X-Forwarded-Host: id1.example.com:8080\r\n" +
+		"X-Forwarded-Proto: https\r\n" +
+		"Forwarded: for=192.0.2.1;host=\"id1.example.com:8080\";proto=https\r\n" +
+		"\r\n" +
+		"3;ext=1\r\nabc\r\n0\r\nTrailer: x\r\n\r\n" +
+		"GET /ws HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Upgrade: websocket\r\n" +
+		"X-Forwarded-For: 192.0.2.1\r\n" +
+		"X-Real-IP: 192.0.2.1\r\n" +
+		"X-Forwarded-Host: id1.example.com\r\n" +
+		"X-Forwarded-Proto: https\r\n" +
+		"Forwarded: for=192.0.2.1;host=id1.example.com;proto=https\r\n" +
+		"\r\n" +
+		// 协议切换后的数据原样写入
+		"GET / HTTP/1.1\r\n\r\n")
+	for i := 1; i <= len(data); i++ {
+		buffer := bytes.NewBuffer(nil)
+		t := newHTTPTask(&fakeConn{buffer})
+		t.service = &service{UseLocalAsHTTPHost: true, ForwardedHeaders: true}
+		t.service.LocalURL.URL = &url.URL{Host: "localhost"}
+		t.setRewrite(visitor{src: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}, tls: true})
+		for in := data; len(in) > 0; {
+			l := i
+			if l > len(in) {
+				l = len(in)
+			}
+			n, err := t.Write(in[:l])
+			if err != nil {
+				t1.Fatal(err)
+			}
+			if n != l {
+				t1.Fatalf("%d is expected, but got %d", l, n)
+			}
+			in = in[l:]
+		}
+		if !bytes.Equal(buffer.Bytes(), result) {
+			t1.Fatalf("write %d bytes each time, got:\n%s\nexpected:\n%s", i, buffer.Bytes(), result)
+		}
+	}
+}
+
+func Test_task_WriteForwardedUnknownVisitor(t1 *testing.T) {
+	data := []byte("GET / HTTP/1.1\r\n" +
+		"Host: id1.example.com\r\n" +
+		"X-Forwarded-For: 10.0.0.1\r\n" +
+		"X-Real-IP: 10.0.0.1\r\n" +
+		"Forwarded: for=10.0.0.1\r\n" +
+		"\r\n")
+	// 服务端没有发送访问者地址时删除访问者伪造的地址
+	result := []byte("GET / HTTP/1.1\r\n" +
+		"Host: id1.example.com\r\n" +
+		"X-Forwarded-Host: id1.example.com\r\n" +
+		"X-Forwarded-Proto: http\r\n" +
+		"Forwarded: host=id1.example.com;proto=http\r\n" +
+		"\r\n")
+	buffer := bytes.NewBuffer(nil)
+	t := newHTTPTask(&fakeConn{buffer})
+	t.service = &service{ForwardedHeaders: true}
+	t.setRewrite(visitor{})
+	_, err := t.Write(data)
+	if err != nil {
+		t1.Fatal(err)
+	}
+	if !bytes.Equal(buffer.Bytes(), result) {
+		t1.Fatalf("got:\n%s\nexpected:\n%s", buffer.Bytes(), result)
+	}
+}
+
+func Test_task_WriteForwardedInvalid(t1 *testing.T) {
+	tests := []string{
+		"POST / HTTP/1.1\r\nContent-Length: 1\r\nTransfer-Encoding: chunked\r\n\r\n",
+		"POST / HTTP/1.1\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\n",
+		"POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost : example.com\r\n\r\n",
+		"GET /\r\n\r\n",
+	}
+	for _, tt := range tests {
+		t := newHTTPTask(&fakeConn{bytes.NewBuffer(nil)})
+		t.service = &service{ForwardedHeaders: true}
+		t.setRewrite(visitor{})
+		_, err := t.Write([]byte(tt))
+		if err == nil {
+			t1.Errorf("%q is expected to be rejected", tt)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conn
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+)
+
+// 质询应答认证：
+//
+//	ClientKey = HMAC-SHA256(secret, "gt client key")
+//	StoredKey = SHA256(ClientKey)
+//	Signature = HMAC-SHA256(StoredKey, nonce || id)
+//	Proof     = ClientKey XOR Signature
+//
+// 客户端只发送 Proof，服务端用自己保存的 StoredKey 计算 Signature，
+// 再用 Proof XOR Signature 还原 ClientKey，比较 SHA256(ClientKey) 与 StoredKey。
+// 知道 StoredKey 的人可以从截获的 Proof 中还原 ClientKey 并伪造之后的应答，
+// 所以 StoredKey 只能在加密的连接上发送，用于 allowAnyClient 模式下登记新的 id。
+const (
+	// NonceSize 服务端质询随机数的长度
+	NonceSize = 32
+	// ProofSize 客户端质询应答的长度
+	ProofSize = sha256.Size
+	// EnrollmentSize 附带 StoredKey 的质询应答的长度
+	EnrollmentSize = ProofSize + sha256.Size
+)
+
+var clientKeyLabel = []byte("gt client key")
+
+func clientKey(secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(clientKeyLabel)
+	return mac.Sum(nil)
+}
+
+func signature(storedKey []byte, id string, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, storedKey)
+	mac.Write(nonce)
+	mac.Write([]byte(id))
+	return mac.Sum(nil)
+}
+
+// StoredKey 返回 secret 对应的 stored key
+func StoredKey(secret string) []byte {
+	ck := clientKey(secret)
+	sk := sha256.Sum256(ck)
+	return sk[:]
+}
+
+// GenProof 生成对 nonce 的质询应答，长度为 ProofSize
+func GenProof(id, secret string, nonce []byte) []byte {
+	ck := clientKey(secret)
+	sk := sha256.Sum256(ck)
+	proof := signature(sk[:], id, nonce)
+	for i := range proof {
+		proof[i] ^= ck[i]
+	}
+	return proof
+}
+
+// GenEnrollment 生成附带 stored key 的质询应答，长度为 EnrollmentSize，只能在加密的连接上发送
+func GenEnrollment(id, secret string, nonce []byte) []byte {
+	return append(GenProof(id, secret, nonce), StoredKey(secret)...)
+}
+
+// ParseEnrollment 拆分质询应答与客户端声明的 stored key，没有附带 stored key 时 storedKey 为 nil
+func ParseEnrollment(b []byte) (proof []byte, storedKey []byte) {
+	if len(b) == EnrollmentSize {
+		return b[:ProofSize], b[ProofSize:]
+	}
+	return b, nil
+}
+
+// VerifyProof 用 storedKey 验证质询应答
+func VerifyProof(storedKey []byte, id string, nonce []byte, proof []byte) bool {
+	if len(storedKey) != sha256.Size || len(proof) != ProofSize {
+		return false
+	}
+	ck := signature(storedKey, id, nonce)
+	for i := range ck {
+		ck[i] ^= proof[i]
+	}
+	sk := sha256.Sum256(ck)
+	return subtle.ConstantTimeCompare(sk[:], storedKey) == 1
+}
@@ -38,6 +38,9 @@ type Connection struct {
 	WriteTimeout time.Duration
 	TasksCount   atomic.Uint32
 	Closing      atomic.Uint32
+
+	// OnErrorSignal 在发送错误信号前被调用，用于统计
+	OnErrorSignal func(code Error)
 }
 
 func (c *Connection) Write(b []byte) (n int, err error) {
@@ -134,7 +137,16 @@ var (
 	errDifferentConfigClientConnectedBytes = []byte{0xFF, 0xFF, 0xFF, 0xFC, 0x00, 0x07}
 	errReachedMaxOptionsBytes              = []byte{0xFF, 0xFF, 0xFF, 0xFC, 0x00, 0x08}
 	errTCPNumberLimited                    = []byte{0xFF, 0xFF, 0xFF, 0xFC, 0x00, 0x09}
+	errFailedToOpenUDPPortBytes            = []byte{0xFF, 0xFF, 0xFF, 0xFC, 0x00, 0x0A}
+	errVersionTooLowBytes                  = []byte{0xFF, 0xFF, 0xFF, 0xFC, 0x00, 0x0B}
+	errDomainNotAllowedBytes               = []byte{0xFF, 0xFF, 0xFF, 0xFC, 0x00, 0x0C}
+	errEdgeAuthNotAllowedBytes             = []byte{0xFF, 0xFF, 0xFF, 0xFC, 0x00, 0x0D}
+	errIPNotAllowedBytes                   = []byte{0xFF, 0xFF, 0xFF, 0xFC, 0x00, 0x0E}
+	errQuotaExceededBytes                  = []byte{0xFF, 0xFF, 0xFF, 0xFC, 0x00, 0x0F}
+	errBannedBytes                         = []byte{0xFF, 0xFF, 0xFF, 0xFC, 0x00, 0x10}
 	infoTCPPortOpened                      = []byte{0xFF, 0xFF, 0xFF, 0xFB, 0x00, 0x01}
+	infoUDPPortOpened                      = []byte{0xFF, 0xFF, 0xFF, 0xFB, 0x00, 0x02}
+	infoCapabilities                       = []byte{0xFF, 0xFF, 0xFF, 0xFB, 0x00, 0x03}
 	ServicesBytes                          = []byte{0xFF, 0xFF, 0xFF, 0xFA}
 	reconnectBytes                         = []byte{0xFF, 0xFF, 0xFF, 0xF9}
 )
@@ -162,6 +174,20 @@ func (e Error) Error() string {
 		return "reached the max options"
 	case ErrTCPNumberLimited:
 		return "tcp number limited"
+	case ErrFailedToOpenUDPPort:
+		return "failed to open udp port"
+	case ErrVersionTooLow:
+		return "protocol version too low"
+	case ErrDomainNotAllowed:
+		return "domain not allowed"
+	case ErrEdgeAuthNotAllowed:
+		return "edge auth not allowed"
+	case ErrIPNotAllowed:
+		return "ip not allowed"
+	case ErrQuotaExceeded:
+		return "quota exceeded"
+	case ErrBanned:
+		return "banned"
 	}
 	return "unknown error"
 }
@@ -186,6 +212,20 @@ const (
 	ErrReachedMaxOptions
 	// ErrTCPNumberLimited represents tcp number limited
 	ErrTCPNumberLimited
+	// ErrFailedToOpenUDPPort represents failed to open udp port
+	ErrFailedToOpenUDPPort
+	// ErrVersionTooLow represents the protocol version of the client is lower than the server required
+	ErrVersionTooLow
+	// ErrDomainNotAllowed represents the domain is not in the allowed domains of the user
+	ErrDomainNotAllowed
+	// ErrEdgeAuthNotAllowed represents the server does not allow the client to declare edge auth policies
+	ErrEdgeAuthNotAllowed
+	// ErrIPNotAllowed represents the client logs in from an IP that is not allowed
+	ErrIPNotAllowed
+	// ErrQuotaExceeded represents the traffic quota of the user is exhausted
+	ErrQuotaExceeded
+	// ErrBanned represents the id or the IP of the client is banned by the operator
+	ErrBanned
 )
 
 // Info represents a specific information signal
@@ -195,6 +235,10 @@ const (
 	_ Info = iota
 	// InfoTCPPortOpened represents TCP port opened successfully
 	InfoTCPPortOpened
+	// InfoUDPPortOpened represents UDP port opened successfully
+	InfoUDPPortOpened
+	// InfoCapabilities represents the negotiated protocol version and features
+	InfoCapabilities
 )
 
 // SendPingSignal sends ping signal to the other side
@@ -246,14 +290,22 @@ func (c *Connection) SendServicesSignal() (err error) {
 	return
 }
 
+func (c *Connection) errorSignal(code Error) {
+	if c.OnErrorSignal != nil {
+		c.OnErrorSignal(code)
+	}
+}
+
 // SendErrorSignalInvalidIDAndSecret sends InvalidIDAndSecret signal to the other side
 func (c *Connection) SendErrorSignalInvalidIDAndSecret() (err error) {
+	c.errorSignal(ErrInvalidIDAndSecret)
 	_, err = c.Write(errInvalidIDAndSecretBytes)
 	return
 }
 
 // SendErrorSignalFailedToOpenTCPPort sends FailedToOpenTCPPort signal to the other side
 func (c *Connection) SendErrorSignalFailedToOpenTCPPort(si uint16) (err error) {
+	c.errorSignal(ErrFailedToOpenTCPPort)
 	buf := pool.BytesPool.Get().([]byte)
 	defer pool.BytesPool.Put(buf)
 	n := copy(buf, errFailedToOpenTCPPortBytes)
@@ -276,44 +328,138 @@ func (c *Connection) SendInfoTCPPortOpened(si uint16, tcpPort uint16) (err error
 	return
 }
 
+// SendErrorSignalFailedToOpenUDPPort sends FailedToOpenUDPPort signal to the other side
+func (c *Connection) SendErrorSignalFailedToOpenUDPPort(si uint16) (err error) {
+	c.errorSignal(ErrFailedToOpenUDPPort)
+	buf := pool.BytesPool.Get().([]byte)
+	defer pool.BytesPool.Put(buf)
+	n := copy(buf, errFailedToOpenUDPPortBytes)
+	buf[n] = byte(si >> 8)
+	buf[n+1] = byte(si)
+	_, err = c.Write(buf[:n+2])
+	return
+}
+
+// SendInfoUDPPortOpened sends InfoUDPPortOpened signal to the other side
+func (c *Connection) SendInfoUDPPortOpened(si uint16, udpPort uint16) (err error) {
+	buf := pool.BytesPool.Get().([]byte)
+	defer pool.BytesPool.Put(buf)
+	n := copy(buf, infoUDPPortOpened)
+	buf[n] = byte(si >> 8)
+	buf[n+1] = byte(si)
+	buf[n+2] = byte(udpPort >> 8)
+	buf[n+3] = byte(udpPort)
+	_, err = c.Write(buf[:n+4])
+	return
+}
+
+// SendErrorSignalVersionTooLow sends VersionTooLow signal with the min version to the other side
+func (c *Connection) SendErrorSignalVersionTooLow(minVersion uint16) (err error) {
+	c.errorSignal(ErrVersionTooLow)
+	buf := pool.BytesPool.Get().([]byte)
+	defer pool.BytesPool.Put(buf)
+	n := copy(buf, errVersionTooLowBytes)
+	buf[n] = byte(minVersion >> 8)
+	buf[n+1] = byte(minVersion)
+	_, err = c.Write(buf[:n+2])
+	return
+}
+
+// SendInfoCapabilities sends InfoCapabilities signal to the other side
+func (c *Connection) SendInfoCapabilities(version uint16, features uint32) (err error) {
+	buf := pool.BytesPool.Get().([]byte)
+	defer pool.BytesPool.Put(buf)
+	n := copy(buf, infoCapabilities)
+	buf[n] = byte(version >> 8)
+	buf[n+1] = byte(version)
+	buf[n+2] = byte(features >> 24)
+	buf[n+3] = byte(features >> 16)
+	buf[n+4] = byte(features >> 8)
+	buf[n+5] = byte(features)
+	_, err = c.Write(buf[:n+6])
+	return
+}
+
 // SendErrorSignalReachedMaxConnections sends ReachedMaxConnections signal to the other side
 func (c *Connection) SendErrorSignalReachedMaxConnections() (err error) {
+	c.errorSignal(ErrReachedMaxConnections)
 	_, err = c.Write(errReachedTheMaxConnectionsBytes)
 	return
 }
 
 // SendErrorSignalHostNumberLimited sends HostNumberLimited signal to the other side
 func (c *Connection) SendErrorSignalHostNumberLimited() (err error) {
+	c.errorSignal(ErrHostNumberLimited)
 	_, err = c.Write(errHostNumberLimitedBytes)
 	return
 }
 
 // SendErrorSignalTCPNumberLimited sends TCPNumberLimited signal to the other side
 func (c *Connection) SendErrorSignalTCPNumberLimited() (err error) {
+	c.errorSignal(ErrTCPNumberLimited)
 	_, err = c.Write(errTCPNumberLimited)
 	return
 }
 
 // SendErrorSignalHostConflict sends HostConflict signal to the other side
 func (c *Connection) SendErrorSignalHostConflict() (err error) {
+	c.errorSignal(ErrHostConflict)
 	_, err = c.Write(errHostConflictBytes)
 	return
 }
 
 // SendErrorSignalHostRegexMismatch sends HostRegexMismatch signal to the other side
 func (c *Connection) SendErrorSignalHostRegexMismatch() (err error) {
+	c.errorSignal(ErrHostRegexMismatch)
 	_, err = c.Write(errHostRegexMismatchBytes)
 	return
 }
 
+// SendErrorSignalDomainNotAllowed sends DomainNotAllowed signal to the other side
+func (c *Connection) SendErrorSignalDomainNotAllowed() (err error) {
+	c.errorSignal(ErrDomainNotAllowed)
+	_, err = c.Write(errDomainNotAllowedBytes)
+	return
+}
+
+// SendErrorSignalEdgeAuthNotAllowed sends EdgeAuthNotAllowed signal to the other side
+func (c *Connection) SendErrorSignalEdgeAuthNotAllowed() (err error) {
+	c.errorSignal(ErrEdgeAuthNotAllowed)
+	_, err = c.Write(errEdgeAuthNotAllowedBytes)
+	return
+}
+
+// SendErrorSignalIPNotAllowed sends IPNotAllowed signal to the other side
+func (c *Connection) SendErrorSignalIPNotAllowed() (err error) {
+	c.errorSignal(ErrIPNotAllowed)
+	_, err = c.Write(errIPNotAllowedBytes)
+	return
+}
+
+// SendErrorSignalQuotaExceeded sends QuotaExceeded signal to the other side
+func (c *Connection) SendErrorSignalQuotaExceeded() (err error) {
+	c.errorSignal(ErrQuotaExceeded)
+	_, err = c.Write(errQuotaExceededBytes)
+	return
+}
+
+// SendErrorSignalBanned sends Banned signal to the other side
+func (c *Connection) SendErrorSignalBanned() (err error) {
+	c.errorSignal(ErrBanned)
+	_, err = c.Write(errBannedBytes)
+	return
+}
+
 // SendErrorSignalDifferentConfigClientConnected sends DifferentConfigClientConnected signal to the other side
 func (c *Connection) SendErrorSignalDifferentConfigClientConnected() (err error) {
+	c.errorSignal(ErrDifferentConfigClientConnected)
 	_, err = c.Write(errDifferentConfigClientConnectedBytes)
 	return
 }
 
 // SendErrorSignalReachedMaxOptions sends ReachedMaxOptions signal to the other side
 func (c *Connection) SendErrorSignalReachedMaxOptions() (err error) {
+	c.errorSignal(ErrReachedMaxOptions)
 	_, err = c.Write(errReachedMaxOptionsBytes)
 	return
 }
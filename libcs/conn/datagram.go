@@ -0,0 +1,82 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conn
+
+import (
+	"net"
+)
+
+// MaxDatagramSize is the max size of a datagram forwarded through the tunnel
+const MaxDatagramSize = 65535
+
+// DatagramConn adapts a datagram oriented net.Conn, every Read and Write of
+// which is exactly one datagram, to the byte stream of a task.
+// Every datagram in the stream is prefixed with its 2 bytes big-endian length.
+type DatagramConn struct {
+	net.Conn
+
+	readBuf  []byte
+	readLeft []byte
+	writeBuf []byte
+}
+
+// NewDatagramConn returns a DatagramConn wrapping c
+func NewDatagramConn(c net.Conn) *DatagramConn {
+	return &DatagramConn{Conn: c}
+}
+
+// Read reads the next framed datagram
+func (d *DatagramConn) Read(b []byte) (n int, err error) {
+	if len(d.readLeft) == 0 {
+		if d.readBuf == nil {
+			d.readBuf = make([]byte, MaxDatagramSize+2)
+		}
+		var l int
+		l, err = d.Conn.Read(d.readBuf[2:])
+		if l <= 0 {
+			return
+		}
+		d.readBuf[0] = byte(l >> 8)
+		d.readBuf[1] = byte(l)
+		d.readLeft = d.readBuf[:l+2]
+	}
+	n = copy(b, d.readLeft)
+	d.readLeft = d.readLeft[n:]
+	return
+}
+
+// Write writes the framed datagrams in b, partial frames are kept until they are completed
+func (d *DatagramConn) Write(b []byte) (n int, err error) {
+	n = len(b)
+	p := b
+	if len(d.writeBuf) > 0 {
+		d.writeBuf = append(d.writeBuf, b...)
+		p = d.writeBuf
+	}
+	for len(p) >= 2 {
+		l := int(p[0])<<8 | int(p[1])
+		if len(p) < l+2 {
+			break
+		}
+		_, err = d.Conn.Write(p[2 : l+2])
+		if err != nil {
+			return
+		}
+		p = p[l+2:]
+	}
+	// p may be the tail of d.writeBuf, append copies with memmove semantics
+	d.writeBuf = append(d.writeBuf[:0], p...)
+	return
+}
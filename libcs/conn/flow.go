@@ -0,0 +1,197 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conn
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/isrc-cas/gt/predef"
+)
+
+// ErrWindowExceeded is an error returned when the remote sends more data than the window allows
+var ErrWindowExceeded = errors.New("window exceeded")
+
+// SendWindow is the credit a task may send to the remote before receiving window updates
+type SendWindow struct {
+	mtx    sync.Mutex
+	cond   sync.Cond
+	credit int64
+	closed bool
+}
+
+// NewSendWindow returns a SendWindow with size credit
+func NewSendWindow(size uint32) *SendWindow {
+	w := &SendWindow{credit: int64(size)}
+	w.cond.L = &w.mtx
+	return w
+}
+
+// Acquire blocks until there is credit, then takes at most n of it.
+// ok is false when the window is closed.
+func (w *SendWindow) Acquire(n int) (granted int, ok bool) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for w.credit <= 0 && !w.closed {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return
+	}
+	granted = n
+	if int64(granted) > w.credit {
+		granted = int(w.credit)
+	}
+	w.credit -= int64(granted)
+	ok = true
+	return
+}
+
+// Release gives n credit back to the window
+func (w *SendWindow) Release(n uint32) {
+	if n == 0 {
+		return
+	}
+	w.mtx.Lock()
+	w.credit += int64(n)
+	w.mtx.Unlock()
+	w.cond.Signal()
+}
+
+// Close wakes up and fails all the Acquire calls
+func (w *SendWindow) Close() {
+	w.mtx.Lock()
+	w.closed = true
+	w.mtx.Unlock()
+	w.cond.Broadcast()
+}
+
+// ReceiveBuffer buffers the data of a task read from the tunnel, so that a slow
+// writer of the task doesn't block the read loop shared by all tasks of the tunnel.
+type ReceiveBuffer struct {
+	mtx      sync.Mutex
+	cond     sync.Cond
+	size     int
+	pending  []byte
+	spare    []byte
+	inflight int
+	closed   bool
+	finished bool
+	block    bool // 缓冲满时 Write 等待而不是返回 ErrWindowExceeded
+}
+
+// NewReceiveBuffer returns a ReceiveBuffer that holds at most size bytes
+func NewReceiveBuffer(size uint32) *ReceiveBuffer {
+	b := &ReceiveBuffer{size: int(size)}
+	b.cond.L = &b.mtx
+	return b
+}
+
+// NewBlockingReceiveBuffer returns a ReceiveBuffer that holds at most size bytes,
+// Write blocks until there is room instead of failing, for remotes without flow control.
+func NewBlockingReceiveBuffer(size uint32) *ReceiveBuffer {
+	b := NewReceiveBuffer(size)
+	b.block = true
+	return b
+}
+
+// Write appends p to the buffer, it only blocks when the buffer is created by NewBlockingReceiveBuffer and is full
+func (b *ReceiveBuffer) Write(p []byte) (n int, err error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for b.block && !b.closed && !b.finished && len(b.pending)+b.inflight > 0 && len(b.pending)+b.inflight+len(p) > b.size {
+		b.cond.Wait()
+	}
+	if b.closed || b.finished {
+		return 0, net.ErrClosed
+	}
+	if len(b.pending)+b.inflight+len(p) > b.size && !b.block {
+		return 0, ErrWindowExceeded
+	}
+	b.pending = append(b.pending, p...)
+	b.cond.Broadcast()
+	return len(p), nil
+}
+
+// WriteLoop writes the buffered data to w until the buffer is closed or the write fails.
+// consumed is called with the number of bytes written so that the remote can be granted more credit.
+// io.EOF is returned when all the data is written after Finish.
+func (b *ReceiveBuffer) WriteLoop(w io.Writer, consumed func(n uint32) error) (err error) {
+	for {
+		b.mtx.Lock()
+		for len(b.pending) == 0 && !b.closed && !b.finished {
+			b.cond.Wait()
+		}
+		if b.closed {
+			b.mtx.Unlock()
+			return net.ErrClosed
+		}
+		if len(b.pending) == 0 {
+			b.mtx.Unlock()
+			return io.EOF
+		}
+		p := b.pending
+		b.pending = b.spare[:0]
+		b.spare = nil
+		b.inflight = len(p)
+		b.mtx.Unlock()
+
+		_, err = w.Write(p)
+		if err != nil {
+			return
+		}
+
+		b.mtx.Lock()
+		b.inflight = 0
+		b.spare = p
+		b.mtx.Unlock()
+		b.cond.Broadcast()
+		err = consumed(uint32(len(p)))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Finish makes WriteLoop return after all the buffered data is written
+func (b *ReceiveBuffer) Finish() {
+	b.mtx.Lock()
+	b.finished = true
+	b.mtx.Unlock()
+	b.cond.Broadcast()
+}
+
+// Close stops WriteLoop, data left in the buffer is dropped
+func (b *ReceiveBuffer) Close() {
+	b.mtx.Lock()
+	b.closed = true
+	b.pending = nil
+	b.spare = nil
+	b.mtx.Unlock()
+	b.cond.Broadcast()
+}
+
+// SendWindowUpdate grants the remote n more bytes of credit on the task
+func (c *Connection) SendWindowUpdate(taskID uint32, n uint32) (err error) {
+	buf := [10]byte{
+		byte(taskID >> 24), byte(taskID >> 16), byte(taskID >> 8), byte(taskID),
+		byte(predef.WindowUpdate >> 8), byte(predef.WindowUpdate),
+		byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n),
+	}
+	_, err = c.Write(buf[:])
+	return
+}
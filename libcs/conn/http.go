@@ -0,0 +1,613 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conn
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MaxHTTPRequestHeadSize 是 HTTP 请求行与头部的最大长度
+const MaxHTTPRequestHeadSize = 64 * 1024
+
+const maxHTTPChunkLineSize = 4096
+
+var (
+	// ErrInvalidHTTPRequest is an error returned when the http request can not be parsed
+	ErrInvalidHTTPRequest = errors.New("invalid http request")
+	// ErrInvalidHTTPResponse is an error returned when the http response can not be parsed
+	ErrInvalidHTTPResponse = errors.New("invalid http response")
+	// ErrSkipHTTPRequest is returned by the rewrite function of HTTPRequestWriter to not write the head of the request
+	ErrSkipHTTPRequest = errors.New("skip http request")
+)
+
+// HTTPHeaderField 是一行 HTTP 头部，保留原始的大小写
+type HTTPHeaderField struct {
+	Name  string
+	Value string
+}
+
+// HTTPHeader 是按原始顺序保存的 HTTP 头部
+type HTTPHeader []HTTPHeaderField
+
+// Get 返回名字为 name 的第一个头部的值
+func (h HTTPHeader) Get(name string) string {
+	for _, f := range h {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// Values 返回名字为 name 的所有头部的值
+func (h HTTPHeader) Values(name string) (values []string) {
+	for _, f := range h {
+		if strings.EqualFold(f.Name, name) {
+			values = append(values, f.Value)
+		}
+	}
+	return
+}
+
+// Set 设置名字为 name 的头部，替换已有的同名头部
+func (h *HTTPHeader) Set(name, value string) {
+	for i, f := range *h {
+		if strings.EqualFold(f.Name, name) {
+			(*h)[i].Value = value
+			h.del(name, i+1)
+			return
+		}
+	}
+	*h = append(*h, HTTPHeaderField{Name: name, Value: value})
+}
+
+// Del 删除名字为 name 的所有头部
+func (h *HTTPHeader) Del(name string) {
+	h.del(name, 0)
+}
+
+func (h *HTTPHeader) del(name string, from int) {
+	header := (*h)[:from]
+	for _, f := range (*h)[from:] {
+		if !strings.EqualFold(f.Name, name) {
+			header = append(header, f)
+		}
+	}
+	*h = header
+}
+
+// hasToken 判断以逗号分隔的头部中是否包含 token
+func (h HTTPHeader) hasToken(name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (h HTTPHeader) appendTo(b []byte) []byte {
+	for _, f := range h {
+		b = append(b, f.Name...)
+		b = append(b, ": "...)
+		b = append(b, f.Value...)
+		b = append(b, "\r\n"...)
+	}
+	return append(b, "\r\n"...)
+}
+
+// bodyLength 返回消息体的长度，没有相关头部时 ok 为 false，chunked 为 true 时消息体使用 chunked 编码
+func (h HTTPHeader) bodyLength() (length int64, chunked bool, ok bool, err error) {
+	te := h.Values("Transfer-Encoding")
+	cl := h.Values("Content-Length")
+	if len(te) > 0 {
+		// 同时存在两者时无法确定对端使用哪一个，拒绝以避免请求走私
+		if len(cl) > 0 {
+			err = errors.New("both Transfer-Encoding and Content-Length are present")
+			return
+		}
+		codings := strings.Split(strings.Join(te, ","), ",")
+		if !strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			err = errors.New("the final transfer coding is not chunked")
+			return
+		}
+		chunked, ok = true, true
+		return
+	}
+	for i, v := range cl {
+		var l int64
+		l, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || l < 0 || (i > 0 && l != length) {
+			err = errors.New("invalid Content-Length")
+			return
+		}
+		length, ok = l, true
+	}
+	return
+}
+
+// splitHTTPHead 将以空行结尾的起始行与头部按行切分
+func splitHTTPHead(head []byte) (startLine string, header HTTPHeader, ok bool) {
+	lines := strings.Split(string(head), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+	// 去掉结尾的空行
+	for len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return
+	}
+	header = make(HTTPHeader, 0, len(lines)-1)
+	for _, line := range lines[1:] {
+		i := strings.IndexByte(line, ':')
+		// 不接受 obs-fold 与名字中的空白，避免与对端的解析结果不一致
+		if i <= 0 || strings.ContainsAny(line[:i], " \t") {
+			return
+		}
+		header = append(header, HTTPHeaderField{
+			Name:  line[:i],
+			Value: strings.Trim(line[i+1:], " \t"),
+		})
+	}
+	return lines[0], header, true
+}
+
+// HTTPRequest 是 HTTP/1.x 请求的请求行与头部
+type HTTPRequest struct {
+	Method string
+	Target string
+	Proto  string
+	Header HTTPHeader
+}
+
+// ParseHTTPRequest 解析以空行结尾的请求行与头部
+func ParseHTTPRequest(head []byte) (req *HTTPRequest, err error) {
+	startLine, header, ok := splitHTTPHead(head)
+	if !ok {
+		err = ErrInvalidHTTPRequest
+		return
+	}
+	parts := strings.Split(startLine, " ")
+	if len(parts) != 3 || len(parts[0]) == 0 || len(parts[1]) == 0 || !strings.HasPrefix(parts[2], "HTTP/1.") {
+		err = ErrInvalidHTTPRequest
+		return
+	}
+	req = &HTTPRequest{
+		Method: parts[0],
+		Target: parts[1],
+		Proto:  parts[2],
+		Header: header,
+	}
+	return
+}
+
+// IsUpgrade 判断请求之后连接是否会切换为其他协议
+func (r *HTTPRequest) IsUpgrade() bool {
+	return r.Method == "CONNECT" || (len(r.Header.Get("Upgrade")) > 0 && r.Header.hasToken("Connection", "upgrade"))
+}
+
+// AppendTo 将请求行与头部编码后追加到 b
+func (r *HTTPRequest) AppendTo(b []byte) []byte {
+	b = append(b, r.Method...)
+	b = append(b, ' ')
+	b = append(b, r.Target...)
+	b = append(b, ' ')
+	b = append(b, r.Proto...)
+	b = append(b, "\r\n"...)
+	return r.Header.appendTo(b)
+}
+
+// HTTPResponse 是 HTTP/1.x 响应的状态行与头部
+type HTTPResponse struct {
+	Proto      string
+	StatusCode int
+	Reason     string
+	Header     HTTPHeader
+}
+
+// ParseHTTPResponse 解析以空行结尾的状态行与头部
+func ParseHTTPResponse(head []byte) (resp *HTTPResponse, err error) {
+	startLine, header, ok := splitHTTPHead(head)
+	if !ok {
+		err = ErrInvalidHTTPResponse
+		return
+	}
+	parts := strings.SplitN(startLine, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "HTTP/1.") || len(parts[1]) != 3 {
+		err = ErrInvalidHTTPResponse
+		return
+	}
+	code, err := strconv.Atoi(parts[1])
+	if err != nil || code < 100 {
+		err = ErrInvalidHTTPResponse
+		return
+	}
+	resp = &HTTPResponse{
+		Proto:      parts[0],
+		StatusCode: code,
+		Header:     header,
+	}
+	if len(parts) == 3 {
+		resp.Reason = parts[2]
+	}
+	return
+}
+
+const (
+	httpStateHead = iota
+	httpStateBody
+	httpStateChunkSize
+	httpStateChunkData
+	httpStateChunkDataEnd
+	httpStateTrailer
+	httpStateTunnel
+)
+
+// httpStream 按 HTTP/1.x 消息的边界将写入的数据写到 w，消息体按 Content-Length 或 chunked 编码原样写入
+type httpStream struct {
+	w io.Writer
+	// onHead 在收到完整的起始行与头部时调用，返回写到 w 的头部与消息体的长度，
+	// length 为 -1 表示消息体直到连接关闭
+	onHead func(head []byte) (out []byte, length int64, chunked bool, err error)
+	// onEnd 在消息结束时调用，返回 true 表示之后的数据不再解析，原样写入
+	onEnd func() (tunnel bool)
+
+	state     int
+	line      []byte
+	remaining int64
+	err       error
+}
+
+func (h *httpStream) Write(p []byte) (n int, err error) {
+	if h.err != nil {
+		return 0, h.err
+	}
+	for n < len(p) && err == nil {
+		var nw int
+		nw, err = h.write(p[n:])
+		n += nw
+	}
+	h.err = err
+	return
+}
+
+// readLine 将 p 中直到换行的数据追加到 h.line，返回消耗的长度与是否读到完整的一行
+func (h *httpStream) readLine(p []byte, max int) (n int, ok bool, err error) {
+	i := bytes.IndexByte(p, '\n')
+	if i < 0 {
+		n = len(p)
+	} else {
+		n = i + 1
+		ok = true
+	}
+	if len(h.line)+n > max {
+		err = errors.New("http line is too long")
+		return
+	}
+	h.line = append(h.line, p[:n]...)
+	return
+}
+
+func (h *httpStream) passThrough(p []byte) (n int, err error) {
+	if h.remaining < int64(len(p)) {
+		p = p[:h.remaining]
+	}
+	n, err = h.w.Write(p)
+	h.remaining -= int64(n)
+	return
+}
+
+func (h *httpStream) flushLine() (err error) {
+	_, err = h.w.Write(h.line)
+	h.line = h.line[:0]
+	return
+}
+
+// endOfMessage 在消息体结束后进入下一个消息
+func (h *httpStream) endOfMessage() {
+	if h.onEnd != nil && h.onEnd() {
+		h.state = httpStateTunnel
+	} else {
+		h.state = httpStateHead
+	}
+}
+
+func (h *httpStream) write(p []byte) (n int, err error) {
+	switch h.state {
+	case httpStateHead:
+		// 忽略消息之间多余的空行
+		if len(h.line) == 0 && (p[0] == '\r' || p[0] == '\n') {
+			return 1, nil
+		}
+		var ok bool
+		n, ok, err = h.readLine(p, MaxHTTPRequestHeadSize)
+		if err != nil || !ok {
+			return
+		}
+		if !bytes.HasSuffix(h.line, []byte("\n\n")) && !bytes.HasSuffix(h.line, []byte("\n\r\n")) {
+			return
+		}
+		var out []byte
+		var length int64
+		var chunked bool
+		out, length, chunked, err = h.onHead(h.line)
+		h.line = h.line[:0]
+		if err != nil {
+			return
+		}
+		_, err = h.w.Write(out)
+		if err != nil {
+			return
+		}
+		switch {
+		case chunked:
+			h.state = httpStateChunkSize
+		case length < 0:
+			h.state = httpStateTunnel
+		case length > 0:
+			h.state = httpStateBody
+			h.remaining = length
+		default:
+			h.endOfMessage()
+		}
+	case httpStateBody:
+		n, err = h.passThrough(p)
+		if h.remaining == 0 {
+			h.endOfMessage()
+		}
+	case httpStateChunkSize:
+		var ok bool
+		n, ok, err = h.readLine(p, maxHTTPChunkLineSize)
+		if err != nil || !ok {
+			return
+		}
+		size := bytes.TrimSpace(h.line)
+		if i := bytes.IndexByte(size, ';'); i >= 0 {
+			size = bytes.TrimSpace(size[:i])
+		}
+		h.remaining, err = strconv.ParseInt(string(size), 16, 64)
+		if err != nil || h.remaining < 0 {
+			err = errors.New("invalid chunk size")
+			return
+		}
+		if h.remaining == 0 {
+			h.state = httpStateTrailer
+		} else {
+			h.state = httpStateChunkData
+		}
+		err = h.flushLine()
+	case httpStateChunkData:
+		n, err = h.passThrough(p)
+		if h.remaining == 0 {
+			h.state = httpStateChunkDataEnd
+		}
+	case httpStateChunkDataEnd:
+		var ok bool
+		n, ok, err = h.readLine(p, 2)
+		if err != nil || !ok {
+			return
+		}
+		if len(bytes.TrimSpace(h.line)) > 0 {
+			err = errors.New("invalid end of chunk data")
+			return
+		}
+		h.state = httpStateChunkSize
+		err = h.flushLine()
+	case httpStateTrailer:
+		var ok bool
+		n, ok, err = h.readLine(p, maxHTTPChunkLineSize)
+		if err != nil || !ok {
+			return
+		}
+		end := len(bytes.TrimSpace(h.line)) == 0
+		err = h.flushLine()
+		if end {
+			h.endOfMessage()
+		}
+	case httpStateTunnel:
+		n, err = h.w.Write(p)
+	}
+	return
+}
+
+// HTTPRequestWriter 解析写入的 HTTP/1.x 请求流，每个请求的头部经过 rewrite 修改后再写到 w，
+// 请求体原样写入。rewrite 返回 ErrSkipHTTPRequest 时不写入头部，只写入请求体。
+// 请求切换协议后，之后的数据原样写入。
+type HTTPRequestWriter struct {
+	httpStream
+	rewrite func(req *HTTPRequest) error
+	upgrade bool
+
+	// Ended 在每个请求结束时调用，可以为 nil
+	Ended func()
+	// Upgraded 在切换协议的请求结束后调用，返回协议切换是否成功，为 nil 时认为成功
+	Upgraded func() bool
+}
+
+// NewHTTPRequestWriter 返回一个 HTTPRequestWriter，rewrite 可以为 nil
+func NewHTTPRequestWriter(w io.Writer, rewrite func(req *HTTPRequest) error) *HTTPRequestWriter {
+	h := &HTTPRequestWriter{rewrite: rewrite}
+	h.w = w
+	h.onHead = h.head
+	h.onEnd = h.end
+	return h
+}
+
+func (h *HTTPRequestWriter) head(head []byte) (out []byte, length int64, chunked bool, err error) {
+	req, err := ParseHTTPRequest(head)
+	if err != nil {
+		return
+	}
+	// 没有 Content-Length 与 Transfer-Encoding 的请求没有请求体
+	length, chunked, _, err = req.Header.bodyLength()
+	if err != nil {
+		return
+	}
+	h.upgrade = req.IsUpgrade()
+	if h.rewrite != nil {
+		err = h.rewrite(req)
+		if errors.Is(err, ErrSkipHTTPRequest) {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+	out = req.AppendTo(head[:0])
+	return
+}
+
+func (h *HTTPRequestWriter) end() bool {
+	if h.Ended != nil {
+		h.Ended()
+	}
+	if !h.upgrade {
+		return false
+	}
+	if h.Upgraded != nil {
+		return h.Upgraded()
+	}
+	return true
+}
+
+// HTTPResponseWriter 将 HTTP/1.x 响应流原样写到 w，同时记录每个请求的响应是否已经结束
+type HTTPResponseWriter struct {
+	httpStream
+	mtx      sync.Mutex
+	methods  []string      // 已发送但还没有收到完整的最终响应的请求的方法
+	tunnel   bool          // 连接已切换为其他协议
+	interim  bool          // 当前响应是 1xx 临时响应
+	finished chan struct{} // 所有请求的响应结束时关闭
+
+	code    int   // 当前响应的状态码
+	written int64 // 已经写出的字节数
+	start   int64 // 当前响应开始时已经写出的字节数
+
+	// Responded 在每个最终响应结束时调用，size 为写出的响应的字节数，可以为 nil
+	Responded func(code int, size int64)
+}
+
+type countWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c countWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	*c.n += int64(n)
+	return
+}
+
+// NewHTTPResponseWriter 返回一个 HTTPResponseWriter
+func NewHTTPResponseWriter(w io.Writer) *HTTPResponseWriter {
+	h := &HTTPResponseWriter{finished: make(chan struct{})}
+	close(h.finished)
+	h.w = countWriter{w: w, n: &h.written}
+	h.onHead = h.head
+	h.onEnd = h.end
+	return h
+}
+
+// Expect 登记一个已经发出的请求，method 用于判断响应是否有响应体
+func (h *HTTPResponseWriter) Expect(method string) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if len(h.methods) == 0 {
+		h.finished = make(chan struct{})
+	}
+	h.methods = append(h.methods, method)
+}
+
+// Finished 返回所有已登记的请求的响应都结束时关闭的 channel
+func (h *HTTPResponseWriter) Finished() <-chan struct{} {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.finished
+}
+
+// Idle 判断是否所有已登记的请求的响应都已经结束
+func (h *HTTPResponseWriter) Idle() bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return len(h.methods) == 0
+}
+
+// Tunnel 判断连接是否已切换为其他协议
+func (h *HTTPResponseWriter) Tunnel() bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.tunnel
+}
+
+func (h *HTTPResponseWriter) head(head []byte) (out []byte, length int64, chunked bool, err error) {
+	resp, err := ParseHTTPResponse(head)
+	if err != nil {
+		return
+	}
+	out = head
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	method := "GET"
+	if len(h.methods) > 0 {
+		method = h.methods[0]
+	}
+	code := resp.StatusCode
+	h.code = code
+	h.start = h.written
+	h.interim = code < 200 && code != 101
+	switch {
+	case code == 101 || (method == "CONNECT" && code < 300 && code >= 200):
+		h.tunnel = true
+		return
+	case h.interim || code == 204 || code == 304 || method == "HEAD":
+		return
+	}
+	var ok bool
+	length, chunked, ok, err = resp.Header.bodyLength()
+	if err == nil && !ok {
+		length = -1
+	}
+	return
+}
+
+func (h *HTTPResponseWriter) end() bool {
+	h.mtx.Lock()
+	if h.interim {
+		h.mtx.Unlock()
+		return false
+	}
+	if len(h.methods) > 0 {
+		h.methods = h.methods[1:]
+		if len(h.methods) == 0 {
+			close(h.finished)
+		}
+	}
+	tunnel := h.tunnel
+	h.mtx.Unlock()
+	if h.Responded != nil {
+		h.Responded(h.code, h.written-h.start)
+	}
+	return tunnel
+}
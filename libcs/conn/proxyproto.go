@@ -0,0 +1,334 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/isrc-cas/gt/bufio"
+)
+
+// 访问者地址在 ServicesData 首帧中的编码：
+//
+//	1 byte 类型：低 4 位为 0（未知）、4（IPv4）或 6（IPv6），0x10 表示 UDP，0x20 表示访问者通过 TLS 连接
+//	源 IP、目的 IP、源端口、目的端口
+const (
+	addrUnknown  = 0
+	addrIPv4     = 4
+	addrIPv6     = 6
+	addrDatagram = 0x10
+	addrTLS      = 0x20
+)
+
+// MaxAddrsSize 是 PutAddrs 编码结果的最大长度
+const MaxAddrsSize = 1 + 2*net.IPv6len + 4
+
+func splitAddr(addr net.Addr) (ip net.IP, port int, datagram bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port, false
+	case *net.UDPAddr:
+		return a.IP, a.Port, true
+	}
+	return
+}
+
+// PutAddrs 将访问者地址 src 与服务端地址 dst 编码到 buf，返回编码长度，tls 表示访问者是否通过 TLS 连接
+func PutAddrs(buf []byte, src, dst net.Addr, tls bool) (n int) {
+	var flags byte
+	if tls {
+		flags = addrTLS
+	}
+	srcIP, srcPort, datagram := splitAddr(src)
+	dstIP, dstPort, _ := splitAddr(dst)
+	if srcIP == nil || dstIP == nil {
+		buf[0] = addrUnknown | flags
+		return 1
+	}
+	var ipLen int
+	if srcIP.To4() != nil && dstIP.To4() != nil {
+		srcIP, dstIP = srcIP.To4(), dstIP.To4()
+		buf[0] = addrIPv4
+		ipLen = net.IPv4len
+	} else {
+		srcIP, dstIP = srcIP.To16(), dstIP.To16()
+		buf[0] = addrIPv6
+		ipLen = net.IPv6len
+	}
+	if datagram {
+		buf[0] |= addrDatagram
+	}
+	buf[0] |= flags
+	n = 1
+	n += copy(buf[n:n+ipLen], srcIP)
+	n += copy(buf[n:n+ipLen], dstIP)
+	binary.BigEndian.PutUint16(buf[n:], uint16(srcPort))
+	binary.BigEndian.PutUint16(buf[n+2:], uint16(dstPort))
+	n += 4
+	return
+}
+
+// ReadAddrs 读取 PutAddrs 编码的地址，地址未知时 src 与 dst 为 nil
+func ReadAddrs(reader *bufio.Reader) (src, dst net.Addr, tls bool, err error) {
+	t, err := reader.ReadByte()
+	if err != nil {
+		return
+	}
+	tls = t&addrTLS != 0
+	var ipLen int
+	switch t &^ (addrDatagram | addrTLS) {
+	case addrUnknown:
+		return
+	case addrIPv4:
+		ipLen = net.IPv4len
+	case addrIPv6:
+		ipLen = net.IPv6len
+	default:
+		err = fmt.Errorf("invalid address type %d", t)
+		return
+	}
+	l := 2*ipLen + 4
+	b, err := reader.Peek(l)
+	if err != nil {
+		return
+	}
+	srcIP := make(net.IP, ipLen)
+	dstIP := make(net.IP, ipLen)
+	copy(srcIP, b)
+	copy(dstIP, b[ipLen:])
+	srcPort := int(binary.BigEndian.Uint16(b[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(b[2*ipLen+2:]))
+	_, err = reader.Discard(l)
+	if err != nil {
+		return
+	}
+	if t&addrDatagram != 0 {
+		src = &net.UDPAddr{IP: srcIP, Port: srcPort}
+		dst = &net.UDPAddr{IP: dstIP, Port: dstPort}
+	} else {
+		src = &net.TCPAddr{IP: srcIP, Port: srcPort}
+		dst = &net.TCPAddr{IP: dstIP, Port: dstPort}
+	}
+	return
+}
+
+// PROXY protocol 版本
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// ErrInvalidProxyProtocolVersion is an error returned when the PROXY protocol version is not v1 or v2
+var ErrInvalidProxyProtocolVersion = errors.New("invalid PROXY protocol version, supported: v1, v2")
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyHeader 生成 PROXY protocol 头部，src 或 dst 为 nil 时生成地址未知的头部
+func ProxyHeader(version string, src, dst net.Addr) (header []byte, err error) {
+	srcIP, srcPort, datagram := splitAddr(src)
+	dstIP, dstPort, _ := splitAddr(dst)
+	ipv4 := srcIP.To4() != nil && dstIP.To4() != nil
+	known := srcIP != nil && dstIP != nil
+	switch version {
+	case ProxyProtocolV1:
+		if !known || datagram {
+			header = []byte("PROXY UNKNOWN\r\n")
+			return
+		}
+		proto := "TCP6"
+		if ipv4 {
+			proto = "TCP4"
+			srcIP, dstIP = srcIP.To4(), dstIP.To4()
+		}
+		header = []byte("PROXY " + proto + " " + srcIP.String() + " " + dstIP.String() + " " +
+			strconv.Itoa(srcPort) + " " + strconv.Itoa(dstPort) + "\r\n")
+	case ProxyProtocolV2:
+		header = append(header, proxyProtocolV2Signature...)
+		if !known {
+			// LOCAL 命令，UNSPEC 地址
+			header = append(header, 0x20, 0x00, 0x00, 0x00)
+			return
+		}
+		header = append(header, 0x21) // version 2, PROXY 命令
+		var family byte = 0x20        // AF_INET6
+		if ipv4 {
+			family = 0x10 // AF_INET
+			srcIP, dstIP = srcIP.To4(), dstIP.To4()
+		} else {
+			srcIP, dstIP = srcIP.To16(), dstIP.To16()
+		}
+		if datagram {
+			family |= 0x02 // DGRAM
+		} else {
+			family |= 0x01 // STREAM
+		}
+		header = append(header, family)
+		header = binary.BigEndian.AppendUint16(header, uint16(2*len(srcIP)+4))
+		header = append(header, srcIP...)
+		header = append(header, dstIP...)
+		header = binary.BigEndian.AppendUint16(header, uint16(srcPort))
+		header = binary.BigEndian.AppendUint16(header, uint16(dstPort))
+	default:
+		err = ErrInvalidProxyProtocolVersion
+	}
+	return
+}
+
+// ErrInvalidProxyHeader is an error returned when the PROXY protocol header is invalid
+var ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+const (
+	proxyProtocolV1Prefix = "PROXY "
+	proxyProtocolV1MaxLen = 107
+	proxyProtocolV2MinLen = 16
+)
+
+// ReadProxyHeader 从 r 读取 PROXY protocol v1 或 v2 头部。头部为 LOCAL 命令或地址未知时 src 与 dst 为 nil。
+// rest 是读取头部时多读出的数据。
+func ReadProxyHeader(r io.Reader) (src, dst net.Addr, rest []byte, err error) {
+	buf := make([]byte, 0, 256)
+	for {
+		if len(buf) == cap(buf) {
+			buf = append(buf, 0)[:len(buf)]
+		}
+		var n int
+		n, err = r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		var headerLen int
+		src, dst, headerLen = parseProxyHeader(buf)
+		if headerLen > 0 {
+			rest = buf[headerLen:]
+			err = nil
+			return
+		}
+		if headerLen < 0 {
+			err = ErrInvalidProxyHeader
+			return
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+	}
+}
+
+// parseProxyHeader 解析 buf 中的头部，返回头部长度，0 表示数据不完整，-1 表示头部无效
+func parseProxyHeader(buf []byte) (src, dst net.Addr, n int) {
+	switch {
+	case hasPrefix(buf, []byte(proxyProtocolV1Prefix)):
+		if len(buf) < len(proxyProtocolV1Prefix) {
+			return
+		}
+		end := bytes.Index(buf, []byte("\r\n"))
+		if end < 0 {
+			if len(buf) >= proxyProtocolV1MaxLen {
+				n = -1
+			}
+			return
+		}
+		if end+2 > proxyProtocolV1MaxLen {
+			n = -1
+			return
+		}
+		n = end + 2
+		fields := strings.Split(string(buf[len(proxyProtocolV1Prefix):end]), " ")
+		if fields[0] == "UNKNOWN" {
+			return
+		}
+		if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+			n = -1
+			return
+		}
+		srcIP := net.ParseIP(fields[1])
+		dstIP := net.ParseIP(fields[2])
+		srcPort, e1 := strconv.ParseUint(fields[3], 10, 16)
+		dstPort, e2 := strconv.ParseUint(fields[4], 10, 16)
+		if srcIP == nil || dstIP == nil || e1 != nil || e2 != nil {
+			n = -1
+			return
+		}
+		src = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+		dst = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	case hasPrefix(buf, proxyProtocolV2Signature):
+		if len(buf) < proxyProtocolV2MinLen {
+			return
+		}
+		l := proxyProtocolV2MinLen + int(binary.BigEndian.Uint16(buf[14:16]))
+		if len(buf) < l {
+			return
+		}
+		n = l
+		if buf[12]>>4 != 2 {
+			n = -1
+			return
+		}
+		// LOCAL 命令
+		if buf[12]&0x0F == 0 {
+			return
+		}
+		if buf[12]&0x0F != 1 {
+			n = -1
+			return
+		}
+		var ipLen int
+		switch buf[13] >> 4 {
+		case 1:
+			ipLen = net.IPv4len
+		case 2:
+			ipLen = net.IPv6len
+		default:
+			// UNSPEC 与 UNIX 地址
+			return
+		}
+		addrs := buf[proxyProtocolV2MinLen:l]
+		if len(addrs) < 2*ipLen+4 {
+			n = -1
+			return
+		}
+		srcIP := make(net.IP, ipLen)
+		dstIP := make(net.IP, ipLen)
+		copy(srcIP, addrs)
+		copy(dstIP, addrs[ipLen:])
+		srcPort := int(binary.BigEndian.Uint16(addrs[2*ipLen:]))
+		dstPort := int(binary.BigEndian.Uint16(addrs[2*ipLen+2:]))
+		if buf[13]&0x0F == 2 {
+			src = &net.UDPAddr{IP: srcIP, Port: srcPort}
+			dst = &net.UDPAddr{IP: dstIP, Port: dstPort}
+		} else {
+			src = &net.TCPAddr{IP: srcIP, Port: srcPort}
+			dst = &net.TCPAddr{IP: dstIP, Port: dstPort}
+		}
+	default:
+		n = -1
+	}
+	return
+}
+
+// hasPrefix 判断 buf 是否可能以 prefix 开头，buf 比 prefix 短时比较已有的部分
+func hasPrefix(buf, prefix []byte) bool {
+	if len(buf) < len(prefix) {
+		return bytes.Equal(buf, prefix[:len(buf)])
+	}
+	return bytes.HasPrefix(buf, prefix)
+}
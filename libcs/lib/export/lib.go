@@ -104,6 +104,10 @@ func RunServer(args []string) {
 	for sig := range osSig {
 		s.Logger.Info().Str("signal", sig.String()).Msg("received os signal")
 		switch sig {
+		case syscall.SIGHUP:
+			// reload the users and the tcp and host settings
+			err := s.Reload()
+			s.Logger.Info().Err(err).Msg("reload users done")
 		case syscall.SIGINT:
 			return
 		default:
@@ -133,6 +137,14 @@ func RunServer(args []string) {
 	}
 }
 
+//export HashSecret
+func HashSecret(args []string) {
+	err := server.RunHashSecret(args, os.Stdin, os.Stdout)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to hash secret")
+	}
+}
+
 //export RunClient
 func RunClient(args []string) {
 	util.SetArgs(args)
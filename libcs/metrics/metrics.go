@@ -0,0 +1,486 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics 实现了以 Prometheus 文本格式（0.0.4）导出的计数器、仪表与直方图
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ContentType Prometheus 文本格式的 Content-Type
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets 默认的直方图桶，单位为秒
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type family interface {
+	write(w *bufio.Writer)
+}
+
+// Registry 保存一组指标，按注册顺序导出
+type Registry struct {
+	mtx      sync.Mutex
+	names    map[string]struct{}
+	families []family
+}
+
+// NewRegistry 返回空的 Registry
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]struct{})}
+}
+
+func (r *Registry) register(name string, f family) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, ok := r.names[name]; ok {
+		panic(fmt.Sprintf("metrics: duplicate metric name %q", name))
+	}
+	r.names[name] = struct{}{}
+	r.families = append(r.families, f)
+}
+
+// WriteTo 以文本格式写出所有指标
+func (r *Registry) WriteTo(w io.Writer) (n int64, err error) {
+	r.mtx.Lock()
+	families := make([]family, len(r.families))
+	copy(families, r.families)
+	r.mtx.Unlock()
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, f := range families {
+		f.write(bw)
+	}
+	err = bw.Flush()
+	n = cw.n
+	return
+}
+
+// ServeHTTP 实现 http.Handler
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	_, _ = r.WriteTo(w)
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	c.n += int64(n)
+	return
+}
+
+// value 以原子方式保存的 float64
+type value struct {
+	bits uint64
+}
+
+func (v *value) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		n := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, n) {
+			return
+		}
+	}
+}
+
+func (v *value) set(f float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(f))
+}
+
+func (v *value) get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// desc 指标的名称、说明、类型与标签名
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	w.WriteString("# HELP ")
+	w.WriteString(d.name)
+	w.WriteByte(' ')
+	w.WriteString(helpEscaper.Replace(d.help))
+	w.WriteString("\n# TYPE ")
+	w.WriteString(d.name)
+	w.WriteByte(' ')
+	w.WriteString(d.typ)
+	w.WriteByte('\n')
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraLabel, extraValue string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(l)
+			w.WriteString(`="`)
+			w.WriteString(labelEscaper.Replace(values[i]))
+			w.WriteByte('"')
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extraLabel)
+			w.WriteString(`="`)
+			w.WriteString(extraValue)
+			w.WriteByte('"')
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// vec 按标签值保存子指标
+type vec[T any] struct {
+	desc
+	mtx      sync.RWMutex
+	children map[string]*child[T]
+	newChild func() *T
+}
+
+type child[T any] struct {
+	values []string
+	metric *T
+}
+
+func newVec[T any](name, help, typ string, labels []string, newChild func() *T) *vec[T] {
+	return &vec[T]{
+		desc:     desc{name: name, help: help, typ: typ, labels: labels},
+		children: make(map[string]*child[T]),
+		newChild: newChild,
+	}
+}
+
+func (v *vec[T]) key(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func (v *vec[T]) with(values []string) *T {
+	k := v.key(values)
+	v.mtx.RLock()
+	c, ok := v.children[k]
+	v.mtx.RUnlock()
+	if ok {
+		return c.metric
+	}
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	c, ok = v.children[k]
+	if !ok {
+		c = &child[T]{values: append([]string(nil), values...), metric: v.newChild()}
+		v.children[k] = c
+	}
+	return c.metric
+}
+
+func (v *vec[T]) delete(values []string) {
+	k := v.key(values)
+	v.mtx.Lock()
+	delete(v.children, k)
+	v.mtx.Unlock()
+}
+
+// sorted 返回按标签值排序的子指标
+func (v *vec[T]) sorted() []*child[T] {
+	v.mtx.RLock()
+	cs := make([]*child[T], 0, len(v.children))
+	for _, c := range v.children {
+		cs = append(cs, c)
+	}
+	v.mtx.RUnlock()
+	sort.Slice(cs, func(i, j int) bool {
+		return lessValues(cs[i].values, cs[j].values)
+	})
+	return cs
+}
+
+func lessValues(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// Counter 只增不减的计数器，nil 时所有操作为空操作
+type Counter struct {
+	v value
+}
+
+// Add 增加 delta，delta 不能为负数
+func (c *Counter) Add(delta float64) {
+	if c == nil || delta <= 0 {
+		return
+	}
+	c.v.add(delta)
+}
+
+// Inc 加 1
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Value 返回当前值
+func (c *Counter) Value() float64 {
+	if c == nil {
+		return 0
+	}
+	return c.v.get()
+}
+
+// CounterVec 带标签的计数器
+type CounterVec struct {
+	*vec[Counter]
+}
+
+// NewCounter 注册带标签的计数器
+func (r *Registry) NewCounter(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{newVec(name, help, "counter", labels, func() *Counter { return &Counter{} })}
+	r.register(name, v)
+	return v
+}
+
+// With 返回标签值对应的计数器，不存在时创建
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.with(values)
+}
+
+// Delete 删除标签值对应的计数器
+func (v *CounterVec) Delete(values ...string) {
+	v.delete(values)
+}
+
+func (v *CounterVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	for _, c := range v.sorted() {
+		writeSample(w, v.name, v.labels, c.values, "", "", c.metric.v.get())
+	}
+}
+
+// Gauge 可增可减的仪表，nil 时所有操作为空操作
+type Gauge struct {
+	v value
+}
+
+// Set 设置为 f
+func (g *Gauge) Set(f float64) {
+	if g == nil {
+		return
+	}
+	g.v.set(f)
+}
+
+// Add 增加 delta
+func (g *Gauge) Add(delta float64) {
+	if g == nil {
+		return
+	}
+	g.v.add(delta)
+}
+
+// Inc 加 1
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+// Dec 减 1
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+// Value 返回当前值
+func (g *Gauge) Value() float64 {
+	if g == nil {
+		return 0
+	}
+	return g.v.get()
+}
+
+// GaugeVec 带标签的仪表
+type GaugeVec struct {
+	*vec[Gauge]
+}
+
+// NewGauge 注册带标签的仪表
+func (r *Registry) NewGauge(name, help string, labels ...string) *GaugeVec {
+	v := &GaugeVec{newVec(name, help, "gauge", labels, func() *Gauge { return &Gauge{} })}
+	r.register(name, v)
+	return v
+}
+
+// With 返回标签值对应的仪表，不存在时创建
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return v.with(values)
+}
+
+// Delete 删除标签值对应的仪表
+func (v *GaugeVec) Delete(values ...string) {
+	v.delete(values)
+}
+
+func (v *GaugeVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	for _, c := range v.sorted() {
+		writeSample(w, v.name, v.labels, c.values, "", "", c.metric.v.get())
+	}
+}
+
+// Histogram 直方图，nil 时所有操作为空操作
+type Histogram struct {
+	upper  []float64
+	counts []uint64
+	count  uint64
+	sum    value
+}
+
+// Observe 记录一次观测值
+func (h *Histogram) Observe(f float64) {
+	if h == nil {
+		return
+	}
+	i := sort.SearchFloat64s(h.upper, f)
+	if i < len(h.counts) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	h.sum.add(f)
+	atomic.AddUint64(&h.count, 1)
+}
+
+// HistogramVec 带标签的直方图
+type HistogramVec struct {
+	*vec[Histogram]
+	buckets []float64
+}
+
+// NewHistogram 注册带标签的直方图，buckets 为各桶的上界，为空时使用 DefBuckets
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	v := &HistogramVec{buckets: buckets}
+	v.vec = newVec(name, help, "histogram", labels, func() *Histogram {
+		return &Histogram{upper: buckets, counts: make([]uint64, len(buckets))}
+	})
+	r.register(name, v)
+	return v
+}
+
+// With 返回标签值对应的直方图，不存在时创建
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.with(values)
+}
+
+// Delete 删除标签值对应的直方图
+func (v *HistogramVec) Delete(values ...string) {
+	v.delete(values)
+}
+
+func (v *HistogramVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	for _, c := range v.sorted() {
+		h := c.metric
+		var cumulative uint64
+		for i, upper := range h.upper {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			writeSample(w, v.name+"_bucket", v.labels, c.values, "le", formatFloat(upper), float64(cumulative))
+		}
+		count := atomic.LoadUint64(&h.count)
+		writeSample(w, v.name+"_bucket", v.labels, c.values, "le", "+Inf", float64(count))
+		writeSample(w, v.name+"_sum", v.labels, c.values, "", "", h.sum.get())
+		writeSample(w, v.name+"_count", v.labels, c.values, "", "", float64(count))
+	}
+}
+
+// CollectFunc 在导出时被调用，通过 emit 输出每组标签值对应的值
+type CollectFunc func(emit func(value float64, labelValues ...string))
+
+type funcMetric struct {
+	desc
+	collect CollectFunc
+}
+
+// NewGaugeFunc 注册导出时才计算值的仪表
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect CollectFunc) {
+	r.register(name, &funcMetric{desc{name: name, help: help, typ: "gauge", labels: labels}, collect})
+}
+
+// NewCounterFunc 注册导出时才计算值的计数器
+func (r *Registry) NewCounterFunc(name, help string, labels []string, collect CollectFunc) {
+	r.register(name, &funcMetric{desc{name: name, help: help, typ: "counter", labels: labels}, collect})
+}
+
+func (f *funcMetric) write(w *bufio.Writer) {
+	var cs []child[float64]
+	f.collect(func(v float64, values ...string) {
+		if len(values) != len(f.labels) {
+			panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(values)))
+		}
+		cs = append(cs, child[float64]{values: values, metric: &v})
+	})
+	sort.SliceStable(cs, func(i, j int) bool {
+		return lessValues(cs[i].values, cs[j].values)
+	})
+	f.writeHeader(w)
+	for _, c := range cs {
+		writeSample(w, f.name, f.labels, c.values, "", "", *c.metric)
+	}
+}
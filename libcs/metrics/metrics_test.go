@@ -0,0 +1,101 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	bytes := r.NewCounter("gt_bytes_total", "Bytes transferred.", "user", "direction")
+	tasks := r.NewGauge("gt_tasks", "Active tasks.\nPer user.")
+	latency := r.NewHistogram("gt_latency_seconds", "Latency.", []float64{1, 0.1})
+	r.NewGaugeFunc("gt_tunnels", "Tunnels.", []string{"user"}, func(emit func(float64, ...string)) {
+		emit(2, "b")
+		emit(1, `a"\`)
+	})
+
+	bytes.With("b", "upload").Add(10)
+	bytes.With("a", "upload").Add(5)
+	bytes.With("a", "upload").Add(-1)
+	bytes.With("c", "upload").Inc()
+	bytes.Delete("c", "upload")
+	tasks.With().Inc()
+	tasks.With().Inc()
+	tasks.With().Dec()
+	latency.With().Observe(0.05)
+	latency.With().Observe(0.1)
+	latency.With().Observe(0.5)
+	latency.With().Observe(3)
+
+	var nilCounter *Counter
+	nilCounter.Inc()
+	var nilHistogram *Histogram
+	nilHistogram.Observe(1)
+
+	want := `# HELP gt_bytes_total Bytes transferred.
+# TYPE gt_bytes_total counter
+gt_bytes_total{user="a",direction="upload"} 5
+gt_bytes_total{user="b",direction="upload"} 10
+# HELP gt_tasks Active tasks.\nPer user.
+# TYPE gt_tasks gauge
+gt_tasks 1
+# HELP gt_latency_seconds Latency.
+# TYPE gt_latency_seconds histogram
+gt_latency_seconds_bucket{le="0.1"} 2
+gt_latency_seconds_bucket{le="1"} 3
+gt_latency_seconds_bucket{le="+Inf"} 4
+gt_latency_seconds_sum 3.65
+gt_latency_seconds_count 4
+# HELP gt_tunnels Tunnels.
+# TYPE gt_tunnels gauge
+gt_tunnels{user="a\"\\"} 1
+gt_tunnels{user="b"} 2
+`
+	var sb strings.Builder
+	n, err := r.WriteTo(&sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb.String() != want {
+		t.Fatalf("unexpected output:\n%s", sb.String())
+	}
+	if n != int64(sb.Len()) {
+		t.Fatalf("wrote %d bytes, reported %d", sb.Len(), n)
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != ContentType {
+		t.Fatalf("content type %q", ct)
+	}
+	if rec.Body.String() != want {
+		t.Fatalf("unexpected body:\n%s", rec.Body.String())
+	}
+}
+
+func TestRegistryDuplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("duplicate name should panic")
+		}
+	}()
+	r := NewRegistry()
+	r.NewCounter("gt_total", "")
+	r.NewGauge("gt_total", "")
+}
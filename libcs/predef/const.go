@@ -43,6 +43,18 @@ const (
 	MinHostPrefixSize = MinIDSize
 	// MaxHostPrefixSize 表示 host 前缀长度的最大值
 	MaxHostPrefixSize = MaxIDSize
+	// MaxRoutePathSize 表示 host 前缀下路由路径长度的最大值
+	MaxRoutePathSize = 255
+	// MaxDomainSize 表示客户端注册的域名长度的最大值
+	MaxDomainSize = 253
+	// MaxEdgeAuthEntries 表示一个服务声明的 basic 用户或 bearer token 数量的最大值
+	MaxEdgeAuthEntries = 32
+	// MaxEdgeAuthSize 表示一个服务的 EdgeAuth option 内容长度的最大值
+	MaxEdgeAuthSize = 1024
+	// MaxIPFilterEntries 表示一个服务声明的允许或拒绝的 CIDR 数量的最大值
+	MaxIPFilterEntries = 32
+	// MaxGroupNameSize 表示服务组名长度的最大值
+	MaxGroupNameSize = 64
 	// MaxHTTPHeaderSize max ending of host in http headers
 	MaxHTTPHeaderSize = 2 * 1024
 )
@@ -57,8 +69,13 @@ const (
 	Close
 	// ServicesData is a multiple service data
 	ServicesData
+	// WindowUpdate grants the remote more credit to send data of the task
+	WindowUpdate
 )
 
+// TaskWindowSize is the initial window of each task when flow control is enabled
+const TaskWindowSize = 256 * 1024
+
 // 通信协议的 option
 // 扩展规则
 //
@@ -71,7 +88,55 @@ var (
 	OpenHost            = []byte{3}
 	IDAsTLSHostPrefix   = []byte{4}
 	OpenTLSHost         = []byte{5}
+	OpenUDPPort         = []byte{6}
+	Capabilities        = []byte{7}
+	OpenHostPath        = []byte{8}  // host 前缀长度、host 前缀（长度为 0 时使用 id）、路径长度、路径、是否去掉路径
+	OpenDomain          = []byte{9}  // 域名长度、域名、路径长度、路径、是否去掉路径
+	OpenTLSDomain       = []byte{10} // 域名长度、域名
+	EdgeAuth            = []byte{11} // 作用于前一个 http 服务：标志位（1 表示登录页）、basic 数量、每个 user:hash 的长度与内容、bearer 数量、每个 token 的长度与内容
+	IPFilter            = []byte{12} // 作用于前一个服务：允许的 CIDR 数量、每个 CIDR 的长度与内容、拒绝的 CIDR 数量、每个 CIDR 的长度与内容
+	SpeedLimit          = []byte{13} // 作用于前一个服务：上行速度（4 字节）、下行速度（4 字节）
+	Group               = []byte{14} // 作用于前一个 http、https 或 tcp 服务：组名长度、组名、组密钥长度、组密钥
+	Standby             = []byte{15} // 作用于前一个带有 Group option 的服务：作为服务组的备用成员
 )
 
+// ProtocolVersion 是当前 tunnel 协议的版本号，没有发送 Capabilities option 的老客户端视为版本 1
+const ProtocolVersion uint16 = 2
+
+// Feature is the bitmap of optional protocol features
+type Feature = uint32
+
+const (
+	// FeatureFlowControl 基于窗口的 task 流量控制
+	FeatureFlowControl Feature = 1 << iota
+	// FeatureUDPPort udp 端口转发
+	FeatureUDPPort
+	// FeatureVisitorAddr ServicesData 首帧携带访问者地址
+	FeatureVisitorAddr
+	// FeatureQuotaSignal 会话中收到 QuotaExceeded 错误信号时保持 tunnel
+	FeatureQuotaSignal
+)
+
+// Features 当前版本支持的所有特性
+const Features = FeatureFlowControl | FeatureUDPPort | FeatureVisitorAddr | FeatureQuotaSignal
+
+var featureNames = []string{
+	"flowControl",
+	"udpPort",
+	"visitorAddr",
+	"quotaSignal",
+}
+
+// FeatureNames returns the names of the features in the bitmap
+func FeatureNames(features Feature) (names []string) {
+	names = []string{}
+	for i, name := range featureNames {
+		if features&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return
+}
+
 // MagicNumber 常量数字，见 https://en.wikipedia.org/wiki/Magic_number_(programming)
 const MagicNumber byte = 0xF0
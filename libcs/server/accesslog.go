@@ -0,0 +1,232 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/isrc-cas/gt/logger/file-rotatelogs"
+	"github.com/rs/zerolog"
+)
+
+// 访问日志的格式
+const (
+	accessLogJSON = "json"
+	accessLogCLF  = "clf"
+)
+
+// clfTimeFormat Common Log Format 的时间格式
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// accessLogger 将访问者的连接与请求记录到单独的日志文件
+type accessLogger struct {
+	out    io.WriteCloser
+	format string
+	json   zerolog.Logger
+	mtx    sync.Mutex
+}
+
+func (s *Server) initAccessLog() (err error) {
+	if len(s.config.AccessLogFile) == 0 {
+		return
+	}
+	switch s.config.AccessLogFormat {
+	case accessLogJSON, accessLogCLF:
+	default:
+		return fmt.Errorf("invalid access log format (-accessLogFormat option) '%s'", s.config.AccessLogFormat)
+	}
+	out, err := rotatelogs.New(
+		s.config.AccessLogFile+".%Y%m%d",
+		rotatelogs.WithRotationCount(s.config.AccessLogFileMaxCount),
+		rotatelogs.WithRotationSize(s.config.AccessLogFileMaxSize),
+		rotatelogs.WithLinkName(s.config.AccessLogFile),
+	)
+	if err != nil {
+		return
+	}
+	s.accessLog = newAccessLogger(out, s.config.AccessLogFormat)
+	return
+}
+
+func newAccessLogger(out io.WriteCloser, format string) *accessLogger {
+	return &accessLogger{
+		out:    out,
+		format: format,
+		json:   zerolog.New(out),
+	}
+}
+
+func (l *accessLogger) close() error {
+	if l == nil {
+		return nil
+	}
+	return l.out.Close()
+}
+
+// accessEntry 访问者连接的访问记录
+type accessEntry struct {
+	start        time.Time
+	ip           string
+	host         string
+	client       string
+	serviceIndex uint16
+	routed       bool // 连接已经交给了客户端的服务
+	bytesIn      atomic.Int64
+	bytesOut     atomic.Int64
+}
+
+// newEntry 开始记录访问者连接，访问日志未启用时返回 nil
+func (l *accessLogger) newEntry(addr net.Addr) *accessEntry {
+	if l == nil {
+		return nil
+	}
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return &accessEntry{start: time.Now(), ip: ip}
+}
+
+func (e *accessEntry) setHost(host string) {
+	if e == nil {
+		return
+	}
+	e.host = host
+}
+
+func (e *accessEntry) setRoute(r clientWithServiceIndex) {
+	if e == nil {
+		return
+	}
+	e.client = r.client.id
+	e.serviceIndex = r.serviceIndex
+	e.routed = true
+}
+
+// in 统计访问者发往客户端的数据
+func (e *accessEntry) in(n int) {
+	if e == nil {
+		return
+	}
+	e.bytesIn.Add(int64(n))
+}
+
+// out 统计发往访问者的数据
+func (e *accessEntry) out(n int) {
+	if e == nil {
+		return
+	}
+	e.bytesOut.Add(int64(n))
+}
+
+// accessRequest 路由模式下访问者连接上的一个请求
+type accessRequest struct {
+	start  time.Time
+	method string
+	target string
+	proto  string
+	host   string
+}
+
+// logConn 记录访问者连接
+func (l *accessLogger) logConn(e *accessEntry) {
+	if l == nil || e == nil {
+		return
+	}
+	duration := time.Since(e.start)
+	if l.format == accessLogJSON {
+		event := l.json.Log().
+			Str("type", "conn").
+			Time("time", e.start).
+			Str("ip", e.ip).
+			Str("host", e.host)
+		if e.routed {
+			event = event.Str("client", e.client).Uint16("serviceIndex", e.serviceIndex)
+		}
+		event.Int64("bytesIn", e.bytesIn.Load()).
+			Int64("bytesOut", e.bytesOut.Load()).
+			Dur("duration", duration).
+			Send()
+		return
+	}
+	l.writeCLF(e, "- "+orDash(e.host)+" -", "-", e.bytesOut.Load())
+}
+
+// logRequest 记录路由模式下的请求
+func (l *accessLogger) logRequest(e *accessEntry, r accessRequest, target clientWithServiceIndex, code int, size int64) {
+	if l == nil || e == nil {
+		return
+	}
+	if l.format == accessLogJSON {
+		event := l.json.Log().
+			Str("type", "request").
+			Time("time", r.start).
+			Str("ip", e.ip).
+			Str("host", r.host)
+		if target.client != nil {
+			event = event.Str("client", target.client.id).Uint16("serviceIndex", target.serviceIndex)
+		}
+		event.Str("method", r.method).
+			Str("path", r.target).
+			Str("proto", r.proto).
+			Int("status", code).
+			Int64("bytesOut", size).
+			Dur("duration", time.Since(r.start)).
+			Send()
+		return
+	}
+	entry := &accessEntry{start: r.start, ip: e.ip}
+	if target.client != nil {
+		entry.client = target.client.id
+	}
+	l.writeCLF(entry, r.method+" "+r.target+" "+r.proto, strconv.Itoa(code), size)
+}
+
+// writeCLF 以 Common Log Format 写入一行，客户端 ID 写在 authuser 字段
+func (l *accessLogger) writeCLF(e *accessEntry, request, status string, size int64) {
+	b := make([]byte, 0, 256)
+	b = append(b, e.ip...)
+	b = append(b, " - "...)
+	b = append(b, orDash(e.client)...)
+	b = append(b, " ["...)
+	b = e.start.AppendFormat(b, clfTimeFormat)
+	b = append(b, "] "...)
+	b = strconv.AppendQuote(b, request)
+	b = append(b, ' ')
+	b = append(b, status...)
+	b = append(b, ' ')
+	if size > 0 {
+		b = strconv.AppendInt(b, size, 10)
+	} else {
+		b = append(b, '-')
+	}
+	b = append(b, '\n')
+	l.mtx.Lock()
+	_, _ = l.out.Write(b)
+	l.mtx.Unlock()
+}
+
+func orDash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func TestAccessLogCLF(t *testing.T) {
+	var b bytes.Buffer
+	l := newAccessLogger(nopWriteCloser{&b}, accessLogCLF)
+	e := l.newEntry(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234})
+	e.start = time.Date(2023, 10, 2, 13, 55, 36, 0, time.FixedZone("", 8*3600))
+	e.setHost("id1.example.com")
+	e.setRoute(clientWithServiceIndex{client: &client{id: "id1"}, serviceIndex: 2})
+	e.in(100)
+	e.out(2326)
+	l.logConn(e)
+	l.logRequest(e, accessRequest{
+		start:  e.start,
+		method: "GET",
+		target: `/a"b`,
+		proto:  "HTTP/1.1",
+		host:   "id1.example.com",
+	}, clientWithServiceIndex{}, 404, 0)
+
+	want := `192.0.2.1 - id1 [02/Oct/2023:13:55:36 +0800] "- id1.example.com -" - 2326
+192.0.2.1 - - [02/Oct/2023:13:55:36 +0800] "GET /a\"b HTTP/1.1" 404 -
+`
+	if b.String() != want {
+		t.Fatalf("unexpected access log:\n%s", b.String())
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	var b bytes.Buffer
+	l := newAccessLogger(nopWriteCloser{&b}, accessLogJSON)
+	e := l.newEntry(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234})
+	e.setHost("id1.example.com")
+	target := clientWithServiceIndex{client: &client{id: "id1"}, serviceIndex: 1}
+	e.setRoute(target)
+	e.in(100)
+	e.out(200)
+	l.logRequest(e, accessRequest{
+		start:  time.Now(),
+		method: "POST",
+		target: "/api",
+		proto:  "HTTP/1.1",
+		host:   "id1.example.com",
+	}, target, 201, 150)
+	l.logConn(e)
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected access log:\n%s", b.String())
+	}
+	var req, conn map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &req); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &conn); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]interface{}{
+		"type":         "request",
+		"ip":           "2001:db8::1",
+		"host":         "id1.example.com",
+		"client":       "id1",
+		"serviceIndex": float64(1),
+		"method":       "POST",
+		"path":         "/api",
+		"status":       float64(201),
+		"bytesOut":     float64(150),
+	} {
+		if req[k] != v {
+			t.Fatalf("request field %s is %v, want %v", k, req[k], v)
+		}
+	}
+	for k, v := range map[string]interface{}{
+		"type":     "conn",
+		"client":   "id1",
+		"bytesIn":  float64(100),
+		"bytesOut": float64(200),
+	} {
+		if conn[k] != v {
+			t.Fatalf("conn field %s is %v, want %v", k, conn[k], v)
+		}
+	}
+	if _, ok := conn["duration"]; !ok {
+		t.Fatal("conn has no duration")
+	}
+
+	var nilLogger *accessLogger
+	if nilLogger.newEntry(&net.TCPAddr{}) != nil {
+		t.Fatal("disabled access log should not create entries")
+	}
+}
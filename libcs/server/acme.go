@@ -0,0 +1,183 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	stdbufio "bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/isrc-cas/gt/bufio"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ErrHostNotRegistered is an error returned when a certificate is requested for a host that no client has registered
+var ErrHostNotRegistered = errors.New("host is not registered by any client")
+
+// acmeChallengePrefix 是 HTTP-01 challenge 请求的请求行前缀
+const acmeChallengePrefix = "GET /.well-known/acme-challenge/"
+
+// newACMEManager 创建按需签发与续期证书的 ACME 管理器，证书缓存在 acmeCacheDir
+func (s *Server) newACMEManager() (m *autocert.Manager, err error) {
+	for _, domain := range s.config.ACMEBaseDomains {
+		var d string
+		d, err = normalizeDomain(strings.TrimSpace(domain))
+		if err != nil || strings.HasPrefix(d, "*.") {
+			err = fmt.Errorf("invalid acme base domain '%s'", domain)
+			return
+		}
+		s.acmeBaseDomains = append(s.acmeBaseDomains, d)
+	}
+	if len(s.config.ACMECacheDir) == 0 {
+		err = errors.New("option 'acmeCacheDir' is required by option 'acme'")
+		return
+	}
+	client := &acme.Client{DirectoryURL: s.config.ACMEDirectory}
+	if len(s.config.ACMECACert) > 0 {
+		var pem []byte
+		pem, err = os.ReadFile(s.config.ACMECACert)
+		if err != nil {
+			err = fmt.Errorf("can not read acme ca cert, cause %s", err.Error())
+			return
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			err = fmt.Errorf("invalid acme ca cert '%s'", s.config.ACMECACert)
+			return
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+	m = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(s.config.ACMECacheDir),
+		HostPolicy: s.acmeHostPolicy,
+		Email:      s.config.ACMEEmail,
+		Client:     client,
+	}
+	return
+}
+
+// acmeHostPolicy 只为已注册的自定义域名与 acmeBaseDomains 下已注册的 host 前缀签发证书
+func (s *Server) acmeHostPolicy(_ context.Context, host string) error {
+	host = normalizeHost(host)
+	if _, ok := matchDomain(&s.domainRoutes, host); ok {
+		return nil
+	}
+	for _, base := range s.acmeBaseDomains {
+		if !strings.HasSuffix(host, "."+base) {
+			continue
+		}
+		prefix := host[:len(host)-len(base)-1]
+		if strings.IndexByte(prefix, '.') < 0 && s.hostRoutes.has(prefix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrHostNotRegistered, host)
+}
+
+// acmeGetCertificate 优先使用 certFile、certFiles 与 certDir 中与 SNI 匹配的证书，其次从 ACME 管理器获取证书，
+// 都失败时使用默认的静态证书
+func (s *Server) acmeGetCertificate() func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		challenge := len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+		if s.certs != nil && !challenge {
+			if cert := s.certs.match(hello); cert != nil {
+				return cert, nil
+			}
+		}
+		cert, err := s.acme.GetCertificate(hello)
+		if err != nil && s.certs != nil && !challenge {
+			s.Logger.Debug().Err(err).Str("serverName", hello.ServerName).Msg("fall back to the static certificate")
+			return s.certs.GetCertificate(hello)
+		}
+		return cert, err
+	}
+}
+
+// isACMEChallenge 判断访问者连接上的请求是否为 HTTP-01 challenge
+func isACMEChallenge(reader *bufio.Reader) (bool, error) {
+	for {
+		buf, err := reader.Peek(reader.Buffered())
+		if err != nil {
+			return false, err
+		}
+		if len(buf) >= len(acmeChallengePrefix) {
+			return bytes.HasPrefix(buf, []byte(acmeChallengePrefix)), nil
+		}
+		if !bytes.Equal(buf, []byte(acmeChallengePrefix[:len(buf)])) {
+			return false, nil
+		}
+		_, err = reader.Peek(len(buf) + 1)
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// acmeResponseWriter 缓存 challenge 的响应
+type acmeResponseWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *acmeResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *acmeResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *acmeResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+// serveACMEChallenge 响应 HTTP-01 challenge 请求后关闭连接
+func (c *conn) serveACMEChallenge() (err error) {
+	req, err := http.ReadRequest(stdbufio.NewReader(c.Reader))
+	if err != nil {
+		return
+	}
+	w := &acmeResponseWriter{header: make(http.Header)}
+	c.server.acme.HTTPHandler(nil).ServeHTTP(w, req)
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	resp := &http.Response{
+		StatusCode:    w.code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		Body:          io.NopCloser(&w.body),
+		ContentLength: int64(w.body.Len()),
+		Close:         true,
+		Request:       req,
+	}
+	return resp.Write(c.Conn)
+}
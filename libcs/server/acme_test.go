@@ -0,0 +1,98 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/isrc-cas/gt/bufio"
+)
+
+func TestACMEHostPolicy(t *testing.T) {
+	s := &Server{acmeBaseDomains: []string{"gt.test"}}
+	s.hostRoutes.store("abc", hostRoute{})
+	s.hostRoutes.store("api/v1", hostRoute{})
+	s.domainRoutes.store("customer.com", hostRoute{})
+	s.domainRoutes.store("*.example.com", hostRoute{})
+	s.tlsHostRoutes.store("tls", hostRoute{})
+
+	tests := []struct {
+		host string
+		ok   bool
+	}{
+		{"abc.gt.test", true},
+		{"ABC.gt.test.", true},
+		{"api.gt.test", true},
+		{"customer.com", true},
+		{"shop.example.com", true},
+		{"a.b.example.com", true},
+		{"example.com", false},
+		{"abc.other.test", false},
+		{"x.abc.gt.test", false},
+		{"unknown.gt.test", false},
+		{"tls.gt.test", false},
+		{"gt.test", false},
+	}
+	for _, tt := range tests {
+		err := s.acmeHostPolicy(context.Background(), tt.host)
+		if (err == nil) != tt.ok {
+			t.Errorf("acmeHostPolicy(%q) = %v, expected ok %v", tt.host, err, tt.ok)
+		}
+		if err != nil && !errors.Is(err, ErrHostNotRegistered) {
+			t.Errorf("acmeHostPolicy(%q) = %v, expected ErrHostNotRegistered", tt.host, err)
+		}
+	}
+}
+
+func TestIsACMEChallenge(t *testing.T) {
+	tests := []struct {
+		request  string
+		expected bool
+	}{
+		{"GET /.well-known/acme-challenge/token HTTP/1.1\r\nHost: a.gt.test\r\n\r\n", true},
+		{"GET / HTTP/1.1\r\nHost: a.gt.test\r\n\r\n", false},
+		{"GET /.well-known/other HTTP/1.1\r\n\r\n", false},
+		{"POST /.well-known/acme-challenge/token HTTP/1.1\r\n\r\n", false},
+	}
+	for _, tt := range tests {
+		// 每次只读出一个字节，模拟请求分多次到达
+		reader := bufio.NewReader(&oneByteReader{strings.NewReader(tt.request)})
+		_, err := reader.Peek(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		challenge, err := isACMEChallenge(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if challenge != tt.expected {
+			t.Errorf("isACMEChallenge(%q) = %v, expected %v", tt.request, challenge, tt.expected)
+		}
+	}
+}
+
+type oneByteReader struct {
+	r *strings.Reader
+}
+
+func (r *oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return r.r.Read(p[:1])
+}
@@ -119,9 +119,10 @@ func (s *Server) randomIDSecret() error {
 	return fmt.Errorf("random id and secret still conflict after %v retries", retries)
 }
 
-// Auth 验证是不是 api server 生成的 id 和 secret
-func (s *Server) Auth(id string, secret string) (ok bool) {
-	ok = id == s.ID() && secret == s.Secret()
+// Auth 验证是不是 api server 生成的 id 和 secret，verify 用于验证客户端是否持有 secret
+func (s *Server) Auth(id string, verify func(id string, secret string) bool) (ok bool) {
+	sid := s.ID()
+	ok = len(sid) > 0 && id == sid && verify(id, s.Secret())
 	return
 }
 
@@ -0,0 +1,62 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/subtle"
+
+	connection "github.com/isrc-cas/gt/conn"
+)
+
+// credential 客户端在握手中提供的认证信息
+type credential struct {
+	secret string // 明文认证时的 secret
+	nonce  []byte // 质询应答认证时服务端发送的随机数
+	proof  []byte // 质询应答认证时客户端的应答
+
+	storedKey []byte // 质询应答认证时客户端在加密连接上声明的 stored key
+}
+
+func (c credential) challenge() bool {
+	return c.nonce != nil
+}
+
+// verify 验证客户端是否持有 secret
+func (c credential) verify(id string, secret string) bool {
+	if len(secret) < 1 {
+		return false
+	}
+	if !c.challenge() {
+		return subtle.ConstantTimeCompare([]byte(c.secret), []byte(secret)) == 1
+	}
+	return connection.VerifyProof(connection.StoredKey(secret), id, c.nonce, c.proof)
+}
+
+// verifyStoredKey 验证客户端是否持有 storedKey 对应的 secret
+func (c credential) verifyStoredKey(id string, storedKey []byte) bool {
+	if !c.challenge() {
+		return subtle.ConstantTimeCompare(connection.StoredKey(c.secret), storedKey) == 1
+	}
+	return connection.VerifyProof(storedKey, id, c.nonce, c.proof)
+}
+
+// enrollment 返回 allowAnyClient 模式下登记新的 id 使用的 stored key，
+// 质询应答认证只有在加密连接上才能登记，否则返回 nil
+func (c credential) enrollment() []byte {
+	if !c.challenge() {
+		return connection.StoredKey(c.secret)
+	}
+	return c.storedKey
+}
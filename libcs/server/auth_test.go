@@ -0,0 +1,61 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	connection "github.com/isrc-cas/gt/conn"
+)
+
+func TestChallengeReplay(t *testing.T) {
+	nonce := bytes.Repeat([]byte{1}, connection.NonceSize)
+	freshNonce := bytes.Repeat([]byte{2}, connection.NonceSize)
+	captured := connection.GenEnrollment("id1", "secret1", nonce)
+	proof, storedKey := connection.ParseEnrollment(captured)
+	if len(proof) != connection.ProofSize || !bytes.Equal(storedKey, connection.StoredKey("secret1")) {
+		t.Fatal("invalid enrollment")
+	}
+
+	u := user{Secret: "secret1"}
+	if !u.verify("id1", credential{nonce: nonce, proof: proof}) {
+		t.Fatal("valid proof is rejected")
+	}
+	if u.verify("id1", credential{nonce: freshNonce, proof: proof}) {
+		t.Fatal("replayed proof is accepted")
+	}
+
+	// allowAnyClient 模式下只有附带 stored key 的加密连接才能登记新的 id
+	s := &Server{}
+	s.defaultUser.Store(s.config.defaultUser())
+	_, err := s.authUserOrCreateUser("id1", credential{nonce: nonce, proof: proof})
+	if !errors.Is(err, ErrEnrollmentRequired) {
+		t.Fatalf("new id is enrolled without stored key: %v", err)
+	}
+	_, err = s.authUserOrCreateUser("id1", credential{nonce: nonce, proof: proof, storedKey: storedKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.authUserOrCreateUser("id1", credential{nonce: freshNonce, proof: connection.GenProof("id1", "secret1", freshNonce)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.authUserOrCreateUser("id1", credential{nonce: freshNonce, proof: proof})
+	if !errors.Is(err, ErrInvalidUser) {
+		t.Fatalf("replayed proof is accepted: %v", err)
+	}
+}
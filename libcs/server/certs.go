@@ -0,0 +1,289 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// ErrNoCertificate is an error returned when no certificate is loaded
+var ErrNoCertificate = errors.New("no certificate")
+
+// certPair 是一对证书与私钥文件
+type certPair struct {
+	cert string
+	key  string
+}
+
+// certStore 保存 tls 监听使用的证书，按 ClientHello 中的 SNI 选择证书，并在文件变化后重新加载。
+// 重新加载只影响之后的握手，已经建立的连接不受影响。
+type certStore struct {
+	pairs  []certPair // certFile、keyFile 与 certFiles、keyFiles 配置的证书
+	dir    string     // 证书目录
+	logger zerolog.Logger
+
+	mtx   gosync.RWMutex
+	certs []*tls.Certificate            // 第一个证书是没有匹配的 SNI 时使用的默认证书
+	names map[string][]*tls.Certificate // key: 证书中的域名，包括 *.example.com 形式的通配符域名
+	stamp string                        // 已加载文件的修改时间与大小
+
+	closeOnce gosync.Once
+	closed    chan struct{}
+}
+
+// newCertStore 加载证书，没有配置任何证书时返回 nil
+func newCertStore(certFile, keyFile string, certFiles, keyFiles []string, dir string, l zerolog.Logger) (c *certStore, err error) {
+	if len(certFiles) != len(keyFiles) {
+		err = errors.New("the number of cert files and key files does not match")
+		return
+	}
+	var pairs []certPair
+	if len(certFile) > 0 && len(keyFile) > 0 {
+		pairs = append(pairs, certPair{cert: certFile, key: keyFile})
+	}
+	for i := range certFiles {
+		pairs = append(pairs, certPair{cert: certFiles[i], key: keyFiles[i]})
+	}
+	if len(pairs) == 0 && len(dir) == 0 {
+		return
+	}
+	c = &certStore{
+		pairs:  pairs,
+		dir:    dir,
+		logger: l,
+		closed: make(chan struct{}),
+	}
+	_, err = c.reload()
+	if err != nil {
+		c = nil
+	}
+	return
+}
+
+// files 返回所有需要加载的证书文件
+func (c *certStore) files() (pairs []certPair, err error) {
+	pairs = append(pairs, c.pairs...)
+	if len(c.dir) == 0 {
+		return
+	}
+	dirPairs, err := scanCertDir(c.dir)
+	if err != nil {
+		return
+	}
+	pairs = append(pairs, dirPairs...)
+	return
+}
+
+// scanCertDir 查找目录中的证书：name.crt 或 name.pem 与 name.key 为一对，
+// 子目录中的 fullchain.pem 与 privkey.pem 为一对（certbot 的目录结构）
+func scanCertDir(dir string) (pairs []certPair, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		err = fmt.Errorf("can not read cert dir, cause %s", err.Error())
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			cert := filepath.Join(dir, name, "fullchain.pem")
+			key := filepath.Join(dir, name, "privkey.pem")
+			if fileExists(cert) && fileExists(key) {
+				pairs = append(pairs, certPair{cert: cert, key: key})
+			}
+			continue
+		}
+		ext := filepath.Ext(name)
+		if ext != ".crt" && ext != ".pem" {
+			continue
+		}
+		key := filepath.Join(dir, strings.TrimSuffix(name, ext)+".key")
+		if fileExists(key) {
+			pairs = append(pairs, certPair{cert: filepath.Join(dir, name), key: key})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].cert < pairs[j].cert
+	})
+	return
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// fileStamp 用文件的路径、修改时间与大小判断文件是否变化
+func fileStamp(pairs []certPair) string {
+	var b strings.Builder
+	for _, pair := range pairs {
+		for _, path := range []string{pair.cert, pair.key} {
+			b.WriteString(path)
+			info, err := os.Stat(path)
+			if err == nil {
+				_, _ = fmt.Fprintf(&b, ":%d:%d", info.ModTime().UnixNano(), info.Size())
+			}
+			b.WriteByte(';')
+		}
+	}
+	return b.String()
+}
+
+// reload 在文件变化时重新加载所有证书。加载失败时保留原来的证书，下次检查时再次尝试
+func (c *certStore) reload() (reloaded bool, err error) {
+	pairs, err := c.files()
+	if err != nil {
+		return
+	}
+	stamp := fileStamp(pairs)
+	c.mtx.RLock()
+	unchanged := stamp == c.stamp
+	c.mtx.RUnlock()
+	if unchanged {
+		return
+	}
+	if len(pairs) == 0 {
+		err = fmt.Errorf("no cert and key pair is found in cert dir '%s'", c.dir)
+		return
+	}
+	certs := make([]*tls.Certificate, 0, len(pairs))
+	names := make(map[string][]*tls.Certificate)
+	for _, pair := range pairs {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(pair.cert, pair.key)
+		if err != nil {
+			err = fmt.Errorf("invalid cert '%s' and key '%s', cause %s", pair.cert, pair.key, err.Error())
+			return
+		}
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			err = fmt.Errorf("invalid cert '%s', cause %s", pair.cert, err.Error())
+			return
+		}
+		certs = append(certs, &cert)
+		dnsNames := cert.Leaf.DNSNames
+		if len(dnsNames) == 0 && len(cert.Leaf.Subject.CommonName) > 0 {
+			dnsNames = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range dnsNames {
+			name = strings.ToLower(name)
+			names[name] = append(names[name], &cert)
+		}
+	}
+	c.mtx.Lock()
+	c.certs = certs
+	c.names = names
+	c.stamp = stamp
+	c.mtx.Unlock()
+	reloaded = true
+	return
+}
+
+// match 返回与 SNI 匹配的证书，优先选择客户端支持的证书
+func (c *certStore) match(hello *tls.ClientHelloInfo) *tls.Certificate {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if len(name) == 0 {
+		return nil
+	}
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	candidates := c.names[name]
+	if len(candidates) == 0 {
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			candidates = c.names["*"+name[i:]]
+		}
+	}
+	for _, cert := range candidates {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert
+		}
+	}
+	if len(candidates) > 0 {
+		return candidates[0]
+	}
+	return nil
+}
+
+// GetCertificate 实现 tls.Config.GetCertificate，没有匹配的证书时返回默认证书
+func (c *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := c.match(hello); cert != nil {
+		return cert, nil
+	}
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	if len(c.certs) == 0 {
+		return nil, ErrNoCertificate
+	}
+	return c.certs[0], nil
+}
+
+// watch 每隔 interval 检查证书文件是否变化
+func (c *certStore) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+		reloaded, err := c.reload()
+		if err != nil {
+			c.logger.Warn().Err(err).Msg("failed to reload certs")
+			continue
+		}
+		if reloaded {
+			c.mtx.RLock()
+			n := len(c.certs)
+			c.mtx.RUnlock()
+			c.logger.Info().Int("certs", n).Msg("certs reloaded")
+		}
+	}
+}
+
+func (c *certStore) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+}
+
+// newCertStore 加载证书并按 certWatchInterval 检查文件变化
+func (s *Server) newCertStore(scope, certFile, keyFile string, certFiles, keyFiles []string, dir string) (c *certStore, err error) {
+	c, err = newCertStore(certFile, keyFile, certFiles, keyFiles, dir, s.Logger.With().Str("scope", scope).Logger())
+	if err != nil || c == nil {
+		return
+	}
+	if s.config.CertWatchInterval.Duration > 0 {
+		go c.watch(s.config.CertWatchInterval.Duration)
+	}
+	return
+}
+
+// newCertTLSConfig 返回从 certStore 获取证书的 tls 配置
+func newCertTLSConfig(c *certStore, tlsMinVersion string) (tlsConfig *tls.Config) {
+	tlsConfig = baseTLSConfig(tlsMinVersion)
+	tlsConfig.GetCertificate = c.GetCertificate
+	return
+}
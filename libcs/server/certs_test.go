@@ -0,0 +1,165 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// writeTestCert 生成包含 hosts 的自签名证书，写入 certPath 与 keyPath
+func writeTestCert(t *testing.T, certPath, keyPath string, hosts ...string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     hosts,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func servedName(t *testing.T, c *certStore, serverName string) string {
+	cert, err := c.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestCertStore(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCert(t, filepath.Join(dir, "default.crt"), filepath.Join(dir, "default.key"), "default.test")
+	writeTestCert(t, filepath.Join(dir, "a.crt"), filepath.Join(dir, "a.key"), "a.example.com")
+
+	certDir := filepath.Join(dir, "certs")
+	err := os.MkdirAll(filepath.Join(certDir, "live"), 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestCert(t, filepath.Join(certDir, "wildcard.pem"), filepath.Join(certDir, "wildcard.key"), "*.example.com")
+	writeTestCert(t, filepath.Join(certDir, "live", "fullchain.pem"), filepath.Join(certDir, "live", "privkey.pem"), "customer.com")
+
+	c, err := newCertStore(
+		filepath.Join(dir, "default.crt"), filepath.Join(dir, "default.key"),
+		[]string{filepath.Join(dir, "a.crt")}, []string{filepath.Join(dir, "a.key")},
+		certDir, zerolog.Nop(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		serverName string
+		expected   string
+	}{
+		{"a.example.com", "a.example.com"},
+		{"A.Example.com.", "a.example.com"},
+		{"b.example.com", "*.example.com"},
+		{"x.b.example.com", "default.test"},
+		{"customer.com", "customer.com"},
+		{"unknown.test", "default.test"},
+		{"", "default.test"},
+	}
+	for _, tt := range tests {
+		if name := servedName(t, c, tt.serverName); name != tt.expected {
+			t.Errorf("%q is served with %q, expected %q", tt.serverName, name, tt.expected)
+		}
+	}
+
+	// 文件没有变化时不重新加载
+	reloaded, err := c.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded {
+		t.Fatal("certs are reloaded without changes")
+	}
+
+	// 替换证书与新增证书
+	writeTestCert(t, filepath.Join(dir, "a.crt"), filepath.Join(dir, "a.key"), "a.example.com", "a2.example.com")
+	writeTestCert(t, filepath.Join(certDir, "new.crt"), filepath.Join(certDir, "new.key"), "new.test")
+	reloaded, err = c.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded {
+		t.Fatal("certs are not reloaded")
+	}
+	if name := servedName(t, c, "a2.example.com"); name != "a.example.com" {
+		t.Fatalf("a2.example.com is served with %q", name)
+	}
+	if name := servedName(t, c, "new.test"); name != "new.test" {
+		t.Fatalf("new.test is served with %q", name)
+	}
+
+	// 证书无效时保留原来的证书
+	err = os.WriteFile(filepath.Join(certDir, "new.key"), []byte("invalid"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.reload()
+	if err == nil {
+		t.Fatal("invalid key is loaded")
+	}
+	if name := servedName(t, c, "new.test"); name != "new.test" {
+		t.Fatalf("new.test is served with %q", name)
+	}
+}
+
+func TestCertStoreNotConfigured(t *testing.T) {
+	c, err := newCertStore("", "", nil, nil, "", zerolog.Nop())
+	if err != nil || c != nil {
+		t.Fatalf("newCertStore() = %v, %v", c, err)
+	}
+	_, err = newCertStore("", "", []string{"a.crt"}, nil, "", zerolog.Nop())
+	if err == nil {
+		t.Fatal("unpaired cert files are accepted")
+	}
+}
@@ -15,7 +15,6 @@
 package server
 
 import (
-	"errors"
 	"fmt"
 	"github.com/libp2p/go-reuseport"
 	"net"
@@ -26,7 +25,9 @@ import (
 
 	lru "github.com/hashicorp/golang-lru/v2"
 	connection "github.com/isrc-cas/gt/conn"
+	"github.com/isrc-cas/gt/predef"
 	ssync "github.com/isrc-cas/gt/server/sync"
+	"github.com/isrc-cas/gt/util"
 	"github.com/rs/zerolog"
 )
 
@@ -38,18 +39,34 @@ type client struct {
 	taskIDSeed   uint32
 	closeOnce    sync.Once
 
+	drainingTunnels map[*conn]struct{} // 正在等待已有的 task 完成后关闭的 tunnel
+
 	portsManager *portsManager
 	tcpListeners ssync.Map // key: serverIndex value: net.Listener
-
-	speedMutex    sync.Mutex
-	speedNum      uint32
-	uploadCount   uint32
-	downloadCount uint32
+	udpListeners ssync.Map // key: serverIndex value: *udpListenerWithOption
+
+	uploadLimit    *util.TokenBucket // 用户上行（客户端发往访问者）限速
+	downloadLimit  *util.TokenBucket // 用户下行（访问者发往客户端）限速
+	uploadShared   *sharedLimiter    // 服务端上行总限速
+	downloadShared *sharedLimiter    // 服务端下行总限速
+	uploadShare    *util.TokenBucket // 用户在服务端上行总限速中的份额
+	downloadShare  *util.TokenBucket // 用户在服务端下行总限速中的份额
+	visitorSpeed   uint32            // 每个访问者连接的上下行速度
+	speedBurst     time.Duration
+	serviceLimits  atomic.Pointer[map[uint16]serviceLimit] // 客户端为服务声明的限速，key: serviceIndex
+
+	traffic       *userTraffic
+	serviceNames  atomic.Pointer[map[uint16]string] // 统计流量使用的服务名称，key: serviceIndex
+	dayQuota      uint64
+	monthQuota    uint64
+	quotaNotified atomic.Bool // 已经通知客户端流量配额用尽
 
 	connections uint32
 
 	host host
 
+	ipFilters atomic.Pointer[map[uint16]*ipFilter] // 客户端为服务声明的过滤器，key: serviceIndex
+
 	checksumBlacklist     *lru.Cache[[32]byte, any]
 	lastProcessedChecksum [32]byte
 }
@@ -62,7 +79,10 @@ func newClient() interface{} {
 func (c *client) init(id string, u user, s *Server) {
 	c.host = u.Host
 	c.portsManager = u.portsManager
-	c.speedNum = u.Speed
+	c.initLimits(u, s)
+	c.traffic = s.traffic.user(id)
+	c.dayQuota = u.DayQuota
+	c.monthQuota = u.MonthQuota
 	c.connections = u.Connections
 	c.checksumBlacklist, _ = lru.New[[32]byte, any](3)
 	c.logger = s.Logger.With().
@@ -76,6 +96,9 @@ func (c *client) init(id string, u user, s *Server) {
 }
 
 func (c *client) process(task *conn) (err error) {
+	if c.quotaExceeded() {
+		return ErrQuotaExceeded
+	}
 	taskID := atomic.AddUint32(&c.taskIDSeed, 1)
 	if taskID >= connection.PreservedSignal {
 		atomic.StoreUint32(&c.taskIDSeed, 1)
@@ -167,8 +190,12 @@ func (c *client) addTunnel(t *conn, reload bool, o options) (ok bool, err error)
 		if err != nil {
 			return
 		}
+		err = t.processUDPOptions(o, c)
+		if err != nil {
+			return
+		}
 	} else {
-		if len(o.ports) > 0 {
+		if len(o.ports) > 0 || len(o.udpPorts) > 0 {
 			err = connection.ErrTCPNumberLimited
 			if e := t.SendErrorSignalTCPNumberLimited(); e != nil {
 				t.Logger.Error().Err(e).Msg("failed to SendErrorSignalTCPNumberLimited")
@@ -177,6 +204,14 @@ func (c *client) addTunnel(t *conn, reload bool, o options) (ok bool, err error)
 		}
 	}
 
+	c.ipFilters.Store(&o.ipFilters)
+	if c.serviceLimits.Load() == nil || o.configChecksum != c.lastProcessedChecksum {
+		// 配置不变时保留令牌桶，避免同一客户端的多个 tunnel 重置限速
+		limits := newServiceLimits(o.serviceSpeeds, c.speedBurst)
+		c.serviceLimits.Store(&limits)
+		names := serviceNames(o)
+		c.serviceNames.Store(&names)
+	}
 	c.lastProcessedChecksum = o.configChecksum
 
 	if reload {
@@ -235,8 +270,8 @@ func (c *client) addTunnel(t *conn, reload bool, o options) (ok bool, err error)
 				Hex("newChecksum", o.configChecksum[:]).
 				Msg("added old checksum to blacklist")
 			for id, changes := range ids {
-				if changes.remove || changes.oldServiceIndex.tls != changes.serviceIndex.tls {
-					t.server.removeHostPrefix(id, changes.oldServiceIndex.tls)
+				if changes.remove || !changes.oldServiceIndex.sameRoutes(changes.serviceIndex) {
+					t.server.removeHostPrefix(id, changes.oldServiceIndex, c)
 					t.Logger.Info().
 						Str("id", c.id).
 						Hex("oldChecksum", checksum[:]).
@@ -245,11 +280,7 @@ func (c *client) addTunnel(t *conn, reload bool, o options) (ok bool, err error)
 						Str("oldServiceIndex", changes.oldServiceIndex.String()).
 						Msg("removed associated host prefix")
 				} else {
-					t.server.storeHostPrefix(id, changes.serviceIndex.tls,
-						clientWithServiceIndex{
-							client:       c,
-							serviceIndex: changes.serviceIndex.serviceIndex,
-						})
+					t.server.storeHostPrefix(id, changes.serviceIndex, changes.serviceIndex.route(c))
 					t.Logger.Info().
 						Str("id", c.id).
 						Hex("oldChecksum", checksum[:]).
@@ -269,6 +300,7 @@ func (c *client) addTunnel(t *conn, reload bool, o options) (ok bool, err error)
 func (c *client) removeTunnel(tunnel *conn) {
 	c.tunnelsRWMtx.Lock()
 	defer c.tunnelsRWMtx.Unlock()
+	delete(c.drainingTunnels, tunnel)
 	if _, ok := c.tunnels[tunnel]; ok {
 		delete(c.tunnels, tunnel)
 		if len(c.tunnels) < 1 {
@@ -280,9 +312,10 @@ func (c *client) removeTunnel(tunnel *conn) {
 					Str("prefix", hostPrefix).
 					Str("serviceIndex", o.String()).
 					Msg("remove associated host prefix")
-				tunnel.server.removeHostPrefix(hostPrefix, o.tls)
+				tunnel.server.removeHostPrefix(hostPrefix, o, c)
 			}
 			c.closeTCPListeners()
+			c.closeUDPListeners()
 		}
 	}
 }
@@ -323,7 +356,12 @@ func (c *client) close() {
 			t.SendForceCloseSignal()
 			t.Close()
 		}
+		for t := range c.drainingTunnels {
+			t.SendForceCloseSignal()
+			t.Close()
+		}
 		c.closeTCPListeners()
+		c.closeUDPListeners()
 		c.tunnelsRWMtx.Unlock()
 	})
 }
@@ -341,98 +379,139 @@ func (c *client) reconnect() {
 }
 
 func (c *client) closeTCPListeners() {
-	c.tcpListeners.Range(func(key, value interface{}) bool {
-		l, ok := value.(*tcpListener)
-		if ok {
-			if l.l != nil {
-				port := uint16(l.l.Addr().(*net.TCPAddr).Port)
-				c.logger.Info().
-					Interface("serviceIndex", key).
-					Uint16("port", port).
-					Msg("close associated tcp listener")
-				c.portsManager.portsMtx.Lock()
-				c.portsManager.ports[port] = struct{}{}
-				c.portsManager.portsMtx.Unlock()
-				_ = l.l.Close()
-			}
+	c.closeListeners(&c.tcpListeners)
+}
+
+func (c *client) deleteTCPListener(si uint16) {
+	c.deleteListener(&c.tcpListeners, si)
+}
+
+// closeListeners 关闭并删除 listeners 中所有的 tcp 或 udp 监听
+func (c *client) closeListeners(listeners *ssync.Map) {
+	listeners.Range(func(key, value interface{}) bool {
+		c.deleteListener(listeners, key.(uint16))
+		return true
+	})
+}
+
+// deleteUnusedListeners 关闭并删除 listeners 中 used 返回 false 的监听
+func (c *client) deleteUnusedListeners(listeners *ssync.Map, used func(si uint16) bool) {
+	listeners.Range(func(key, value interface{}) bool {
+		if si := key.(uint16); !used(si) {
+			c.deleteListener(listeners, si)
 		}
 		return true
 	})
 }
 
-func (c *client) deleteTCPListener(si uint16) {
-	value, loaded := c.tcpListeners.LoadAndDelete(si)
-	if loaded {
-		l, ok := value.(*tcpListener)
-		if ok {
-			if l.l != nil {
-				port := uint16(l.l.Addr().(*net.TCPAddr).Port)
-				c.logger.Info().
-					Uint16("serviceIndex", si).
-					Uint16("port", port).
-					Msg("close associated tcp listener")
-				c.portsManager.portsMtx.Lock()
-				c.portsManager.ports[port] = struct{}{}
-				c.portsManager.portsMtx.Unlock()
-				_ = l.l.Close()
-			}
+func (c *client) deleteListener(listeners *ssync.Map, si uint16) {
+	value, loaded := listeners.LoadAndDelete(si)
+	if !loaded {
+		return
+	}
+	switch l := value.(type) {
+	case *tcpListener:
+		if l.group != nil {
+			l.group.leave(c)
+		}
+		if l.l != nil {
+			c.closePortListener("tcp", si, l.l)
+		}
+	case *udpListenerWithOption:
+		if l.l != nil {
+			c.closePortListener("udp", si, l.l)
 		}
 	}
 }
 
+// closePortListener 关闭监听并将端口归还到端口池
+func (c *client) closePortListener(network string, si uint16, l net.Listener) {
+	port := listenerPort(l)
+	c.logger.Info().
+		Uint16("serviceIndex", si).
+		Uint16("port", port).
+		Msg("close associated " + network + " listener")
+	c.portsManager.release(port)
+	_ = l.Close()
+}
+
+// listenerPort 返回 tcp 或 udp 监听的端口
+func listenerPort(l net.Listener) uint16 {
+	switch addr := l.Addr().(type) {
+	case *net.TCPAddr:
+		return uint16(addr.Port)
+	case *net.UDPAddr:
+		return uint16(addr.Port)
+	}
+	return 0
+}
+
 type portsManager struct {
 	ports    map[uint16]struct{}
 	portsMtx sync.Mutex
 }
 
 type tcpListener struct {
-	l    net.Listener
-	port openTCPOption
+	l     net.Listener
+	port  openTCPOption
+	group *tcpGroup // 服务组共享的端口，l 为 nil
 }
 
-func (c *client) openTCPPort(serviceIndex uint16, l *tcpListener, tunnel *conn) (openedTCPPort uint16, err error) {
-	tcpPort := l.port.port
-	random := l.port.random
-
-	c.portsManager.portsMtx.Lock()
-	defer c.portsManager.portsMtx.Unlock()
-	if len(c.portsManager.ports) == 0 {
-		err = errors.New("no available tcp port")
+// open 从端口池中取出端口并用 open 打开，优先使用 port，失败且 random 为 true 时最多再尝试 3 个随机端口
+func (m *portsManager) open(network string, port uint16, random bool, logger zerolog.Logger,
+	open func(port uint16) error) (opened uint16, err error) {
+	m.portsMtx.Lock()
+	defer m.portsMtx.Unlock()
+	if len(m.ports) == 0 {
+		err = fmt.Errorf("no available %s port", network)
 		return
 	}
 
-	if _, ok := c.portsManager.ports[tcpPort]; ok {
-		err = c.openSpecifiedTCPPort(serviceIndex, l, tcpPort, tunnel)
+	if _, ok := m.ports[port]; ok {
+		err = open(port)
 		if err == nil {
-			openedTCPPort = tcpPort
-			delete(c.portsManager.ports, tcpPort)
+			opened = port
+			delete(m.ports, port)
 			return
 		}
 	}
-	tunnel.Logger.Warn().Err(err).Uint16("port", tcpPort).Msg("failed to open the tcp port user asked")
+	logger.Warn().Err(err).Uint16("port", port).Msgf("failed to open the %s port user asked", network)
 	if !random {
-		err = fmt.Errorf("user disable random tcp port when %w", err)
+		err = fmt.Errorf("user disable random %s port when %w", network, err)
 		return
 	}
 
 	retry := 0
-	for tcpPort := range c.portsManager.ports {
-		err = c.openSpecifiedTCPPort(serviceIndex, l, tcpPort, tunnel)
+	for port := range m.ports {
+		err = open(port)
 		if err == nil {
-			openedTCPPort = tcpPort
-			delete(c.portsManager.ports, tcpPort)
+			opened = port
+			delete(m.ports, port)
 			return
 		}
-		tunnel.Logger.Warn().Err(err).Msg("failed to open tcp port")
+		logger.Warn().Err(err).Msgf("failed to open %s port", network)
 		retry++
 		if retry >= 3 {
 			break
 		}
 	}
-	err = errors.New("failed to open random tcp port")
+	err = fmt.Errorf("failed to open random %s port", network)
 	return
 }
 
+// release 将端口归还到端口池
+func (m *portsManager) release(port uint16) {
+	m.portsMtx.Lock()
+	m.ports[port] = struct{}{}
+	m.portsMtx.Unlock()
+}
+
+func (c *client) openTCPPort(serviceIndex uint16, l *tcpListener, tunnel *conn) (uint16, error) {
+	return c.portsManager.open("tcp", l.port.port, l.port.random, tunnel.Logger, func(port uint16) error {
+		return c.openSpecifiedTCPPort(serviceIndex, l, port, tunnel)
+	})
+}
+
 func (c *client) openSpecifiedTCPPort(serviceIndex uint16, l *tcpListener, tcpPort uint16, tunnel *conn) error {
 	listener, err := reuseport.Listen("tcp", ":"+strconv.Itoa(int(tcpPort)))
 	if err != nil {
@@ -440,6 +519,7 @@ func (c *client) openSpecifiedTCPPort(serviceIndex uint16, l *tcpListener, tcpPo
 	}
 	tunnel.Logger.Info().Uint16("port", tcpPort).Msg("tcp port opened")
 	l.l = listener
+	listener = tunnel.server.proxyProtocolListen(listener, tunnel.server.config.TCPProxyProtocol)
 
 	// 启动 goroutine 处理 tcp 连接
 	go tunnel.server.acceptLoop(listener, func(conn *conn) {
@@ -449,6 +529,10 @@ func (c *client) openSpecifiedTCPPort(serviceIndex uint16, l *tcpListener, tcpPo
 		tunnel.Logger.Info().Uint16("serviceIndex", serviceIndex).Uint16("tcpPort", tcpPort).Msg("tcp forward start")
 		conn.serviceIndex = serviceIndex
 		conn.handleTCP(func() {
+			if !tunnel.server.serviceVisitorAllowed(conn.RemoteAddr(), c, serviceIndex) {
+				conn.Logger.Info().Uint16("tcpPort", tcpPort).Msg("visitor ip is not allowed")
+				return
+			}
 			err = c.process(conn)
 			if err != nil {
 				conn.Logger.Error().Err(err).Msg("tcp handle")
@@ -459,34 +543,12 @@ func (c *client) openSpecifiedTCPPort(serviceIndex uint16, l *tcpListener, tcpPo
 	return nil
 }
 
-func (c *client) needSpeedLimit() (ok bool) {
-	return c.speedNum > 0
-}
-
-func (c *client) speedLimit(bufLen uint32, isUpload bool) {
-	c.speedMutex.Lock()
-	defer c.speedMutex.Unlock()
-
-	// 上下行分开限速，限制的速度都是 Speed
-	count := &c.downloadCount
-	if isUpload {
-		count = &c.uploadCount
-	}
-
-	// 乐观思想，假设数据包可以立即到达客户端，仅控制服务端的发包速度
-	*count += bufLen
-	if *count < c.speedNum {
-		return
-	}
-	sleepSeconds := *count / c.speedNum
-	*count -= sleepSeconds * c.speedNum
-	time.Sleep(time.Duration(sleepSeconds) * time.Second)
-}
-
 type ConnectionInfo struct {
-	ID         string
-	LocalAddr  net.Addr
-	RemoteAddr net.Addr
+	ID              string
+	LocalAddr       net.Addr
+	RemoteAddr      net.Addr
+	ProtocolVersion uint16
+	Features        []string
 }
 
 func (c *client) GetConnectionInfo() (info []ConnectionInfo) {
@@ -494,9 +556,11 @@ func (c *client) GetConnectionInfo() (info []ConnectionInfo) {
 	defer c.tunnelsRWMtx.RUnlock()
 	for conn := range c.tunnels {
 		info = append(info, ConnectionInfo{
-			ID:         c.id,
-			RemoteAddr: conn.RemoteAddr(),
-			LocalAddr:  conn.LocalAddr(),
+			ID:              c.id,
+			RemoteAddr:      conn.RemoteAddr(),
+			LocalAddr:       conn.LocalAddr(),
+			ProtocolVersion: uint16(conn.version.Load()),
+			Features:        predef.FeatureNames(conn.features.Load()),
 		})
 	}
 	return
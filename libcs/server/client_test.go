@@ -0,0 +1,58 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestCloseListeners(t *testing.T) {
+	c := &client{
+		logger:       zerolog.Nop(),
+		portsManager: &portsManager{ports: make(map[uint16]struct{})},
+	}
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ul := newUDPListener(pc, time.Minute)
+	c.tcpListeners.Store(uint16(0), &tcpListener{l: tl})
+	c.udpListeners.Store(uint16(0), &udpListenerWithOption{l: ul})
+
+	c.closeTCPListeners()
+	c.closeUDPListeners()
+	if n := countListeners(&c.tcpListeners); n != 0 {
+		t.Fatalf("%d tcp listeners left after close", n)
+	}
+	if n := countListeners(&c.udpListeners); n != 0 {
+		t.Fatalf("%d udp listeners left after close", n)
+	}
+	for _, port := range []uint16{listenerPort(tl), listenerPort(ul)} {
+		if _, ok := c.portsManager.ports[port]; !ok {
+			t.Fatalf("port %d was not returned to the pool", port)
+		}
+	}
+	if _, err := tl.Accept(); err == nil {
+		t.Fatal("tcp listener is still open")
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"github.com/isrc-cas/gt/predef"
 	"github.com/isrc-cas/gt/server/sync"
 	"github.com/rs/zerolog"
+	"golang.org/x/crypto/acme"
 )
 
 // Config is a server config.
@@ -46,38 +47,90 @@ type Options struct {
 	CertFile      string `yaml:"certFile,omitempty" json:",omitempty" usage:"The path to cert file"`
 	KeyFile       string `yaml:"keyFile,omitempty" json:",omitempty" usage:"The path to key file"`
 
-	IDs               config.Slice[string] `arg:"id" yaml:"-" json:"-" usage:"The user id"`
-	Secrets           config.Slice[string] `arg:"secret" yaml:"-" json:"-" usage:"The secret for user id"`
-	Users             string               `yaml:"users,omitempty" json:"UserPath,omitempty" usage:"The users yaml file to load"`
-	AuthAPI           string               `yaml:"authAPI,omitempty" json:",omitempty" usage:"The API to authenticate user with id and secret"`
-	AllowAnyClient    bool                 `yaml:"allowAnyClient,omitempty" json:",omitempty" usage:"Allow any client to connect to the server"`
-	TCPRanges         config.Slice[string] `arg:"tcpRange" yaml:"-" json:"-" usage:"The tcp port range, like 1024-65535"`
-	TCPNumber         uint16               `arg:"tcpNumber" yaml:"tcpNumber,omitempty" json:",omitempty" usage:"The number of tcp ports allowed to be opened for each id"`
-	Speed             uint32               `yaml:"speed,omitempty" json:",omitempty" usage:"The max number of bytes the client can transfer per second"`
-	Connections       uint32               `yaml:"connections,omitempty" json:",omitempty" usage:"The max number of tunnel connections for a client"`
-	ReconnectTimes    uint32               `yaml:"reconnectTimes,omitempty" json:",omitempty" usage:"The max number of times the client fails to reconnect"`
-	ReconnectDuration config.Duration      `yaml:"reconnectDuration,omitempty" json:",omitempty" json:",omitempty" usage:"The time that the client cannot connect after the number of failed reconnections reaches the max number"`
-	HostNumber        uint32               `arg:"hostNumber" yaml:"-" json:"-" usage:"The number of host-based services that the user can start"`
-	HostRegex         config.Slice[string] `arg:"hostRegex" yaml:"-" json:"-" usage:"The host prefix started by user must conform to one of these rules"`
-	HostWithID        bool                 `arg:"hostWithID" yaml:"-" json:"-" usage:"The prefix of host will become the form of id-host"`
+	CertFiles         config.Slice[string] `yaml:"certFiles,omitempty" json:",omitempty" usage:"The paths to additional cert files, paired with 'keyFiles' in order. The cert is picked by the server name of each tls handshake"`
+	KeyFiles          config.Slice[string] `yaml:"keyFiles,omitempty" json:",omitempty" usage:"The paths to additional key files, paired with 'certFiles' in order"`
+	CertDir           string               `yaml:"certDir,omitempty" json:",omitempty" usage:"The directory to load certs from. Supports 'name.crt' or 'name.pem' with 'name.key', and 'fullchain.pem' with 'privkey.pem' in subdirectories"`
+	CertWatchInterval config.Duration      `yaml:"certWatchInterval,omitempty" json:",omitempty" usage:"The interval to check cert files for changes and reload them. Supports values like '10s', '1m'. 0 disables reloading"`
+
+	ACME            bool                 `yaml:"acme,omitempty" json:",omitempty" usage:"Issue and renew the certificates of 'tlsAddr' automatically with ACME. HTTP-01 challenges are served on 'addr' and TLS-ALPN-01 challenges on 'tlsAddr'"`
+	ACMEDirectory   string               `yaml:"acmeDirectory,omitempty" json:",omitempty" usage:"The ACME directory URL, like the directory of a local Pebble instance"`
+	ACMEEmail       string               `yaml:"acmeEmail,omitempty" json:",omitempty" usage:"The contact email of the ACME account"`
+	ACMECacheDir    string               `yaml:"acmeCacheDir,omitempty" json:",omitempty" usage:"The directory to store the ACME account key and certificates"`
+	ACMECACert      string               `yaml:"acmeCACert,omitempty" json:",omitempty" usage:"The path to the CA certs used to verify the ACME directory"`
+	ACMEBaseDomains config.Slice[string] `yaml:"acmeBaseDomains,omitempty" json:",omitempty" usage:"The domains under which host prefixes are served. Certificates are issued for '<host prefix>.<base domain>' when the host prefix is registered"`
+
+	IDs                 config.Slice[string] `arg:"id" yaml:"-" json:"-" usage:"The user id"`
+	Secrets             config.Slice[string] `arg:"secret" yaml:"-" json:"-" usage:"The secret for user id"`
+	Users               string               `yaml:"users,omitempty" json:"UserPath,omitempty" usage:"The users yaml file to load"`
+	UserStore           string               `yaml:"userStore,omitempty" json:",omitempty" usage:"The bbolt database file of the embedded user store. Users saved through the admin API and ids claimed in allowAnyClient mode are kept in it and override the users of the config on start"`
+	ConfigWatchInterval config.Duration      `yaml:"configWatchInterval,omitempty" json:",omitempty" usage:"The interval to check the config file and the users file for changes and reload the users and the tcp and host settings. Supports values like '10s', '1m'. 0 disables reloading"`
+	AuthAPI             string               `yaml:"authAPI,omitempty" json:",omitempty" usage:"The API to authenticate user with id and secret"`
+	AllowAnyClient      bool                 `yaml:"allowAnyClient,omitempty" json:",omitempty" usage:"Allow any client to connect to the server"`
+	PlaintextAuth       bool                 `yaml:"plaintextAuth,omitempty" json:",omitempty" usage:"Accept legacy clients that send the secret in cleartext instead of the challenge-response authentication"`
+	TCPRanges           config.Slice[string] `arg:"tcpRange" yaml:"-" json:"-" usage:"The tcp port range, like 1024-65535"`
+	TCPNumber           uint16               `arg:"tcpNumber" yaml:"tcpNumber,omitempty" json:",omitempty" usage:"The number of tcp ports allowed to be opened for each id"`
+	Speed               uint32               `yaml:"speed,omitempty" json:",omitempty" usage:"The max number of bytes the client can transfer per second"`
+	UploadSpeed         uint32               `yaml:"uploadSpeed,omitempty" json:",omitempty" usage:"The max number of bytes per second the client can send to visitors, overrides speed for this direction"`
+	DownloadSpeed       uint32               `yaml:"downloadSpeed,omitempty" json:",omitempty" usage:"The max number of bytes per second visitors can send to the client, overrides speed for this direction"`
+	VisitorSpeed        uint32               `yaml:"visitorSpeed,omitempty" json:",omitempty" usage:"The max number of bytes each visitor connection can transfer per second in each direction"`
+	GlobalUploadSpeed   uint32               `yaml:"globalUploadSpeed,omitempty" json:",omitempty" usage:"The max number of bytes per second all clients can send to visitors, shared equally among the active users"`
+	GlobalDownloadSpeed uint32               `yaml:"globalDownloadSpeed,omitempty" json:",omitempty" usage:"The max number of bytes per second visitors can send to all clients, shared equally among the active users"`
+	SpeedBurst          config.Duration      `yaml:"speedBurst,omitempty" json:",omitempty" usage:"The traffic that can be sent at once after idle, as the time of traffic at the speed limit. Supports values like '500ms', '1s'. 0 disables bursts"`
+	DayQuota            uint64               `yaml:"dayQuota,omitempty" json:",omitempty" usage:"The max number of bytes each user can transfer per day in both directions. New tasks are rejected after the quota is exhausted"`
+	MonthQuota          uint64               `yaml:"monthQuota,omitempty" json:",omitempty" usage:"The max number of bytes each user can transfer per month in both directions. New tasks are rejected after the quota is exhausted"`
+	TrafficFile         string               `yaml:"trafficFile,omitempty" json:",omitempty" usage:"The json file to persist the daily and monthly traffic of users, the traffic is only kept in memory if it is empty"`
+	TrafficSaveInterval config.Duration      `yaml:"trafficSaveInterval,omitempty" json:",omitempty" usage:"The interval to save the traffic to the traffic file. Supports values like '30s', '1m'"`
+	Connections         uint32               `yaml:"connections,omitempty" json:",omitempty" usage:"The max number of tunnel connections for a client"`
+	ReconnectTimes      uint32               `yaml:"reconnectTimes,omitempty" json:",omitempty" usage:"The max number of times the client fails to reconnect"`
+	ReconnectDuration   config.Duration      `yaml:"reconnectDuration,omitempty" json:",omitempty" json:",omitempty" usage:"The time that the client cannot connect after the number of failed reconnections reaches the max number"`
+	HostNumber          uint32               `arg:"hostNumber" yaml:"-" json:"-" usage:"The number of host-based services that the user can start"`
+	HostRegex           config.Slice[string] `arg:"hostRegex" yaml:"-" json:"-" usage:"The host prefix started by user must conform to one of these rules"`
+	HostWithID          bool                 `arg:"hostWithID" yaml:"-" json:"-" usage:"The prefix of host will become the form of id-host"`
+	HostDomains         config.Slice[string] `arg:"hostDomain" yaml:"-" json:"-" usage:"The full domains that the user can register, '*.example.com' allows any subdomain of example.com"`
+	HostAllowClientAuth bool                 `arg:"hostAllowClientAuth" yaml:"-" json:"-" usage:"Allow clients to declare basic auth users, bearer tokens and login pages for their http services"`
+
+	AllowIPs              config.Slice[string] `arg:"allowIP" yaml:"allowIPs,omitempty" json:",omitempty" usage:"The CIDR or IP allowed to visit the services of all clients, like 10.0.0.0/8. Visitors from other addresses are rejected"`
+	DenyIPs               config.Slice[string] `arg:"denyIP" yaml:"denyIPs,omitempty" json:",omitempty" usage:"The CIDR or IP denied to visit the services of all clients, like 192.168.1.0/24"`
+	ClientAllowIPs        config.Slice[string] `arg:"clientAllowIP" yaml:"clientAllowIPs,omitempty" json:",omitempty" usage:"The CIDR or IP that clients are allowed to log in from. Clients from other addresses are rejected"`
+	ClientDenyIPs         config.Slice[string] `arg:"clientDenyIP" yaml:"clientDenyIPs,omitempty" json:",omitempty" usage:"The CIDR or IP that clients are denied to log in from"`
+	IPFilterFile          string               `yaml:"ipFilterFile,omitempty" json:",omitempty" usage:"The yaml file with the allowed and denied CIDRs of visitors and clients, for all users and for each user"`
+	IPFilterWatchInterval config.Duration      `yaml:"ipFilterWatchInterval,omitempty" json:",omitempty" usage:"The interval to check the ip filter file for changes and reload it. Supports values like '10s', '1m'. 0 disables reloading"`
+
+	EdgeAuthKey     string          `yaml:"edgeAuthKey,omitempty" json:"-" usage:"The key to sign the login cookies of auth policies. A random key is used if empty, so logins expire when the server restarts"`
+	EdgeAuthSession config.Duration `yaml:"edgeAuthSession,omitempty" json:",omitempty" usage:"The lifetime of the login cookies of auth policies. Supports values like '12h', '168h'"`
 
 	HTTPMUXHeader       string `yaml:"httpMUXHeader,omitempty" json:",omitempty" usage:"The http multiplexing header to be used"`
+	HTTPRouting         bool   `yaml:"httpRouting,omitempty" json:",omitempty" usage:"Parse every request on visitor connections and route it by its own host or http multiplexing header, instead of pinning the connection to the first request"`
 	MaxHandShakeOptions uint16 `yaml:"maxHandShakeOptions,omitempty" json:",omitempty" usage:"The max number of hand shake options"`
+	MinClientVersion    uint16 `yaml:"minClientVersion,omitempty" json:",omitempty" usage:"The min protocol version of clients. Clients that do not negotiate capabilities are version 1"`
+	DowngradeClients    bool   `yaml:"downgradeClients,omitempty" json:",omitempty" usage:"Accept clients below minClientVersion with all optional protocol features disabled instead of rejecting them"`
 
 	Timeout                        config.Duration `yaml:"timeout,omitempty" json:",omitempty" usage:"The timeout of connections. Supports values like '30s', '5m'"`
 	TimeoutOnUnidirectionalTraffic bool            `yaml:"timeoutOnUnidirectionalTraffic,omitempty" json:",omitempty" usage:"Timeout will happens when traffic is unidirectional"`
+	UDPIdleTimeout                 config.Duration `yaml:"udpIdleTimeout,omitempty" json:",omitempty" usage:"The idle timeout of udp sessions on opened udp ports. Supports values like '30s', '5m'"`
 
 	// internal api service
-	APIAddr          string `yaml:"apiAddr,omitempty" json:",omitempty" usage:"The address to listen on for internal api service. Supports values like: '8080', ':8080' or '0.0.0.0:8080'"`
-	APICertFile      string `yaml:"apiCertFile,omitempty" json:",omitempty" usage:"The path to cert file"`
-	APIKeyFile       string `yaml:"apiKeyFile,omitempty" json:",omitempty" usage:"The path to key file"`
-	APITLSMinVersion string `yaml:"apiTLSVersion,omitempty" json:",omitempty" usage:"The tls min version. Supports values: tls1.1, tls1.2, tls1.3"`
+	APIAddr          string               `yaml:"apiAddr,omitempty" json:",omitempty" usage:"The address to listen on for internal api service. Supports values like: '8080', ':8080' or '0.0.0.0:8080'"`
+	APICertFile      string               `yaml:"apiCertFile,omitempty" json:",omitempty" usage:"The path to cert file"`
+	APIKeyFile       string               `yaml:"apiKeyFile,omitempty" json:",omitempty" usage:"The path to key file"`
+	APITLSMinVersion string               `yaml:"apiTLSVersion,omitempty" json:",omitempty" usage:"The tls min version. Supports values: tls1.1, tls1.2, tls1.3"`
+	APICertFiles     config.Slice[string] `yaml:"apiCertFiles,omitempty" json:",omitempty" usage:"The paths to additional cert files, paired with 'apiKeyFiles' in order"`
+	APIKeyFiles      config.Slice[string] `yaml:"apiKeyFiles,omitempty" json:",omitempty" usage:"The paths to additional key files, paired with 'apiCertFiles' in order"`
+	APICertDir       string               `yaml:"apiCertDir,omitempty" json:",omitempty" usage:"The directory to load certs from for internal api service"`
+
+	MetricsAddr string `yaml:"metricsAddr,omitempty" json:",omitempty" usage:"The address to listen on for Prometheus metrics at '/metrics'. Supports values like: '9100', ':9100' or '127.0.0.1:9100'"`
 
 	STUNAddr     string `yaml:"stunAddr,omitempty" json:",omitempty" usage:"The address to listen on for STUN service. Supports values like: '3478', ':3478' or '0.0.0.0:3478'"`
 	STUNLogLevel string `yaml:"stunLogLevel,omitempty" json:",omitempty" usage:"Log level: trace, debug, info, warn, error, disable"`
 
 	SNIAddr string `yaml:"sniAddr,omitempty" json:",omitempty" usage:"The address to listen on for raw tls proxy. Host comes from Server Name Indication. Supports values like: '443', ':443' or '0.0.0.0:443'"`
 
+	ProxyProtocolTrustedCIDRs config.Slice[string] `yaml:"proxyProtocolTrustedCIDRs,omitempty" json:",omitempty" usage:"The CIDR or IP of load balancers allowed to send PROXY protocol headers, like 10.0.0.0/8"`
+	AddrProxyProtocol         bool                 `yaml:"addrProxyProtocol,omitempty" json:",omitempty" usage:"Accept PROXY protocol v1/v2 headers from trusted sources on 'addr'"`
+	TLSAddrProxyProtocol      bool                 `yaml:"tlsAddrProxyProtocol,omitempty" json:",omitempty" usage:"Accept PROXY protocol v1/v2 headers from trusted sources on 'tlsAddr'"`
+	SNIAddrProxyProtocol      bool                 `yaml:"sniAddrProxyProtocol,omitempty" json:",omitempty" usage:"Accept PROXY protocol v1/v2 headers from trusted sources on 'sniAddr'"`
+	TCPProxyProtocol          bool                 `yaml:"tcpProxyProtocol,omitempty" json:",omitempty" usage:"Accept PROXY protocol v1/v2 headers from trusted sources on tcp ports opened for clients"`
+
 	SentryDSN         string               `yaml:"sentryDSN,omitempty" json:",omitempty" usage:"Sentry DSN to use"`
 	SentryLevel       config.Slice[string] `yaml:"sentryLevel,omitempty" json:",omitempty" usage:"Sentry levels: trace, debug, info, warn, error, fatal, panic (default [\"error\", \"fatal\", \"panic\"])"`
 	SentrySampleRate  float64              `yaml:"sentrySampleRate,omitempty" json:",omitempty" usage:"Sentry sample rate for event submission: [0.0 - 1.0]"`
@@ -92,6 +145,15 @@ type Options struct {
 	LogLevel        string `yaml:"logLevel,omitempty" json:",omitempty" usage:"Log level: trace, debug, info, warn, error, fatal, panic, disable"`
 	Version         bool   `arg:"version" yaml:"-" json:"-" usage:"Show the version of this program"`
 
+	AccessLogFile         string `yaml:"accessLogFile,omitempty" json:",omitempty" usage:"Path to save the access log of visitors of http, https and sni services. The access log is disabled if it is empty"`
+	AccessLogFormat       string `yaml:"accessLogFormat,omitempty" json:",omitempty" usage:"Format of the access log. Supports values: json, clf"`
+	AccessLogFileMaxSize  int64  `yaml:"accessLogFileMaxSize,omitempty" json:",omitempty" usage:"Max size of the access log files"`
+	AccessLogFileMaxCount uint   `yaml:"accessLogFileMaxCount,omitempty" json:",omitempty" usage:"Max count of the access log files"`
+
+	GroupBalance string `yaml:"groupBalance,omitempty" json:",omitempty" usage:"How visitors are balanced across the clients of a service group sharing one host prefix or tcp port. Supports values: round-robin, least-tasks, ip-hash"`
+
+	ErrorPages string `yaml:"errorPages,omitempty" json:",omitempty" usage:"Directory of html templates answered to visitors when the client or the local service is unavailable. Templates are looked up as <host prefix>/<code>.html, <user>/<code>.html and <code>.html, code is 502, 503 or 504"`
+
 	WebAddr     string `arg:"webAddr"  yaml:"webAddr,omitempty" json:"webAddr,omitempty" usage:"The address to listen on for web server"`
 	WebCertFile string `arg:"webCertFile" yaml:"webCertFile,omitempty" json:"-" usage:"The path to cert file for GT-Web server"`
 	WebKeyFile  string `arg:"webKeyFile" yaml:"webKeyFile,omitempty" json:"-" usage:"The path to key file for GT-Web server"`
@@ -100,7 +162,7 @@ type Options struct {
 	Admin       string `arg:"admin" yaml:"admin,omitempty" json:"-" usage:"Admin username use for login in web server"`
 	Password    string `arg:"password" yaml:"password,omitempty" json:"-" usage:"Admin password use for login in web server"`
 
-	Signal string `arg:"s" yaml:"-" json:"-" usage:"Send signal to client processes. Supports values: restart, stop, kill"`
+	Signal string `arg:"s" yaml:"-" json:"-" usage:"Send signal to server processes. Supports values: reload, restart, stop, kill"`
 
 	QuicAddr string `yaml:"quicAddr,omitempty" usage:"The address for quic connection (between GT client and GT server) to listen on. Supports values like: '443', ':443' or '0.0.0.0:443'"`
 	OpenBBR  bool   `yaml:"bbr,omitempty" usage:"Use bbr as congestion control algorithm (through msquic) when GT use QUIC connection. Default algorithm is Cubic (through quic-go)."`
@@ -110,19 +172,33 @@ func DefaultConfig() Config {
 	return Config{
 		ConfigType: "Server",
 		Options: Options{
-			Timeout:          config.Duration{Duration: 90 * time.Second},
-			TLSMinVersion:    "tls1.2",
-			APITLSMinVersion: "tls1.2",
-			LogFileMaxCount:  7,
-			LogFileMaxSize:   512 * 1024 * 1024,
-			LogLevel:         zerolog.InfoLevel.String(),
-			STUNLogLevel:     "warn",
+			Timeout:           config.Duration{Duration: 90 * time.Second},
+			UDPIdleTimeout:    config.Duration{Duration: 60 * time.Second},
+			TLSMinVersion:     "tls1.2",
+			CertWatchInterval: config.Duration{Duration: 10 * time.Second},
+			EdgeAuthSession:   config.Duration{Duration: 24 * time.Hour},
+			ACMEDirectory:     acme.LetsEncryptURL,
+			ACMECacheDir:      "acme",
+			APITLSMinVersion:  "tls1.2",
+			LogFileMaxCount:   7,
+			LogFileMaxSize:    512 * 1024 * 1024,
+			LogLevel:          zerolog.InfoLevel.String(),
+			STUNLogLevel:      "warn",
+
+			AccessLogFormat:       accessLogJSON,
+			GroupBalance:          balanceRoundRobin,
+			AccessLogFileMaxCount: 7,
+			AccessLogFileMaxSize:  512 * 1024 * 1024,
 
 			SentrySampleRate: 1.0,
 			SentryRelease:    predef.Version,
 
 			HTTPMUXHeader: "Host",
 
+			IPFilterWatchInterval: config.Duration{Duration: 10 * time.Second},
+
+			TrafficSaveInterval: config.Duration{Duration: time.Minute},
+
 			Connections:       10,
 			ReconnectTimes:    3,
 			ReconnectDuration: config.Duration{Duration: 5 * time.Minute},
@@ -153,15 +229,49 @@ type tcp struct {
 
 // user 用户权限细节
 type user struct {
-	Secret      string
-	TCPs        []tcp   `yaml:"tcp,omitempty" json:",omitempty"`
-	TCPNumber   *uint16 `yaml:"tcpNumber,omitempty"`
-	Speed       uint32  `yaml:"speed,omitempty" json:",omitempty"`
-	Connections uint32  `yaml:"connections,omitempty" json:",omitempty"`
-	Host        host    `yaml:"host,omitempty" json:",omitempty"`
+	Secret        string
+	TCPs          []tcp     `yaml:"tcp,omitempty" json:",omitempty"`
+	TCPNumber     *uint16   `yaml:"tcpNumber,omitempty"`
+	Speed         uint32    `yaml:"speed,omitempty" json:",omitempty"`
+	UploadSpeed   uint32    `yaml:"uploadSpeed,omitempty" json:",omitempty"`
+	DownloadSpeed uint32    `yaml:"downloadSpeed,omitempty" json:",omitempty"`
+	VisitorSpeed  uint32    `yaml:"visitorSpeed,omitempty" json:",omitempty"`
+	DayQuota      uint64    `yaml:"dayQuota,omitempty" json:",omitempty"`
+	MonthQuota    uint64    `yaml:"monthQuota,omitempty" json:",omitempty"`
+	Connections   uint32    `yaml:"connections,omitempty" json:",omitempty"`
+	Host          host      `yaml:"host,omitempty" json:",omitempty"`
+	Expires       time.Time `yaml:"expires,omitempty" json:",omitempty"`
 
 	temp         bool
+	claimed      bool   // allowAnyClient 模式下认领并保存到用户存储的 id
+	configured   bool   // 配置文件、命令行或 -users 文件中的用户，不能通过 admin API 删除
+	storedKey    []byte // allowAnyClient 模式下通过质询应答认证创建的用户没有 secret，只有 stored key
 	portsManager *portsManager
+	record       *UserRecord // 填充全局的值之前的用户，由 admin API 返回
+}
+
+// expired 判断用户是否已经过期
+func (u user) expired() bool {
+	return !u.Expires.IsZero() && time.Now().After(u.Expires)
+}
+
+// verify 验证客户端提供的认证信息
+func (u user) verify(id string, cred credential) bool {
+	if u.storedKey != nil {
+		return cred.verifyStoredKey(id, u.storedKey)
+	}
+	if isHashedSecret(u.Secret) {
+		if storedKey, ok := parseStoredKey(u.Secret); ok {
+			return cred.verifyStoredKey(id, storedKey)
+		}
+		// bcrypt、argon2id、scrypt 哈希无法验证质询应答，启动时已经要求 -plaintextAuth
+		if cred.challenge() {
+			return false
+		}
+		ok, _ := verifyHashedSecret(u.Secret, cred.secret)
+		return ok
+	}
+	return cred.verify(id, u.Secret)
 }
 
 // users 客户端的权限管理
@@ -188,22 +298,58 @@ func (u *users) mergeUsers(users map[string]*user, ids, secrets []string) error
 	return u.verify()
 }
 
-func (u *users) verify() (err error) {
+// load 合并配置文件、users 文件与命令行中的用户
+func (u *users) load(conf Config) (err error) {
+	err = u.mergeUsers(conf.Users, nil, nil)
+	if err != nil {
+		return
+	}
+	users := make(map[string]*user)
+	err = config.Yaml2Interface(conf.Options.Users, users)
+	if err != nil {
+		return
+	}
+	return u.mergeUsers(users, conf.IDs, conf.Secrets)
+}
+
+// checkSecretHashes 检查所有用户的 secret 哈希能否验证 conf 启用的认证方式
+func (u *users) checkSecretHashes(conf *Config) (err error) {
 	u.Range(func(idValue, userValue interface{}) bool {
-		id := idValue.(string)
-		user := userValue.(user)
-		if len(id) < predef.MinIDSize || len(id) > predef.MaxIDSize {
-			err = fmt.Errorf("invalid id length: '%s'", id)
-		}
+		err = conf.checkSecretHash(idValue.(string), userValue.(user).Secret)
+		return err == nil
+	})
+	return
+}
 
-		if len(user.Secret) < predef.MinSecretSize || len(user.Secret) > predef.MaxSecretSize {
-			err = fmt.Errorf("invalid secret length: '%s'", user.Secret)
+func (u *users) verify() (err error) {
+	u.Range(func(idValue, userValue interface{}) bool {
+		if e := verifyUser(idValue.(string), userValue.(user)); e != nil {
+			err = e
 		}
 		return true
 	})
 	return
 }
 
+// verifyUser 校验用户的 id 与 secret
+func verifyUser(id string, user user) (err error) {
+	if len(id) < predef.MinIDSize || len(id) > predef.MaxIDSize {
+		err = fmt.Errorf("invalid id length: '%s'", id)
+	}
+
+	if user.storedKey != nil && len(user.Secret) == 0 {
+		return
+	}
+	if isHashedSecret(user.Secret) {
+		if e := verifyHash(user.Secret); e != nil {
+			err = fmt.Errorf("invalid secret hash of id '%s': %w", id, e)
+		}
+	} else if len(user.Secret) < predef.MinSecretSize || len(user.Secret) > predef.MaxSecretSize {
+		err = fmt.Errorf("invalid secret length: '%s'", user.Secret)
+	}
+	return
+}
+
 func (u *users) empty() (empty bool) {
 	empty = true
 	u.Range(func(key, value interface{}) bool {
@@ -213,7 +359,7 @@ func (u *users) empty() (empty bool) {
 	return
 }
 
-func (u *users) auth(id string, secret string) (result user, err error) {
+func (u *users) auth(id string, cred credential) (result user, err error) {
 	value, ok := u.Load(id)
 	if !ok {
 		err = ErrInvalidUser
@@ -224,8 +370,12 @@ func (u *users) auth(id string, secret string) (result user, err error) {
 		err = ErrInvalidUser
 		return
 	}
-	if result.Secret != secret {
+	if !result.verify(id, cred) {
 		err = ErrInvalidUser
+		return
+	}
+	if result.expired() {
+		err = ErrUserExpired
 	}
 	return
 }
@@ -241,5 +391,11 @@ type host struct {
 	RegexStr *config.Slice[string] `yaml:"regex,omitempty" json:",omitempty"`
 	Regex    *[]*regexp.Regexp     `yaml:"-" json:"-"`
 	WithID   *bool                 `yaml:"withID,omitempty" json:",omitempty"`
+	Domains  *config.Slice[string] `yaml:"domains,omitempty" json:",omitempty"`
 	Prefixes map[string]struct{}   `yaml:"-" json:"-"`
+
+	// Auth 是 host 前缀（访问者看到的 host 前缀，包括 withID 添加的 id）或域名的访问策略，"*" 作用于所有 http 服务。
+	// 服务端配置的策略优先于客户端声明的策略
+	Auth            map[string]*edgeAuth `yaml:"auth,omitempty" json:",omitempty"`
+	AllowClientAuth *bool                `yaml:"allowClientAuth,omitempty" json:",omitempty"`
 }
@@ -17,17 +17,18 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"errors"
 	"io"
 	"net"
+	"net/http"
 	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
-	"unsafe"
 
 	"github.com/emirpasic/gods/trees/btree"
 	"github.com/emirpasic/gods/utils"
@@ -48,12 +49,27 @@ var (
 
 type conn struct {
 	connection.Connection
+	id             uint64 // 连接的递增 id，即日志中的 serverConn 字段
 	server         *Server
 	tasks          map[uint32]*conn
 	tasksRWMtx     sync.RWMutex
 	serviceIndex   uint16 // 0 表示客户端只有一个 Local，使用 predef.Data，兼容老客户端；大于 0 使用 predef.ServicesData
 	ids            hostPrefixOptions
 	configChecksum [32]byte
+	nonce          []byte                    // tunnel 质询应答认证使用的随机数，nil 表示明文认证
+	version        atomic.Uint32             // tunnel 协商的协议版本
+	features       atomic.Uint32             // tunnel 协商的协议特性
+	window         *connection.SendWindow    // task 向对端发送数据的窗口
+	recvBuffer     *connection.ReceiveBuffer // task 从 tunnel 收到但还未写出的数据
+	uploadLimit    *limiter                  // task 上行（客户端发往访问者）限速
+	downloadLimit  *limiter                  // task 下行（访问者发往客户端）限速
+	service        string                    // task 统计流量使用的服务名称
+	metrics        *taskMetrics              // task 使用的指标
+	access         *accessEntry              // 访问者连接的访问记录，访问日志未启用时为 nil
+	errorPage      *errorPage                // task 没有收到客户端的响应时如何告知访问者
+	responded      atomic.Bool               // task 已经收到客户端的响应或已经返回了错误页面
+	draining       atomic.Bool               // tunnel 不再分配新的 task，已有的 task 完成后关闭
+	secure         bool                      // 连接经过 TLS 或 QUIC 加密
 }
 
 func newConn(c net.Conn, s *Server) *conn {
@@ -62,17 +78,24 @@ func newConn(c net.Conn, s *Server) *conn {
 			Conn:         c,
 			WriteTimeout: s.config.Timeout.Duration,
 		},
+		id:     s.connIDSeed.Add(1),
 		server: s,
 		tasks:  make(map[uint32]*conn, 100),
 	}
+	nc.OnErrorSignal = s.metrics.errorSignal
 	nc.Logger = s.Logger.With().
-		Str("serverConn", strconv.FormatUint(uint64(uintptr(unsafe.Pointer(nc))), 16)).
+		Str("serverConn", nc.name()).
 		Str("ip", c.RemoteAddr().String()).
 		Logger()
 	nc.Logger.Info().Msg("accepted")
 	return nc
 }
 
+// name 返回日志中 serverConn 的值，控制 API 使用它指定 tunnel
+func (c *conn) name() string {
+	return strconv.FormatUint(c.id, 10)
+}
+
 func (c *conn) addTask(taskID uint32, conn *conn) {
 	c.tasksRWMtx.Lock()
 	c.tasks[taskID] = conn
@@ -125,7 +148,8 @@ func (c *conn) handle(handleFunc func()) {
 	}
 	if version[0] == predef.MagicNumber {
 		switch version[1] {
-		case 0x01:
+		case 0x01, 0x03:
+			challenge := version[1] == 0x03
 			_, err = reader.Discard(2)
 			if err != nil {
 				c.Logger.Warn().Err(err).Msg("failed to discard version field")
@@ -156,6 +180,14 @@ func (c *conn) handle(handleFunc func()) {
 				return
 			}
 
+			if challenge {
+				err = c.sendChallenge()
+				if err != nil {
+					c.Logger.Warn().Err(err).Msg("failed to send challenge")
+					return
+				}
+			}
+
 			// 不能将 reconnectTimes 传参，多线程环境下这个值应该实时获取
 			c.handleTunnelLoop(remoteIP)
 			return
@@ -169,6 +201,10 @@ func (c *conn) handle(handleFunc func()) {
 			return
 		}
 	}
+	if !c.server.visitorAllowed(c.RemoteAddr()) {
+		c.Logger.Info().Msg("visitor ip is not allowed")
+		return
+	}
 	handleFunc()
 }
 
@@ -195,6 +231,10 @@ func (c *conn) handleTCP(handleFunc func()) {
 			return
 		}
 	}
+	if !c.server.visitorAllowed(c.RemoteAddr()) {
+		c.Logger.Info().Msg("visitor ip is not allowed")
+		return
+	}
 	handleFunc()
 }
 
@@ -230,7 +270,9 @@ func (c *conn) handleProbe(r *bufio.Reader) {
 func (c *conn) handleSNI() {
 	var err error
 	var host []byte
+	c.access = c.server.accessLog.newEntry(c.RemoteAddr())
 	defer func() {
+		c.server.accessLog.logConn(c.access)
 		if err != nil {
 			c.Logger.Error().Bytes("host", host).Err(err).Msg("handleSNI")
 		}
@@ -249,25 +291,34 @@ func (c *conn) handleSNI() {
 		err = ErrInvalidHTTPProtocol
 		return
 	}
-	id, err := parseIDFromHost(host)
+	c.access.setHost(string(host))
+	table, name, err := c.server.resolveHost(host, nil, true)
 	if err != nil {
 		return
 	}
-	if len(id) < predef.MinIDSize {
-		err = ErrInvalidID
-		return
+	route, ok := table.lookup(name, "")
+	if ok {
+		route, ok = route.balance(c.RemoteAddr())
 	}
-	for i := 0; i < 3; i++ {
-		client, ok := c.server.getTLSHostPrefix(string(id))
-		if ok {
-			c.serviceIndex = client.serviceIndex
-			err = client.process(c)
-			break
-		} else {
-			err = ErrIDNotFound
-			c.Logger.Info().Err(err).Bytes("id", id).Int("times", i).Msg("will try again later")
-			time.Sleep(time.Second * 1)
+	if ok {
+		if !c.server.serviceVisitorAllowed(c.RemoteAddr(), route.client, route.serviceIndex) {
+			c.Logger.Info().Bytes("host", host).Msg("visitor ip is not allowed")
+			return
 		}
+		c.serviceIndex = route.serviceIndex
+		c.access.setRoute(route.clientWithServiceIndex)
+		c.errorPage = &errorPage{tls: true}
+		err = route.process(c)
+	} else {
+		// 客户端不在线时立即回应访问者，不再等待客户端重连
+		err = ErrIDNotFound
+		c.Logger.Info().Err(err).Str("id", name).Msg("client is offline")
+	}
+	if errors.Is(err, ErrIDNotFound) {
+		n, _ := c.Write(tlsAlert(tlsAlertUnrecognizedName))
+		c.access.out(n)
+	} else if code, msg, ok := offlineError(err); ok {
+		c.writeErrorPage(code, msg)
 	}
 	return
 }
@@ -276,7 +327,9 @@ func (c *conn) handleHTTP() {
 	var err error
 	var host []byte
 	var id []byte
+	c.access = c.server.accessLog.newEntry(c.RemoteAddr())
 	defer func() {
+		c.server.accessLog.logConn(c.access)
 		if err != nil {
 			c.Logger.Error().Bytes("host", host).Bytes("id", id).Err(err).Msg("handleHTTP")
 		}
@@ -286,6 +339,21 @@ func (c *conn) handleHTTP() {
 			}
 		}
 	}()
+	if c.server.acme != nil && !isTLSConn(c.Conn) {
+		var challenge bool
+		challenge, err = isACMEChallenge(c.Reader)
+		if err != nil {
+			return
+		}
+		if challenge {
+			err = c.serveACMEChallenge()
+			return
+		}
+	}
+	if c.server.config.HTTPRouting {
+		c.handleHTTPRouting()
+		return
+	}
 	if c.server.config.HTTPMUXHeader == "Host" {
 		host, err = peekHost(c.Reader)
 		if err != nil {
@@ -295,31 +363,47 @@ func (c *conn) handleHTTP() {
 			err = ErrInvalidHTTPProtocol
 			return
 		}
-		id, err = parseIDFromHost(host)
-		if err != nil {
-			return
-		}
+		c.access.setHost(string(host))
 	} else {
 		id, err = peekHeader(c.Reader, c.server.config.HTTPMUXHeader+":")
 		if err != nil {
 			return
 		}
+		c.access.setHost(string(id))
 	}
-	if len(id) < predef.MinIDSize {
-		err = ErrInvalidID
+	table, name, err := c.server.resolveHost(host, id, false)
+	if err != nil {
 		return
 	}
-	for i := 0; i < 3; i++ {
-		client, ok := c.server.getHostPrefix(string(id))
-		if ok {
-			c.serviceIndex = client.serviceIndex
-			err = client.process(c)
-			break
-		} else {
-			err = ErrIDNotFound
-			c.Logger.Info().Err(err).Bytes("id", id).Int("times", i).Msg("will try again later")
-			time.Sleep(time.Second * 1)
+	if table.hasPaths(name) || table.hasAuth(name) {
+		// 按路径路由或需要验证访问者时，连接上的每个请求都可能发往不同的服务
+		c.handleHTTPRouting()
+		return
+	}
+	route, ok := table.lookup(name, "")
+	if ok {
+		route, ok = route.balance(c.RemoteAddr())
+	}
+	if ok {
+		if !c.server.serviceVisitorAllowed(c.RemoteAddr(), route.client, route.serviceIndex) {
+			c.Logger.Info().Bytes("host", host).Msg("visitor ip is not allowed")
+			c.writeForbidden()
+			return
 		}
+		c.serviceIndex = route.serviceIndex
+		c.access.setRoute(route.clientWithServiceIndex)
+		c.errorPage = &errorPage{host: name, user: route.client.id}
+		err = route.process(c)
+	} else {
+		// 客户端不在线时立即回应访问者，不再等待客户端重连
+		err = ErrIDNotFound
+		c.Logger.Info().Err(err).Str("id", name).Msg("client is offline")
+	}
+	if code, msg, ok := offlineError(err); ok {
+		if c.errorPage == nil {
+			c.errorPage = &errorPage{host: name}
+		}
+		c.writeErrorPage(code, msg)
 	}
 	return
 }
@@ -347,6 +431,21 @@ func (c *conn) handleTunnelLoop(remoteIP string) {
 	return
 }
 
+// sendChallenge 向客户端发送质询应答认证的随机数
+func (c *conn) sendChallenge() (err error) {
+	c.nonce = make([]byte, connection.NonceSize)
+	_, err = rand.Read(c.nonce)
+	if err != nil {
+		return
+	}
+	buf := make([]byte, 2+connection.NonceSize)
+	buf[0] = predef.MagicNumber
+	buf[1] = 0x03
+	copy(buf[2:], c.nonce)
+	_, err = c.Write(buf)
+	return
+}
+
 func (c *conn) handleTunnel(remoteIP string, r bool) (reload bool, cli *client) {
 	reader := c.Reader
 
@@ -387,18 +486,41 @@ func (c *conn) handleTunnel(remoteIP string, r bool) (reload bool, cli *client)
 		c.Logger.Error().Err(err).Msg("failed to read secret")
 		return
 	}
-	secretStr := string(secret)
+	cred := credential{secret: string(secret)}
+	if c.nonce != nil {
+		proof, storedKey := connection.ParseEnrollment([]byte(cred.secret))
+		cred = credential{nonce: c.nonce, proof: proof, storedKey: storedKey}
+		if !c.secure {
+			// 明文连接上的 stored key 可能已经被截获，不能用于登记新的 id
+			cred.storedKey = nil
+		}
+	}
 	_, err = reader.Discard(int(secretLen))
 	if err != nil {
 		c.Logger.Error().Err(err).Msg("failed to discard secret")
 		return
 	}
+	if c.nonce == nil && !c.server.config.PlaintextAuth {
+		e := c.SendErrorSignalInvalidIDAndSecret()
+		c.Logger.Info().Str("id", idStr).AnErr("respErr", e).Msg("plaintext authentication is disabled")
+		return
+	}
+	if c.server.banned(idStr, c.RemoteAddr()) {
+		e := c.SendErrorSignalBanned()
+		c.Logger.Info().Str("id", idStr).AnErr("respErr", e).Msg("client is banned")
+		return
+	}
+	if !c.server.clientAllowed(idStr, c.RemoteAddr()) {
+		e := c.SendErrorSignalIPNotAllowed()
+		c.Logger.Info().Str("id", idStr).AnErr("respErr", e).Msg("client ip is not allowed")
+		return
+	}
 
 	var options options
 	var u user
 	if c.server.authUser != nil {
 		// 验证 id secret
-		u, err = c.server.authUser(idStr, secretStr)
+		u, err = c.server.authUser(idStr, cred)
 		if err != nil {
 			// 使用局部锁而不是全局锁可以明显提高并发性能，但少数情况下会降低限制效果
 			c.server.reconnectRWMutex.Lock()
@@ -428,22 +550,26 @@ func (c *conn) handleTunnel(remoteIP string, r bool) (reload bool, cli *client)
 			return
 		}
 	} else {
-		u = user{
-			TCPNumber:   &c.server.config.TCPNumber,
-			Speed:       c.server.config.Speed,
-			Connections: c.server.config.Connections,
-			Host:        c.server.config.Host,
-		}
+		u = *c.server.defaultUser.Load()
 		options, err = c.parseOptions(reader, idStr, u)
 		if err != nil {
 			c.Logger.Info().Err(err).Msg("failed to parse options")
 			return
 		}
 		prefixes := make([]string, 0, len(options.ids))
-		for s := range options.ids {
-			prefixes = append(prefixes, s)
+		seen := make(map[string]struct{}, len(options.ids))
+		for key, o := range options.ids {
+			if o.domain {
+				continue
+			}
+			hostPrefix, _ := splitRouteKey(key)
+			if _, ok := seen[hostPrefix]; ok {
+				continue
+			}
+			seen[hostPrefix] = struct{}{}
+			prefixes = append(prefixes, hostPrefix)
 		}
-		u, err = c.server.authUserWithAPI(idStr, secretStr, prefixes)
+		u, err = c.server.authUserWithAPI(idStr, cred, prefixes)
 		if err != nil {
 			// 使用局部锁而不是全局锁可以明显提高并发性能，但少数情况下会降低限制效果
 			c.server.reconnectRWMutex.Lock()
@@ -467,15 +593,19 @@ func (c *conn) handleTunnel(remoteIP string, r bool) (reload bool, cli *client)
 			return
 		}
 		if len(u.Host.Prefixes) > 0 {
-			for id := range options.ids {
-				if _, ok := u.Host.Prefixes[id]; !ok {
+			for id, o := range options.ids {
+				if o.domain {
+					continue
+				}
+				hostPrefix, _ := splitRouteKey(id)
+				if _, ok := u.Host.Prefixes[hostPrefix]; !ok {
 					c.Logger.Info().Str("id", idStr).Str("prefix", id).Msg("prefix not exists on platform")
 					delete(options.ids, id)
 				}
 			}
 		} else {
-			for id := range options.ids {
-				if id != idStr {
+			for id, o := range options.ids {
+				if hostPrefix, _ := splitRouteKey(id); !o.domain && hostPrefix != idStr {
 					c.Logger.Info().Str("id", idStr).Str("prefix", id).Msg("prefix not exists on platform")
 					delete(options.ids, id)
 				}
@@ -483,7 +613,42 @@ func (c *conn) handleTunnel(remoteIP string, r bool) (reload bool, cli *client)
 		}
 	}
 
-	c.Logger.Info().Hex("checksum", options.configChecksum[:]).Bool("reload", r).Msg("handling tunnel")
+	// 协商协议版本与特性
+	features := options.features & predef.Features
+	if options.version < c.server.config.MinClientVersion {
+		if !c.server.config.DowngradeClients {
+			e := c.SendErrorSignalVersionTooLow(c.server.config.MinClientVersion)
+			c.Logger.Info().
+				Uint16("version", options.version).
+				Uint16("minVersion", c.server.config.MinClientVersion).
+				AnErr("respErr", e).
+				Msg("client protocol version too low")
+			return
+		}
+		features = 0
+	}
+	if options.version > 1 {
+		err = c.SendInfoCapabilities(predef.ProtocolVersion, features)
+		if err != nil {
+			c.Logger.Error().Err(err).Msg("failed to send capabilities info signal")
+			return
+		}
+	}
+	c.version.Store(uint32(options.version))
+	c.features.Store(features)
+
+	c.Logger.Info().
+		Hex("checksum", options.configChecksum[:]).
+		Bool("reload", r).
+		Uint16("version", options.version).
+		Strs("features", predef.FeatureNames(features)).
+		Msg("handling tunnel")
+
+	if !r && c.server.traffic.user(idStr).exceeded(u.DayQuota, u.MonthQuota) {
+		e := c.SendErrorSignalQuotaExceeded()
+		c.Logger.Info().Str("id", idStr).AnErr("respErr", e).Msg("traffic quota exceeded")
+		return
+	}
 
 	// 获取或创建 client
 	var ok bool
@@ -523,15 +688,24 @@ func (c *conn) handleTunnel(remoteIP string, r bool) (reload bool, cli *client)
 }
 
 func (c *conn) processHostPrefixes(options options, cli *client) (err error) {
-	rollbackIds := make(map[string]bool)
+	rollbackIds := make(map[string]hostPrefixOption)
 	// add host prefixes
 	for id, o := range options.ids {
-		v, ok := c.server.getOrCreateHostPrefix(id, o.tls, func() interface{} {
-			return clientWithServiceIndex{client: cli, serviceIndex: o.serviceIndex}
+		v, ok := c.server.getOrCreateHostPrefix(id, o, func() hostRoute {
+			return o.route(cli)
 		})
 		if ok {
-			if v.client == cli {
+			if v.group == nil && v.client == cli {
 				continue
+			} else if v.group != nil && v.group.accepts(o.group) {
+				v.group.join(clientWithServiceIndex{client: cli, serviceIndex: o.serviceIndex}, o.group.standby)
+				c.Logger.Info().
+					Str("id", cli.id).
+					Str("prefix", id).
+					Str("group", o.group.name).
+					Bool("standby", o.group.standby).
+					Int("members", v.group.size()).
+					Msg("joined group of host prefix")
 			} else {
 				c.Logger.Error().
 					Str("id", cli.id).
@@ -539,13 +713,13 @@ func (c *conn) processHostPrefixes(options options, cli *client) (err error) {
 					Bool("tls", o.tls).
 					Err(connection.ErrHostConflict).
 					Msg("failed to add host prefix")
-				for id, tls := range rollbackIds {
-					c.server.removeHostPrefix(id, tls)
+				for id, o := range rollbackIds {
+					c.server.removeHostPrefix(id, o, cli)
 					c.Logger.Info().
 						Hex("checksum", options.configChecksum[:]).
 						Str("id", cli.id).
 						Str("prefix", id).
-						Bool("tls", tls).
+						Bool("tls", o.tls).
 						Msg("rollback added associated host prefix because host prefixes conflict")
 				}
 				err = c.SendErrorSignalHostConflict()
@@ -561,21 +735,21 @@ func (c *conn) processHostPrefixes(options options, cli *client) (err error) {
 			Str("prefix", id).
 			Str("newServiceIndex", o.String()).
 			Msg("added associated host prefix")
-		rollbackIds[id] = o.tls
+		rollbackIds[id] = o
 	}
 	// remove host prefixes that are no longer used
 	for id, oo := range c.ids {
 		o, ok := options.ids[id]
-		if !ok || oo.tls != o.tls {
-			c.server.removeHostPrefix(id, oo.tls)
+		if !ok || !oo.sameRoutes(o) {
+			c.server.removeHostPrefix(id, oo, cli)
 			c.Logger.Info().
 				Str("id", cli.id).
 				Hex("last checksum", c.configChecksum[:]).
 				Hex("checksum", options.configChecksum[:]).
 				Str("oldServiceIndex", oo.String()).
 				Str("prefix", id).Msg("removed associated host prefix no longer needed")
-		} else if oo.serviceIndex != o.serviceIndex {
-			c.server.storeHostPrefix(id, oo.tls, clientWithServiceIndex{client: cli, serviceIndex: o.serviceIndex})
+		} else if oo != o {
+			c.server.storeHostPrefix(id, o, o.route(cli))
 			c.Logger.Info().
 				Str("id", cli.id).
 				Hex("last checksum", c.configChecksum[:]).
@@ -597,24 +771,70 @@ func (c *conn) processHostPrefixes(options options, cli *client) (err error) {
 type options struct {
 	ids            hostPrefixOptions
 	ports          map[uint16]openTCPOption
+	udpPorts       map[uint16]openUDPOption
+	ipFilters      map[uint16]*ipFilter // 客户端为服务声明的过滤器，key: serviceIndex
+	serviceSpeeds  map[uint16]speed     // 客户端为服务声明的限速，key: serviceIndex
 	configChecksum [32]byte
+	version        uint16
+	features       predef.Feature
 }
 
 type openTCPOption struct {
 	port   uint16
 	random bool
+	group  *groupOption // 与其它客户端共享端口的服务组
 }
 
+type openUDPOption openTCPOption
+
 type hostPrefixOption struct {
 	serviceIndex uint16
 	tls          bool
+	strip        bool
+	domain       bool         // 完整域名或通配符域名
+	auth         *edgeAuth    // 访问策略
+	group        *groupOption // 与其它客户端共享 host 前缀的服务组
 }
 
 func (h *hostPrefixOption) String() string {
+	s := strconv.FormatUint(uint64(h.serviceIndex), 10)
 	if h.tls {
-		return strconv.FormatUint(uint64(h.serviceIndex), 10) + "tls"
+		s += "tls"
+	}
+	if h.strip {
+		s += "strip"
+	}
+	if h.domain {
+		s += "domain"
+	}
+	if h.auth != nil {
+		s += "auth"
+	}
+	if h.group != nil {
+		s += "group"
+	}
+	return s
+}
+
+// sameRoutes 判断两个 option 是否在同一个路由表中
+func (h *hostPrefixOption) sameRoutes(o hostPrefixOption) bool {
+	return h.tls == o.tls && h.domain == o.domain
+}
+
+func (h *hostPrefixOption) route(cli *client) hostRoute {
+	m := clientWithServiceIndex{client: cli, serviceIndex: h.serviceIndex}
+	if h.group != nil {
+		return hostRoute{
+			strip: h.strip,
+			auth:  h.auth,
+			group: newServiceGroup(h.group, m),
+		}
+	}
+	return hostRoute{
+		clientWithServiceIndex: m,
+		strip:                  h.strip,
+		auth:                   h.auth,
 	}
-	return strconv.FormatUint(uint64(h.serviceIndex), 10)
 }
 
 type hostPrefixOptions map[string]hostPrefixOption
@@ -635,8 +855,14 @@ func (c *conn) parseOptions(reader *bufio.Reader, idStr string, u user) (options
 	var serviceIndex uint16
 	ids := make(hostPrefixOptions)
 	ports := make(map[uint16]openTCPOption)
+	udpPorts := make(map[uint16]openUDPOption)
+	ipFilters := make(map[uint16]*ipFilter)
+	serviceSpeeds := make(map[uint16]speed)
+	groups := make(map[uint16]*groupOption)
 	num := *u.Host.Number
 	tcpNum := *u.TCPNumber
+	lastKey := ""       // 前一个 http 服务的 key，EdgeAuth option 作用于该服务
+	options.version = 1 // 没有发送 Capabilities option 的老客户端
 	for leftOptions := 1; leftOptions > 0; leftOptions-- {
 		if optionsCount+1 > c.server.config.MaxHandShakeOptions {
 			c.Logger.Error().
@@ -683,9 +909,10 @@ func (c *conn) parseOptions(reader *bufio.Reader, idStr string, u user) (options
 				Str("id", idStr).
 				Msg("adding associated host prefix")
 			ids[idStr] = hostPrefixOption{serviceIndex: serviceIndex, tls: tls}
+			lastKey = httpKey(idStr, tls)
 			serviceIndex++
 		case bytes.Equal(option, predef.OpenTCPPort):
-			if tcpNum != 0 && uint16(len(ports))+1 > tcpNum {
+			if tcpNum != 0 && uint16(len(ports)+len(udpPorts))+1 > tcpNum {
 				err = connection.ErrTCPNumberLimited
 				e := c.SendErrorSignalTCPNumberLimited()
 				c.Logger.Error().Err(err).AnErr("SendError", e).Msg("client has reached the max number of tcp ports")
@@ -711,10 +938,56 @@ func (c *conn) parseOptions(reader *bufio.Reader, idStr string, u user) (options
 			}
 
 			ports[serviceIndex] = openTCPOption{port: tcpPort, random: random != 0}
+			lastKey = ""
+			serviceIndex++
+		case bytes.Equal(option, predef.OpenUDPPort):
+			// udp ports share the tcp ports number limit and ranges
+			if tcpNum != 0 && uint16(len(ports)+len(udpPorts))+1 > tcpNum {
+				err = connection.ErrTCPNumberLimited
+				e := c.SendErrorSignalTCPNumberLimited()
+				c.Logger.Error().Err(err).AnErr("SendError", e).Msg("client has reached the max number of udp ports")
+				return options, err
+			}
+			var random byte
+			random, err = reader.ReadByte()
+			if err != nil {
+				c.Logger.Error().Err(err).Msg("failed to read random byte")
+				return options, err
+			}
+			var peekBytes []byte
+			peekBytes, err = reader.Peek(2)
+			if err != nil {
+				c.Logger.Error().Err(err).Msg("failed to peek udp port range")
+				return options, err
+			}
+			udpPort := uint16(peekBytes[1]) | uint16(peekBytes[0])<<8
+			_, err = reader.Discard(2)
+			if err != nil {
+				c.Logger.Error().Err(err).Msg("failed to discard udp port range")
+				return options, err
+			}
+
+			udpPorts[serviceIndex] = openUDPOption{port: udpPort, random: random != 0}
+			lastKey = ""
 			serviceIndex++
 		case bytes.Equal(option, predef.OptionAndNextOption):
 			leftOptions += 2
 			continue // 跳过 serverIndex++
+		case bytes.Equal(option, predef.Capabilities):
+			var peekBytes []byte
+			peekBytes, err = reader.Peek(6)
+			if err != nil {
+				c.Logger.Error().Err(err).Msg("failed to peek capabilities")
+				return options, err
+			}
+			options.version = uint16(peekBytes[1]) | uint16(peekBytes[0])<<8
+			options.features = uint32(peekBytes[5]) | uint32(peekBytes[4])<<8 | uint32(peekBytes[3])<<16 | uint32(peekBytes[2])<<24
+			_, err = reader.Discard(6)
+			if err != nil {
+				c.Logger.Error().Err(err).Msg("failed to discard capabilities")
+				return options, err
+			}
+			continue // 跳过 serverIndex++
 		case bytes.Equal(option, predef.OpenTLSHost):
 			tls = true
 			fallthrough
@@ -725,73 +998,353 @@ func (c *conn) parseOptions(reader *bufio.Reader, idStr string, u user) (options
 				c.Logger.Error().Err(err).AnErr("SendError", e).Msg("client has reached the max number of host prefixes")
 				return options, err
 			}
-			var hostPrefixLen byte
-			hostPrefixLen, err = reader.ReadByte()
+			var hostPrefixStr string
+			hostPrefixStr, err = c.readHostPrefix(reader, idStr, u, false)
 			if err != nil {
-				c.Logger.Error().Err(err).Msg("failed to read host prefix length")
 				return options, err
 			}
-			hostPrefix, err := reader.Peek(int(hostPrefixLen))
-			if err != nil {
-				c.Logger.Error().Err(err).Msg("failed to peek host prefix")
+			c.Logger.Info().
+				Str("prefix", hostPrefixStr).
+				Uint16("serviceIndex", serviceIndex).
+				Str("id", idStr).
+				Msg("adding associated host prefix")
+			ids[hostPrefixStr] = hostPrefixOption{serviceIndex: serviceIndex, tls: tls}
+			lastKey = httpKey(hostPrefixStr, tls)
+			serviceIndex++
+		case bytes.Equal(option, predef.OpenHostPath):
+			if num != 0 && uint32(len(ids))+1 > num {
+				err = connection.ErrHostNumberLimited
+				e := c.SendErrorSignalHostNumberLimited()
+				c.Logger.Error().Err(err).AnErr("SendError", e).Msg("client has reached the max number of host prefixes")
 				return options, err
 			}
-			hostPrefixStr := string(hostPrefix)
-			_, err = reader.Discard(int(hostPrefixLen))
+			var hostPrefixStr string
+			hostPrefixStr, err = c.readHostPrefix(reader, idStr, u, true)
 			if err != nil {
-				c.Logger.Error().Err(err).Msg("failed to discard host prefix")
 				return options, err
 			}
-
-			if len(*u.Host.Regex) > 0 {
-				match := false
-				for _, r := range *u.Host.Regex {
-					if r.MatchString(hostPrefixStr) {
-						match = true
-						break
-					}
-				}
-				if !match {
-					c.Logger.Info().Err(err).
-						AnErr("sendSignalError", c.SendErrorSignalHostRegexMismatch()).
-						Msg("invalid host prefixes")
-					return options, connection.ErrHostRegexMismatch
-				}
+			var pathStr string
+			var strip bool
+			pathStr, strip, err = c.readRoutePath(reader)
+			if err != nil {
+				return options, err
 			}
-			if *u.Host.WithID {
-				hostPrefixStr = idStr + "-" + hostPrefixStr
+			key := routeKey(hostPrefixStr, pathStr)
+			if _, ok := ids[key]; ok {
+				c.Logger.Error().Str("prefix", hostPrefixStr).Str("path", pathStr).Msg("duplicated route path")
+				return options, ErrInvalidRoutePath
 			}
 			c.Logger.Info().
 				Str("prefix", hostPrefixStr).
+				Str("path", pathStr).
+				Bool("strip", strip).
 				Uint16("serviceIndex", serviceIndex).
 				Str("id", idStr).
 				Msg("adding associated host prefix")
-			ids[hostPrefixStr] = hostPrefixOption{serviceIndex: serviceIndex, tls: tls}
+			ids[key] = hostPrefixOption{serviceIndex: serviceIndex, strip: strip}
+			lastKey = key
+			serviceIndex++
+		case bytes.Equal(option, predef.OpenTLSDomain):
+			tls = true
+			fallthrough
+		case bytes.Equal(option, predef.OpenDomain):
+			if num != 0 && uint32(len(ids))+1 > num {
+				err = connection.ErrHostNumberLimited
+				e := c.SendErrorSignalHostNumberLimited()
+				c.Logger.Error().Err(err).AnErr("SendError", e).Msg("client has reached the max number of host prefixes")
+				return options, err
+			}
+			var domain string
+			domain, err = c.readDomain(reader, u)
+			if err != nil {
+				return options, err
+			}
+			var pathStr string
+			var strip bool
+			if !tls {
+				pathStr, strip, err = c.readRoutePath(reader)
+				if err != nil {
+					return options, err
+				}
+			}
+			key := routeKey(domain, pathStr)
+			if _, ok := ids[key]; ok {
+				c.Logger.Error().Str("domain", domain).Str("path", pathStr).Msg("duplicated domain")
+				return options, ErrInvalidDomain
+			}
+			c.Logger.Info().
+				Str("domain", domain).
+				Str("path", pathStr).
+				Bool("strip", strip).
+				Uint16("serviceIndex", serviceIndex).
+				Str("id", idStr).
+				Msg("adding associated domain")
+			ids[key] = hostPrefixOption{serviceIndex: serviceIndex, tls: tls, strip: strip, domain: true}
+			lastKey = httpKey(key, tls)
 			serviceIndex++
+		case bytes.Equal(option, predef.EdgeAuth):
+			var a *edgeAuth
+			a, err = c.readEdgeAuth(reader)
+			if err != nil {
+				return options, err
+			}
+			if len(lastKey) == 0 {
+				c.Logger.Error().Msg("edge auth option does not follow a http service")
+				return options, ErrInvalidEdgeAuth
+			}
+			if u.Host.AllowClientAuth == nil || !*u.Host.AllowClientAuth {
+				err = connection.ErrEdgeAuthNotAllowed
+				c.Logger.Info().Err(err).
+					Str("prefix", lastKey).
+					AnErr("sendSignalError", c.SendErrorSignalEdgeAuthNotAllowed()).
+					Msg("edge auth is not allowed")
+				return options, err
+			}
+			o := ids[lastKey]
+			o.auth = a
+			ids[lastKey] = o
+			continue // 跳过 serverIndex++
+		case bytes.Equal(option, predef.IPFilter):
+			var f *ipFilter
+			f, err = c.readIPFilter(reader)
+			if err != nil {
+				return options, err
+			}
+			if serviceIndex == 0 {
+				c.Logger.Error().Msg("ip filter option does not follow a service")
+				return options, ErrInvalidIPFilter
+			}
+			ipFilters[serviceIndex-1] = f
+			continue // 跳过 serverIndex++
+		case bytes.Equal(option, predef.SpeedLimit):
+			var sp speed
+			sp, err = c.readSpeedLimit(reader)
+			if err != nil {
+				return options, err
+			}
+			if serviceIndex == 0 {
+				c.Logger.Error().Msg("speed limit option does not follow a service")
+				return options, ErrInvalidSpeedLimit
+			}
+			serviceSpeeds[serviceIndex-1] = sp
+			continue // 跳过 serverIndex++
+		case bytes.Equal(option, predef.Group):
+			var g *groupOption
+			g, err = c.readGroup(reader, idStr)
+			if err != nil {
+				return options, err
+			}
+			if serviceIndex == 0 {
+				c.Logger.Error().Msg("group option does not follow a service")
+				return options, ErrInvalidGroup
+			}
+			groups[serviceIndex-1] = g
+			continue // 跳过 serverIndex++
+		case bytes.Equal(option, predef.Standby):
+			if serviceIndex == 0 || groups[serviceIndex-1] == nil {
+				c.Logger.Error().Msg("standby option does not follow a group option")
+				return options, ErrInvalidGroup
+			}
+			groups[serviceIndex-1].standby = true
+			continue // 跳过 serverIndex++
 		default:
 			c.Logger.Error().Msgf("invalid option: %v", optionFirst)
 			return options, errors.New("invalid option")
 		}
 	}
-	sum := calChecksum(ids, ports)
+	// 服务组作用于 host 前缀与指定的 tcp 端口
+	for si, g := range groups {
+		if o, ok := ports[si]; ok && o.port != 0 {
+			o.group = g
+			ports[si] = o
+			continue
+		}
+		found := false
+		for key, o := range ids {
+			if o.serviceIndex == si {
+				o.group = g
+				ids[key] = o
+				found = true
+				break
+			}
+		}
+		if !found {
+			c.Logger.Error().Uint16("serviceIndex", si).Msg("group option is only supported by http, https and tcp services with a specified port")
+			return options, ErrInvalidGroup
+		}
+	}
+	// 服务端配置的访问策略优先于客户端声明的策略
+	for key, o := range ids {
+		if o.tls {
+			continue
+		}
+		name, _ := splitRouteKey(key)
+		if a := u.Host.edgeAuthPolicy(name); a != nil {
+			o.auth = a
+			ids[key] = o
+		}
+	}
+	sum := calChecksum(ids, ports, udpPorts, ipFilters, serviceSpeeds)
 	options.ids = ids
 	options.ports = ports
+	options.udpPorts = udpPorts
+	options.ipFilters = ipFilters
+	options.serviceSpeeds = serviceSpeeds
 	options.configChecksum = sum
 	return
 }
 
-func calChecksum(ids hostPrefixOptions, ports map[uint16]openTCPOption) (result [32]byte) {
+// httpKey 返回可以设置访问策略的 http 服务的 key，tls 服务的请求无法解析，返回空
+func httpKey(key string, tls bool) string {
+	if tls {
+		return ""
+	}
+	return key
+}
+
+// readHostPrefix 读取 OpenHost 与 OpenHostPath option 中的 host 前缀，allowID 为 true 时长度为 0 表示使用 id
+func (c *conn) readHostPrefix(reader *bufio.Reader, idStr string, u user, allowID bool) (hostPrefixStr string, err error) {
+	var hostPrefixLen byte
+	hostPrefixLen, err = reader.ReadByte()
+	if err != nil {
+		c.Logger.Error().Err(err).Msg("failed to read host prefix length")
+		return
+	}
+	if hostPrefixLen == 0 && allowID {
+		hostPrefixStr = idStr
+		return
+	}
+	hostPrefix, err := reader.Peek(int(hostPrefixLen))
+	if err != nil {
+		c.Logger.Error().Err(err).Msg("failed to peek host prefix")
+		return
+	}
+	hostPrefixStr = string(hostPrefix)
+	_, err = reader.Discard(int(hostPrefixLen))
+	if err != nil {
+		c.Logger.Error().Err(err).Msg("failed to discard host prefix")
+		return
+	}
+	if strings.ContainsRune(hostPrefixStr, '/') {
+		err = ErrInvalidHost
+		c.Logger.Error().Err(err).Str("prefix", hostPrefixStr).Msg("invalid host prefix")
+		return
+	}
+
+	if len(*u.Host.Regex) > 0 {
+		match := false
+		for _, r := range *u.Host.Regex {
+			if r.MatchString(hostPrefixStr) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			c.Logger.Info().Err(err).
+				AnErr("sendSignalError", c.SendErrorSignalHostRegexMismatch()).
+				Msg("invalid host prefixes")
+			err = connection.ErrHostRegexMismatch
+			return
+		}
+	}
+	if *u.Host.WithID {
+		hostPrefixStr = idStr + "-" + hostPrefixStr
+	}
+	return
+}
+
+// readRoutePath 读取 OpenHostPath 与 OpenDomain option 中的路径与是否去掉路径
+func (c *conn) readRoutePath(reader *bufio.Reader) (pathStr string, strip bool, err error) {
+	var pathLen byte
+	pathLen, err = reader.ReadByte()
+	if err != nil {
+		c.Logger.Error().Err(err).Msg("failed to read route path length")
+		return
+	}
+	path, err := reader.Peek(int(pathLen))
+	if err != nil {
+		c.Logger.Error().Err(err).Msg("failed to peek route path")
+		return
+	}
+	pathStr, err = cleanRoutePath(string(path))
+	if err != nil {
+		c.Logger.Error().Err(err).Bytes("path", path).Msg("invalid route path")
+		return
+	}
+	_, err = reader.Discard(int(pathLen))
+	if err != nil {
+		c.Logger.Error().Err(err).Msg("failed to discard route path")
+		return
+	}
+	b, err := reader.ReadByte()
+	if err != nil {
+		c.Logger.Error().Err(err).Msg("failed to read strip path byte")
+		return
+	}
+	strip = b != 0
+	return
+}
+
+// readDomain 读取 OpenDomain 与 OpenTLSDomain option 中的域名，域名必须在用户允许的域名列表中
+func (c *conn) readDomain(reader *bufio.Reader, u user) (domain string, err error) {
+	var domainLen byte
+	domainLen, err = reader.ReadByte()
+	if err != nil {
+		c.Logger.Error().Err(err).Msg("failed to read domain length")
+		return
+	}
+	b, err := reader.Peek(int(domainLen))
+	if err != nil {
+		c.Logger.Error().Err(err).Msg("failed to peek domain")
+		return
+	}
+	domain, err = normalizeDomain(string(b))
+	if err != nil {
+		c.Logger.Error().Err(err).Bytes("domain", b).Msg("invalid domain")
+		return
+	}
+	_, err = reader.Discard(int(domainLen))
+	if err != nil {
+		c.Logger.Error().Err(err).Msg("failed to discard domain")
+		return
+	}
+	if !u.Host.allowDomain(domain) {
+		err = connection.ErrDomainNotAllowed
+		c.Logger.Info().Err(err).
+			Str("domain", domain).
+			AnErr("sendSignalError", c.SendErrorSignalDomainNotAllowed()).
+			Msg("domain is not allowed")
+	}
+	return
+}
+
+func calChecksum(ids hostPrefixOptions, ports map[uint16]openTCPOption, udpPorts map[uint16]openUDPOption, ipFilters map[uint16]*ipFilter, serviceSpeeds map[uint16]speed) (result [32]byte) {
 	tree := btree.NewWith(3, utils.UInt16Comparator)
 	for id, o := range ids {
 		si := o.serviceIndex
 		if o.tls {
 			id = id + "-tls"
 		}
+		if o.strip {
+			id = id + "-strip"
+		}
+		if o.domain {
+			id = id + "-domain"
+		}
+		if o.auth != nil {
+			id = id + "-auth-" + o.auth.digest
+		}
+		if o.group != nil {
+			id = id + "-group-" + o.group.String()
+		}
 		tree.Put(si, id)
 	}
 	for si, port := range ports {
 		tree.Put(si, port)
 	}
+	for si, port := range udpPorts {
+		tree.Put(si, port)
+	}
 	h := sha256.New()
 	it := tree.Iterator()
 	k := []byte{0x0, 0x0}
@@ -811,6 +1364,26 @@ func calChecksum(ids hostPrefixOptions, ports map[uint16]openTCPOption) (result
 			} else {
 				h.Write([]byte{0x0})
 			}
+			if v.group != nil {
+				h.Write([]byte(v.group.String()))
+			}
+		case openUDPOption:
+			k[0], k[1] = byte(v.port>>8), byte(v.port)
+			h.Write(k)
+			if v.random {
+				h.Write([]byte{0x1, 'u'})
+			} else {
+				h.Write([]byte{0x0, 'u'})
+			}
+		}
+		if f, ok := ipFilters[key]; ok {
+			h.Write([]byte(f.String()))
+		}
+		if sp, ok := serviceSpeeds[key]; ok {
+			h.Write([]byte{'s',
+				byte(sp.upload >> 24), byte(sp.upload >> 16), byte(sp.upload >> 8), byte(sp.upload),
+				byte(sp.download >> 24), byte(sp.download >> 16), byte(sp.download >> 8), byte(sp.download),
+			})
 		}
 	}
 	h.Sum(result[:0])
@@ -824,6 +1397,7 @@ func (c *conn) readLoop(cli *client) (reload bool) {
 		c.Logger.Info().Err(err).Msg("readLoop ended")
 		c.tasksRWMtx.RLock()
 		for _, t := range c.tasks {
+			t.closeFlowControl()
 			t.Close()
 		}
 		c.tasksRWMtx.RUnlock()
@@ -856,7 +1430,7 @@ func (c *conn) readLoop(cli *client) (reload bool) {
 			cli.tunnelsRWMtx.RLock()
 			_, ok := cli.tunnels[c]
 			cli.tunnelsRWMtx.RUnlock()
-			if !ok {
+			if !ok && !c.draining.Load() {
 				c.SendCloseSignal()
 				return
 			}
@@ -911,8 +1485,11 @@ func (c *conn) readLoop(cli *client) (reload bool) {
 			if err != nil {
 				return
 			}
-			if cli.needSpeedLimit() {
-				cli.speedLimit(l, true) // 对客户端上行进行限速
+			if ok {
+				task.responded.Store(true)
+				cli.traffic.add(task.service, Traffic{Upload: uint64(l)})
+				task.metrics.received(l)
+				task.access.out(int(l))
 			}
 			if predef.Debug {
 				c.Logger.Trace().Uint32("len", l).Msg("readLoop read len")
@@ -932,7 +1509,11 @@ func (c *conn) readLoop(cli *client) (reload bool) {
 				}
 				continue
 			}
-			_, err = r.WriteTo(task)
+			if task.recvBuffer != nil {
+				_, err = r.WriteTo(task.recvBuffer)
+			} else {
+				_, err = r.WriteTo(task)
+			}
 			if r.N > 0 {
 				if !predef.Debug {
 					_, err = r.Discard(int(r.N))
@@ -954,6 +1535,11 @@ func (c *conn) readLoop(cli *client) (reload bool) {
 						continue
 					}
 				case *bufio.WriteErr:
+					if errors.Is(err, connection.ErrWindowExceeded) {
+						c.Logger.Warn().Err(err).Uint32("taskID", taskID).Msg("remote sent data beyond the window")
+						task.Close()
+						continue
+					}
 					c.Logger.Debug().Err(err).Uint32("taskID", taskID).Msg("remote req resp writer closed")
 					continue
 				}
@@ -971,7 +1557,30 @@ func (c *conn) readLoop(cli *client) (reload bool) {
 				c.Logger.Trace().Uint32("taskID", taskID).Msg("read close op")
 			}
 			if ok {
-				task.CloseByRemote()
+				// 客户端没有响应就关闭了 task，说明客户端无法连接本地服务
+				task.writeErrorPage(http.StatusBadGateway, msgServiceUnreachable)
+				if task.recvBuffer != nil {
+					// 等待缓冲的数据写完后再关闭
+					task.recvBuffer.Finish()
+				} else {
+					task.CloseByRemote()
+				}
+			}
+		case predef.WindowUpdate:
+			peekBytes, err = c.Reader.Peek(4)
+			if err != nil {
+				return
+			}
+			n := uint32(peekBytes[3]) | uint32(peekBytes[2])<<8 | uint32(peekBytes[1])<<16 | uint32(peekBytes[0])<<24
+			_, err = c.Reader.Discard(4)
+			if err != nil {
+				return
+			}
+			if predef.Debug {
+				c.Logger.Trace().Uint32("taskID", taskID).Uint32("n", n).Msg("read window update op")
+			}
+			if ok && task.window != nil {
+				task.window.Release(n)
 			}
 		}
 	}
@@ -980,10 +1589,28 @@ func (c *conn) readLoop(cli *client) (reload bool) {
 func (c *conn) process(taskID uint32, task *conn, cli *client) {
 	var rErr error
 	var wErr error
+	task.service = cli.serviceName(task.serviceIndex)
+	task.metrics = c.server.metrics.newTask(cli.id, task.service)
+	task.uploadLimit = cli.newLimiter(task.serviceIndex, true)
+	task.downloadLimit = cli.newLimiter(task.serviceIndex, false)
+	if c.features.Load()&predef.FeatureFlowControl != 0 {
+		task.window = connection.NewSendWindow(predef.TaskWindowSize)
+		task.recvBuffer = connection.NewReceiveBuffer(predef.TaskWindowSize)
+		go c.writeLoop(taskID, task)
+	} else if task.uploadLimit != nil {
+		// 没有流量控制时在 writeLoop 中对客户端上行进行限速，缓冲满时才阻塞 readLoop
+		task.recvBuffer = connection.NewBlockingReceiveBuffer(predef.TaskWindowSize)
+		go c.writeLoop(taskID, task)
+	}
 	c.addTask(taskID, task)
 	buf := pool.BytesPool.Get().([]byte)
 	defer func() {
 		c.removeTask(taskID)
+		task.closeFlowControl()
+		task.metrics.done()
+		if isTimeout(rErr) {
+			task.writeErrorPage(http.StatusGatewayTimeout, msgServiceTimeout)
+		}
 		if wErr == nil && !task.IsClosingByRemote() {
 			buf[4] = byte(predef.Close >> 8)
 			buf[5] = byte(predef.Close)
@@ -999,7 +1626,7 @@ func (c *conn) process(taskID uint32, task *conn, cli *client) {
 		if rErr != nil || wErr != nil {
 			c.Logger.Debug().AnErr("read err", rErr).AnErr("write err", wErr).Uint32("taskID", taskID).Msg("process err")
 		}
-		if c.TasksCount.Add(^uint32(0)) == 0 && c.IsClosing() {
+		if c.TasksCount.Add(^uint32(0)) == 0 && (c.IsClosing() || c.draining.Load()) {
 			c.SendForceCloseSignal()
 			c.Close()
 		} else if wErr != nil {
@@ -1016,6 +1643,9 @@ func (c *conn) process(taskID uint32, task *conn, cli *client) {
 	buf[bufIndex+2] = byte(task.serviceIndex >> 8)
 	buf[bufIndex+3] = byte(task.serviceIndex)
 	bufIndex += 4
+	if c.features.Load()&predef.FeatureVisitorAddr != 0 {
+		bufIndex += connection.PutAddrs(buf[bufIndex:], task.RemoteAddr(), task.LocalAddr(), isTLSConn(task.Conn))
+	}
 
 	buffered := task.Reader.Buffered()
 	var l int
@@ -1025,14 +1655,31 @@ func (c *conn) process(taskID uint32, task *conn, cli *client) {
 		if rErr != nil {
 			return
 		}
-		l = copy(buf[bufIndex+4:], peek)
+		p := buf[bufIndex+4:]
+		if task.window != nil {
+			var granted int
+			var ok bool
+			granted, ok = task.window.Acquire(len(p))
+			if !ok {
+				rErr = net.ErrClosed
+				return
+			}
+			p = p[:granted]
+		}
+		l = copy(p, peek)
+		if task.window != nil {
+			task.window.Release(uint32(len(p) - l))
+		}
 		_, rErr = task.Reader.Discard(l)
 		if rErr != nil {
 			return
 		}
 	}
-	if cli.needSpeedLimit() {
-		cli.speedLimit(uint32(l), false) // 对客户端下行进行限速
+	task.downloadLimit.wait(l) // 对客户端下行进行限速
+	if l > 0 {
+		cli.traffic.add(task.service, Traffic{Download: uint64(l)})
+		task.metrics.sent(l)
+		task.access.in(l)
 	}
 	buf[bufIndex] = byte(l >> 24)
 	buf[bufIndex+1] = byte(l >> 16)
@@ -1051,7 +1698,7 @@ func (c *conn) process(taskID uint32, task *conn, cli *client) {
 		}
 	}
 
-	bufIndex -= 4
+	bufIndex = 4
 	buf[bufIndex] = byte(predef.Data >> 8)
 	buf[bufIndex+1] = byte(predef.Data)
 	bufIndex += 2
@@ -1063,11 +1710,24 @@ func (c *conn) process(taskID uint32, task *conn, cli *client) {
 				return
 			}
 		}
-		l, rErr = task.Reader.Read(buf[bufIndex+4:])
-		if cli.needSpeedLimit() {
-			cli.speedLimit(uint32(l), false) // 对客户端下行进行限速
+		p := buf[bufIndex+4:]
+		if task.window != nil {
+			granted, ok := task.window.Acquire(len(p))
+			if !ok {
+				rErr = net.ErrClosed
+				return
+			}
+			p = p[:granted]
+		}
+		l, rErr = task.Reader.Read(p)
+		if task.window != nil {
+			task.window.Release(uint32(len(p) - l))
 		}
+		task.downloadLimit.wait(l) // 对客户端下行进行限速
 		if l > 0 {
+			cli.traffic.add(task.service, Traffic{Download: uint64(l)})
+			task.metrics.sent(l)
+			task.access.in(l)
 			buf[bufIndex] = byte(l >> 24)
 			buf[bufIndex+1] = byte(l >> 16)
 			buf[bufIndex+2] = byte(l >> 8)
@@ -1095,6 +1755,37 @@ func (c *conn) process(taskID uint32, task *conn, cli *client) {
 	}
 }
 
+// writeLoop 将 task 缓冲的数据限速写出，有流量控制时向对端更新窗口
+func (c *conn) writeLoop(taskID uint32, task *conn) {
+	var w io.Writer = task
+	if task.uploadLimit != nil {
+		w = limitedWriter{Writer: task, limiter: task.uploadLimit}
+	}
+	err := task.recvBuffer.WriteLoop(w, func(n uint32) error {
+		if task.window == nil {
+			return nil
+		}
+		return c.SendWindowUpdate(taskID, n)
+	})
+	if errors.Is(err, io.EOF) {
+		task.CloseByRemote()
+		return
+	}
+	if !errors.Is(err, net.ErrClosed) {
+		c.Logger.Debug().Err(err).Uint32("taskID", taskID).Msg("remote req resp writer closed")
+	}
+	task.Close()
+}
+
+func (c *conn) closeFlowControl() {
+	if c.window != nil {
+		c.window.Close()
+	}
+	if c.recvBuffer != nil {
+		c.recvBuffer.Close()
+	}
+}
+
 type clientWithServiceIndex struct {
 	*client
 	serviceIndex uint16
@@ -1110,6 +1801,43 @@ func (c *conn) processTCPOptions(o options, cli *client) (err error) {
 		}
 	}()
 	for si, portOption := range o.ports {
+		if v, ok := cli.tcpListeners.Load(si); ok && (v.(*tcpListener).group != nil || portOption.group != nil) {
+			vl := v.(*tcpListener)
+			if vl.group != nil && vl.group.port == portOption.port && vl.group.accepts(portOption.group) {
+				vl.group.join(clientWithServiceIndex{client: cli, serviceIndex: si}, portOption.group.standby)
+				if err := c.SendInfoTCPPortOpened(si, portOption.port); err != nil {
+					c.Logger.Error().Err(err).Msg("failed to send InfoTCPPortOpened signal")
+				}
+				continue
+			}
+			// 加入或离开服务组时关闭原来的端口
+			cli.deleteTCPListener(si)
+		}
+		if portOption.group != nil {
+			var g *tcpGroup
+			g, err = c.server.joinTCPGroup(portOption, clientWithServiceIndex{client: cli, serviceIndex: si}, c)
+			if err != nil {
+				c.Logger.Error().Err(err).
+					Uint16("port", portOption.port).
+					Str("group", portOption.group.name).
+					AnErr("respErr", c.SendErrorSignalFailedToOpenTCPPort(si)).
+					Msg("failed to join group tcp port")
+				return err
+			}
+			cli.tcpListeners.Store(si, &tcpListener{port: portOption, group: g})
+			success = append(success, si)
+			c.Logger.Info().
+				Uint16("port", portOption.port).
+				Str("group", portOption.group.name).
+				Bool("standby", portOption.group.standby).
+				Int("members", g.size()).
+				Msg("joined group of tcp port")
+			c.server.metrics.tcpPortOpened(cli.id)
+			if err := c.SendInfoTCPPortOpened(si, portOption.port); err != nil {
+				c.Logger.Error().Err(err).Msg("failed to send InfoTCPPortOpened signal")
+			}
+			continue
+		}
 		v, ok := cli.tcpListeners.LoadOrCreate(si, func() interface{} {
 			return &tcpListener{
 				port: portOption,
@@ -1117,25 +1845,14 @@ func (c *conn) processTCPOptions(o options, cli *client) (err error) {
 		})
 		vl := v.(*tcpListener)
 		if ok && vl.l != nil {
-			port := vl.l.Addr().(*net.TCPAddr).Port
-			if port == int(portOption.port) || portOption.random {
-				if err := c.SendInfoTCPPortOpened(si, uint16(port)); err != nil {
+			port := listenerPort(vl.l)
+			if port == portOption.port || portOption.random {
+				if err := c.SendInfoTCPPortOpened(si, port); err != nil {
 					c.Logger.Error().Err(err).Msg("failed to send InfoTCPPortOpened signal")
 				}
 				continue
-			} else {
-				if vl.l != nil {
-					port := uint16(vl.l.Addr().(*net.TCPAddr).Port)
-					cli.logger.Info().
-						Uint16("serviceIndex", si).
-						Uint16("port", port).
-						Msg("close associated tcp listener")
-					cli.portsManager.portsMtx.Lock()
-					cli.portsManager.ports[port] = struct{}{}
-					cli.portsManager.portsMtx.Unlock()
-					_ = vl.l.Close()
-				}
 			}
+			cli.closePortListener("tcp", si, vl.l)
 		}
 
 		var openedPort uint16
@@ -1150,23 +1867,16 @@ func (c *conn) processTCPOptions(o options, cli *client) (err error) {
 				Msg("failed to open tcp port")
 			return err
 		}
+		c.server.metrics.tcpPortOpened(cli.id)
 		if err := c.SendInfoTCPPortOpened(si, openedPort); err != nil {
 			c.Logger.Error().Err(err).Msg("failed to send InfoTCPPortOpened signal")
 		}
 	}
 
 	// remove old tcp listeners that are no longer needed
-	var oldServiceIndexes []uint16
-	cli.tcpListeners.Range(func(key, value any) bool {
-		si := key.(uint16)
+	cli.deleteUnusedListeners(&cli.tcpListeners, func(si uint16) bool {
 		_, ok := o.ports[si]
-		if !ok {
-			oldServiceIndexes = append(oldServiceIndexes, si)
-		}
-		return true
+		return ok
 	})
-	for _, si := range oldServiceIndexes {
-		cli.deleteTCPListener(si)
-	}
 	return
 }
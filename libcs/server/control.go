@@ -0,0 +1,345 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/isrc-cas/gt/util"
+)
+
+var (
+	// ErrClientNotConnected is an error returned when no client of the id is connected
+	ErrClientNotConnected = errors.New("client is not connected")
+	// ErrTunnelNotFound is an error returned when the client has no such tunnel
+	ErrTunnelNotFound = errors.New("tunnel not found")
+	// ErrOnlyTunnel is an error returned when draining the only tunnel of the client
+	ErrOnlyTunnel = errors.New("can not drain the only tunnel of the client")
+	// ErrInvalidBan is an error returned when the ban has no id or ip or has no positive duration
+	ErrInvalidBan = errors.New("invalid ban")
+)
+
+// ClientInfo is the state of a connected client
+type ClientInfo struct {
+	ID           string       `json:"id"`
+	Tunnels      []TunnelInfo `json:"tunnels"`
+	Services     []string     `json:"services"`
+	HostPrefixes []string     `json:"hostPrefixes"`
+	TCPPorts     []uint16     `json:"tcpPorts"`
+	UDPPorts     []uint16     `json:"udpPorts"`
+	Tasks        uint32       `json:"tasks"`
+}
+
+// TunnelInfo is the state of a tunnel of the client, the id is the serverConn field in the log
+type TunnelInfo struct {
+	ID         string `json:"id"`
+	RemoteAddr string `json:"remoteAddr"`
+	Tasks      uint32 `json:"tasks"`
+	Draining   bool   `json:"draining"`
+}
+
+// Ban is a client id or a client ip (CIDR) banned by the operator until the time
+type Ban struct {
+	ID    string    `json:"id,omitempty"`
+	IP    string    `json:"ip,omitempty"`
+	Until time.Time `json:"until"`
+}
+
+type ipBan struct {
+	ipNet *net.IPNet
+	until time.Time
+}
+
+// GetClients returns the connected clients, all clients are returned if the id is empty
+func (s *Server) GetClients(id string) (result []ClientInfo) {
+	s.id2Client.Range(func(key, value interface{}) bool {
+		cid := key.(string)
+		if len(id) > 0 && cid != id {
+			return true
+		}
+		info := value.(*client).info()
+		if len(info.Tunnels) > 0 {
+			result = append(result, info)
+		}
+		return true
+	})
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return
+}
+
+// KickClient closes all tunnels and listeners of the client
+func (s *Server) KickClient(id string) (err error) {
+	v, ok := s.id2Client.Load(id)
+	if !ok {
+		return ErrClientNotConnected
+	}
+	s.Logger.Info().Str("id", id).Msg("kick client")
+	v.(*client).close()
+	return
+}
+
+// ReconnectClient asks the client to reconnect
+func (s *Server) ReconnectClient(id string) (err error) {
+	v, ok := s.id2Client.Load(id)
+	if !ok {
+		return ErrClientNotConnected
+	}
+	s.Logger.Info().Str("id", id).Msg("ask client to reconnect")
+	v.(*client).reconnect()
+	return
+}
+
+// DrainTunnel stops dispatching new tasks to the tunnel and closes it after the in-flight tasks are done
+func (s *Server) DrainTunnel(id string, tunnel string) (err error) {
+	v, ok := s.id2Client.Load(id)
+	if !ok {
+		return ErrClientNotConnected
+	}
+	return v.(*client).drain(tunnel)
+}
+
+// BanID refuses the client of the id to log in for the duration and closes it if it is connected
+func (s *Server) BanID(id string, d time.Duration) (err error) {
+	if len(id) == 0 || d <= 0 {
+		return ErrInvalidBan
+	}
+	s.bansMtx.Lock()
+	if s.idBans == nil {
+		s.idBans = make(map[string]time.Time)
+	}
+	s.idBans[id] = time.Now().Add(d)
+	s.bansMtx.Unlock()
+	s.Logger.Info().Str("id", id).Dur("duration", d).Msg("id banned")
+	if v, ok := s.id2Client.Load(id); ok {
+		v.(*client).close()
+	}
+	return
+}
+
+// BanIP refuses clients from the ip or CIDR to log in for the duration and closes the connected ones
+func (s *Server) BanIP(ip string, d time.Duration) (err error) {
+	if d <= 0 {
+		return ErrInvalidBan
+	}
+	ipNet, err := util.ParseCIDR(ip)
+	if err != nil {
+		return fmt.Errorf("%w: '%s', cause %s", ErrInvalidBan, ip, err.Error())
+	}
+	s.bansMtx.Lock()
+	if s.ipBans == nil {
+		s.ipBans = make(map[string]ipBan)
+	}
+	s.ipBans[ipNet.String()] = ipBan{ipNet: ipNet, until: time.Now().Add(d)}
+	s.bansMtx.Unlock()
+	s.Logger.Info().Str("ip", ipNet.String()).Dur("duration", d).Msg("ip banned")
+	s.id2Client.Range(func(key, value interface{}) bool {
+		c := value.(*client)
+		if c.connectedFrom(ipNet) {
+			c.close()
+		}
+		return true
+	})
+	return
+}
+
+// UnbanID lifts the ban of the id
+func (s *Server) UnbanID(id string) {
+	s.bansMtx.Lock()
+	delete(s.idBans, id)
+	s.bansMtx.Unlock()
+	s.Logger.Info().Str("id", id).Msg("id unbanned")
+}
+
+// UnbanIP lifts the ban of the ip or CIDR
+func (s *Server) UnbanIP(ip string) (err error) {
+	ipNet, err := util.ParseCIDR(ip)
+	if err != nil {
+		return fmt.Errorf("%w: '%s', cause %s", ErrInvalidBan, ip, err.Error())
+	}
+	s.bansMtx.Lock()
+	delete(s.ipBans, ipNet.String())
+	s.bansMtx.Unlock()
+	s.Logger.Info().Str("ip", ipNet.String()).Msg("ip unbanned")
+	return
+}
+
+// GetBans returns the bans that have not expired
+func (s *Server) GetBans() (result []Ban) {
+	s.bansMtx.Lock()
+	defer s.bansMtx.Unlock()
+	now := time.Now()
+	for id, until := range s.idBans {
+		if now.After(until) {
+			delete(s.idBans, id)
+			continue
+		}
+		result = append(result, Ban{ID: id, Until: until})
+	}
+	for key, b := range s.ipBans {
+		if now.After(b.until) {
+			delete(s.ipBans, key)
+			continue
+		}
+		result = append(result, Ban{IP: key, Until: b.until})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].ID != result[j].ID {
+			return result[i].ID < result[j].ID
+		}
+		return result[i].IP < result[j].IP
+	})
+	return
+}
+
+// banned 判断客户端的 id 或 IP 是否被封禁，过期的封禁会被删除
+func (s *Server) banned(id string, addr net.Addr) bool {
+	s.bansMtx.Lock()
+	defer s.bansMtx.Unlock()
+	now := time.Now()
+	if until, ok := s.idBans[id]; ok {
+		if now.Before(until) {
+			return true
+		}
+		delete(s.idBans, id)
+	}
+	if len(s.ipBans) == 0 {
+		return false
+	}
+	ip := remoteIP(addr)
+	if ip == nil {
+		return false
+	}
+	for key, b := range s.ipBans {
+		if now.After(b.until) {
+			delete(s.ipBans, key)
+			continue
+		}
+		if b.ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// info 返回客户端的 tunnel、服务、host 前缀、端口以及正在处理的 task 数量
+func (c *client) info() (info ClientInfo) {
+	info.ID = c.id
+	prefixes := make(map[string]struct{})
+	var tunnels []*conn
+	c.tunnelsRWMtx.RLock()
+	for _, m := range []map[*conn]struct{}{c.tunnels, c.drainingTunnels} {
+		for t := range m {
+			tunnels = append(tunnels, t)
+			for prefix := range t.ids {
+				prefixes[prefix] = struct{}{}
+			}
+		}
+	}
+	c.tunnelsRWMtx.RUnlock()
+	// 按连接的先后顺序排列
+	sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].id < tunnels[j].id })
+	for _, t := range tunnels {
+		tasks := t.TasksCount.Load()
+		info.Tasks += tasks
+		info.Tunnels = append(info.Tunnels, TunnelInfo{
+			ID:         t.name(),
+			RemoteAddr: t.RemoteAddr().String(),
+			Tasks:      tasks,
+			Draining:   t.draining.Load(),
+		})
+	}
+	for prefix := range prefixes {
+		info.HostPrefixes = append(info.HostPrefixes, prefix)
+	}
+	sort.Strings(info.HostPrefixes)
+	if names := c.serviceNames.Load(); names != nil {
+		for _, name := range *names {
+			info.Services = append(info.Services, name)
+		}
+		sort.Strings(info.Services)
+	}
+	c.tcpListeners.Range(func(key, value interface{}) bool {
+		if l, ok := value.(*tcpListener); ok {
+			if l.l != nil {
+				info.TCPPorts = append(info.TCPPorts, listenerPort(l.l))
+			} else if l.group != nil {
+				info.TCPPorts = append(info.TCPPorts, l.group.port)
+			}
+		}
+		return true
+	})
+	sort.Slice(info.TCPPorts, func(i, j int) bool { return info.TCPPorts[i] < info.TCPPorts[j] })
+	c.udpListeners.Range(func(key, value interface{}) bool {
+		if l, ok := value.(*udpListenerWithOption); ok && l.l != nil {
+			info.UDPPorts = append(info.UDPPorts, listenerPort(l.l))
+		}
+		return true
+	})
+	sort.Slice(info.UDPPorts, func(i, j int) bool { return info.UDPPorts[i] < info.UDPPorts[j] })
+	return
+}
+
+// drain 将 tunnel 移出可分配 task 的列表并通知客户端关闭，已有的 task 完成后关闭 tunnel
+func (c *client) drain(name string) (err error) {
+	c.tunnelsRWMtx.Lock()
+	var tunnel *conn
+	for t := range c.tunnels {
+		if t.name() == name {
+			tunnel = t
+			break
+		}
+	}
+	if tunnel == nil {
+		c.tunnelsRWMtx.Unlock()
+		return ErrTunnelNotFound
+	}
+	if len(c.tunnels) < 2 {
+		c.tunnelsRWMtx.Unlock()
+		return ErrOnlyTunnel
+	}
+	delete(c.tunnels, tunnel)
+	if c.drainingTunnels == nil {
+		c.drainingTunnels = make(map[*conn]struct{})
+	}
+	c.drainingTunnels[tunnel] = struct{}{}
+	tunnel.draining.Store(true)
+	c.tunnelsRWMtx.Unlock()
+
+	tunnel.Logger.Info().Uint32("tasks", tunnel.TasksCount.Load()).Msg("drain tunnel")
+	tunnel.SendCloseSignal()
+	if tunnel.TasksCount.Load() == 0 {
+		tunnel.SendForceCloseSignal()
+		tunnel.Close()
+	}
+	return
+}
+
+// connectedFrom 判断客户端是否有来自 ipNet 的 tunnel
+func (c *client) connectedFrom(ipNet *net.IPNet) bool {
+	c.tunnelsRWMtx.RLock()
+	defer c.tunnelsRWMtx.RUnlock()
+	for t := range c.tunnels {
+		if ip := remoteIP(t.RemoteAddr()); ip != nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBans(t *testing.T) {
+	s, err := New([]string{"server"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+	}
+	for _, err := range []error{
+		s.BanID("", time.Hour),
+		s.BanID("id1", 0),
+		s.BanIP("not-an-ip", time.Hour),
+		s.BanIP("10.0.0.1", -time.Hour),
+	} {
+		if !errors.Is(err, ErrInvalidBan) {
+			t.Fatalf("invalid ban is accepted, err: %v", err)
+		}
+	}
+
+	if err = s.BanID("id1", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.BanIP("10.0.0.0/24", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.BanIP("192.168.1.1", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		id     string
+		ip     string
+		banned bool
+	}{
+		{"id1", "127.0.0.1", true},
+		{"id2", "127.0.0.1", false},
+		{"id2", "10.0.0.8", true},
+		{"id2", "10.0.1.8", false},
+		{"id2", "192.168.1.1", true},
+	} {
+		if s.banned(c.id, addr(c.ip)) != c.banned {
+			t.Fatalf("banned(%s, %s) should be %v", c.id, c.ip, c.banned)
+		}
+	}
+	bans := s.GetBans()
+	if len(bans) != 3 || bans[0].IP != "10.0.0.0/24" || bans[1].IP != "192.168.1.1/32" || bans[2].ID != "id1" {
+		t.Fatalf("invalid bans %+v", bans)
+	}
+
+	// 过期或解除的封禁不再生效
+	time.Sleep(100 * time.Millisecond)
+	if s.banned("id2", addr("192.168.1.1")) {
+		t.Fatal("expired ban is still in effect")
+	}
+	s.UnbanID("id1")
+	if err = s.UnbanIP("10.0.0.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if s.banned("id1", addr("10.0.0.8")) {
+		t.Fatal("ban is still in effect after unban")
+	}
+	if bans = s.GetBans(); len(bans) != 0 {
+		t.Fatalf("invalid bans %+v", bans)
+	}
+}
+
+func TestClientInfoTunnelIDs(t *testing.T) {
+	s, err := New([]string{"server"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &client{id: "id1", tunnels: make(map[*conn]struct{})}
+	for i := 0; i < 10; i++ {
+		local, remote := net.Pipe()
+		defer local.Close()
+		defer remote.Close()
+		c.tunnels[newConn(local, s)] = struct{}{}
+	}
+	// 连接 id 从 1 开始递增，tunnel 按连接的先后顺序排列
+	info := c.info()
+	if len(info.Tunnels) != 10 {
+		t.Fatalf("invalid tunnels %+v", info.Tunnels)
+	}
+	for i, tunnel := range info.Tunnels {
+		if want := strconv.Itoa(i + 1); tunnel.ID != want {
+			t.Fatalf("tunnel %d has id %q, want %q", i, tunnel.ID, want)
+		}
+	}
+}
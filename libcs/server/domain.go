@@ -0,0 +1,138 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/isrc-cas/gt/predef"
+)
+
+// ErrInvalidDomain is an error returned when the domain registered by a client is invalid
+var ErrInvalidDomain = errors.New("invalid domain")
+
+// normalizeHost 去掉 host 中的端口与结尾的 .，并转换为小写
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// normalizeDomain 校验客户端注册的域名。支持完整域名 shop.example.com 与通配符域名 *.example.com
+func normalizeDomain(domain string) (string, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if len(domain) == 0 || len(domain) > predef.MaxDomainSize {
+		return "", ErrInvalidDomain
+	}
+	name := strings.TrimPrefix(domain, "*.")
+	labels := strings.Split(name, ".")
+	if len(labels) < 2 {
+		return "", ErrInvalidDomain
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return "", ErrInvalidDomain
+		}
+		for i := 0; i < len(label); i++ {
+			b := label[i]
+			if (b < 'a' || b > 'z') && (b < '0' || b > '9') && b != '-' && b != '_' {
+				return "", ErrInvalidDomain
+			}
+		}
+	}
+	return domain, nil
+}
+
+// allowDomain 判断用户是否可以注册 domain。允许列表中的 *.example.com 允许注册 example.com 下的任意子域名与通配符域名
+func (h *host) allowDomain(domain string) bool {
+	if h.Domains == nil {
+		return false
+	}
+	for _, allowed := range *h.Domains {
+		if allowed == domain {
+			return true
+		}
+		if strings.HasPrefix(allowed, "*.") && strings.HasSuffix(domain, allowed[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDomains 校验并规范化允许的域名列表
+func parseDomains(domains []string) (result []string, err error) {
+	seen := make(map[string]struct{}, len(domains))
+	for _, domain := range domains {
+		var d string
+		d, err = normalizeDomain(strings.TrimSpace(domain))
+		if err != nil {
+			err = fmt.Errorf("invalid host domain '%s'", domain)
+			return
+		}
+		if _, ok := seen[d]; ok {
+			continue
+		}
+		seen[d] = struct{}{}
+		result = append(result, d)
+	}
+	return
+}
+
+// matchDomain 在路由表中查找与 host 匹配的精确域名或通配符域名
+func matchDomain(domains *routeTable, host string) (name string, ok bool) {
+	if domains.has(host) {
+		return host, true
+	}
+	// 由长到短尝试通配符域名，a.b.example.com 依次尝试 *.b.example.com 与 *.example.com
+	for i := strings.IndexByte(host, '.'); i >= 0 && i < len(host)-1; {
+		wildcard := "*" + host[i:]
+		if domains.has(wildcard) {
+			return wildcard, true
+		}
+		j := strings.IndexByte(host[i+1:], '.')
+		if j < 0 {
+			break
+		}
+		i += 1 + j
+	}
+	return
+}
+
+// resolveHost 按精确域名、通配符域名、host 前缀的顺序查找访问者请求的 host 所在的路由表与名字。
+// host 为空时使用 http 多路复用头部中的 id。
+func (s *Server) resolveHost(host, id []byte, tls bool) (table *routeTable, name string, err error) {
+	domains, prefixes := &s.domainRoutes, &s.hostRoutes
+	if tls {
+		domains, prefixes = &s.tlsDomainRoutes, &s.tlsHostRoutes
+	}
+	if len(host) > 0 {
+		if name, ok := matchDomain(domains, normalizeHost(string(host))); ok {
+			return domains, name, nil
+		}
+		id, err = parseIDFromHost(host)
+		if err != nil {
+			return
+		}
+	}
+	if len(id) < predef.MinIDSize {
+		err = ErrInvalidID
+		return
+	}
+	return prefixes, string(id), nil
+}
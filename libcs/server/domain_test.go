@@ -0,0 +1,106 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/isrc-cas/gt/config"
+)
+
+func TestNormalizeDomain(t *testing.T) {
+	tests := []struct {
+		domain   string
+		expected string
+		ok       bool
+	}{
+		{"Shop.Example.com.", "shop.example.com", true},
+		{"*.example.com", "*.example.com", true},
+		{"example.com", "example.com", true},
+		{"localhost", "", false},
+		{"*.com", "", false},
+		{"a.*.example.com", "", false},
+		{"-a.example.com", "", false},
+		{"a..example.com", "", false},
+		{"a/b.example.com", "", false},
+	}
+	for _, tt := range tests {
+		d, err := normalizeDomain(tt.domain)
+		if (err == nil) != tt.ok || d != tt.expected {
+			t.Fatalf("normalizeDomain(%q) = %q, %v", tt.domain, d, err)
+		}
+	}
+}
+
+func TestAllowDomain(t *testing.T) {
+	h := host{Domains: &config.Slice[string]{"customer.com", "*.example.com"}}
+	tests := []struct {
+		domain string
+		ok     bool
+	}{
+		{"customer.com", true},
+		{"shop.customer.com", false},
+		{"*.example.com", true},
+		{"shop.example.com", true},
+		{"*.shop.example.com", true},
+		{"example.com", false},
+		{"badexample.com", false},
+	}
+	for _, tt := range tests {
+		if h.allowDomain(tt.domain) != tt.ok {
+			t.Fatalf("allowDomain(%q) != %v", tt.domain, tt.ok)
+		}
+	}
+	if (&host{}).allowDomain("customer.com") {
+		t.Fatal("domain is allowed without allowed domains")
+	}
+}
+
+func TestResolveHost(t *testing.T) {
+	s := &Server{}
+	for _, key := range []string{"customer.com", "shop.example.com", "*.example.com", "*.b.example.com"} {
+		s.domainRoutes.store(key, hostRoute{})
+	}
+	s.tlsDomainRoutes.store("secure.example.com", hostRoute{})
+	tests := []struct {
+		host   string
+		tls    bool
+		domain bool
+		name   string
+	}{
+		{"customer.com", false, true, "customer.com"},
+		{"Customer.COM:8080", false, true, "customer.com"},
+		{"shop.example.com", false, true, "shop.example.com"},
+		{"other.example.com", false, true, "*.example.com"},
+		{"a.b.example.com", false, true, "*.b.example.com"},
+		{"a.c.example.com", false, true, "*.example.com"},
+		{"abcdefgh.shop.customer.com", false, false, "abcdefgh"},
+		{"secure.example.com", true, true, "secure.example.com"},
+		{"abcdefgh.example.com", true, false, "abcdefgh"},
+	}
+	for _, tt := range tests {
+		table, name, err := s.resolveHost([]byte(tt.host), nil, tt.tls)
+		if err != nil {
+			t.Fatalf("resolveHost(%q): %v", tt.host, err)
+		}
+		domain := table == &s.domainRoutes || table == &s.tlsDomainRoutes
+		if domain != tt.domain || name != tt.name {
+			t.Fatalf("resolveHost(%q) = %q, %v, expected %q, %v", tt.host, name, domain, tt.name, tt.domain)
+		}
+	}
+	if _, _, err := s.resolveHost([]byte("unknown.com"), nil, false); err == nil {
+		t.Fatal("unknown apex domain is resolved")
+	}
+}
@@ -0,0 +1,587 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	stdbufio "bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/isrc-cas/gt/bufio"
+	"github.com/isrc-cas/gt/config"
+	connection "github.com/isrc-cas/gt/conn"
+	"github.com/isrc-cas/gt/predef"
+)
+
+// 登录页与签名 cookie 使用的名字与路径，路径位于路由路径之下
+const (
+	edgeAuthCookieName = "gt_auth"
+	edgeAuthLoginPath  = "/.gt-auth/login"
+	edgeAuthLogoutPath = "/.gt-auth/logout"
+	edgeAuthSHAPrefix  = "{SHA}"
+	edgeAuthAPR1Prefix = "$apr1$"
+)
+
+// ErrInvalidEdgeAuth is an error returned when an edge auth policy is invalid
+var ErrInvalidEdgeAuth = errors.New("invalid edge auth policy")
+
+// edgeAuth 是 host 前缀或域名的访问策略，在请求转发到客户端之前验证访问者。
+// 访问者可以使用 HTTP Basic、Bearer token 或登录页签发的 cookie 通过验证。
+type edgeAuth struct {
+	Basic    config.Slice[string] `yaml:"basic,omitempty" json:",omitempty"`    // user:hash，支持 bcrypt、argon2id、scrypt、$apr1$、{SHA} 与明文
+	Htpasswd string               `yaml:"htpasswd,omitempty" json:",omitempty"` // htpasswd 文件，每行一个 user:hash
+	Bearer   config.Slice[string] `yaml:"bearer,omitempty" json:",omitempty"`
+	Login    bool                 `yaml:"login,omitempty" json:",omitempty"` // 浏览器访问时显示登录页，登录后使用签名 cookie
+	Realm    string               `yaml:"realm,omitempty" json:",omitempty"`
+
+	users    map[string]string // user -> hash
+	tokens   map[[32]byte]struct{}
+	digest   string                         // 策略内容的摘要，策略变化后之前签发的 cookie 失效
+	verified *lru.Cache[[32]byte, struct{}] // 已验证的 basic 凭据，避免每个请求都计算慢哈希
+}
+
+// init 解析并校验策略，requireHash 为 true 时不接受明文密码
+func (a *edgeAuth) init(requireHash bool) (err error) {
+	a.users = make(map[string]string)
+	a.tokens = make(map[[32]byte]struct{})
+	entries := append([]string(nil), a.Basic...)
+	if len(a.Htpasswd) > 0 {
+		var lines []string
+		lines, err = readHtpasswd(a.Htpasswd)
+		if err != nil {
+			return
+		}
+		entries = append(entries, lines...)
+	}
+	for _, entry := range entries {
+		user, hash, ok := strings.Cut(entry, ":")
+		if !ok || len(user) == 0 || len(hash) == 0 {
+			return fmt.Errorf("%w: basic user '%s' should be in the form of user:hash", ErrInvalidEdgeAuth, user)
+		}
+		if err = verifyPasswordHash(hash); err != nil {
+			if requireHash || !errors.Is(err, errInvalidHash) {
+				return fmt.Errorf("%w: invalid password hash of basic user '%s'", ErrInvalidEdgeAuth, user)
+			}
+			err = nil // 明文密码
+		}
+		a.users[user] = hash
+	}
+	for _, token := range a.Bearer {
+		if len(token) == 0 {
+			return fmt.Errorf("%w: empty bearer token", ErrInvalidEdgeAuth)
+		}
+		a.tokens[sha256.Sum256([]byte(token))] = struct{}{}
+	}
+	if len(a.users) == 0 && len(a.tokens) == 0 {
+		return fmt.Errorf("%w: no basic user or bearer token", ErrInvalidEdgeAuth)
+	}
+	if a.Login && len(a.users) == 0 {
+		return fmt.Errorf("%w: login page needs basic users", ErrInvalidEdgeAuth)
+	}
+	if len(a.Realm) == 0 {
+		a.Realm = "gt"
+	}
+	a.Realm = strings.NewReplacer(`"`, "", "\r", "", "\n", "").Replace(a.Realm)
+	a.digest = a.calDigest()
+	a.verified, err = lru.New[[32]byte, struct{}](256)
+	return
+}
+
+func (a *edgeAuth) calDigest() string {
+	users := make([]string, 0, len(a.users))
+	for user, hash := range a.users {
+		users = append(users, user+":"+hash)
+	}
+	sort.Strings(users)
+	tokens := make([]string, 0, len(a.tokens))
+	for token := range a.tokens {
+		tokens = append(tokens, hex.EncodeToString(token[:]))
+	}
+	sort.Strings(tokens)
+	h := sha256.New()
+	for _, s := range users {
+		h.Write([]byte(s))
+		h.Write([]byte{'\n'})
+	}
+	h.Write([]byte{0})
+	for _, s := range tokens {
+		h.Write([]byte(s))
+		h.Write([]byte{'\n'})
+	}
+	if a.Login {
+		h.Write([]byte("login"))
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// readHtpasswd 读取 htpasswd 文件，忽略空行与 # 开头的注释
+func readHtpasswd(path string) (entries []string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		err = fmt.Errorf("can not read htpasswd file, cause %s", err.Error())
+		return
+	}
+	defer f.Close()
+	scanner := stdbufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	err = scanner.Err()
+	return
+}
+
+// verifyBasic 验证 basic 用户名与密码
+func (a *edgeAuth) verifyBasic(user, password string) bool {
+	hash, ok := a.users[user]
+	if !ok {
+		return false
+	}
+	key := sha256.Sum256([]byte(user + ":" + password + ":" + hash))
+	if a.verified.Contains(key) {
+		return true
+	}
+	ok, err := verifyPassword(hash, password)
+	if err != nil || !ok {
+		return false
+	}
+	a.verified.Add(key, struct{}{})
+	return true
+}
+
+// verifyBearer 验证 bearer token
+func (a *edgeAuth) verifyBearer(token string) bool {
+	_, ok := a.tokens[sha256.Sum256([]byte(token))]
+	return ok
+}
+
+// verifyPasswordHash 校验 basic 用户的密码哈希，不是哈希时返回 errInvalidHash
+func verifyPasswordHash(hash string) error {
+	switch {
+	case strings.HasPrefix(hash, edgeAuthSHAPrefix):
+		b, err := base64.StdEncoding.DecodeString(hash[len(edgeAuthSHAPrefix):])
+		if err != nil || len(b) != sha1.Size {
+			return fmt.Errorf("invalid {SHA} hash")
+		}
+		return nil
+	case strings.HasPrefix(hash, edgeAuthAPR1Prefix):
+		parts := strings.Split(hash, "$")
+		if len(parts) != 4 || len(parts[3]) != 22 {
+			return fmt.Errorf("invalid $apr1$ hash")
+		}
+		return nil
+	case strings.HasPrefix(hash, storedKeyPrefix):
+		return fmt.Errorf("storedkey hash is not supported")
+	}
+	return verifyHash(hash)
+}
+
+// verifyPassword 验证密码与 htpasswd 风格的哈希是否匹配，不是哈希时按明文比较
+func verifyPassword(hash, password string) (ok bool, err error) {
+	switch {
+	case strings.HasPrefix(hash, edgeAuthSHAPrefix):
+		sum := sha1.Sum([]byte(password))
+		ok = subtle.ConstantTimeCompare([]byte(base64.StdEncoding.EncodeToString(sum[:])), []byte(hash[len(edgeAuthSHAPrefix):])) == 1
+	case strings.HasPrefix(hash, edgeAuthAPR1Prefix):
+		parts := strings.Split(hash, "$")
+		if len(parts) != 4 {
+			err = errInvalidHash
+			return
+		}
+		ok = subtle.ConstantTimeCompare([]byte(apr1(password, parts[2])), []byte(hash)) == 1
+	case isSlowHash(hash):
+		ok, err = verifyHashedSecret(hash, password)
+	default:
+		ok = subtle.ConstantTimeCompare([]byte(hash), []byte(password)) == 1
+	}
+	return
+}
+
+// apr1 是 Apache htpasswd 默认使用的基于 MD5 的哈希算法
+func apr1(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw, s := []byte(password), []byte(salt)
+	d := md5.New()
+	d.Write(pw)
+	d.Write([]byte(edgeAuthAPR1Prefix))
+	d.Write(s)
+	alt := md5.Sum(append(append(append([]byte{}, pw...), s...), pw...))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			d.Write(alt[:])
+		} else {
+			d.Write(alt[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+	sum := d.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		d = md5.New()
+		if i&1 == 1 {
+			d.Write(pw)
+		} else {
+			d.Write(sum)
+		}
+		if i%3 != 0 {
+			d.Write(s)
+		}
+		if i%7 != 0 {
+			d.Write(pw)
+		}
+		if i&1 == 1 {
+			d.Write(sum)
+		} else {
+			d.Write(pw)
+		}
+		sum = d.Sum(nil)
+	}
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	b := []byte(edgeAuthAPR1Prefix + salt + "$")
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			b = append(b, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	encode(uint32(sum[0])<<16|uint32(sum[6])<<8|uint32(sum[12]), 4)
+	encode(uint32(sum[1])<<16|uint32(sum[7])<<8|uint32(sum[13]), 4)
+	encode(uint32(sum[2])<<16|uint32(sum[8])<<8|uint32(sum[14]), 4)
+	encode(uint32(sum[3])<<16|uint32(sum[9])<<8|uint32(sum[15]), 4)
+	encode(uint32(sum[4])<<16|uint32(sum[10])<<8|uint32(sum[5]), 4)
+	encode(uint32(sum[11]), 2)
+	return string(b)
+}
+
+// edgeAuthPolicy 返回 host 前缀或域名 name 在服务端配置中的访问策略，"*" 作用于所有 http 服务
+func (h *host) edgeAuthPolicy(name string) *edgeAuth {
+	if a, ok := h.Auth[name]; ok {
+		return a
+	}
+	return h.Auth["*"]
+}
+
+// initEdgeAuth 解析服务端配置中的访问策略
+func initEdgeAuth(policies map[string]*edgeAuth) (err error) {
+	for name, a := range policies {
+		if a == nil {
+			return fmt.Errorf("%w: empty policy of '%s'", ErrInvalidEdgeAuth, name)
+		}
+		err = a.init(false)
+		if err != nil {
+			return fmt.Errorf("host '%s': %w", name, err)
+		}
+	}
+	return
+}
+
+// readEdgeAuth 读取 EdgeAuth option 中客户端声明的访问策略
+func (c *conn) readEdgeAuth(reader *bufio.Reader) (a *edgeAuth, err error) {
+	defer func() {
+		if err != nil {
+			c.Logger.Error().Err(err).Msg("failed to read edge auth")
+		}
+	}()
+	flags, err := reader.ReadByte()
+	if err != nil {
+		return
+	}
+	a = &edgeAuth{Login: flags&1 != 0}
+	readList := func() (list []string, err error) {
+		n, err := reader.ReadByte()
+		if err != nil {
+			return
+		}
+		if n > predef.MaxEdgeAuthEntries {
+			err = ErrInvalidEdgeAuth
+			return
+		}
+		for i := 0; i < int(n); i++ {
+			var l byte
+			l, err = reader.ReadByte()
+			if err != nil {
+				return
+			}
+			var b []byte
+			b, err = reader.Peek(int(l))
+			if err != nil {
+				return
+			}
+			list = append(list, string(b))
+			_, err = reader.Discard(int(l))
+			if err != nil {
+				return
+			}
+		}
+		return
+	}
+	a.Basic, err = readList()
+	if err != nil {
+		return
+	}
+	a.Bearer, err = readList()
+	if err != nil {
+		return
+	}
+	err = a.init(true)
+	return
+}
+
+// initEdgeAuthKey 设置签名登录 cookie 的密钥，没有配置时使用随机密钥
+func (s *Server) initEdgeAuthKey() (err error) {
+	if len(s.config.EdgeAuthKey) > 0 {
+		s.edgeAuthKey = []byte(s.config.EdgeAuthKey)
+		return
+	}
+	s.edgeAuthKey = make([]byte, 32)
+	_, err = rand.Read(s.edgeAuthKey)
+	return
+}
+
+// signSession 签发登录 cookie 的值：过期时间.用户名.签名，签名绑定 host、路由路径与策略摘要
+func (s *Server) signSession(name, path string, a *edgeAuth, user string, expiry int64) string {
+	exp := strconv.FormatInt(expiry, 10)
+	u := base64.RawURLEncoding.EncodeToString([]byte(user))
+	return exp + "." + u + "." + s.sessionSignature(name, path, a, exp, u)
+}
+
+func (s *Server) sessionSignature(name, path string, a *edgeAuth, exp, user string) string {
+	m := hmac.New(sha256.New, s.edgeAuthKey)
+	m.Write([]byte(name + "\n" + path + "\n" + a.digest + "\n" + exp + "\n" + user))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// verifySession 验证登录 cookie，用户被删除或密码变化后 cookie 失效
+func (s *Server) verifySession(name, path string, a *edgeAuth, value string) bool {
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		return false
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(s.sessionSignature(name, path, a, parts[0], parts[1]))) {
+		return false
+	}
+	user, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	_, ok := a.users[string(user)]
+	return ok
+}
+
+// authorize 验证请求的凭据，通过验证后删除转发给本地服务时不需要的凭据
+func (s *Server) authorize(req *connection.HTTPRequest, name, path string, a *edgeAuth) (ok bool) {
+	if v := req.Header.Get("Authorization"); len(v) > 0 {
+		scheme, credentials, _ := strings.Cut(v, " ")
+		credentials = strings.TrimSpace(credentials)
+		switch {
+		case strings.EqualFold(scheme, "Basic"):
+			if b, err := base64.StdEncoding.DecodeString(credentials); err == nil {
+				user, password, found := strings.Cut(string(b), ":")
+				ok = found && a.verifyBasic(user, password)
+			}
+		case strings.EqualFold(scheme, "Bearer"):
+			ok = a.verifyBearer(credentials)
+		}
+		if ok {
+			req.Header.Del("Authorization")
+		}
+	}
+	cookies, values := removeCookie(req.Header.Values("Cookie"), edgeAuthCookieName)
+	if len(values) == 0 {
+		return
+	}
+	for i := 0; !ok && a.Login && i < len(values); i++ {
+		ok = s.verifySession(name, path, a, values[i])
+	}
+	if ok {
+		req.Header.Del("Cookie")
+		for _, cookie := range cookies {
+			req.Header = append(req.Header, connection.HTTPHeaderField{Name: "Cookie", Value: cookie})
+		}
+	}
+	return
+}
+
+// removeCookie 从 Cookie 头部中取出名字为 name 的 cookie，返回剩下的头部与取出的值
+func removeCookie(headers []string, name string) (rest []string, values []string) {
+	for _, header := range headers {
+		var kept []string
+		for _, pair := range strings.Split(header, ";") {
+			pair = strings.TrimSpace(pair)
+			if k, v, ok := strings.Cut(pair, "="); ok && k == name {
+				values = append(values, v)
+				continue
+			}
+			if len(pair) > 0 {
+				kept = append(kept, pair)
+			}
+		}
+		if len(kept) > 0 {
+			rest = append(rest, strings.Join(kept, "; "))
+		}
+	}
+	return
+}
+
+// edgeAuthSubPath 返回请求路径中路由路径之后的部分
+func edgeAuthSubPath(req *connection.HTTPRequest, route hostRoute) string {
+	_, path, _ := requestPath(req.Target)
+	return strings.TrimPrefix(path, route.path)
+}
+
+// isEdgeAuthPath 判断请求是否为路由路径下的登录或登出请求
+func isEdgeAuthPath(req *connection.HTTPRequest, route hostRoute) bool {
+	if !route.auth.Login {
+		return false
+	}
+	p := edgeAuthSubPath(req, route)
+	return p == edgeAuthLoginPath || p == edgeAuthLogoutPath
+}
+
+var edgeAuthLoginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Realm}}</title>
+<style>
+body{font-family:sans-serif;background:#f5f5f5;display:flex;justify-content:center;padding-top:15vh}
+form{background:#fff;padding:2em;border-radius:8px;box-shadow:0 1px 4px rgba(0,0,0,.2);width:280px}
+input{display:block;width:100%;box-sizing:border-box;margin:.4em 0 1em;padding:.5em}
+button{width:100%;padding:.6em}
+.error{color:#c00}
+</style>
+</head>
+<body>
+<form method="post" action="{{.Action}}">
+<h2>{{.Realm}}</h2>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<label>Username<input name="username" autocomplete="username" autofocus required></label>
+<label>Password<input name="password" type="password" autocomplete="current-password" required></label>
+<input type="hidden" name="next" value="{{.Next}}">
+<button type="submit">Sign in</button>
+</form>
+</body>
+</html>
+`))
+
+// safeRedirect 只允许重定向到同一 host 下的路径，避免开放重定向
+func safeRedirect(next, fallback string) string {
+	if len(next) == 0 || next[0] != '/' || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") ||
+		strings.ContainsAny(next, "\r\n") {
+		return fallback
+	}
+	return next
+}
+
+// serveEdgeAuth 生成没有通过验证的请求与登录、登出请求的响应
+func (s *Server) serveEdgeAuth(l *localRequest, tls bool) (code int, header http.Header, body []byte) {
+	a := l.route.auth
+	header = make(http.Header)
+	header.Set("Cache-Control", "no-store")
+	cookiePath := l.route.path
+	if len(cookiePath) == 0 {
+		cookiePath = "/"
+	}
+	cookie := &http.Cookie{
+		Name:     edgeAuthCookieName,
+		Path:     cookiePath,
+		HttpOnly: true,
+		Secure:   tls,
+		SameSite: http.SameSiteLaxMode,
+	}
+	loginPage := func(code int, next, errMsg string) (int, http.Header, []byte) {
+		var b bytes.Buffer
+		_ = edgeAuthLoginPage.Execute(&b, struct {
+			Realm, Action, Next, Error string
+		}{a.Realm, l.route.path + edgeAuthLoginPath, safeRedirect(next, cookiePath), errMsg})
+		header.Set("Content-Type", "text/html; charset=utf-8")
+		return code, header, b.Bytes()
+	}
+
+	p := edgeAuthSubPath(l.req, l.route)
+	switch {
+	case a.Login && p == edgeAuthLoginPath && l.req.Method == http.MethodPost:
+		if l.tooLarge || len(l.req.Header.Get("Transfer-Encoding")) > 0 {
+			return http.StatusBadRequest, header, []byte("Bad Request\n")
+		}
+		form, err := url.ParseQuery(string(l.body))
+		if err != nil {
+			return http.StatusBadRequest, header, []byte("Bad Request\n")
+		}
+		user := form.Get("username")
+		next := form.Get("next")
+		if !a.verifyBasic(user, form.Get("password")) {
+			return loginPage(http.StatusUnauthorized, next, "Invalid username or password")
+		}
+		expiry := time.Now().Add(s.config.EdgeAuthSession.Duration)
+		cookie.Value = s.signSession(l.name, l.route.path, a, user, expiry.Unix())
+		cookie.Expires = expiry
+		header.Add("Set-Cookie", cookie.String())
+		header.Set("Location", safeRedirect(next, cookiePath))
+		return http.StatusSeeOther, header, nil
+	case a.Login && p == edgeAuthLogoutPath:
+		cookie.MaxAge = -1
+		header.Add("Set-Cookie", cookie.String())
+		header.Set("Location", cookiePath)
+		return http.StatusSeeOther, header, nil
+	case a.Login && (p == edgeAuthLoginPath || strings.Contains(l.req.Header.Get("Accept"), "text/html")):
+		next := l.req.Target
+		if p == edgeAuthLoginPath {
+			next = cookiePath
+		}
+		return loginPage(http.StatusUnauthorized, next, "")
+	}
+	if len(a.users) > 0 {
+		header.Add("WWW-Authenticate", `Basic realm="`+a.Realm+`", charset="UTF-8"`)
+	}
+	if len(a.tokens) > 0 {
+		header.Add("WWW-Authenticate", `Bearer realm="`+a.Realm+`"`)
+	}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	return http.StatusUnauthorized, header, []byte("Unauthorized\n")
+}
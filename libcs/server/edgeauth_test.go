@@ -0,0 +1,162 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	connection "github.com/isrc-cas/gt/conn"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 由 openssl passwd -apr1 与 htpasswd -s 生成
+	hashes := []string{
+		"$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/",
+		"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+		string(bcryptHash),
+		"password",
+	}
+	for _, hash := range hashes {
+		ok, err := verifyPassword(hash, "password")
+		if err != nil || !ok {
+			t.Errorf("verifyPassword(%q, password) = %v, %v", hash, ok, err)
+		}
+		ok, err = verifyPassword(hash, "wrong")
+		if err != nil || ok {
+			t.Errorf("verifyPassword(%q, wrong) = %v, %v", hash, ok, err)
+		}
+	}
+}
+
+func TestEdgeAuthInit(t *testing.T) {
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	err := os.WriteFile(htpasswd, []byte("# users\nbob:$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/\n\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &edgeAuth{Basic: []string{"alice:password"}, Htpasswd: htpasswd, Login: true}
+	err = a.init(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.verifyBasic("alice", "password") || !a.verifyBasic("bob", "password") || a.verifyBasic("bob", "wrong") {
+		t.Fatal("basic users are not verified")
+	}
+	if a.Realm != "gt" {
+		t.Fatalf("default realm is %q", a.Realm)
+	}
+
+	tests := []struct {
+		name        string
+		auth        edgeAuth
+		requireHash bool
+	}{
+		{"empty", edgeAuth{}, false},
+		{"no user", edgeAuth{Basic: []string{"password"}}, false},
+		{"plaintext from client", edgeAuth{Basic: []string{"alice:password"}}, true},
+		{"invalid hash", edgeAuth{Basic: []string{"alice:$2a$invalid"}}, false},
+		{"storedkey", edgeAuth{Basic: []string{"alice:" + storedKeyPrefix + "00"}}, false},
+		{"login without users", edgeAuth{Bearer: []string{"token"}, Login: true}, false},
+	}
+	for _, tt := range tests {
+		err := tt.auth.init(tt.requireHash)
+		if !errors.Is(err, ErrInvalidEdgeAuth) {
+			t.Errorf("%s: init() = %v", tt.name, err)
+		}
+	}
+}
+
+func TestEdgeAuthAuthorize(t *testing.T) {
+	s := &Server{edgeAuthKey: []byte("key")}
+	a := &edgeAuth{Basic: []string{"alice:password"}, Bearer: []string{"token"}, Login: true}
+	err := a.init(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := s.signSession("app", "/x", a, "alice", time.Now().Add(time.Hour).Unix())
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:password"))
+	tests := []struct {
+		name   string
+		header connection.HTTPHeader
+		ok     bool
+		rest   connection.HTTPHeader
+	}{
+		{"no credentials", nil, false, nil},
+		{"basic", connection.HTTPHeader{{Name: "Authorization", Value: basic}}, true, connection.HTTPHeader{}},
+		{"wrong basic", connection.HTTPHeader{{Name: "Authorization", Value: "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:x"))}}, false, nil},
+		{"bearer", connection.HTTPHeader{{Name: "authorization", Value: "bearer token"}}, true, connection.HTTPHeader{}},
+		{"wrong bearer", connection.HTTPHeader{{Name: "Authorization", Value: "Bearer x"}}, false, nil},
+		{
+			"cookie",
+			connection.HTTPHeader{{Name: "Cookie", Value: "a=1; gt_auth=" + session + "; b=2"}},
+			true,
+			connection.HTTPHeader{{Name: "Cookie", Value: "a=1; b=2"}},
+		},
+		{"only cookie", connection.HTTPHeader{{Name: "Cookie", Value: "gt_auth=" + session}}, true, connection.HTTPHeader{}},
+		{"forged cookie", connection.HTTPHeader{{Name: "Cookie", Value: "gt_auth=" + session + "x"}}, false, nil},
+	}
+	for _, tt := range tests {
+		req := &connection.HTTPRequest{Method: "GET", Target: "/x", Proto: "HTTP/1.1", Header: tt.header}
+		ok := s.authorize(req, "app", "/x", a)
+		if ok != tt.ok {
+			t.Errorf("%s: authorize() = %v", tt.name, ok)
+			continue
+		}
+		if ok && fmt.Sprint(req.Header) != fmt.Sprint(tt.rest) {
+			t.Errorf("%s: header forwarded to local is %q", tt.name, req.Header)
+		}
+	}
+
+	// cookie 绑定 host 与路由路径，过期后失效
+	if s.verifySession("other", "/x", a, session) || s.verifySession("app", "/y", a, session) {
+		t.Fatal("session is accepted by another route")
+	}
+	if s.verifySession("app", "/x", a, s.signSession("app", "/x", a, "alice", time.Now().Add(-time.Second).Unix())) {
+		t.Fatal("expired session is accepted")
+	}
+	if s.verifySession("app", "/x", a, s.signSession("app", "/x", a, "mallory", time.Now().Add(time.Hour).Unix())) {
+		t.Fatal("session of unknown user is accepted")
+	}
+}
+
+func TestSafeRedirect(t *testing.T) {
+	tests := []struct {
+		next     string
+		expected string
+	}{
+		{"/app?x=1", "/app?x=1"},
+		{"", "/"},
+		{"https://evil.test/", "/"},
+		{"//evil.test/", "/"},
+		{"/\\evil.test/", "/"},
+		{"/a\r\nSet-Cookie: x", "/"},
+	}
+	for _, tt := range tests {
+		if next := safeRedirect(tt.next, "/"); next != tt.expected {
+			t.Errorf("safeRedirect(%q) = %q, expected %q", tt.next, next, tt.expected)
+		}
+	}
+}
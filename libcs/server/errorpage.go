@@ -0,0 +1,209 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultErrorPage 是没有配置错误页面时使用的模板
+const defaultErrorPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Code}} {{.Status}}</title>
+</head>
+<body>
+<h1>{{.Code}} {{.Status}}</h1>
+<p>{{.Message}}</p>
+</body>
+</html>
+`
+
+var defaultErrorTemplate = template.Must(template.New("default").Parse(defaultErrorPage))
+
+// 错误页面中的说明
+const (
+	msgClientOffline      = "The client serving this host is offline."
+	msgQuotaExceeded      = "The traffic quota of this service is exhausted."
+	msgServiceUnreachable = "The client cannot reach the local service."
+	msgServiceTimeout     = "The local service did not respond in time."
+)
+
+// TLS alert 的描述，SNI 直通时无法返回 http 响应，只能返回 TLS alert
+const (
+	tlsAlertInternalError    = 80
+	tlsAlertUnrecognizedName = 112
+)
+
+// errorPageData 是渲染错误页面模板的数据
+type errorPageData struct {
+	Code    int    // http 状态码
+	Status  string // http 状态码的说明
+	Message string // 错误的说明
+	Host    string // 访问者请求的 host 前缀
+	User    string // host 前缀所属的用户，客户端离线时可能为空
+}
+
+// errorPages 是从 -errorPages 目录加载的错误页面模板，
+// 按 <host 前缀>/<状态码>.html、<用户>/<状态码>.html、<状态码>.html 的顺序查找
+type errorPages struct {
+	templates map[string]*template.Template
+}
+
+func (s *Server) initErrorPages() (err error) {
+	s.errorPages, err = loadErrorPages(s.config.ErrorPages)
+	return
+}
+
+func loadErrorPages(dir string) (p *errorPages, err error) {
+	p = &errorPages{templates: make(map[string]*template.Template)}
+	if len(dir) == 0 {
+		return
+	}
+	err = filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || filepath.Ext(path) != ".html" {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		key := strings.TrimSuffix(filepath.ToSlash(rel), ".html")
+		if strings.Count(key, "/") > 1 {
+			return nil
+		}
+		t, err := template.ParseFiles(path)
+		if err != nil {
+			return err
+		}
+		p.templates[key] = t
+		return nil
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to load error pages (-errorPages option): %w", err)
+	}
+	return
+}
+
+// lookup 按 host 前缀、用户的顺序查找状态码对应的模板
+func (p *errorPages) lookup(host, user string, code int) *template.Template {
+	if p != nil {
+		c := strconv.Itoa(code)
+		for _, key := range []string{host, user} {
+			if len(key) == 0 {
+				continue
+			}
+			if t, ok := p.templates[key+"/"+c]; ok {
+				return t
+			}
+		}
+		if t, ok := p.templates[c]; ok {
+			return t
+		}
+	}
+	return defaultErrorTemplate
+}
+
+// render 渲染错误页面，模板执行出错时使用默认模板
+func (p *errorPages) render(host, user string, code int, message string) []byte {
+	data := errorPageData{
+		Code:    code,
+		Status:  http.StatusText(code),
+		Message: message,
+		Host:    host,
+		User:    user,
+	}
+	var b bytes.Buffer
+	err := p.lookup(host, user, code).Execute(&b, data)
+	if err != nil {
+		b.Reset()
+		_ = defaultErrorTemplate.Execute(&b, data)
+	}
+	return b.Bytes()
+}
+
+// response 生成完整的 http 响应
+func (p *errorPages) response(host, user string, code int, message string) []byte {
+	body := p.render(host, user, code, message)
+	var b bytes.Buffer
+	_, _ = fmt.Fprintf(&b, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	b.WriteString("Content-Type: text/html; charset=utf-8\r\n")
+	b.WriteString("Cache-Control: no-store\r\n")
+	_, _ = fmt.Fprintf(&b, "Content-Length: %d\r\n", len(body))
+	b.WriteString("Connection: close\r\n\r\n")
+	b.Write(body)
+	return b.Bytes()
+}
+
+// tlsAlert 生成 fatal 级别的 TLS alert 记录
+func tlsAlert(description byte) []byte {
+	return []byte{21, 3, 3, 0, 2, 2, description}
+}
+
+// errorPage 说明 task 没有收到客户端的响应时如何告知访问者，nil 表示直接关闭访问者连接
+type errorPage struct {
+	tls  bool   // SNI 直通，返回 TLS alert
+	host string // 访问者请求的 host 前缀
+	user string
+}
+
+// offlineError 返回客户端无法处理 task 的错误对应的状态码与说明
+func offlineError(err error) (code int, message string, ok bool) {
+	switch {
+	case errors.Is(err, ErrIDNotFound), errors.Is(err, ErrNoTunnelExists):
+		return http.StatusServiceUnavailable, msgClientOffline, true
+	case errors.Is(err, ErrQuotaExceeded):
+		return http.StatusServiceUnavailable, msgQuotaExceeded, true
+	}
+	return
+}
+
+// writeErrorPage 在没有收到客户端的响应时告知访问者
+func (c *conn) writeErrorPage(code int, message string) {
+	p := c.errorPage
+	if p == nil || !c.responded.CompareAndSwap(false, true) {
+		return
+	}
+	var b []byte
+	if p.tls {
+		b = tlsAlert(tlsAlertInternalError)
+	} else {
+		b = c.server.errorPages.response(p.host, p.user, code, message)
+	}
+	n, err := c.Write(b)
+	c.access.out(n)
+	if err != nil {
+		c.Logger.Debug().Err(err).Int("code", code).Msg("failed to write error page")
+	}
+}
+
+// isTimeout 判断是否为读写超时的错误
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestErrorPagesLookup(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"503.html":        "default {{.Code}}",
+		"user/503.html":   "user {{.User}}",
+		"host/503.html":   "host {{.Host}}",
+		"broken/503.html": "{{.Missing}}",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p, err := loadErrorPages(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		host, user string
+		code       int
+		want       string
+	}{
+		{"host", "user", 503, "host host"},
+		{"other", "user", 503, "user user"},
+		{"other", "", 503, "default 503"},
+		{"host", "user", 502, "<h1>502 Bad Gateway</h1>"},
+		{"broken", "", 503, "<p>offline</p>"},
+	}
+	for _, c := range cases {
+		got := string(p.render(c.host, c.user, c.code, "offline"))
+		if !strings.Contains(got, c.want) {
+			t.Fatalf("render(%q, %q, %d) = %q, want %q", c.host, c.user, c.code, got, c.want)
+		}
+	}
+
+	resp := string(p.response("other", "", 503, "offline"))
+	if !strings.HasPrefix(resp, "HTTP/1.1 503 Service Unavailable\r\n") || !strings.HasSuffix(resp, "\r\n\r\ndefault 503") {
+		t.Fatalf("invalid response %q", resp)
+	}
+}
@@ -0,0 +1,392 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/isrc-cas/gt/bufio"
+	"github.com/isrc-cas/gt/predef"
+	"github.com/libp2p/go-reuseport"
+)
+
+// ErrInvalidGroup is an error returned when the group option of a service is invalid
+var ErrInvalidGroup = errors.New("invalid group")
+
+// ErrGroupMismatch is an error returned when the tcp port is held by another group
+var ErrGroupMismatch = errors.New("tcp port is held by another group")
+
+// ErrGroupNotSecure is an error returned when the group secret is sent over a tunnel without TLS
+var ErrGroupNotSecure = errors.New("group secret is not sent over a secure tunnel")
+
+// 服务组在成员之间分配访问者的策略
+const (
+	balanceRoundRobin = "round-robin"
+	balanceLeastTasks = "least-tasks"
+	balanceIPHash     = "ip-hash"
+)
+
+func checkGroupBalance(balance string) error {
+	switch balance {
+	case balanceRoundRobin, balanceLeastTasks, balanceIPHash:
+		return nil
+	}
+	return fmt.Errorf("invalid group balance (-groupBalance option) '%s'", balance)
+}
+
+// groupOption 是客户端为服务声明的组，组名与组密钥都相同的客户端可以共享同一个 host 前缀或 tcp 端口
+type groupOption struct {
+	name    string   // 带有所属 id 的组名，即 'owner/name'
+	secret  [32]byte // 组密钥的 sha256
+	balance string
+	standby bool // 备用成员，只在没有在线的主成员时接收访问者
+}
+
+func (g *groupOption) String() string {
+	s := g.name + "-" + strconv.FormatUint(uint64(g.secret[0])<<8|uint64(g.secret[1]), 16)
+	if g.standby {
+		s += "-standby"
+	}
+	return s
+}
+
+// readGroup 读取 Group option 中的组名与组密钥，没有指定所属 id 的组属于 id 本身
+func (c *conn) readGroup(reader *bufio.Reader, id string) (g *groupOption, err error) {
+	defer func() {
+		if err != nil {
+			c.Logger.Error().Err(err).Msg("failed to read group")
+		}
+	}()
+	var fields [2][]byte
+	for i := range fields {
+		var l byte
+		l, err = reader.ReadByte()
+		if err != nil {
+			return
+		}
+		if l == 0 || (i == 0 && l > predef.MaxGroupNameSize) {
+			err = ErrInvalidGroup
+			return
+		}
+		var b []byte
+		b, err = reader.Peek(int(l))
+		if err != nil {
+			return
+		}
+		fields[i] = append([]byte(nil), b...)
+		_, err = reader.Discard(int(l))
+		if err != nil {
+			return
+		}
+	}
+	// 组密钥是明文，只接受加密连接上的组，除非服务端允许明文认证
+	if !c.secure && !c.server.config.PlaintextAuth {
+		err = ErrGroupNotSecure
+		return
+	}
+	name := string(fields[0])
+	if !strings.Contains(name, "/") {
+		name = id + "/" + name
+	}
+	g = &groupOption{
+		name:    name,
+		secret:  sha256.Sum256(fields[1]),
+		balance: c.server.config.GroupBalance,
+	}
+	return
+}
+
+// groupMember 是服务组的成员
+type groupMember struct {
+	clientWithServiceIndex
+	standby bool
+}
+
+// serviceGroup 是共享同一个 host 前缀或 tcp 端口的客户端服务，访问者的连接按策略分配到在线的成员。
+// 主成员都没有 tunnel 时由备用成员接管，主成员恢复后访问者的新连接重新分配到主成员。
+type serviceGroup struct {
+	groupOption
+	mtx      sync.RWMutex
+	members  []groupMember
+	next     atomic.Uint32
+	promoted atomic.Bool // 备用成员是否正在接管
+}
+
+func newServiceGroup(o *groupOption, m clientWithServiceIndex) *serviceGroup {
+	return &serviceGroup{
+		groupOption: *o,
+		members:     []groupMember{{clientWithServiceIndex: m, standby: o.standby}},
+	}
+}
+
+// accepts 判断客户端声明的组能否加入该服务组
+func (g *serviceGroup) accepts(o *groupOption) bool {
+	return o != nil && o.name == g.name && subtle.ConstantTimeCompare(o.secret[:], g.secret[:]) == 1
+}
+
+// join 加入成员，客户端已经是成员时更新服务序号与是否为备用成员
+func (g *serviceGroup) join(m clientWithServiceIndex, standby bool) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	for i := range g.members {
+		if g.members[i].client == m.client {
+			g.members[i].serviceIndex = m.serviceIndex
+			g.members[i].standby = standby
+			return
+		}
+	}
+	g.members = append(g.members, groupMember{clientWithServiceIndex: m, standby: standby})
+}
+
+// leave 移除客户端，返回组是否已经没有成员
+func (g *serviceGroup) leave(cli *client) (empty bool) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	for i := range g.members {
+		if g.members[i].client == cli {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+	return len(g.members) == 0
+}
+
+// serving 判断 m 是否为组中可以接收访问者的成员，主成员在线时备用成员不接收访问者
+func (g *serviceGroup) serving(m clientWithServiceIndex) bool {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+	found := false
+	for _, member := range g.members {
+		if member.clientWithServiceIndex == m {
+			if !member.standby {
+				return m.client.online()
+			}
+			found = true
+		}
+	}
+	if !found || !m.client.online() {
+		return false
+	}
+	return !g.primaryOnline()
+}
+
+// primaryOnline 判断是否有在线的主成员，调用时需要持有读锁
+func (g *serviceGroup) primaryOnline() bool {
+	for _, member := range g.members {
+		if !member.standby && member.client.online() {
+			return true
+		}
+	}
+	return false
+}
+
+// size 返回成员数量
+func (g *serviceGroup) size() int {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+	return len(g.members)
+}
+
+// pick 为访问者选择一个在线的成员，没有 tunnel 的成员不参与分配，主成员都不在线时选择备用成员
+func (g *serviceGroup) pick(visitor net.Addr) (m clientWithServiceIndex, ok bool) {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+	m, ok = g.pickFrom(visitor, false)
+	if ok {
+		if g.promoted.CompareAndSwap(true, false) {
+			m.client.logger.Info().Str("group", g.name).Msg("primary member of the group is back online")
+		}
+		return
+	}
+	m, ok = g.pickFrom(visitor, true)
+	if ok && g.promoted.CompareAndSwap(false, true) {
+		m.client.logger.Info().Str("group", g.name).Msg("standby member of the group promoted")
+	}
+	return
+}
+
+// pickFrom 按策略在主成员或备用成员中选择，调用时需要持有读锁
+func (g *serviceGroup) pickFrom(visitor net.Addr, standby bool) (m clientWithServiceIndex, ok bool) {
+	n := len(g.members)
+	switch g.balance {
+	case balanceLeastTasks:
+		var least uint32
+		for _, member := range g.members {
+			if member.standby != standby || !member.client.online() {
+				continue
+			}
+			if tasks := member.client.tasks(); !ok || tasks < least {
+				m, least, ok = member.clientWithServiceIndex, tasks, true
+			}
+		}
+	case balanceIPHash:
+		// rendezvous hashing，成员变化时只有该成员的访问者被重新分配
+		ip := visitor.String()
+		if host, _, e := net.SplitHostPort(ip); e == nil {
+			ip = host
+		}
+		var highest uint64
+		for _, member := range g.members {
+			if member.standby != standby || !member.client.online() {
+				continue
+			}
+			h := fnv.New64a()
+			_, _ = h.Write([]byte(ip))
+			_, _ = h.Write([]byte{0})
+			_, _ = h.Write([]byte(member.client.id))
+			_, _ = h.Write([]byte{byte(member.serviceIndex >> 8), byte(member.serviceIndex)})
+			if w := h.Sum64(); !ok || w > highest {
+				m, highest, ok = member.clientWithServiceIndex, w, true
+			}
+		}
+	default:
+		start := int(g.next.Add(1))
+		for i := 0; i < n; i++ {
+			member := g.members[(start+i)%n]
+			if member.standby == standby && member.client.online() {
+				return member.clientWithServiceIndex, true
+			}
+		}
+	}
+	return
+}
+
+// balance 返回处理访问者的路由，服务组的路由按策略选择成员
+func (r hostRoute) balance(visitor net.Addr) (hostRoute, bool) {
+	if r.group == nil {
+		return r, true
+	}
+	m, ok := r.group.pick(visitor)
+	r.clientWithServiceIndex = m
+	return r, ok
+}
+
+// online 判断客户端是否有可用的 tunnel
+func (c *client) online() bool {
+	c.tunnelsRWMtx.RLock()
+	defer c.tunnelsRWMtx.RUnlock()
+	return len(c.tunnels) > 0
+}
+
+// tasks 返回客户端所有 tunnel 上正在处理的 task 数量
+func (c *client) tasks() (n uint32) {
+	c.tunnelsRWMtx.RLock()
+	defer c.tunnelsRWMtx.RUnlock()
+	for t := range c.tunnels {
+		n += t.TasksCount.Load()
+	}
+	return
+}
+
+// tcpGroup 是服务组共享的 tcp 端口，最后一个成员离开时关闭
+type tcpGroup struct {
+	*serviceGroup
+	server   *Server
+	port     uint16
+	listener net.Listener
+	ports    *portsManager // 端口所属的端口池，关闭时归还
+}
+
+// joinTCPGroup 加入监听 port 的服务组，端口还没有被服务组打开时由 cli 打开
+func (s *Server) joinTCPGroup(o openTCPOption, m clientWithServiceIndex, tunnel *conn) (g *tcpGroup, err error) {
+	s.tcpGroupsMtx.Lock()
+	defer s.tcpGroupsMtx.Unlock()
+	cli := m.client
+	if g = s.tcpGroups[o.port]; g != nil {
+		if !g.accepts(o.group) {
+			return nil, ErrGroupMismatch
+		}
+		if g.ports != cli.portsManager && !cli.portsManager.has(o.port) {
+			return nil, fmt.Errorf("tcp port %d is not allowed", o.port)
+		}
+		g.join(m, o.group.standby)
+		return
+	}
+
+	cli.portsManager.portsMtx.Lock()
+	defer cli.portsManager.portsMtx.Unlock()
+	if _, ok := cli.portsManager.ports[o.port]; !ok {
+		return nil, fmt.Errorf("tcp port %d is not available", o.port)
+	}
+	listener, err := reuseport.Listen("tcp", ":"+strconv.Itoa(int(o.port)))
+	if err != nil {
+		return
+	}
+	delete(cli.portsManager.ports, o.port)
+	tunnel.Logger.Info().Uint16("port", o.port).Str("group", o.group.name).Msg("tcp port opened for group")
+	g = &tcpGroup{
+		serviceGroup: newServiceGroup(o.group, m),
+		server:       s,
+		port:         o.port,
+		listener:     listener,
+		ports:        cli.portsManager,
+	}
+	if s.tcpGroups == nil {
+		s.tcpGroups = make(map[uint16]*tcpGroup)
+	}
+	s.tcpGroups[o.port] = g
+
+	go s.acceptLoop(s.proxyProtocolListen(listener, s.config.TCPProxyProtocol), func(conn *conn) {
+		conn.handleTCP(func() {
+			target, ok := g.pick(conn.RemoteAddr())
+			if !ok {
+				conn.Logger.Info().Uint16("tcpPort", g.port).Str("group", g.name).Msg("no member of the group is online")
+				return
+			}
+			conn.serviceIndex = target.serviceIndex
+			if !s.serviceVisitorAllowed(conn.RemoteAddr(), target.client, target.serviceIndex) {
+				conn.Logger.Info().Uint16("tcpPort", g.port).Msg("visitor ip is not allowed")
+				return
+			}
+			err := target.process(conn)
+			if err != nil {
+				conn.Logger.Error().Err(err).Msg("tcp handle")
+			}
+		})
+	})
+	return
+}
+
+// leave 移除客户端，最后一个成员离开时关闭端口并归还到端口池
+func (g *tcpGroup) leave(cli *client) {
+	g.server.tcpGroupsMtx.Lock()
+	defer g.server.tcpGroupsMtx.Unlock()
+	if !g.serviceGroup.leave(cli) || g.server.tcpGroups[g.port] != g {
+		return
+	}
+	delete(g.server.tcpGroups, g.port)
+	cli.logger.Info().Uint16("port", g.port).Str("group", g.name).Msg("close group tcp listener")
+	g.ports.portsMtx.Lock()
+	g.ports.ports[g.port] = struct{}{}
+	g.ports.portsMtx.Unlock()
+	_ = g.listener.Close()
+}
+
+// has 判断端口是否在端口池中
+func (p *portsManager) has(port uint16) bool {
+	p.portsMtx.Lock()
+	defer p.portsMtx.Unlock()
+	_, ok := p.ports[port]
+	return ok
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/isrc-cas/gt/bufio"
+)
+
+func TestServiceGroupPick(t *testing.T) {
+	newMember := func(id string, tasks ...uint32) clientWithServiceIndex {
+		c := &client{id: id, tunnels: make(map[*conn]struct{})}
+		for _, n := range tasks {
+			tunnel := &conn{}
+			tunnel.TasksCount.Store(n)
+			c.tunnels[tunnel] = struct{}{}
+		}
+		return clientWithServiceIndex{client: c}
+	}
+	a := newMember("a", 3, 2)
+	b := newMember("b", 1)
+	offline := newMember("offline")
+	visitor := &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234}
+
+	g := newServiceGroup(&groupOption{name: "g", balance: balanceRoundRobin}, a)
+	g.join(offline, false)
+	g.join(b, false)
+	seen := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		m, ok := g.pick(visitor)
+		if !ok {
+			t.Fatal("no member picked")
+		}
+		seen[m.client.id]++
+	}
+	if seen["offline"] != 0 || seen["a"] == 0 || seen["b"] == 0 {
+		t.Fatalf("round-robin picked %v", seen)
+	}
+
+	g.balance = balanceLeastTasks
+	if m, _ := g.pick(visitor); m != b {
+		t.Fatalf("least-tasks picked %s", m.client.id)
+	}
+
+	// 同一个访问者 IP 总是分配到同一个成员，其它成员离开时不受影响
+	g.balance = balanceIPHash
+	first, _ := g.pick(visitor)
+	for i := 0; i < 3; i++ {
+		visitor.Port++
+		if m, _ := g.pick(visitor); m != first {
+			t.Fatalf("ip-hash picked %s then %s", first.client.id, m.client.id)
+		}
+	}
+	g.leave(offline.client)
+	if m, _ := g.pick(visitor); m != first {
+		t.Fatalf("ip-hash changed after an offline member left")
+	}
+
+	if g.leave(a.client) || !g.leave(b.client) {
+		t.Fatal("group should be empty after all members left")
+	}
+	if _, ok := g.pick(visitor); ok {
+		t.Fatal("empty group picked a member")
+	}
+}
+
+func TestServiceGroupStandby(t *testing.T) {
+	primary := clientWithServiceIndex{client: &client{id: "primary", tunnels: map[*conn]struct{}{{}: {}}}}
+	standby := clientWithServiceIndex{client: &client{id: "standby", tunnels: map[*conn]struct{}{{}: {}}}}
+	visitor := &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234}
+
+	g := newServiceGroup(&groupOption{name: "g", balance: balanceRoundRobin}, primary)
+	g.join(standby, true)
+	for i := 0; i < 3; i++ {
+		if m, _ := g.pick(visitor); m != primary {
+			t.Fatalf("picked %s while the primary is online", m.client.id)
+		}
+	}
+	if g.serving(standby) {
+		t.Fatal("standby is serving while the primary is online")
+	}
+
+	// 主成员的 tunnel 全部关闭后备用成员接管
+	tunnels := primary.client.tunnels
+	primary.client.tunnels = map[*conn]struct{}{}
+	if m, ok := g.pick(visitor); !ok || m != standby {
+		t.Fatal("standby is not promoted after the primary went offline")
+	}
+	if !g.serving(standby) || !g.promoted.Load() {
+		t.Fatal("standby should be serving")
+	}
+
+	primary.client.tunnels = tunnels
+	if m, _ := g.pick(visitor); m != primary || g.promoted.Load() {
+		t.Fatal("primary should take over again after it is back online")
+	}
+}
+
+func TestReadGroup(t *testing.T) {
+	option := func(name, secret string) *bufio.Reader {
+		b := []byte{byte(len(name))}
+		b = append(b, name...)
+		b = append(b, byte(len(secret)))
+		b = append(b, secret...)
+		return bufio.NewReader(bytes.NewReader(b))
+	}
+	c := &conn{server: &Server{}, secure: true}
+	for _, v := range [][2]string{
+		{"web", "id1/web"},
+		{"id2/web", "id2/web"},
+	} {
+		g, err := c.readGroup(option(v[0], "secret"), "id1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g.name != v[1] {
+			t.Fatalf("group %q is read as %q, want %q", v[0], g.name, v[1])
+		}
+	}
+
+	// 未加密的连接上只有允许明文认证时才接受组
+	c.secure = false
+	_, err := c.readGroup(option("web", "secret"), "id1")
+	if !errors.Is(err, ErrGroupNotSecure) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	c.server.config.PlaintextAuth = true
+	_, err = c.readGroup(option("web", "secret"), "id1")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
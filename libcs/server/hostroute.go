@@ -0,0 +1,217 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	gosync "sync"
+
+	"github.com/isrc-cas/gt/predef"
+)
+
+// ErrInvalidRoutePath is an error returned when the path of a host prefix route is invalid
+var ErrInvalidRoutePath = errors.New("invalid route path")
+
+// hostRoute 是 host 前缀下某个路径前缀对应的服务
+type hostRoute struct {
+	clientWithServiceIndex
+	path  string        // 以 / 开头且不以 / 结尾，为空表示整个 host 前缀
+	strip bool          // 转发前从请求路径中去掉 path
+	auth  *edgeAuth     // 访问策略，为 nil 时不验证访问者
+	group *serviceGroup // 共享该路由的服务组，不为 nil 时按负载均衡策略选择 clientWithServiceIndex
+}
+
+// routeKey 是路由在 hostPrefixOptions 与 routeTable 中的 key。host 前缀不包含 /，所以 key 可以无歧义地拆分
+func routeKey(hostPrefix, path string) string {
+	return hostPrefix + path
+}
+
+func splitRouteKey(key string) (hostPrefix, path string) {
+	i := strings.IndexByte(key, '/')
+	if i < 0 {
+		return key, ""
+	}
+	return key[:i], key[i:]
+}
+
+// cleanRoutePath 校验路由路径并去掉结尾的 /，"/" 等价于空路径
+func cleanRoutePath(path string) (string, error) {
+	if len(path) == 0 {
+		return "", nil
+	}
+	if path[0] != '/' || len(path) > predef.MaxRoutePathSize ||
+		strings.ContainsAny(path, "?# \t\r\n") || strings.Contains(path, "//") {
+		return "", ErrInvalidRoutePath
+	}
+	return strings.TrimRight(path, "/"), nil
+}
+
+// requestPath 返回请求目标中的路径部分，支持 origin-form 与 absolute-form
+func requestPath(target string) (prefix, path, query string) {
+	if !strings.HasPrefix(target, "/") {
+		i := strings.Index(target, "://")
+		if i < 0 {
+			return target, "", ""
+		}
+		j := strings.IndexByte(target[i+3:], '/')
+		if j < 0 {
+			return target, "", ""
+		}
+		prefix, target = target[:i+3+j], target[i+3+j:]
+	}
+	if i := strings.IndexAny(target, "?#"); i >= 0 {
+		return prefix, target[:i], target[i:]
+	}
+	return prefix, target, ""
+}
+
+// matchPath 判断请求路径 path 是否在路由路径 routePath 之下，"/api" 匹配 "/api" 与 "/api/x"，不匹配 "/apix"
+func matchPath(routePath, path string) bool {
+	if !strings.HasPrefix(path, routePath) {
+		return false
+	}
+	return len(path) == len(routePath) || path[len(routePath)] == '/'
+}
+
+// stripPath 从请求目标中去掉路由路径
+func stripPath(target, routePath string) string {
+	prefix, path, query := requestPath(target)
+	if !matchPath(routePath, path) {
+		return target
+	}
+	path = path[len(routePath):]
+	if len(path) == 0 {
+		path = "/"
+	}
+	return prefix + path + query
+}
+
+// routeTable 是 host 前缀或域名到服务的路由表，同一 host 前缀下按路径最长前缀匹配
+type routeTable struct {
+	mtx   gosync.RWMutex
+	hosts map[string][]hostRoute // 按 path 长度降序排列
+}
+
+// lookup 返回 hostPrefix 下与请求路径最长匹配的路由
+func (t *routeTable) lookup(hostPrefix, target string) (r hostRoute, ok bool) {
+	_, path, _ := requestPath(target)
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	for _, route := range t.hosts[hostPrefix] {
+		if matchPath(route.path, path) {
+			return route, true
+		}
+	}
+	return
+}
+
+// has 判断 hostPrefix 下是否存在路由
+func (t *routeTable) has(hostPrefix string) bool {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return len(t.hosts[hostPrefix]) > 0
+}
+
+// hasPaths 判断 hostPrefix 下是否存在带路径的路由
+func (t *routeTable) hasPaths(hostPrefix string) bool {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	routes := t.hosts[hostPrefix]
+	return len(routes) > 0 && routes[0].path != ""
+}
+
+// hasAuth 判断 hostPrefix 下是否存在需要验证访问者的路由
+func (t *routeTable) hasAuth(hostPrefix string) bool {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	for _, route := range t.hosts[hostPrefix] {
+		if route.auth != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *routeTable) find(hostPrefix, path string) (i int, ok bool) {
+	for i, route := range t.hosts[hostPrefix] {
+		if route.path == path {
+			return i, true
+		}
+	}
+	return
+}
+
+func (t *routeTable) insert(hostPrefix string, r hostRoute) {
+	if t.hosts == nil {
+		t.hosts = make(map[string][]hostRoute)
+	}
+	routes := append(t.hosts[hostPrefix], r)
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].path) > len(routes[j].path)
+	})
+	t.hosts[hostPrefix] = routes
+}
+
+func (t *routeTable) loadOrCreate(key string, fn func() hostRoute) (actual hostRoute, loaded bool) {
+	hostPrefix, path := splitRouteKey(key)
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if i, ok := t.find(hostPrefix, path); ok {
+		return t.hosts[hostPrefix][i], true
+	}
+	actual = fn()
+	actual.path = path
+	t.insert(hostPrefix, actual)
+	return
+}
+
+func (t *routeTable) store(key string, r hostRoute) {
+	hostPrefix, path := splitRouteKey(key)
+	r.path = path
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if i, ok := t.find(hostPrefix, path); ok {
+		if g := t.hosts[hostPrefix][i].group; g != nil && r.group != nil && g.accepts(&r.group.groupOption) {
+			// 服务组的路由只更新成员
+			m := r.group.members[0]
+			g.join(m.clientWithServiceIndex, m.standby)
+			return
+		}
+		t.hosts[hostPrefix][i] = r
+		return
+	}
+	t.insert(hostPrefix, r)
+}
+
+func (t *routeTable) delete(key string, cli *client) {
+	hostPrefix, path := splitRouteKey(key)
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	i, ok := t.find(hostPrefix, path)
+	if !ok {
+		return
+	}
+	routes := t.hosts[hostPrefix]
+	if g := routes[i].group; g != nil && !g.leave(cli) {
+		return
+	}
+	if len(routes) == 1 {
+		delete(t.hosts, hostPrefix)
+		return
+	}
+	t.hosts[hostPrefix] = append(routes[:i], routes[i+1:]...)
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+)
+
+func TestRouteTableLookup(t *testing.T) {
+	var table routeTable
+	for i, key := range []string{"a", "a/api", "a/api/v1", "b/app"} {
+		table.store(key, hostRoute{clientWithServiceIndex: clientWithServiceIndex{serviceIndex: uint16(i)}})
+	}
+	tests := []struct {
+		hostPrefix string
+		target     string
+		ok         bool
+		path       string
+	}{
+		{"a", "/", true, ""},
+		{"a", "/apix", true, ""},
+		{"a", "/api", true, "/api"},
+		{"a", "/api?x=1", true, "/api"},
+		{"a", "/api/v1/users", true, "/api/v1"},
+		{"a", "http://a.example.com/api/v2", true, "/api"},
+		{"a", "*", true, ""},
+		{"b", "/app/x", true, "/app"},
+		{"b", "/", false, ""},
+		{"c", "/", false, ""},
+	}
+	for _, tt := range tests {
+		r, ok := table.lookup(tt.hostPrefix, tt.target)
+		if ok != tt.ok || r.path != tt.path {
+			t.Fatalf("lookup(%q, %q) = %q, %v, expected %q, %v", tt.hostPrefix, tt.target, r.path, ok, tt.path, tt.ok)
+		}
+	}
+	if !table.hasPaths("a") || !table.hasPaths("b") || table.hasPaths("c") {
+		t.Fatal("invalid hasPaths")
+	}
+
+	table.delete("a/api/v1", nil)
+	r, ok := table.lookup("a", "/api/v1/users")
+	if !ok || r.path != "/api" {
+		t.Fatalf("invalid route %q after delete", r.path)
+	}
+	table.delete("a/api", nil)
+	if table.hasPaths("a") {
+		t.Fatal("invalid hasPaths after delete")
+	}
+	table.delete("b/app", nil)
+	if _, ok = table.lookup("b", "/app"); ok {
+		t.Fatal("route is not deleted")
+	}
+}
+
+func TestStripPath(t *testing.T) {
+	tests := []struct {
+		target   string
+		path     string
+		expected string
+	}{
+		{"/api", "/api", "/"},
+		{"/api/", "/api", "/"},
+		{"/api/users?q=/api", "/api", "/users?q=/api"},
+		{"/api?q=1", "/api", "/?q=1"},
+		{"/apix", "/api", "/apix"},
+		{"http://a.example.com/api/users", "/api", "http://a.example.com/users"},
+	}
+	for _, tt := range tests {
+		if got := stripPath(tt.target, tt.path); got != tt.expected {
+			t.Fatalf("stripPath(%q, %q) = %q, expected %q", tt.target, tt.path, got, tt.expected)
+		}
+	}
+}
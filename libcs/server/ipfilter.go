@@ -0,0 +1,374 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	gosync "sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/isrc-cas/gt/bufio"
+	"github.com/isrc-cas/gt/config"
+	"github.com/isrc-cas/gt/predef"
+	"github.com/isrc-cas/gt/util"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrInvalidIPFilter is an error returned when the allowed or denied CIDRs are invalid
+var ErrInvalidIPFilter = errors.New("invalid ip filter")
+
+// ipRules 是允许与拒绝访问的 CIDR 或 IP 列表
+type ipRules struct {
+	Allow config.Slice[string] `yaml:"allow,omitempty" json:",omitempty"`
+	Deny  config.Slice[string] `yaml:"deny,omitempty" json:",omitempty"`
+}
+
+// userIPRules 是访问者与客户端登录的访问规则
+type userIPRules struct {
+	Visitors ipRules `yaml:"visitors,omitempty" json:",omitempty"`
+	Clients  ipRules `yaml:"clients,omitempty" json:",omitempty"`
+}
+
+// ipFilterConfig 是 ipFilterFile 的内容，顶层的规则作用于所有用户，users 中的规则只作用于对应的用户
+type ipFilterConfig struct {
+	userIPRules `yaml:",inline"`
+	Users       map[string]userIPRules `yaml:"users,omitempty"`
+}
+
+// ipFilter 先检查拒绝列表，允许列表不为空时只允许列表中的地址
+type ipFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// newIPFilter 解析允许与拒绝访问的 CIDR，两个列表都为空时返回 nil
+func newIPFilter(allow, deny []string) (f *ipFilter, err error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return
+	}
+	f = &ipFilter{}
+	for _, list := range []struct {
+		cidrs []string
+		nets  *[]*net.IPNet
+	}{{allow, &f.allow}, {deny, &f.deny}} {
+		for _, cidr := range list.cidrs {
+			var ipNet *net.IPNet
+			ipNet, err = util.ParseCIDR(cidr)
+			if err != nil {
+				err = fmt.Errorf("%w: '%s', cause %s", ErrInvalidIPFilter, cidr, err.Error())
+				return
+			}
+			*list.nets = append(*list.nets, ipNet)
+		}
+	}
+	return
+}
+
+// allowed 判断 ip 是否可以访问，nil 表示不限制
+func (f *ipFilter) allowed(ip net.IP) bool {
+	if f == nil {
+		return true
+	}
+	if ip == nil {
+		return len(f.allow) == 0
+	}
+	for _, n := range f.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, n := range f.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *ipFilter) String() string {
+	if f == nil {
+		return ""
+	}
+	var sb strings.Builder
+	for _, n := range f.allow {
+		sb.WriteString("+")
+		sb.WriteString(n.String())
+	}
+	for _, n := range f.deny {
+		sb.WriteString("-")
+		sb.WriteString(n.String())
+	}
+	return sb.String()
+}
+
+// remoteIP 返回访问者或客户端的 IP，PROXY protocol 连接返回头部中的地址
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// userIPFilters 是访问者与客户端登录的过滤器
+type userIPFilters struct {
+	visitors *ipFilter
+	clients  *ipFilter
+}
+
+func newUserIPFilters(rules userIPRules) (f userIPFilters, err error) {
+	f.visitors, err = newIPFilter(rules.Visitors.Allow, rules.Visitors.Deny)
+	if err != nil {
+		return
+	}
+	f.clients, err = newIPFilter(rules.Clients.Allow, rules.Clients.Deny)
+	return
+}
+
+// ipFilters 是某一时刻生效的全部过滤器
+type ipFilters struct {
+	userIPFilters // 作用于所有用户
+	users         map[string]userIPFilters
+}
+
+// ipFilterStore 保存命令行与 ipFilterFile 中的规则，文件变化后重新加载。
+// 重新加载只影响之后的访问者连接、请求与客户端登录。
+type ipFilterStore struct {
+	path   string
+	global userIPRules // 命令行与配置文件中的规则
+	logger zerolog.Logger
+
+	filters atomic.Pointer[ipFilters]
+	stamp   string // 已加载文件的修改时间与大小
+
+	closeOnce gosync.Once
+	closed    chan struct{}
+}
+
+func newIPFilterStore(path string, global userIPRules, l zerolog.Logger) (st *ipFilterStore, err error) {
+	st = &ipFilterStore{
+		path:   path,
+		global: global,
+		logger: l,
+		closed: make(chan struct{}),
+	}
+	_, err = st.reload()
+	return
+}
+
+// pathStamp 返回文件的修改时间与大小，文件不存在时返回空字符串
+func pathStamp(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", info.ModTime().UnixNano(), info.Size())
+}
+
+// reload 在文件变化时重新加载规则。加载失败时保留原来的规则，下次检查时再次尝试
+func (st *ipFilterStore) reload() (reloaded bool, err error) {
+	stamp := pathStamp(st.path)
+	if st.filters.Load() != nil && stamp == st.stamp {
+		return
+	}
+	var conf ipFilterConfig
+	if len(st.path) > 0 {
+		var b []byte
+		b, err = os.ReadFile(st.path)
+		if err != nil {
+			err = fmt.Errorf("can not read ip filter file '%s', cause %s", st.path, err.Error())
+			return
+		}
+		err = yaml.Unmarshal(b, &conf)
+		if err != nil {
+			err = fmt.Errorf("invalid ip filter file '%s', cause %s", st.path, err.Error())
+			return
+		}
+	}
+	rules := st.global
+	rules.Visitors.Allow = append(append(config.Slice[string](nil), rules.Visitors.Allow...), conf.Visitors.Allow...)
+	rules.Visitors.Deny = append(append(config.Slice[string](nil), rules.Visitors.Deny...), conf.Visitors.Deny...)
+	rules.Clients.Allow = append(append(config.Slice[string](nil), rules.Clients.Allow...), conf.Clients.Allow...)
+	rules.Clients.Deny = append(append(config.Slice[string](nil), rules.Clients.Deny...), conf.Clients.Deny...)
+	filters := &ipFilters{users: make(map[string]userIPFilters, len(conf.Users))}
+	filters.userIPFilters, err = newUserIPFilters(rules)
+	if err != nil {
+		return
+	}
+	for id, r := range conf.Users {
+		var f userIPFilters
+		f, err = newUserIPFilters(r)
+		if err != nil {
+			err = fmt.Errorf("user '%s': %w", id, err)
+			return
+		}
+		filters.users[id] = f
+	}
+	st.filters.Store(filters)
+	st.stamp = stamp
+	reloaded = true
+	return
+}
+
+// load 返回当前生效的过滤器，没有 store 时不限制
+func (st *ipFilterStore) load() *ipFilters {
+	if st == nil {
+		return &ipFilters{}
+	}
+	return st.filters.Load()
+}
+
+// watch 每隔 interval 检查 ipFilterFile 是否变化
+func (st *ipFilterStore) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-st.closed:
+			return
+		case <-ticker.C:
+		}
+		reloaded, err := st.reload()
+		if err != nil {
+			st.logger.Warn().Err(err).Msg("failed to reload ip filters")
+			continue
+		}
+		if reloaded {
+			st.logger.Info().Int("users", len(st.load().users)).Msg("ip filters reloaded")
+		}
+	}
+}
+
+func (st *ipFilterStore) close() {
+	st.closeOnce.Do(func() {
+		close(st.closed)
+	})
+}
+
+// initIPFilters 加载命令行与 ipFilterFile 中的规则，并按 ipFilterWatchInterval 检查文件变化
+func (s *Server) initIPFilters() (err error) {
+	global := userIPRules{
+		Visitors: ipRules{Allow: s.config.AllowIPs, Deny: s.config.DenyIPs},
+		Clients:  ipRules{Allow: s.config.ClientAllowIPs, Deny: s.config.ClientDenyIPs},
+	}
+	s.ipFilters, err = newIPFilterStore(s.config.IPFilterFile, global, s.Logger.With().Str("scope", "ipFilter").Logger())
+	if err != nil {
+		return
+	}
+	if len(s.config.IPFilterFile) > 0 && s.config.IPFilterWatchInterval.Duration > 0 {
+		go s.ipFilters.watch(s.config.IPFilterWatchInterval.Duration)
+	}
+	return
+}
+
+// visitorAllowed 判断访问者是否可以连接服务端，在知道访问的服务之前检查
+func (s *Server) visitorAllowed(addr net.Addr) bool {
+	return s.ipFilters.load().visitors.allowed(remoteIP(addr))
+}
+
+// serviceVisitorAllowed 判断访问者是否可以访问客户端的服务，检查用户与服务的规则
+func (s *Server) serviceVisitorAllowed(addr net.Addr, cli *client, serviceIndex uint16) bool {
+	ip := remoteIP(addr)
+	return s.ipFilters.load().users[cli.id].visitors.allowed(ip) && cli.serviceIPFilter(serviceIndex).allowed(ip)
+}
+
+// clientAllowed 判断客户端是否可以从 addr 登录
+func (s *Server) clientAllowed(id string, addr net.Addr) bool {
+	ip := remoteIP(addr)
+	filters := s.ipFilters.load()
+	return filters.clients.allowed(ip) && filters.users[id].clients.allowed(ip)
+}
+
+// serviceIPFilter 返回客户端为服务声明的过滤器
+func (c *client) serviceIPFilter(serviceIndex uint16) *ipFilter {
+	filters := c.ipFilters.Load()
+	if filters == nil {
+		return nil
+	}
+	return (*filters)[serviceIndex]
+}
+
+// readIPFilter 读取 IPFilter option 中允许与拒绝访问的 CIDR
+func (c *conn) readIPFilter(reader *bufio.Reader) (f *ipFilter, err error) {
+	defer func() {
+		if err != nil {
+			c.Logger.Error().Err(err).Msg("failed to read ip filter")
+		}
+	}()
+	var lists [2][]string
+	for i := range lists {
+		var n byte
+		n, err = reader.ReadByte()
+		if err != nil {
+			return
+		}
+		if n > predef.MaxIPFilterEntries {
+			err = ErrInvalidIPFilter
+			return
+		}
+		for j := 0; j < int(n); j++ {
+			var l byte
+			l, err = reader.ReadByte()
+			if err != nil {
+				return
+			}
+			var b []byte
+			b, err = reader.Peek(int(l))
+			if err != nil {
+				return
+			}
+			lists[i] = append(lists[i], string(b))
+			_, err = reader.Discard(int(l))
+			if err != nil {
+				return
+			}
+		}
+	}
+	f, err = newIPFilter(lists[0], lists[1])
+	if err == nil && f == nil {
+		err = ErrInvalidIPFilter
+	}
+	return
+}
+
+// forbiddenResponse 是拒绝访问者时的响应
+const forbiddenResponse = "HTTP/1.1 403 Forbidden\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: 10\r\nConnection: close\r\n\r\nForbidden\n"
+
+// writeForbidden 拒绝访问者的 http 请求
+func (c *conn) writeForbidden() {
+	if c.server.config.Timeout.Duration > 0 {
+		_ = c.SetWriteDeadline(time.Now().Add(c.server.config.Timeout.Duration))
+	}
+	n, _ := c.Write([]byte(forbiddenResponse))
+	c.access.out(n)
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestIPFilterAllowed(t *testing.T) {
+	f, err := newIPFilter([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.1.0.0/16", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"10.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"10.1.2.3", false},
+		{"192.168.1.1", false},
+		{"2001:db8::2", true},
+		{"2001:db8::1", false},
+		{"::1", false},
+	}
+	for _, tt := range tests {
+		if allowed := f.allowed(net.ParseIP(tt.ip)); allowed != tt.allowed {
+			t.Errorf("allowed(%s) = %v", tt.ip, allowed)
+		}
+	}
+
+	deny, err := newIPFilter(nil, []string{"192.168.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deny.allowed(net.ParseIP("10.0.0.1")) || deny.allowed(net.ParseIP("192.168.1.1")) {
+		t.Fatal("deny list is not applied")
+	}
+	var none *ipFilter
+	if !none.allowed(net.ParseIP("192.168.1.1")) {
+		t.Fatal("nil filter should allow all")
+	}
+	if f, err := newIPFilter(nil, nil); f != nil || err != nil {
+		t.Fatalf("newIPFilter(nil, nil) = %v, %v", f, err)
+	}
+	if _, err := newIPFilter([]string{"10.0.0.0/33"}, nil); !errors.Is(err, ErrInvalidIPFilter) {
+		t.Fatalf("invalid CIDR: %v", err)
+	}
+}
+
+func TestIPFilterStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip.yaml")
+	err := os.WriteFile(path, []byte(`
+visitors:
+  deny:
+    - 192.168.1.0/24
+users:
+  id1:
+    clients:
+      allow:
+        - 10.0.0.0/8
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	global := userIPRules{Visitors: ipRules{Deny: []string{"172.16.0.0/12"}}}
+	st, err := newIPFilterStore(path, global, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	filters := st.load()
+	for _, ip := range []string{"192.168.1.1", "172.16.0.1"} {
+		if filters.visitors.allowed(net.ParseIP(ip)) {
+			t.Fatalf("visitor %s is not denied", ip)
+		}
+	}
+	if filters.users["id1"].clients.allowed(net.ParseIP("192.168.1.1")) || !filters.users["id1"].clients.allowed(net.ParseIP("10.0.0.1")) {
+		t.Fatal("client rules of id1 are not applied")
+	}
+
+	// 文件无效时保留原来的规则
+	err = os.WriteFile(path, []byte("visitors:\n  deny:\n    - invalid\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = st.reload(); !errors.Is(err, ErrInvalidIPFilter) {
+		t.Fatalf("reload invalid file: %v", err)
+	}
+	if st.load() != filters {
+		t.Fatal("filters are replaced by an invalid file")
+	}
+
+	err = os.WriteFile(path, []byte("users: {}\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := st.reload()
+	if err != nil || !reloaded {
+		t.Fatalf("reload() = %v, %v", reloaded, err)
+	}
+	filters = st.load()
+	if !filters.visitors.allowed(net.ParseIP("192.168.1.1")) || filters.visitors.allowed(net.ParseIP("172.16.0.1")) {
+		t.Fatal("rules are not reloaded")
+	}
+	if _, ok := filters.users["id1"]; ok {
+		t.Fatal("rules of removed user are kept")
+	}
+}
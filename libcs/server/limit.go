@@ -0,0 +1,207 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/isrc-cas/gt/bufio"
+	"github.com/isrc-cas/gt/util"
+)
+
+// ErrInvalidSpeedLimit is an error returned when the speed limit option of a service is invalid
+var ErrInvalidSpeedLimit = errors.New("invalid speed limit")
+
+// sharedLimiter 服务端的总限速，由最近活跃的用户平分，一个用户的连接再多也只能使用自己的份额
+type sharedLimiter struct {
+	bucket *util.TokenBucket
+	rate   uint32
+	burst  time.Duration
+
+	mtx    sync.Mutex
+	active map[*client]time.Time
+	pruned time.Time
+}
+
+func newSharedLimiter(rate uint32, burst time.Duration) *sharedLimiter {
+	if rate == 0 {
+		return nil
+	}
+	return &sharedLimiter{
+		bucket: util.NewTokenBucket(rate, burst),
+		rate:   rate,
+		burst:  burst,
+		active: make(map[*client]time.Time),
+	}
+}
+
+// share 记录用户活跃，返回用户当前可以使用的速度
+func (l *sharedLimiter) share(c *client) uint32 {
+	now := time.Now()
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.active[c] = now
+	if now.Sub(l.pruned) >= time.Second {
+		for k, t := range l.active {
+			if now.Sub(t) > time.Second {
+				delete(l.active, k)
+			}
+		}
+		l.pruned = now
+	}
+	share := l.rate / uint32(len(l.active))
+	if share == 0 {
+		share = 1
+	}
+	return share
+}
+
+// speed 上行（客户端发往访问者）与下行（访问者发往客户端）的速度
+type speed struct {
+	upload   uint32
+	download uint32
+}
+
+// serviceLimit 服务的所有访问者连接共用的令牌桶
+type serviceLimit struct {
+	upload   *util.TokenBucket
+	download *util.TokenBucket
+}
+
+func newServiceLimits(speeds map[uint16]speed, burst time.Duration) map[uint16]serviceLimit {
+	limits := make(map[uint16]serviceLimit, len(speeds))
+	for si, s := range speeds {
+		limits[si] = serviceLimit{
+			upload:   util.NewTokenBucket(s.upload, burst),
+			download: util.NewTokenBucket(s.download, burst),
+		}
+	}
+	return limits
+}
+
+// limiter 访问者连接一个方向的数据需要经过的令牌桶
+type limiter struct {
+	buckets []*util.TokenBucket
+	shared  *sharedLimiter
+	share   *util.TokenBucket // 用户在总限速中的份额
+	cli     *client
+	burst   time.Duration
+}
+
+// wait 取出 n 个令牌并等待欠账还清
+func (l *limiter) wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	if l.shared != nil {
+		l.share.SetRate(l.shared.share(l.cli), l.burst)
+		util.Wait(n, append(l.buckets, l.share, l.shared.bucket)...)
+		return
+	}
+	util.Wait(n, l.buckets...)
+}
+
+// initLimits 根据用户与服务端的限速创建客户端的令牌桶
+func (c *client) initLimits(u user, s *Server) {
+	burst := s.config.SpeedBurst.Duration
+	upload, download := u.UploadSpeed, u.DownloadSpeed
+	if upload == 0 {
+		upload = u.Speed
+	}
+	if download == 0 {
+		download = u.Speed
+	}
+	c.uploadLimit = util.NewTokenBucket(upload, burst)
+	c.downloadLimit = util.NewTokenBucket(download, burst)
+	c.uploadShared, c.downloadShared = s.uploadLimit, s.downloadLimit
+	if c.uploadShared != nil {
+		c.uploadShare = util.NewTokenBucket(c.uploadShared.rate, burst)
+	}
+	if c.downloadShared != nil {
+		c.downloadShare = util.NewTokenBucket(c.downloadShared.rate, burst)
+	}
+	c.visitorSpeed = u.VisitorSpeed
+	c.speedBurst = burst
+}
+
+// newLimiter 返回访问者连接上行（客户端发往访问者）或下行（访问者发往客户端）的限速器，不限速时返回 nil
+func (c *client) newLimiter(serviceIndex uint16, upload bool) *limiter {
+	l := &limiter{
+		cli:   c,
+		burst: c.speedBurst,
+	}
+	if upload {
+		l.buckets = append(l.buckets, c.uploadLimit)
+		l.shared, l.share = c.uploadShared, c.uploadShare
+	} else {
+		l.buckets = append(l.buckets, c.downloadLimit)
+		l.shared, l.share = c.downloadShared, c.downloadShare
+	}
+	l.buckets = append(l.buckets, util.NewTokenBucket(c.visitorSpeed, c.speedBurst))
+	if limits := c.serviceLimits.Load(); limits != nil {
+		if s, ok := (*limits)[serviceIndex]; ok {
+			if upload {
+				l.buckets = append(l.buckets, s.upload)
+			} else {
+				l.buckets = append(l.buckets, s.download)
+			}
+		}
+	}
+	n := 0
+	for _, b := range l.buckets {
+		if b != nil {
+			l.buckets[n] = b
+			n++
+		}
+	}
+	l.buckets = l.buckets[:n]
+	if n == 0 && l.shared == nil {
+		return nil
+	}
+	return l
+}
+
+// limitedWriter 写入前等待上行限速
+type limitedWriter struct {
+	io.Writer
+	limiter *limiter
+}
+
+func (w limitedWriter) Write(p []byte) (n int, err error) {
+	w.limiter.wait(len(p))
+	return w.Writer.Write(p)
+}
+
+// readSpeedLimit 读取 SpeedLimit option 中服务的上下行速度
+func (c *conn) readSpeedLimit(reader *bufio.Reader) (s speed, err error) {
+	b, err := reader.Peek(8)
+	if err != nil {
+		c.Logger.Error().Err(err).Msg("failed to read speed limit")
+		return
+	}
+	s.upload = uint32(b[3]) | uint32(b[2])<<8 | uint32(b[1])<<16 | uint32(b[0])<<24
+	s.download = uint32(b[7]) | uint32(b[6])<<8 | uint32(b[5])<<16 | uint32(b[4])<<24
+	_, err = reader.Discard(8)
+	if err != nil {
+		return
+	}
+	if s.upload == 0 && s.download == 0 {
+		err = ErrInvalidSpeedLimit
+	}
+	return
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	connection "github.com/isrc-cas/gt/conn"
+	"github.com/isrc-cas/gt/util"
+)
+
+func TestSharedLimiterShare(t *testing.T) {
+	if newSharedLimiter(0, time.Second) != nil {
+		t.Fatal("shared limiter without rate should be nil")
+	}
+	l := newSharedLimiter(1000, 0)
+	c1, c2 := &client{id: "1"}, &client{id: "2"}
+	if share := l.share(c1); share != 1000 {
+		t.Fatalf("the only active user should get the whole rate, got %d", share)
+	}
+	if share := l.share(c1); share != 1000 {
+		t.Fatalf("connections of the same user should not split the rate, got %d", share)
+	}
+	if share := l.share(c2); share != 500 {
+		t.Fatalf("two active users should split the rate, got %d", share)
+	}
+
+	// 不再活跃的用户让出份额
+	l.active[c2] = time.Now().Add(-2 * time.Second)
+	l.pruned = time.Time{}
+	if share := l.share(c1); share != 1000 {
+		t.Fatalf("idle users should be pruned, got %d", share)
+	}
+}
+
+func TestClientNewLimiter(t *testing.T) {
+	c := &client{}
+	if l := c.newLimiter(0, true); l != nil {
+		t.Fatal("limiter without any limit should be nil")
+	}
+
+	c.downloadLimit = util.NewTokenBucket(1000, 0)
+	c.visitorSpeed = 2000
+	limits := map[uint16]serviceLimit{
+		1: {upload: util.NewTokenBucket(3000, 0)},
+	}
+	c.serviceLimits.Store(&limits)
+	if l := c.newLimiter(0, true); l == nil || len(l.buckets) != 1 {
+		t.Fatalf("upload of service 0 should only be limited per visitor, got %+v", l)
+	}
+	if l := c.newLimiter(1, true); l == nil || len(l.buckets) != 2 {
+		t.Fatalf("upload of service 1 should be limited per visitor and per service, got %+v", l)
+	}
+	if l := c.newLimiter(1, false); l == nil || len(l.buckets) != 2 {
+		t.Fatalf("download of service 1 should be limited per user and per visitor, got %+v", l)
+	}
+
+	// 每个访问者连接有自己的令牌桶
+	if a, b := c.newLimiter(0, true), c.newLimiter(0, true); a.buckets[0] == b.buckets[0] {
+		t.Fatal("visitor connections should not share buckets")
+	}
+
+	c = &client{}
+	c.uploadShared = newSharedLimiter(1000, 0)
+	c.uploadShare = util.NewTokenBucket(1000, 0)
+	l := c.newLimiter(0, true)
+	if l == nil || l.shared == nil {
+		t.Fatal("limiter should use the global limit")
+	}
+	start := time.Now()
+	l.wait(100)
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Fatalf("elapsed %v, want about 100ms", elapsed)
+	}
+}
+
+func TestBlockingReceiveBuffer(t *testing.T) {
+	b := connection.NewBlockingReceiveBuffer(4)
+	if _, err := b.Write([]byte("1234")); err != nil {
+		t.Fatal(err)
+	}
+	written := make(chan error, 1)
+	go func() {
+		_, err := b.Write([]byte("5678"))
+		written <- err
+	}()
+	select {
+	case <-written:
+		t.Fatal("write to a full blocking buffer should wait")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	var out bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		done <- b.WriteLoop(&out, func(n uint32) error { return nil })
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write should continue after the buffer is drained")
+	}
+	b.Finish()
+	if err := <-done; err != io.EOF {
+		t.Fatal(err)
+	}
+	if out.String() != "12345678" {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+
+	// 关闭后阻塞的写入需要返回
+	b = connection.NewBlockingReceiveBuffer(4)
+	_, _ = b.Write([]byte("1234"))
+	go func() {
+		_, err := b.Write([]byte("5678"))
+		written <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	b.Close()
+	select {
+	case err := <-written:
+		if err == nil {
+			t.Fatal("write to a closed buffer should fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("close should wake up the blocked write")
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	connection "github.com/isrc-cas/gt/conn"
+	"github.com/isrc-cas/gt/metrics"
+	"github.com/libp2p/go-reuseport"
+)
+
+// serverMetrics 服务端以 Prometheus 文本格式导出的指标
+type serverMetrics struct {
+	registry          *metrics.Registry
+	bytes             *metrics.CounterVec
+	tasks             *metrics.GaugeVec
+	taskLatency       *metrics.HistogramVec
+	handshakeFailures *metrics.CounterVec
+	authFailures      *metrics.CounterVec
+	tcpPortsOpened    *metrics.CounterVec
+	udpPortsOpened    *metrics.CounterVec
+
+	listener   net.Listener
+	httpServer *http.Server
+}
+
+func newServerMetrics(s *Server) *serverMetrics {
+	r := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry: r,
+		bytes: r.NewCounter("gt_server_bytes_total",
+			"Bytes transferred by tasks. Upload is from clients to visitors, download is from visitors to clients.",
+			"user", "service", "direction"),
+		tasks: r.NewGauge("gt_server_active_tasks",
+			"Tasks that are being forwarded.",
+			"user", "service"),
+		taskLatency: r.NewHistogram("gt_server_task_latency_seconds",
+			"Time from a task being dispatched to a client until the first data is received from the client.",
+			nil, "user", "service"),
+		handshakeFailures: r.NewCounter("gt_server_handshake_failures_total",
+			"Error signals sent to clients.",
+			"code", "error"),
+		authFailures: r.NewCounter("gt_server_auth_failures_total",
+			"Authentication failures of clients and of visitors of services with edge auth.",
+			"kind"),
+		tcpPortsOpened: r.NewCounter("gt_server_tcp_ports_opened_total",
+			"TCP ports opened for clients.",
+			"user"),
+		udpPortsOpened: r.NewCounter("gt_server_udp_ports_opened_total",
+			"UDP ports opened for clients.",
+			"user"),
+	}
+	r.NewCounterFunc("gt_server_connections_accepted_total", "Connections accepted.", nil,
+		func(emit func(float64, ...string)) {
+			emit(float64(s.GetAccepted()))
+		})
+	r.NewCounterFunc("gt_server_connections_served_total", "Visitor connections served.", nil,
+		func(emit func(float64, ...string)) {
+			emit(float64(s.GetServed()))
+		})
+	r.NewGaugeFunc("gt_server_tunneling_connections", "Connections used as tunnels.", nil,
+		func(emit func(float64, ...string)) {
+			emit(float64(s.GetTunneling()))
+		})
+	r.NewGaugeFunc("gt_server_tunnels", "Tunnels of connected clients.", []string{"user"},
+		func(emit func(float64, ...string)) {
+			s.rangeClients(func(c *client) {
+				c.tunnelsRWMtx.RLock()
+				n := len(c.tunnels)
+				c.tunnelsRWMtx.RUnlock()
+				emit(float64(n), c.id)
+			})
+		})
+	r.NewGaugeFunc("gt_server_tcp_ports", "TCP ports currently opened for clients.", []string{"user"},
+		func(emit func(float64, ...string)) {
+			s.rangeClients(func(c *client) {
+				emit(float64(countListeners(&c.tcpListeners)), c.id)
+			})
+		})
+	r.NewGaugeFunc("gt_server_udp_ports", "UDP ports currently opened for clients.", []string{"user"},
+		func(emit func(float64, ...string)) {
+			s.rangeClients(func(c *client) {
+				emit(float64(countListeners(&c.udpListeners)), c.id)
+			})
+		})
+	return m
+}
+
+func (s *Server) rangeClients(fn func(c *client)) {
+	s.id2Client.Range(func(key, value interface{}) bool {
+		if c, ok := value.(*client); ok && c != nil && len(c.id) > 0 {
+			fn(c)
+		}
+		return true
+	})
+}
+
+func countListeners(m interface {
+	Range(func(key, value interface{}) bool)
+}) (n int) {
+	m.Range(func(key, value interface{}) bool {
+		n++
+		return true
+	})
+	return
+}
+
+// errorSignal 统计发送给客户端的错误信号
+func (m *serverMetrics) errorSignal(code connection.Error) {
+	if m == nil {
+		return
+	}
+	m.handshakeFailures.With(strconv.Itoa(int(code)), code.Error()).Inc()
+	if code == connection.ErrInvalidIDAndSecret {
+		m.authFailures.With("client").Inc()
+	}
+}
+
+func (m *serverMetrics) visitorAuthFailed() {
+	if m == nil {
+		return
+	}
+	m.authFailures.With("visitor").Inc()
+}
+
+func (m *serverMetrics) tcpPortOpened(user string) {
+	if m == nil {
+		return
+	}
+	m.tcpPortsOpened.With(user).Inc()
+}
+
+func (m *serverMetrics) udpPortOpened(user string) {
+	if m == nil {
+		return
+	}
+	m.udpPortsOpened.With(user).Inc()
+}
+
+// taskMetrics task 使用的指标
+type taskMetrics struct {
+	upload    *metrics.Counter
+	download  *metrics.Counter
+	active    *metrics.Gauge
+	latency   *metrics.Histogram
+	start     time.Time
+	responded atomic.Bool
+}
+
+// newTask 返回 task 使用的指标并将活跃 task 数加 1，task 结束时需要调用 done
+func (m *serverMetrics) newTask(user, service string) *taskMetrics {
+	if m == nil {
+		return nil
+	}
+	t := &taskMetrics{
+		upload:   m.bytes.With(user, service, "upload"),
+		download: m.bytes.With(user, service, "download"),
+		active:   m.tasks.With(user, service),
+		latency:  m.taskLatency.With(user, service),
+		start:    time.Now(),
+	}
+	t.active.Inc()
+	return t
+}
+
+// received 统计从客户端收到的数据，第一次收到数据时记录延迟
+func (t *taskMetrics) received(n uint32) {
+	if t == nil {
+		return
+	}
+	if t.responded.CompareAndSwap(false, true) {
+		t.latency.Observe(time.Since(t.start).Seconds())
+	}
+	t.upload.Add(float64(n))
+}
+
+// sent 统计发往客户端的数据
+func (t *taskMetrics) sent(n int) {
+	if t == nil {
+		return
+	}
+	t.download.Add(float64(n))
+}
+
+func (t *taskMetrics) done() {
+	if t == nil {
+		return
+	}
+	t.active.Dec()
+}
+
+func (s *Server) startMetricsServer() (err error) {
+	if strings.IndexByte(s.config.MetricsAddr, ':') == -1 {
+		s.config.MetricsAddr = ":" + s.config.MetricsAddr
+	}
+	s.metrics.listener, err = reuseport.Listen("tcp", s.config.MetricsAddr)
+	if err != nil {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.metrics.registry)
+	s.metrics.httpServer = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	s.Logger.Info().Str("addr", s.metrics.listener.Addr().String()).Msg("Listening metrics")
+	go func() {
+		err := s.metrics.httpServer.Serve(s.metrics.listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.Logger.Error().Err(err).Msg("metrics server stopped")
+		}
+	}()
+	return
+}
+
+func (m *serverMetrics) close() error {
+	if m == nil || m.httpServer == nil {
+		return nil
+	}
+	return m.httpServer.Close()
+}
+
+// GetMetricsListenerAddrPort 获取 metrics listener 地址，返回值可能为空
+func (s *Server) GetMetricsListenerAddrPort() (addrPort netip.AddrPort) {
+	if s.metrics == nil || s.metrics.listener == nil {
+		return
+	}
+	addrPort = s.metrics.listener.Addr().(*net.TCPAddr).AddrPort()
+	return
+}
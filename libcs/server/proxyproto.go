@@ -0,0 +1,179 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	gosync "sync"
+	"time"
+
+	connection "github.com/isrc-cas/gt/conn"
+	"github.com/isrc-cas/gt/util"
+)
+
+// proxyProtocolHeaderTimeout 是读取 PROXY protocol 头部的超时时间
+const proxyProtocolHeaderTimeout = 10 * time.Second
+
+// parseTrustedCIDRs 解析可信来源列表，支持 CIDR 与单个 IP
+func parseTrustedCIDRs(cidrs []string) (nets []*net.IPNet, err error) {
+	for _, cidr := range cidrs {
+		var ipNet *net.IPNet
+		ipNet, err = util.ParseCIDR(cidr)
+		if err != nil {
+			err = fmt.Errorf("invalid proxy protocol trusted CIDR '%s', cause %s", cidr, err.Error())
+			return
+		}
+		nets = append(nets, ipNet)
+	}
+	return
+}
+
+func (s *Server) parseProxyProtocol() (err error) {
+	s.proxyProtocolTrusted, err = parseTrustedCIDRs(s.config.ProxyProtocolTrustedCIDRs)
+	if err != nil {
+		return
+	}
+	enabled := s.config.AddrProxyProtocol || s.config.TLSAddrProxyProtocol ||
+		s.config.SNIAddrProxyProtocol || s.config.TCPProxyProtocol
+	if enabled && len(s.proxyProtocolTrusted) == 0 {
+		err = errors.New("PROXY protocol is enabled but no trusted source is configured, please check option 'proxyProtocolTrustedCIDRs'")
+	}
+	return
+}
+
+// proxyProtocolListener 接受 PROXY protocol 头部的 listener，只有来自可信来源的连接才会解析头部
+type proxyProtocolListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func (s *Server) proxyProtocolListen(l net.Listener, enabled bool) net.Listener {
+	if !enabled {
+		return l
+	}
+	return &proxyProtocolListener{Listener: l, trusted: s.proxyProtocolTrusted}
+}
+
+func (l *proxyProtocolListener) isTrusted(addr net.Addr) bool {
+	a, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.trusted {
+		if n.Contains(a.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(c.RemoteAddr()) {
+		return c, nil
+	}
+	return &proxyProtocolConn{Conn: c}, nil
+}
+
+// proxyProtocolConn 在第一次读取或获取地址时解析 PROXY protocol 头部，
+// 之后 RemoteAddr 与 LocalAddr 返回头部中的地址
+type proxyProtocolConn struct {
+	net.Conn
+	once gosync.Once
+	src  net.Addr
+	dst  net.Addr
+	rest []byte
+	err  error
+
+	// 解析头部期间使用者设置的读超时，解析完成后生效
+	deadlineMtx gosync.Mutex
+	deadline    time.Time
+	parsed      bool
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		defer func() {
+			c.deadlineMtx.Lock()
+			c.parsed = true
+			if c.err == nil {
+				c.err = c.Conn.SetReadDeadline(c.deadline)
+			}
+			c.deadlineMtx.Unlock()
+		}()
+		c.err = c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeout))
+		if c.err != nil {
+			return
+		}
+		c.src, c.dst, c.rest, c.err = connection.ReadProxyHeader(c.Conn)
+		if c.err != nil {
+			c.err = fmt.Errorf("failed to read PROXY protocol header from '%s': %w", c.Conn.RemoteAddr(), c.err)
+			_ = c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (n int, err error) {
+	c.readHeader()
+	if c.err != nil {
+		err = c.err
+		return
+	}
+	if len(c.rest) > 0 {
+		n = copy(b, c.rest)
+		c.rest = c.rest[n:]
+		return
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *proxyProtocolConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *proxyProtocolConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMtx.Lock()
+	defer c.deadlineMtx.Unlock()
+	if !c.parsed {
+		c.deadline = t
+		return nil
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
@@ -0,0 +1,351 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Reload re-reads the config file and the users file, and applies the users and the tcp and host settings without
+// restarting. Clients of unchanged users are left alone, clients of changed users reconnect, and clients of removed
+// users or users whose permissions shrank are closed. The other options require a restart
+func (s *Server) Reload() (err error) {
+	if !s.reloading.CompareAndSwap(false, true) {
+		return errors.New("already reloading")
+	}
+	defer s.reloading.Store(false)
+
+	conf, err := parseConfig(s.args)
+	if err != nil {
+		return
+	}
+	err = conf.parseHost()
+	if err != nil {
+		return
+	}
+	globalPorts, err := conf.tcpPorts()
+	if err != nil {
+		return
+	}
+	var loaded users
+	err = loaded.load(conf)
+	if err != nil {
+		return
+	}
+	_, err = s.loadUserStore(&loaded)
+	if err != nil {
+		return
+	}
+	err = loaded.checkSecretHashes(&conf)
+	if err != nil {
+		return
+	}
+	all := make(map[uint16]struct{}, len(globalPorts))
+	for port := range globalPorts {
+		all[port] = struct{}{}
+	}
+	newUsers := make(map[string]user)
+	loaded.Range(func(key, value interface{}) bool {
+		id, u := key.(string), value.(user)
+		u.portsManager, err = s.userPortsManager(u, all)
+		if err != nil {
+			return false
+		}
+		err = conf.fillUser(id, &u)
+		if err != nil {
+			return false
+		}
+		newUsers[id] = u
+		return true
+	})
+	if err != nil {
+		return
+	}
+
+	s.usersMtx.Lock()
+	defer s.usersMtx.Unlock()
+	oldGlobalPorts, err := s.config.tcpPorts()
+	if err != nil {
+		return
+	}
+	var added, changed, unchanged int
+	var closed, reconnected, removed []string
+	var resets []portsReset
+	for id, u := range newUsers {
+		value, ok := s.users.Load(id)
+		if !ok {
+			added++
+			continue
+		}
+		old := value.(user)
+		oldPorts, _ := userTCPPorts(old, oldGlobalPorts)
+		newPorts, _ := userTCPPorts(u, globalPorts)
+		isChanged, shrank := compareUsers(old, u, oldPorts, newPorts)
+		switch {
+		case !isChanged:
+			unchanged++
+			old.record = u.record
+			newUsers[id] = old
+			continue
+		case shrank:
+			closed = append(closed, id)
+		default:
+			reconnected = append(reconnected, id)
+		}
+		changed++
+		// 用户自己的端口池原地修改，客户端关闭端口时归还到同一个端口池
+		if len(old.TCPs) > 0 && len(u.TCPs) > 0 {
+			u.portsManager = old.portsManager
+			newUsers[id] = u
+			resets = append(resets, portsReset{ports: old.portsManager, from: oldPorts, to: newPorts})
+		}
+	}
+	s.users.Range(func(key, value interface{}) bool {
+		id := key.(string)
+		if _, ok := newUsers[id]; !ok && !value.(user).temp {
+			removed = append(removed, id)
+		}
+		return true
+	})
+
+	s.applyReloadedConfig(conf)
+	for id, u := range newUsers {
+		s.users.Store(id, u)
+		s.scheduleUserExpiry(id, u.Expires)
+	}
+	for _, id := range removed {
+		s.users.Delete(id)
+		s.scheduleUserExpiry(id, time.Time{})
+	}
+	for _, ids := range [][]string{removed, closed} {
+		for _, id := range ids {
+			if v, ok := s.id2Client.Load(id); ok {
+				s.Logger.Info().Str("id", id).Msg("close the client because its user is removed or its permissions shrank")
+				v.(*client).close()
+			}
+		}
+	}
+	// 先关闭客户端再修改端口池，正在使用的端口不会被放入端口池
+	s.portsManager.reset(oldGlobalPorts, globalPorts)
+	for _, r := range resets {
+		r.ports.reset(r.from, r.to)
+	}
+	for _, id := range reconnected {
+		if v, ok := s.id2Client.Load(id); ok {
+			s.Logger.Info().Str("id", id).Msg("ask the client to reconnect because its user changed")
+			v.(*client).reconnect()
+		}
+	}
+	sort.Strings(removed)
+	sort.Strings(closed)
+	sort.Strings(reconnected)
+	s.Logger.Info().
+		Int("added", added).
+		Int("changed", changed).
+		Int("unchanged", unchanged).
+		Strs("removed", removed).
+		Strs("shrank", closed).
+		Strs("reconnected", reconnected).
+		Msg("users reloaded")
+	return
+}
+
+// applyReloadedConfig 将重新加载的用户、tcp 与 host 设置写入当前的配置，fillUser 使用这些全局的值。
+// 需要持有 usersMtx，这些字段只在持有 usersMtx 时读取，登录时读取的全局设置通过 defaultUser 原子地替换
+func (s *Server) applyReloadedConfig(conf Config) {
+	s.config.Users = conf.Users
+	s.config.TCPs = conf.TCPs
+	s.config.Host = conf.Host
+	s.config.IDs = conf.IDs
+	s.config.Secrets = conf.Secrets
+	s.config.TCPRanges = conf.TCPRanges
+	s.config.TCPNumber = conf.TCPNumber
+	s.config.HostNumber = conf.HostNumber
+	s.config.HostRegex = conf.HostRegex
+	s.config.HostWithID = conf.HostWithID
+	s.config.HostDomains = conf.HostDomains
+	s.config.HostAllowClientAuth = conf.HostAllowClientAuth
+	s.config.Speed = conf.Speed
+	s.config.UploadSpeed = conf.UploadSpeed
+	s.config.DownloadSpeed = conf.DownloadSpeed
+	s.config.VisitorSpeed = conf.VisitorSpeed
+	s.config.DayQuota = conf.DayQuota
+	s.config.MonthQuota = conf.MonthQuota
+	s.config.Connections = conf.Connections
+	s.defaultUser.Store(conf.defaultUser())
+}
+
+// watchConfig 每隔 interval 检查配置文件与 users 文件是否变化，变化后重新加载。加载失败时下次检查时再次尝试
+func (s *Server) watchConfig(interval time.Duration) {
+	paths := []string{s.config.Options.Config, s.config.Options.Users}
+	stamp := configStamp(paths)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s.IsClosing() {
+			return
+		}
+		st := configStamp(paths)
+		if st == stamp {
+			continue
+		}
+		err := s.Reload()
+		if err != nil {
+			s.Logger.Warn().Err(err).Msg("failed to reload the changed config")
+			continue
+		}
+		stamp = st
+	}
+}
+
+func configStamp(paths []string) string {
+	var stamp string
+	for _, path := range paths {
+		if len(path) > 0 {
+			stamp += pathStamp(path) + ";"
+		}
+	}
+	return stamp
+}
+
+// portsReset 是重新加载后需要修改范围的端口池
+type portsReset struct {
+	ports    *portsManager
+	from, to map[uint16]struct{}
+}
+
+// reset 将端口池的端口范围从 from 修改为 to，正在使用的端口不放入端口池，关闭时再归还
+func (p *portsManager) reset(from, to map[uint16]struct{}) {
+	if samePorts(from, to) {
+		return
+	}
+	p.portsMtx.Lock()
+	defer p.portsMtx.Unlock()
+	ports := make(map[uint16]struct{}, len(to))
+	for port := range to {
+		if _, ok := from[port]; ok {
+			if _, free := p.ports[port]; !free {
+				continue
+			}
+		}
+		ports[port] = struct{}{}
+	}
+	p.ports = ports
+}
+
+// userTCPPorts 返回用户可以使用的 tcp 端口，用户没有设置时使用全局的
+func userTCPPorts(u user, global map[uint16]struct{}) (map[uint16]struct{}, error) {
+	if len(u.TCPs) == 0 {
+		return global, nil
+	}
+	ranges := make([]string, 0, len(u.TCPs))
+	for _, tcp := range u.TCPs {
+		ranges = append(ranges, tcp.Range)
+	}
+	return portRanges(ranges)
+}
+
+// compareUsers 比较重新加载前后的用户，shrank 表示新的权限不再包含原来的权限，需要断开客户端
+func compareUsers(old, new user, oldPorts, newPorts map[uint16]struct{}) (changed, shrank bool) {
+	shrank = old.temp ||
+		old.Secret != new.Secret ||
+		!bytes.Equal(old.storedKey, new.storedKey) ||
+		new.expired() ||
+		!new.Expires.IsZero() && (old.Expires.IsZero() || new.Expires.Before(old.Expires)) ||
+		!containsPorts(newPorts, oldPorts) ||
+		limitShrank(uint64(*old.TCPNumber), uint64(*new.TCPNumber)) ||
+		limitShrank(uint64(old.Speed), uint64(new.Speed)) ||
+		limitShrank(uint64(old.UploadSpeed), uint64(new.UploadSpeed)) ||
+		limitShrank(uint64(old.DownloadSpeed), uint64(new.DownloadSpeed)) ||
+		limitShrank(uint64(old.VisitorSpeed), uint64(new.VisitorSpeed)) ||
+		limitShrank(old.DayQuota, new.DayQuota) ||
+		limitShrank(old.MonthQuota, new.MonthQuota) ||
+		limitShrank(uint64(old.Connections), uint64(new.Connections)) ||
+		limitShrank(uint64(*old.Host.Number), uint64(*new.Host.Number)) ||
+		// 没有 host regex 时允许任意 host 前缀
+		len(*new.Host.RegexStr) > 0 && (len(*old.Host.RegexStr) == 0 || !containsStrings(*new.Host.RegexStr, *old.Host.RegexStr)) ||
+		*old.Host.WithID != *new.Host.WithID ||
+		!containsStrings(*new.Host.Domains, *old.Host.Domains)
+	if shrank {
+		return true, true
+	}
+	changed = !new.Expires.Equal(old.Expires) ||
+		!samePorts(oldPorts, newPorts) ||
+		*old.TCPNumber != *new.TCPNumber ||
+		old.Speed != new.Speed ||
+		old.UploadSpeed != new.UploadSpeed ||
+		old.DownloadSpeed != new.DownloadSpeed ||
+		old.VisitorSpeed != new.VisitorSpeed ||
+		old.DayQuota != new.DayQuota ||
+		old.MonthQuota != new.MonthQuota ||
+		old.Connections != new.Connections ||
+		*old.Host.Number != *new.Host.Number ||
+		!containsStrings(*old.Host.RegexStr, *new.Host.RegexStr) ||
+		!containsStrings(*old.Host.Domains, *new.Host.Domains) ||
+		*old.Host.AllowClientAuth != *new.Host.AllowClientAuth ||
+		!sameEdgeAuth(old.Host.Auth, new.Host.Auth)
+	return
+}
+
+// limitShrank 判断限制是否变小，0 表示不限制
+func limitShrank(old, new uint64) bool {
+	return new != 0 && (old == 0 || new < old)
+}
+
+func containsPorts(ports, subset map[uint16]struct{}) bool {
+	for port := range subset {
+		if _, ok := ports[port]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func samePorts(a, b map[uint16]struct{}) bool {
+	return len(a) == len(b) && containsPorts(a, b)
+}
+
+func containsStrings(list, subset []string) bool {
+	for _, s := range subset {
+		found := false
+		for _, l := range list {
+			if l == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// sameEdgeAuth 通过策略的摘要比较访问策略
+func sameEdgeAuth(a, b map[string]*edgeAuth) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, pa := range a {
+		pb, ok := b[key]
+		if !ok || (pa == nil) != (pb == nil) || pa != nil && pa.digest != pb.digest {
+			return false
+		}
+	}
+	return true
+}
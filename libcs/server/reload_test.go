@@ -0,0 +1,272 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/isrc-cas/gt/config"
+)
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(content string) {
+		err := os.WriteFile(path, []byte(content), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`
+users:
+  id1:
+    secret: secret1
+    tcp:
+      - range: 3000-3001
+  id2:
+    secret: secret2
+  id3:
+    secret: secret3
+tcp:
+  - range: 2000-2002
+`)
+	s, err := New([]string{"server", "-config", path}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.users.load(s.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.initUserStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.parseTCPs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.parseHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _ := s.users.Load("id1")
+	pm := value.(user).portsManager
+	// 模拟正在使用的端口
+	delete(pm.ports, 3000)
+	delete(s.portsManager.ports, 2000)
+
+	// 配置错误时保留原来的用户
+	write(`
+users:
+  id1:
+    secret: secret1
+    tcp:
+      - range: 2000-2000
+tcp:
+  - range: 2000-2002
+`)
+	err = s.Reload()
+	if err == nil {
+		t.Fatal("invalid config is reloaded")
+	}
+	if _, ok := s.users.Load("id3"); !ok {
+		t.Fatal("users are changed by an invalid config")
+	}
+
+	write(`
+users:
+  id1:
+    secret: secret1
+    tcp:
+      - range: 3000-3003
+  id2:
+    secret: secret2-changed
+  id4:
+    secret: secret4
+tcp:
+  - range: 2000-2001
+host:
+  number: 1
+`)
+	err = s.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.users.Load("id3"); ok {
+		t.Fatal("removed user is still loaded")
+	}
+	if _, err = s.users.auth("id4", credential{secret: "secret4"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.users.auth("id2", credential{secret: "secret2"}); err == nil {
+		t.Fatal("old secret is still accepted")
+	}
+	value, _ = s.users.Load("id1")
+	u := value.(user)
+	if u.portsManager != pm || *u.Host.Number != 1 {
+		t.Fatalf("invalid user %+v", u)
+	}
+	// 正在使用的端口不放入端口池
+	for _, c := range []struct {
+		ports    *portsManager
+		expected []uint16
+	}{
+		{pm, []uint16{3001, 3002, 3003}},
+		{&s.portsManager, []uint16{2001}},
+	} {
+		if len(c.ports.ports) != len(c.expected) {
+			t.Fatalf("invalid ports %v, expected %v", c.ports.ports, c.expected)
+		}
+		for _, port := range c.expected {
+			if !c.ports.has(port) {
+				t.Fatalf("invalid ports %v, expected %v", c.ports.ports, c.expected)
+			}
+		}
+	}
+}
+
+// TestReloadWhileLogin 需要使用 go test -race 运行才能发现重新加载与登录之间的数据竞争
+func TestReloadWhileLogin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(speed int) {
+		err := os.WriteFile(path, []byte(fmt.Sprintf(`
+options:
+  allowAnyClient: true
+  speed: %d
+users:
+  id1:
+    secret: secret1
+`, speed)), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(1024)
+	s, err := New([]string{"server", "-config", path}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.users.load(s.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.parseTCPs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.parseHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				_, err := s.authUserOrCreateUser(fmt.Sprintf("any-%d-%d", i, j), credential{secret: "secret-any"})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				_, err = s.users.auth("id1", credential{secret: "secret1"})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				s.quotas("id1")
+			}
+		}(i)
+	}
+	for i := 1; i <= 20; i++ {
+		write(1024 + i)
+		err = s.Reload()
+		if err != nil {
+			break
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新加载后新登记的 id 使用新的全局设置
+	u, err := s.authUserOrCreateUser("any-new", credential{secret: "secret-any"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Speed != 1044 {
+		t.Fatalf("new user has speed %d, want 1044", u.Speed)
+	}
+}
+
+func TestCompareUsers(t *testing.T) {
+	conf := DefaultConfig()
+	err := conf.parseHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill := func(u user) user {
+		err := conf.fillUser("id1", &u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+	ports := func(p ...uint16) map[uint16]struct{} {
+		m := make(map[uint16]struct{})
+		for _, port := range p {
+			m[port] = struct{}{}
+		}
+		return m
+	}
+	number := uint32(2)
+	smaller := uint32(1)
+	base := user{Secret: "secret1", Speed: 1024, Host: host{Number: &number}}
+	for _, c := range []struct {
+		name            string
+		new             user
+		oldPorts        map[uint16]struct{}
+		newPorts        map[uint16]struct{}
+		changed, shrank bool
+	}{
+		{"unchanged", base, ports(1, 2), ports(1, 2), false, false},
+		{"more ports", base, ports(1, 2), ports(1, 2, 3), true, false},
+		{"fewer ports", base, ports(1, 2), ports(1), true, true},
+		{"secret", user{Secret: "secret2", Speed: 1024, Host: host{Number: &number}}, nil, nil, true, true},
+		{"faster", user{Secret: "secret1", Speed: 2048, Host: host{Number: &number}}, nil, nil, true, false},
+		{"unlimited", user{Secret: "secret1", Host: host{Number: &number}}, nil, nil, true, false},
+		{"slower", user{Secret: "secret1", Speed: 512, Host: host{Number: &number}}, nil, nil, true, true},
+		{"fewer hosts", user{Secret: "secret1", Speed: 1024, Host: host{Number: &smaller}}, nil, nil, true, true},
+		{"host regex", user{Secret: "secret1", Speed: 1024, Host: host{Number: &number, RegexStr: &config.Slice[string]{"^a$"}}}, nil, nil, true, true},
+	} {
+		changed, shrank := compareUsers(fill(base), fill(c.new), c.oldPorts, c.newPorts)
+		if changed != c.changed || shrank != c.shrank {
+			t.Fatalf("%s: changed %v shrank %v, expected %v %v", c.name, changed, shrank, c.changed, c.shrank)
+		}
+	}
+}
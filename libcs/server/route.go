@@ -0,0 +1,441 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"time"
+
+	connection "github.com/isrc-cas/gt/conn"
+	"github.com/isrc-cas/gt/pool"
+)
+
+// ErrResponseTimeout is an error returned when the response of the previous request is not finished in time
+var ErrResponseTimeout = errors.New("timeout waiting for the response of the previous request")
+
+// httpExchange 是路由模式下连续发往同一个服务的请求，作为一个 task 交给 client.process。
+// 读取得到路由写入的请求，写入的响应经过解析后写到访问者连接。
+type httpExchange struct {
+	net.Conn // 访问者连接
+	target   clientWithServiceIndex
+	pr       *io.PipeReader
+	pw       *io.PipeWriter
+	resp     *connection.HTTPResponseWriter
+
+	closeOnce gosync.Once
+	closed    chan struct{}
+
+	pending    []accessRequest // 已发送但还没有响应的请求，访问日志未启用时为空
+	pendingMtx gosync.Mutex
+}
+
+func (e *httpExchange) Read(b []byte) (int, error) {
+	return e.pr.Read(b)
+}
+
+func (e *httpExchange) Write(b []byte) (int, error) {
+	return e.resp.Write(b)
+}
+
+// SetReadDeadline 访问者连接的读超时由路由设置
+func (e *httpExchange) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (e *httpExchange) SetDeadline(t time.Time) error {
+	return e.Conn.SetWriteDeadline(t)
+}
+
+// Close 关闭 exchange，响应已经结束时访问者连接可以继续发送请求，否则只能关闭访问者连接
+func (e *httpExchange) Close() (err error) {
+	e.closeOnce.Do(func() {
+		close(e.closed)
+		_ = e.pr.CloseWithError(net.ErrClosed)
+		if !e.resp.Idle() {
+			err = e.Conn.Close()
+		}
+	})
+	return
+}
+
+func (e *httpExchange) isClosed() bool {
+	select {
+	case <-e.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait 等待已发送请求的响应全部结束
+func (e *httpExchange) wait(timeout time.Duration) (err error) {
+	var timer <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+	select {
+	case <-e.resp.Finished():
+	case <-e.closed:
+		if !e.resp.Idle() {
+			err = net.ErrClosed
+		}
+	case <-timer:
+		err = ErrResponseTimeout
+	}
+	return
+}
+
+// expect 登记发往服务的请求，ar 不为 nil 时在响应结束后记录访问日志
+func (e *httpExchange) expect(method string, ar *accessRequest) {
+	if ar != nil {
+		e.pendingMtx.Lock()
+		e.pending = append(e.pending, *ar)
+		e.pendingMtx.Unlock()
+	}
+	e.resp.Expect(method)
+}
+
+// responded 取出最早发送的请求
+func (e *httpExchange) responded() (ar accessRequest, ok bool) {
+	e.pendingMtx.Lock()
+	defer e.pendingMtx.Unlock()
+	if len(e.pending) == 0 {
+		return
+	}
+	ar = e.pending[0]
+	e.pending = e.pending[1:]
+	return ar, true
+}
+
+// finish 不再向 exchange 发送请求，client.process 读到 EOF 后结束 task
+func (e *httpExchange) finish() {
+	_ = e.pw.Close()
+}
+
+// isTLSConn 判断访问者是否通过 TLS 连接
+func isTLSConn(c net.Conn) bool {
+	switch conn := c.(type) {
+	case *tls.Conn:
+		return true
+	case *httpExchange:
+		return isTLSConn(conn.Conn)
+	}
+	return false
+}
+
+// httpRouter 解析访问者连接上的每个请求，按请求自身的 host 与路径选择服务
+type httpRouter struct {
+	c     *conn
+	cur   *httpExchange
+	local *localRequest // 由服务端直接响应的请求
+}
+
+// localRequest 是由服务端直接响应的请求，比如没有通过验证的请求、登录请求与被拒绝的访问者的请求
+type localRequest struct {
+	req       *connection.HTTPRequest
+	name      string
+	route     hostRoute
+	body      []byte
+	tooLarge  bool
+	forbidden bool           // 访问者的 IP 不允许访问服务
+	code      int            // 大于 0 时返回错误页面，比如客户端离线
+	access    *accessRequest // 访问日志未启用时为 nil
+}
+
+// maxLocalRequestBodySize 是由服务端直接响应的请求的请求体的最大长度
+const maxLocalRequestBodySize = 16 * 1024
+
+func (r *httpRouter) Write(p []byte) (n int, err error) {
+	if r.local != nil {
+		if len(r.local.body)+len(p) > maxLocalRequestBodySize {
+			r.local.tooLarge = true
+		} else {
+			r.local.body = append(r.local.body, p...)
+		}
+		return len(p), nil
+	}
+	if r.cur == nil {
+		err = ErrIDNotFound
+		return
+	}
+	return r.cur.pw.Write(p)
+}
+
+// route 为请求选择 exchange，在切换服务前等待上一个服务的响应结束
+func (r *httpRouter) route(req *connection.HTTPRequest) (err error) {
+	var host, id []byte
+	defer func() {
+		if err != nil && !errors.Is(err, connection.ErrSkipHTTPRequest) {
+			r.c.Logger.Error().Bytes("host", host).Bytes("id", id).Err(err).Msg("route http request")
+		}
+	}()
+	if r.c.server.config.HTTPMUXHeader == "Host" {
+		host = []byte(req.Header.Get("Host"))
+		if len(host) < 1 {
+			err = ErrInvalidHTTPProtocol
+			return
+		}
+	} else {
+		id = []byte(req.Header.Get(r.c.server.config.HTTPMUXHeader))
+	}
+	var ar *accessRequest
+	if r.c.access != nil {
+		ar = &accessRequest{
+			start:  time.Now(),
+			method: req.Method,
+			target: req.Target,
+			proto:  req.Proto,
+			host:   req.Header.Get("Host"),
+		}
+		r.c.access.setHost(ar.host)
+	}
+	table, name, err := r.c.server.resolveHost(host, id, false)
+	if err != nil {
+		return
+	}
+	route, ok := table.lookup(name, req.Target)
+	if ok {
+		route, ok = r.balance(route)
+	}
+	if !ok {
+		// 客户端不在线时立即回应访问者，不再等待客户端重连
+		r.c.Logger.Info().Err(ErrIDNotFound).Str("id", name).Msg("client is offline")
+		err = r.respondLocally(&localRequest{req: req, name: name, code: http.StatusServiceUnavailable, access: ar})
+		return
+	}
+	if !r.c.server.serviceVisitorAllowed(r.c.RemoteAddr(), route.client, route.serviceIndex) {
+		r.c.Logger.Info().Str("id", name).Msg("visitor ip is not allowed")
+		err = r.respondLocally(&localRequest{req: req, name: name, route: route, forbidden: true, access: ar})
+		return
+	}
+	if route.auth != nil && (isEdgeAuthPath(req, route) || !r.c.server.authorize(req, name, route.path, route.auth)) {
+		err = r.respondLocally(&localRequest{req: req, name: name, route: route, access: ar})
+		return
+	}
+	if route.strip {
+		req.Target = stripPath(req.Target, route.path)
+	}
+	target := route.clientWithServiceIndex
+	r.c.access.setRoute(target)
+
+	if r.cur != nil && r.cur.target == target && !r.cur.isClosed() {
+		r.cur.expect(req.Method, ar)
+		return
+	}
+	err = r.finishExchange()
+	if err != nil {
+		return
+	}
+	r.cur = r.newExchange(target, name)
+	r.cur.expect(req.Method, ar)
+	return
+}
+
+// balance 为请求选择服务组的成员，访问者连接上的请求尽量发往当前 exchange 的成员以复用连接
+func (r *httpRouter) balance(route hostRoute) (hostRoute, bool) {
+	if route.group != nil && r.cur != nil && !r.cur.isClosed() && route.group.serving(r.cur.target) {
+		route.clientWithServiceIndex = r.cur.target
+		return route, true
+	}
+	return route.balance(r.c.RemoteAddr())
+}
+
+// respondLocally 等待之前的响应结束后，在请求结束时由服务端响应
+func (r *httpRouter) respondLocally(l *localRequest) (err error) {
+	err = r.finishExchange()
+	if err != nil {
+		return
+	}
+	r.local = l
+	return connection.ErrSkipHTTPRequest
+}
+
+// finishExchange 等待当前服务的响应结束后不再向其发送请求
+func (r *httpRouter) finishExchange() (err error) {
+	if r.cur == nil {
+		return
+	}
+	err = r.cur.wait(r.c.server.config.Timeout.Duration)
+	r.cur.finish()
+	r.cur = nil
+	return
+}
+
+// ended 在请求结束时响应由服务端处理的请求
+func (r *httpRouter) ended() {
+	l := r.local
+	if l == nil {
+		return
+	}
+	r.local = nil
+	var code int
+	var header http.Header
+	var body []byte
+	if l.forbidden {
+		code, header, body = http.StatusForbidden, http.Header{"Content-Type": {"text/plain; charset=utf-8"}}, []byte("Forbidden\n")
+	} else if l.code > 0 {
+		code, header = l.code, http.Header{"Content-Type": {"text/html; charset=utf-8"}, "Cache-Control": {"no-store"}}
+		body = r.c.server.errorPages.render(l.name, "", l.code, msgClientOffline)
+	} else {
+		code, header, body = r.c.server.serveEdgeAuth(l, isTLSConn(r.c.Conn))
+		if code == http.StatusUnauthorized {
+			r.c.server.metrics.visitorAuthFailed()
+		}
+	}
+	n, err := writeLocalResponse(r.c.Conn, l, code, header, body, r.c.server.config.Timeout.Duration)
+	r.c.access.out(n)
+	if l.access != nil {
+		r.c.server.accessLog.logRequest(r.c.access, *l.access, l.route.clientWithServiceIndex, code, int64(n))
+	}
+	if err != nil {
+		r.c.Logger.Debug().Err(err).Msg("failed to write local response")
+		_ = r.c.Conn.Close()
+	}
+}
+
+// writeLocalResponse 向访问者写入由服务端生成的响应，访问者要求关闭连接时写入后关闭连接
+func writeLocalResponse(c net.Conn, l *localRequest, code int, header http.Header, body []byte, timeout time.Duration) (n int, err error) {
+	closeConn := l.tooLarge || l.req.Proto == "HTTP/1.0" || strings.EqualFold(l.req.Header.Get("Connection"), "close")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	if closeConn {
+		header.Set("Connection", "close")
+	}
+	var b bytes.Buffer
+	_, _ = fmt.Fprintf(&b, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	_ = header.Write(&b)
+	b.WriteString("\r\n")
+	if l.req.Method != http.MethodHead {
+		b.Write(body)
+	}
+	if timeout > 0 {
+		err = c.SetWriteDeadline(time.Now().Add(timeout))
+		if err != nil {
+			return
+		}
+	}
+	n, err = c.Write(b.Bytes())
+	if err == nil && closeConn {
+		err = c.Close()
+	}
+	return
+}
+
+func (r *httpRouter) newExchange(target clientWithServiceIndex, name string) *httpExchange {
+	e := &httpExchange{
+		Conn:   r.c.Conn,
+		target: target,
+		resp:   connection.NewHTTPResponseWriter(r.c.Conn),
+		closed: make(chan struct{}),
+	}
+	e.pr, e.pw = io.Pipe()
+	if r.c.access != nil {
+		e.resp.Responded = func(code int, size int64) {
+			if ar, ok := e.responded(); ok {
+				r.c.server.accessLog.logRequest(r.c.access, ar, target, code, size)
+			}
+		}
+	}
+	task := &conn{
+		Connection: connection.Connection{
+			Conn:         e,
+			Logger:       r.c.Logger,
+			WriteTimeout: r.c.server.config.Timeout.Duration,
+		},
+		server:       r.c.server,
+		tasks:        make(map[uint32]*conn),
+		serviceIndex: target.serviceIndex,
+		access:       r.c.access,
+		errorPage:    &errorPage{host: name, user: target.client.id},
+	}
+	task.Reader = pool.GetReader(e)
+	go func() {
+		defer pool.PutReader(task.Reader)
+		err := target.process(task)
+		if err != nil {
+			task.Logger.Error().Err(err).Msg("process http request")
+			if code, msg, ok := offlineError(err); ok {
+				task.writeErrorPage(code, msg)
+			}
+		}
+		_ = e.pr.CloseWithError(net.ErrClosed)
+	}()
+	return e
+}
+
+// upgraded 在切换协议的请求结束后等待响应，返回协议切换是否成功
+func (r *httpRouter) upgraded() bool {
+	if r.cur == nil || r.cur.wait(r.c.server.config.Timeout.Duration) != nil {
+		return false
+	}
+	return r.cur.resp.Tunnel()
+}
+
+// handleHTTPRouting 逐个解析访问者连接上的请求并分别路由
+func (c *conn) handleHTTPRouting() {
+	var err error
+	r := &httpRouter{c: c}
+	w := connection.NewHTTPRequestWriter(r, r.route)
+	w.Ended = r.ended
+	w.Upgraded = r.upgraded
+	buf := pool.BytesPool.Get().([]byte)
+	defer func() {
+		pool.BytesPool.Put(buf)
+		if r.cur != nil {
+			if err == nil {
+				// 访问者不再发送请求，等待响应结束后再结束 task
+				_ = r.cur.wait(c.server.config.Timeout.Duration)
+			}
+			r.cur.finish()
+		}
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			c.Logger.Debug().Err(err).Msg("handleHTTPRouting")
+		}
+	}()
+	for {
+		if c.server.config.Timeout.Duration > 0 {
+			dl := time.Now().Add(c.server.config.Timeout.Duration)
+			err = c.SetReadDeadline(dl)
+			if err != nil {
+				return
+			}
+		}
+		var n int
+		n, err = c.Reader.Read(buf)
+		if n > 0 {
+			_, wErr := w.Write(buf[:n])
+			if wErr != nil {
+				err = wErr
+				return
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			return
+		}
+	}
+}
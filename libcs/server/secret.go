@@ -0,0 +1,310 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	connection "github.com/isrc-cas/gt/conn"
+	"github.com/isrc-cas/gt/predef"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// 哈希后的 secret 的前缀
+const (
+	storedKeyPrefix = "$gt-storedkey$"
+	argon2idPrefix  = "$argon2id$"
+	scryptPrefix    = "$scrypt$"
+)
+
+// HashAlgorithms 是 HashSecret 支持的算法
+var HashAlgorithms = []string{"bcrypt", "argon2id", "scrypt", "storedkey"}
+
+var errInvalidHash = errors.New("invalid secret hash")
+
+var b64 = base64.RawStdEncoding
+
+// HashSecret 使用 algorithm 哈希 secret，结果可以直接作为 users 配置中的 secret。
+// bcrypt、argon2id、scrypt 是慢哈希，能抵抗泄露后的暴力破解，但只能验证明文认证的客户端；
+// storedkey 可以验证质询应答认证的客户端，但它是快速哈希，泄露后更容易被暴力破解，需要使用足够长的随机 secret。
+func HashSecret(algorithm string, secret string) (hash string, err error) {
+	switch algorithm {
+	case "bcrypt":
+		var h []byte
+		h, err = bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+		hash = string(h)
+	case "argon2id":
+		salt := make([]byte, 16)
+		_, err = rand.Read(salt)
+		if err != nil {
+			return
+		}
+		var m, t uint32 = 64 * 1024, 3
+		var p uint8 = 4
+		h := argon2.IDKey([]byte(secret), salt, t, m, p, 32)
+		hash = fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version, m, t, p, b64.EncodeToString(salt), b64.EncodeToString(h))
+	case "scrypt":
+		salt := make([]byte, 16)
+		_, err = rand.Read(salt)
+		if err != nil {
+			return
+		}
+		ln, r, p := 15, 8, 1
+		var h []byte
+		h, err = scrypt.Key([]byte(secret), salt, 1<<ln, r, p, 32)
+		if err != nil {
+			return
+		}
+		hash = fmt.Sprintf("%sln=%d,r=%d,p=%d$%s$%s", scryptPrefix, ln, r, p, b64.EncodeToString(salt), b64.EncodeToString(h))
+	case "storedkey":
+		hash = storedKeyPrefix + hex.EncodeToString(connection.StoredKey(secret))
+	default:
+		err = fmt.Errorf("unknown hash algorithm '%s', supported: %s", algorithm, strings.Join(HashAlgorithms, ", "))
+	}
+	return
+}
+
+// RunHashSecret 运行 hash-secret 子命令：hash-secret [-algorithm storedkey] [secret]。
+// 没有提供 secret 时从 in 读取一行，避免 secret 留在 shell 历史中。
+func RunHashSecret(args []string, in io.Reader, out io.Writer) (err error) {
+	name := "hash-secret"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(out)
+	algorithm := flags.String("algorithm", "storedkey", "The hash algorithm: "+strings.Join(HashAlgorithms, ", ")+
+		". storedkey works with the default challenge-response authentication, but it is a fast hash, so use a long random secret."+
+		" bcrypt, argon2id and scrypt resist brute force if the hash leaks, but the server only starts with them when -plaintextAuth is enabled,"+
+		" because they need the cleartext secret sent by clients")
+	err = flags.Parse(args)
+	if err != nil {
+		return
+	}
+	var secret string
+	switch flags.NArg() {
+	case 0:
+		scanner := bufio.NewScanner(in)
+		if !scanner.Scan() {
+			err = scanner.Err()
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+		secret = strings.TrimRight(scanner.Text(), "\r")
+	case 1:
+		secret = flags.Arg(0)
+	default:
+		err = errors.New("too many arguments")
+		return
+	}
+	if len(secret) < predef.MinSecretSize || len(secret) > predef.MaxSecretSize {
+		err = fmt.Errorf("invalid secret length: %d", len(secret))
+		return
+	}
+	hash, err := HashSecret(*algorithm, secret)
+	if err != nil {
+		return
+	}
+	_, err = fmt.Fprintln(out, hash)
+	return
+}
+
+func isBcryptHash(secret string) bool {
+	return strings.HasPrefix(secret, "$2a$") || strings.HasPrefix(secret, "$2b$") || strings.HasPrefix(secret, "$2y$")
+}
+
+// checkSecretHash 检查 secret 能否验证启用的认证方式，bcrypt、argon2id、scrypt 哈希需要明文 secret，只能在启用 -plaintextAuth 时使用
+func (c *Config) checkSecretHash(id, secret string) error {
+	if c.PlaintextAuth || !isSlowHash(secret) {
+		return nil
+	}
+	return fmt.Errorf("the secret of id '%s' is hashed with bcrypt, argon2id or scrypt, which can not verify the challenge-response authentication, hash it with storedkey or enable -plaintextAuth", id)
+}
+
+// isSlowHash 判断 secret 是否为 bcrypt、argon2id 或 scrypt 哈希
+func isSlowHash(secret string) bool {
+	return isHashedSecret(secret) && !strings.HasPrefix(secret, storedKeyPrefix)
+}
+
+// isHashedSecret 判断 secret 是否为哈希后的 secret
+func isHashedSecret(secret string) bool {
+	return isBcryptHash(secret) ||
+		strings.HasPrefix(secret, argon2idPrefix) ||
+		strings.HasPrefix(secret, scryptPrefix) ||
+		strings.HasPrefix(secret, storedKeyPrefix)
+}
+
+// parseStoredKey 解析 storedkey 算法哈希后的 secret
+func parseStoredKey(hash string) (storedKey []byte, ok bool) {
+	if !strings.HasPrefix(hash, storedKeyPrefix) {
+		return
+	}
+	storedKey, err := hex.DecodeString(hash[len(storedKeyPrefix):])
+	if err != nil || len(storedKey) != sha256.Size {
+		return nil, false
+	}
+	ok = true
+	return
+}
+
+// verifyHashedSecret 验证明文 secret 与哈希是否匹配
+func verifyHashedSecret(hash string, secret string) (ok bool, err error) {
+	switch {
+	case isBcryptHash(hash):
+		err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			err = nil
+			return
+		}
+		ok = err == nil
+	case strings.HasPrefix(hash, argon2idPrefix):
+		var a argon2idHash
+		a, err = parseArgon2idHash(hash)
+		if err != nil {
+			return
+		}
+		ok = subtle.ConstantTimeCompare(argon2.IDKey([]byte(secret), a.salt, a.t, a.m, a.p, uint32(len(a.hash))), a.hash) == 1
+	case strings.HasPrefix(hash, scryptPrefix):
+		var sh scryptHash
+		sh, err = parseScryptHash(hash)
+		if err != nil {
+			return
+		}
+		var k []byte
+		k, err = scrypt.Key([]byte(secret), sh.salt, 1<<sh.ln, sh.r, sh.p, len(sh.hash))
+		if err != nil {
+			return
+		}
+		ok = subtle.ConstantTimeCompare(k, sh.hash) == 1
+	case strings.HasPrefix(hash, storedKeyPrefix):
+		storedKey, valid := parseStoredKey(hash)
+		if !valid {
+			err = errInvalidHash
+			return
+		}
+		ok = subtle.ConstantTimeCompare(connection.StoredKey(secret), storedKey) == 1
+	default:
+		err = errInvalidHash
+	}
+	return
+}
+
+type argon2idHash struct {
+	m, t uint32
+	p    uint8
+	salt []byte
+	hash []byte
+}
+
+// parseArgon2idHash 解析 $argon2id$v=19$m=65536,t=3,p=4$salt$hash
+func parseArgon2idHash(hash string) (a argon2idHash, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		err = errInvalidHash
+		return
+	}
+	var version int
+	_, err = fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil {
+		return
+	}
+	if version != argon2.Version {
+		err = fmt.Errorf("unsupported argon2 version %d", version)
+		return
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &a.m, &a.t, &a.p)
+	if err != nil {
+		return
+	}
+	if a.t == 0 || a.p == 0 {
+		err = errInvalidHash
+		return
+	}
+	a.salt, a.hash, err = decodeSaltAndHash(parts[4], parts[5])
+	return
+}
+
+type scryptHash struct {
+	ln, r, p int
+	salt     []byte
+	hash     []byte
+}
+
+// parseScryptHash 解析 $scrypt$ln=15,r=8,p=1$salt$hash
+func parseScryptHash(hash string) (s scryptHash, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 {
+		err = errInvalidHash
+		return
+	}
+	_, err = fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &s.ln, &s.r, &s.p)
+	if err != nil {
+		return
+	}
+	if s.ln <= 0 || s.ln >= 32 || s.r <= 0 || s.p <= 0 {
+		err = errInvalidHash
+		return
+	}
+	s.salt, s.hash, err = decodeSaltAndHash(parts[3], parts[4])
+	return
+}
+
+func decodeSaltAndHash(saltStr, hashStr string) (salt, hash []byte, err error) {
+	salt, err = b64.DecodeString(saltStr)
+	if err != nil {
+		return
+	}
+	hash, err = b64.DecodeString(hashStr)
+	if err != nil {
+		return
+	}
+	if len(hash) == 0 {
+		err = errInvalidHash
+	}
+	return
+}
+
+// verifyHash 校验哈希后的 secret 的格式
+func verifyHash(hash string) (err error) {
+	switch {
+	case isBcryptHash(hash):
+		_, err = bcrypt.Cost([]byte(hash))
+	case strings.HasPrefix(hash, argon2idPrefix):
+		_, err = parseArgon2idHash(hash)
+	case strings.HasPrefix(hash, scryptPrefix):
+		_, err = parseScryptHash(hash)
+	case strings.HasPrefix(hash, storedKeyPrefix):
+		if _, ok := parseStoredKey(hash); !ok {
+			err = errInvalidHash
+		}
+	default:
+		err = errInvalidHash
+	}
+	return
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	connection "github.com/isrc-cas/gt/conn"
+)
+
+func TestHashSecret(t *testing.T) {
+	for _, algorithm := range HashAlgorithms {
+		hash, err := HashSecret(algorithm, "secret1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isHashedSecret(hash) {
+			t.Fatalf("%s: %q is not detected as a hash", algorithm, hash)
+		}
+		err = verifyHash(hash)
+		if err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+		ok, err := verifyHashedSecret(hash, "secret1")
+		if err != nil || !ok {
+			t.Fatalf("%s: failed to verify the right secret: %v", algorithm, err)
+		}
+		ok, err = verifyHashedSecret(hash, "secret2")
+		if err != nil || ok {
+			t.Fatalf("%s: verified the wrong secret: %v", algorithm, err)
+		}
+
+		u := user{Secret: hash}
+		if !u.verify("id1", credential{secret: "secret1"}) {
+			t.Fatalf("%s: plaintext credential is rejected", algorithm)
+		}
+		nonce := bytes.Repeat([]byte{1}, connection.NonceSize)
+		cred := credential{nonce: nonce, proof: connection.GenProof("id1", "secret1", nonce)}
+		if u.verify("id1", cred) != (algorithm == "storedkey") {
+			t.Fatalf("%s: unexpected result of challenge-response credential", algorithm)
+		}
+	}
+	if isHashedSecret("secret1") {
+		t.Fatal("plaintext secret is detected as a hash")
+	}
+	err := verifyHash("$argon2id$v=19$m=65536,t=3$salt$hash")
+	if err == nil {
+		t.Fatal("invalid hash is accepted")
+	}
+}
+
+func TestRunHashSecret(t *testing.T) {
+	var out bytes.Buffer
+	err := RunHashSecret([]string{"hash-secret", "-algorithm", "storedkey"}, strings.NewReader("secret1\n"), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := strings.TrimSpace(out.String())
+	ok, err := verifyHashedSecret(hash, "secret1")
+	if err != nil || !ok {
+		t.Fatalf("failed to verify %q: %v", hash, err)
+	}
+}
+
+func TestSlowHashNeedsPlaintextAuth(t *testing.T) {
+	hash, err := HashSecret("bcrypt", "secret1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plaintextAuth := range []bool{false, true} {
+		args := []string{"server", "-addr", "127.0.0.1:0", "-id", "id1", "-secret", hash}
+		if plaintextAuth {
+			args = append(args, "-plaintextAuth")
+		}
+		s, err := New(args, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Start()
+		s.Close()
+		if plaintextAuth && err != nil {
+			t.Fatalf("server with -plaintextAuth failed to start: %v", err)
+		}
+		if !plaintextAuth && err == nil {
+			t.Fatal("server started with a bcrypt secret without -plaintextAuth")
+		}
+	}
+}
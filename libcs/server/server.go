@@ -17,6 +17,7 @@ package server
 import (
 	"bytes"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -50,11 +51,16 @@ import (
 	"github.com/pion/logging"
 	"github.com/pion/turn/v3"
 	"github.com/shirou/gopsutil/v3/process"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 // Server is a network agent server.
 type Server struct {
 	config       Config
+	args         []string // 重新加载时再次解析的命令行
+	reloading    atomic.Bool
+	connIDSeed   atomic.Uint64 // 分配给连接的递增 id，用于日志与控制 API
 	users        users
 	portsManager portsManager
 	Logger       logger.Logger
@@ -69,36 +75,73 @@ type Server struct {
 	tunneling    uint64
 	apiServer    *api.Server
 	apiListener  net.Listener
-	authUser     func(id string, secret string) (user, error)
+	authUser     func(id string, cred credential) (user, error)
 	removeClient func(id string)
 	stunServer   *turn.Server
 	turnListener net.PacketConn
 
+	// 证书，按 SNI 选择并在文件变化后重新加载
+	certs    *certStore
+	apiCerts *certStore
+
+	// ACME 自动证书
+	acme            *autocert.Manager
+	acmeBaseDomains []string
+
+	// 签名访问策略登录 cookie 的密钥
+	edgeAuthKey []byte
+
+	// 允许发送 PROXY protocol 头部的来源
+	proxyProtocolTrusted []*net.IPNet
+
+	// 访问者与客户端登录的 IP 过滤规则
+	ipFilters *ipFilterStore
+
+	// 服务端上下行总限速
+	uploadLimit   *sharedLimiter
+	downloadLimit *sharedLimiter
+
+	// 用户的流量统计
+	traffic *trafficStore
+
+	// Prometheus 指标
+	metrics *serverMetrics
+
+	// 访问者的访问日志
+	accessLog *accessLogger
+
+	// 服务不可用时返回给访问者的错误页面
+	errorPages *errorPages
+
+	// 保存 admin API 管理的用户与 allowAnyClient 模式下认领的 id
+	userStore     UserStore
+	usersMtx      gosync.Mutex         // 串行修改用户，避免并发添加的用户 tcp 端口冲突
+	defaultUser   atomic.Pointer[user] // 使用全局设置的用户模板，重新加载配置时整体替换，登录时无需加锁读取
+	userExpiry    map[string]*time.Timer
+	userExpiryMtx gosync.Mutex
+
+	// 运维封禁的客户端 id 与 IP
+	idBans  map[string]time.Time
+	ipBans  map[string]ipBan // key: CIDR
+	bansMtx gosync.Mutex
+
+	// 服务组共享的 tcp 端口，key: 端口
+	tcpGroups    map[uint16]*tcpGroup
+	tcpGroupsMtx gosync.Mutex
+
 	// 重连限制
 	reconnect        map[string]uint32
 	reconnectRWMutex gosync.RWMutex
 
-	hostPrefix2Client    sync.Map // key: hostPrefix(string) value: *client
-	tlsHostPrefix2Client sync.Map // key: hostPrefix(string) value: *client
+	hostRoutes      routeTable // key: hostPrefix + path
+	tlsHostRoutes   routeTable // key: hostPrefix
+	domainRoutes    routeTable // key: domain + path
+	tlsDomainRoutes routeTable // key: domain
 }
 
 // New parses the command line args and creates a Server. out 用于测试
 func New(args []string, out io.Writer) (s *Server, err error) {
-	var conf Config
-	if util.IsNoArgs() {
-		conf = defaultConfigWithNoArgs()
-	} else {
-		conf = DefaultConfig()
-		if util.Contains(args, "-webAddr") {
-			conf.Config = util.GetDefaultServerConfigPath()
-		}
-	}
-	err = config.ParseFlags(args, &conf, &conf.Options)
-	if err != nil {
-		return
-	}
-	conf.ConfigType = "server"
-	err = MergeConfig(&conf)
+	conf, err := parseConfig(args)
 	if err != nil {
 		return
 	}
@@ -134,14 +177,42 @@ func New(args []string, out io.Writer) (s *Server, err error) {
 
 	s = &Server{
 		config:    conf,
+		args:      args,
 		Logger:    l,
 		reconnect: make(map[string]uint32),
 	}
+	// 解析 host 设置后再次更新
+	s.defaultUser.Store(conf.defaultUser())
+	return
+}
+
+// parseConfig 解析命令行与配置文件，重新加载时也使用它
+func parseConfig(args []string) (conf Config, err error) {
+	if util.IsNoArgs() {
+		conf = defaultConfigWithNoArgs()
+	} else {
+		conf = DefaultConfig()
+		if util.Contains(args, "-webAddr") {
+			conf.Config = util.GetDefaultServerConfigPath()
+		}
+	}
+	err = config.ParseFlags(args, &conf, &conf.Options)
+	if err != nil {
+		return
+	}
+	conf.ConfigType = "server"
+	err = MergeConfig(&conf)
 	return
 }
 
 func processSignal(signal string) (err error) {
 	switch signal {
+	case "reload":
+		err := sig(syscall.SIGHUP)
+		if err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
 	case "restart":
 		err := sig(syscall.SIGQUIT)
 		if err != nil {
@@ -216,18 +287,24 @@ func sig(sig syscall.Signal) (err error) {
 }
 func (s *Server) tlsListen() (err error) {
 	var tlsConfig *tls.Config
-	tlsConfig, err = newTLSConfig(s.config.CertFile, s.config.KeyFile, s.config.TLSMinVersion)
-	if err != nil {
-		return
+	if s.certs != nil {
+		tlsConfig = newCertTLSConfig(s.certs, s.config.TLSMinVersion)
+	} else {
+		tlsConfig = baseTLSConfig(s.config.TLSMinVersion)
+	}
+	if s.acme != nil {
+		tlsConfig.GetCertificate = s.acmeGetCertificate()
+		tlsConfig.NextProtos = []string{"http/1.1", acme.ALPNProto}
 	}
 	listener, err := reuseport.Listen("tcp", s.config.TLSAddr)
 	if err != nil {
 		err = fmt.Errorf("can not listen on addr '%s', cause %s, please check option 'tlsAddr'", s.config.TLSAddr, err.Error())
 		return
 	}
-	s.tlsListener = tls.NewListener(listener, tlsConfig)
+	s.tlsListener = tls.NewListener(s.proxyProtocolListen(listener, s.config.TLSAddrProxyProtocol), tlsConfig)
 	s.Logger.Info().Str("addr", s.tlsListener.Addr().String()).Msg("Listening TLS")
 	go s.acceptLoop(s.tlsListener, func(c *conn) {
+		c.secure = true
 		c.handle(c.handleHTTP)
 	})
 	return
@@ -239,6 +316,7 @@ func (s *Server) listen() (err error) {
 		err = fmt.Errorf("can not listen on addr '%s', cause %s, please check option 'addr'", s.config.Addr, err.Error())
 		return
 	}
+	s.listener = s.proxyProtocolListen(s.listener, s.config.AddrProxyProtocol)
 	s.Logger.Info().Str("addr", s.listener.Addr().String()).Msg("Listening")
 	go s.acceptLoop(s.listener, func(c *conn) {
 		c.handle(c.handleHTTP)
@@ -248,15 +326,13 @@ func (s *Server) listen() (err error) {
 
 func (s *Server) quicListen(openBBR bool) (err error) {
 	var tlsConfig *tls.Config
-	if len(s.config.CertFile) > 0 && len(s.config.KeyFile) > 0 {
-		tlsConfig, err = newTLSConfig(s.config.CertFile, s.config.KeyFile, s.config.TLSMinVersion)
+	if s.certs != nil {
+		tlsConfig = newCertTLSConfig(s.certs, s.config.TLSMinVersion)
 	} else {
 		tlsConfig = connection.GenerateTLSConfig()
 	}
-	if err != nil {
-		return
-	}
 	if openBBR {
+		// msquic 只支持从 certFile 与 keyFile 加载证书
 		//s.quicListener, err = connection.QuicBbrListen(s.config.QuicAddr, tlsConfig)
 		//s.quicListener, err = quic.NewListenr(s.config.QuicAddr, 10_000, s.config.KeyFile, s.config.CertFile, "")
 		s.quicListener, err = msquic.MsquicListen(s.config.QuicAddr, s.config.KeyFile, s.config.CertFile)
@@ -269,6 +345,7 @@ func (s *Server) quicListen(openBBR bool) (err error) {
 	}
 	s.Logger.Info().Str("QuicAddr", s.quicListener.Addr().String()).Msg("Listening")
 	go s.acceptLoop(s.quicListener, func(c *conn) {
+		c.secure = true
 		c.handle(c.handleHTTP)
 	})
 	return
@@ -280,6 +357,7 @@ func (s *Server) sniListen() (err error) {
 		err = fmt.Errorf("can not listen on addr '%s', cause %s, please check option 'sniAddr'", s.config.SNIAddr, err.Error())
 		return
 	}
+	s.sniListener = s.proxyProtocolListen(s.sniListener, s.config.SNIAddrProxyProtocol)
 	s.Logger.Info().Str("sniAddr", s.sniListener.Addr().String()).Msg("Listening SNI")
 	go s.acceptLoop(s.sniListener, func(c *conn) {
 		c.handle(c.handleSNI)
@@ -329,9 +407,10 @@ func (s *Server) acceptLoop(l net.Listener, handle func(*conn)) {
 			return
 		}
 		atomic.AddUint64(&s.accepted, 1)
-		c := newConn(conn, s)
 		go func() {
 			defer atomic.AddUint64(&s.served, 1)
+			// 解析 PROXY protocol 头部时 newConn 可能阻塞，所以不在 accept 循环中调用
+			c := newConn(conn, s)
 			handle(c)
 		}()
 	}
@@ -340,16 +419,16 @@ func (s *Server) acceptLoop(l net.Listener, handle func(*conn)) {
 // Start runs the server.
 func (s *Server) Start() (err error) {
 	s.Logger.Info().Msg(predef.Version)
-	err = s.users.mergeUsers(s.config.Users, nil, nil)
+	s.metrics = newServerMetrics(s)
+	err = s.users.load(s.config)
 	if err != nil {
 		return
 	}
-	users := make(map[string]*user)
-	err = config.Yaml2Interface(s.config.Options.Users, users)
+	err = s.initUserStore()
 	if err != nil {
 		return
 	}
-	err = s.users.mergeUsers(users, s.config.IDs, s.config.Secrets)
+	err = s.users.checkSecretHashes(&s.config)
 	if err != nil {
 		return
 	}
@@ -361,6 +440,44 @@ func (s *Server) Start() (err error) {
 	if err != nil {
 		return
 	}
+	s.users.Range(func(key, value interface{}) bool {
+		s.scheduleUserExpiry(key.(string), value.(user).Expires)
+		return true
+	})
+	if s.config.ConfigWatchInterval.Duration > 0 && (len(s.config.Options.Config) > 0 || len(s.config.Options.Users) > 0) {
+		go s.watchConfig(s.config.ConfigWatchInterval.Duration)
+	}
+	err = s.initEdgeAuthKey()
+	if err != nil {
+		return
+	}
+
+	err = s.parseProxyProtocol()
+	if err != nil {
+		return
+	}
+	err = s.initIPFilters()
+	if err != nil {
+		return
+	}
+	s.uploadLimit = newSharedLimiter(s.config.GlobalUploadSpeed, s.config.SpeedBurst.Duration)
+	s.downloadLimit = newSharedLimiter(s.config.GlobalDownloadSpeed, s.config.SpeedBurst.Duration)
+	err = s.initTraffic()
+	if err != nil {
+		return
+	}
+	err = s.initAccessLog()
+	if err != nil {
+		return
+	}
+	err = s.initErrorPages()
+	if err != nil {
+		return
+	}
+	err = checkGroupBalance(s.config.GroupBalance)
+	if err != nil {
+		return
+	}
 
 	if len(s.config.HTTPMUXHeader) <= 0 {
 		err = fmt.Errorf("HTTP multiplexing header (-httpMUXHeader option) '%s' is invalid", s.config.HTTPMUXHeader)
@@ -370,10 +487,10 @@ func (s *Server) Start() (err error) {
 	if len(s.config.AuthAPI) > 0 {
 		s.authUser = nil
 		s.removeClient = s.removeClientOnly
-	} else if s.users.empty() {
+	} else if s.users.empty() && s.userStore == nil {
 		s.Logger.Warn().Msg("working on -allowAnyClient mode, because no user is configured")
 		s.authUser = s.authUserOrCreateUser
-		s.removeClient = s.removeClientAndUser
+		s.removeClient = s.removeClientAndTempUser
 	} else if !s.config.AllowAnyClient {
 		s.authUser = s.authUserWithConfig
 		s.removeClient = s.removeClientOnly
@@ -395,7 +512,21 @@ func (s *Server) Start() (err error) {
 	}
 
 	var listening bool
-	if len(s.config.TLSAddr) > 0 && len(s.config.CertFile) > 0 && len(s.config.KeyFile) > 0 {
+	if s.config.ACME {
+		if len(s.config.TLSAddr) == 0 {
+			err = errors.New("option 'acme' requires option 'tlsAddr'")
+			return
+		}
+		s.acme, err = s.newACMEManager()
+		if err != nil {
+			return
+		}
+	}
+	s.certs, err = s.newCertStore("tls", s.config.CertFile, s.config.KeyFile, s.config.CertFiles, s.config.KeyFiles, s.config.CertDir)
+	if err != nil {
+		return
+	}
+	if len(s.config.TLSAddr) > 0 && (s.acme != nil || s.certs != nil) {
 		if strings.IndexByte(s.config.TLSAddr, ':') == -1 {
 			s.config.TLSAddr = ":" + s.config.TLSAddr
 		}
@@ -462,6 +593,13 @@ func (s *Server) Start() (err error) {
 		}
 	}
 
+	if len(s.config.MetricsAddr) > 0 {
+		err = s.startMetricsServer()
+		if err != nil {
+			return
+		}
+	}
+
 	conf4log := *s.Config()
 	conf4log.Password = "******"
 	conf4log.SigningKey = "******"
@@ -521,14 +659,9 @@ func (s *Server) startSTUNServer() (err error) {
 	return
 }
 
-func newTLSConfig(cert, key, tlsMinVersion string) (tlsConfig *tls.Config, err error) {
-	crt, err := tls.LoadX509KeyPair(cert, key)
-	if err != nil {
-		err = fmt.Errorf("invalid cert and key, cause %s", err.Error())
-		return
-	}
+// baseTLSConfig 返回不含证书的 tls 配置
+func baseTLSConfig(tlsMinVersion string) (tlsConfig *tls.Config) {
 	tlsConfig = &tls.Config{}
-	tlsConfig.Certificates = []tls.Certificate{crt}
 	switch strings.ToLower(tlsMinVersion) {
 	case "tls1.1":
 		tlsConfig.MinVersion = tls.VersionTLS11
@@ -558,12 +691,12 @@ func (s *Server) startAPIServer() (err error) {
 		s.apiServer.RemoteSchema = "tcp://"
 		s.apiServer.RemoteAddr = s.listener.Addr().String()
 	}
-	if len(s.config.APICertFile) > 0 && len(s.config.APIKeyFile) > 0 {
-		var tlsConfig *tls.Config
-		tlsConfig, err = newTLSConfig(s.config.APICertFile, s.config.APIKeyFile, s.config.APITLSMinVersion)
-		if err != nil {
-			return
-		}
+	s.apiCerts, err = s.newCertStore("api", s.config.APICertFile, s.config.APIKeyFile, s.config.APICertFiles, s.config.APIKeyFiles, s.config.APICertDir)
+	if err != nil {
+		return
+	}
+	if s.apiCerts != nil {
+		tlsConfig := newCertTLSConfig(s.apiCerts, s.config.APITLSMinVersion)
 		ln, err := reuseport.Listen("tcp", s.config.APIAddr)
 		if err != nil {
 			return fmt.Errorf("can not listen on addr '%s', cause %s, please check option 'tlsAddr'", s.config.APIAddr, err.Error())
@@ -587,20 +720,29 @@ func (s *Server) startAPIServer() (err error) {
 	return nil
 }
 
+// authParam 是发送给 AuthAPI 的认证参数。质询应答认证时 networkSecretKey 为空，
+// AuthAPI 需要用 nonce 与 proof 验证客户端，算法见 conn.VerifyProof
 type authParam struct {
 	NetworkClientId  string   `json:"networkClientId"`
 	NetworkSecretKey string   `json:"networkSecretKey"`
+	Nonce            string   `json:"nonce,omitempty"`
+	Proof            string   `json:"proof,omitempty"`
 	AppletTokens     []string `json:"appletTokens"`
 }
 
-func (s *Server) authWithAPI(id string, secret string, prefixes []string) (hostPrefixes map[string]struct{}, ok bool, err error) {
+func (s *Server) authWithAPI(id string, cred credential, prefixes []string) (hostPrefixes map[string]struct{}, ok bool, err error) {
 	var bs bytes.Buffer
 	encoder := json.NewEncoder(&bs)
 	p := &authParam{
 		NetworkClientId:  id,
-		NetworkSecretKey: secret,
+		NetworkSecretKey: cred.secret,
 		AppletTokens:     prefixes,
 	}
+	if cred.challenge() {
+		p.NetworkSecretKey = ""
+		p.Nonce = hex.EncodeToString(cred.nonce)
+		p.Proof = hex.EncodeToString(cred.proof)
+	}
 	err = encoder.Encode(p)
 	if err != nil {
 		return
@@ -651,6 +793,9 @@ func (s *Server) Close() {
 	if s.apiServer != nil {
 		event.AnErr("api", s.apiServer.Close())
 	}
+	if s.metrics != nil {
+		event.AnErr("metrics", s.metrics.close())
+	}
 	if s.stunServer != nil {
 		event.AnErr("turn", s.stunServer.Close())
 	}
@@ -663,12 +808,31 @@ func (s *Server) Close() {
 	if s.sniListener != nil {
 		event.AnErr("sniListener", s.sniListener.Close())
 	}
+	if s.certs != nil {
+		s.certs.close()
+	}
+	if s.apiCerts != nil {
+		s.apiCerts.close()
+	}
+	if s.ipFilters != nil {
+		s.ipFilters.close()
+	}
 	s.id2Client.Range(func(key, value interface{}) bool {
 		if c, ok := value.(*client); ok && c != nil {
 			c.close()
 		}
 		return true
 	})
+	if s.traffic != nil {
+		s.traffic.close()
+	}
+	s.stopUserExpiry()
+	if s.userStore != nil {
+		event.AnErr("userStore", s.userStore.Close())
+	}
+	if s.accessLog != nil {
+		event.AnErr("accessLog", s.accessLog.close())
+	}
 	event.Msg("server stopped")
 }
 
@@ -687,6 +851,9 @@ func (s *Server) Shutdown() {
 	if s.apiServer != nil {
 		event.AnErr("api", s.apiServer.Close())
 	}
+	if s.metrics != nil {
+		event.AnErr("metrics", s.metrics.close())
+	}
 	if s.stunServer != nil {
 		event.AnErr("turn", s.stunServer.Close())
 	}
@@ -725,6 +892,16 @@ func (s *Server) Shutdown() {
 		}
 		return true
 	})
+	if s.traffic != nil {
+		s.traffic.close()
+	}
+	s.stopUserExpiry()
+	if s.userStore != nil {
+		event.AnErr("userStore", s.userStore.Close())
+	}
+	if s.accessLog != nil {
+		event.AnErr("accessLog", s.accessLog.close())
+	}
 	event.Msg("server stopped")
 }
 
@@ -734,46 +911,30 @@ func (s *Server) getOrCreateClient(id string, fn func() interface{}) (result *cl
 	return
 }
 
-func (s *Server) getHostPrefix(hostPrefix string) (c clientWithServiceIndex, ok bool) {
-	value, ok := s.hostPrefix2Client.Load(hostPrefix)
-	if ok {
-		c = value.(clientWithServiceIndex)
-	}
-	return
-}
-
-func (s *Server) getOrCreateHostPrefix(hostPrefix string, tls bool, fn func() interface{}) (c clientWithServiceIndex, ok bool) {
-	if !tls {
-		actual, loaded := s.hostPrefix2Client.LoadOrCreate(hostPrefix, fn)
-		return actual.(clientWithServiceIndex), loaded
-	} else {
-		actual, loaded := s.tlsHostPrefix2Client.LoadOrCreate(hostPrefix, fn)
-		return actual.(clientWithServiceIndex), loaded
-	}
+// routes 返回 option 所在的路由表
+func (s *Server) routes(o hostPrefixOption) *routeTable {
+	switch {
+	case o.domain && o.tls:
+		return &s.tlsDomainRoutes
+	case o.domain:
+		return &s.domainRoutes
+	case o.tls:
+		return &s.tlsHostRoutes
+	}
+	return &s.hostRoutes
 }
 
-func (s *Server) storeHostPrefix(hostPrefix string, tls bool, c clientWithServiceIndex) {
-	if !tls {
-		s.hostPrefix2Client.Store(hostPrefix, c)
-	} else {
-		s.tlsHostPrefix2Client.Store(hostPrefix, c)
-	}
+func (s *Server) getOrCreateHostPrefix(key string, o hostPrefixOption, fn func() hostRoute) (r hostRoute, ok bool) {
+	return s.routes(o).loadOrCreate(key, fn)
 }
 
-func (s *Server) removeHostPrefix(hostPrefix string, tls bool) {
-	if !tls {
-		s.hostPrefix2Client.Delete(hostPrefix)
-	} else {
-		s.tlsHostPrefix2Client.Delete(hostPrefix)
-	}
+func (s *Server) storeHostPrefix(key string, o hostPrefixOption, r hostRoute) {
+	s.routes(o).store(key, r)
 }
 
-func (s *Server) getTLSHostPrefix(hostPrefix string) (c clientWithServiceIndex, ok bool) {
-	value, ok := s.tlsHostPrefix2Client.Load(hostPrefix)
-	if ok {
-		c = value.(clientWithServiceIndex)
-	}
-	return
+// removeHostPrefix 删除 cli 的路由，服务组的路由在最后一个成员离开时删除
+func (s *Server) removeHostPrefix(key string, o hostPrefixOption, cli *client) {
+	s.routes(o).delete(key, cli)
 }
 
 // GetAccepted returns value of accepted
@@ -794,14 +955,17 @@ func (s *Server) GetTunneling() uint64 {
 // ErrInvalidUser is returned if id and secret are invalid
 var ErrInvalidUser = errors.New("invalid user")
 
-func (s *Server) authUserWithConfig(id string, secret string) (u user, err error) {
-	if len(id) < 1 || len(secret) < 1 {
+// ErrEnrollmentRequired is returned if a new id logs in with challenge-response authentication over an unencrypted connection
+var ErrEnrollmentRequired = errors.New("new id must log in over TLS or with plaintext authentication first")
+
+func (s *Server) authUserWithConfig(id string, cred credential) (u user, err error) {
+	if len(id) < 1 {
 		err = ErrInvalidUser
 		return
 	}
-	u, err = s.users.auth(id, secret)
+	u, err = s.users.auth(id, cred)
 	if err != nil {
-		if s.apiServer != nil && s.apiServer.Auth(id, secret) {
+		if s.apiServer != nil && s.apiServer.Auth(id, cred.verify) {
 			u = s.newTempUserForAPIServer()
 			err = nil
 			return
@@ -811,26 +975,43 @@ func (s *Server) authUserWithConfig(id string, secret string) (u user, err error
 }
 
 func (s *Server) newTempUserForAPIServer() user {
-	return user{
-		TCPNumber:    &s.config.TCPNumber,
-		Speed:        s.config.Speed,
-		Connections:  s.config.Connections,
-		Host:         s.config.Host,
-		portsManager: &s.portsManager,
+	return s.newDefaultUser()
+}
+
+// defaultUser 返回使用全局设置的用户模板
+func (c *Config) defaultUser() *user {
+	tcpNumber := c.TCPNumber
+	return &user{
+		TCPNumber:     &tcpNumber,
+		Speed:         c.Speed,
+		UploadSpeed:   c.UploadSpeed,
+		DownloadSpeed: c.DownloadSpeed,
+		VisitorSpeed:  c.VisitorSpeed,
+		DayQuota:      c.DayQuota,
+		MonthQuota:    c.MonthQuota,
+		Connections:   c.Connections,
+		Host:          c.Host,
 	}
 }
 
-func (s *Server) authUserWithAPI(id string, secret string, prefixes []string) (u user, err error) {
-	if len(id) < 1 || len(secret) < 1 {
+// newDefaultUser 从当前的用户模板创建使用全局设置和全局端口池的用户
+func (s *Server) newDefaultUser() (u user) {
+	u = *s.defaultUser.Load()
+	u.portsManager = &s.portsManager
+	return
+}
+
+func (s *Server) authUserWithAPI(id string, cred credential, prefixes []string) (u user, err error) {
+	if len(id) < 1 {
 		err = ErrInvalidUser
 		return
 	}
-	hostPrefixes, ok, err := s.authWithAPI(id, secret, prefixes)
+	hostPrefixes, ok, err := s.authWithAPI(id, cred, prefixes)
 	if err != nil {
 		return
 	}
 	if !ok {
-		if s.apiServer != nil && s.apiServer.Auth(id, secret) {
+		if s.apiServer != nil && s.apiServer.Auth(id, cred.verify) {
 			u = s.newTempUserForAPIServer()
 			err = nil
 			return
@@ -838,54 +1019,73 @@ func (s *Server) authUserWithAPI(id string, secret string, prefixes []string) (u
 		err = ErrInvalidUser
 		return
 	}
-	u = user{
-		TCPNumber:    &s.config.TCPNumber,
-		Speed:        s.config.Speed,
-		Connections:  s.config.Connections,
-		Host:         s.config.Host,
-		portsManager: &s.portsManager,
-	}
+	u = s.newDefaultUser()
 	u.Host.Prefixes = hostPrefixes
 	return
 }
 
-func (s *Server) authUserOrCreateUser(id, secret string) (u user, err error) {
-	if s.apiServer != nil && s.apiServer.Auth(id, secret) {
+func (s *Server) authUserOrCreateUser(id string, cred credential) (u user, err error) {
+	if s.apiServer != nil && s.apiServer.Auth(id, cred.verify) {
 		u = s.newTempUserForAPIServer()
 		err = nil
 		return
 	}
 
-	value, _ := s.users.LoadOrCreate(id, func() interface{} {
-		return user{
-			Secret:       secret,
-			TCPNumber:    &s.config.TCPNumber,
-			Speed:        s.config.Speed,
-			Connections:  s.config.Connections,
-			Host:         s.config.Host,
-			temp:         true,
-			portsManager: &s.portsManager,
+	storedKey := cred.enrollment()
+	var value interface{}
+	var loaded bool
+	if storedKey == nil {
+		// 质询应答认证时服务端拿不到 secret，新的 id 只能通过加密连接或明文认证登记
+		value, loaded = s.users.Load(id)
+		if !loaded {
+			err = ErrEnrollmentRequired
+			return
 		}
-	})
+	} else {
+		value, loaded = s.users.LoadOrCreate(id, s.newAnyClientUser(id, cred, storedKey))
+	}
 	var ok bool
 	u, ok = value.(user)
 	if !ok {
 		err = ErrInvalidUser
 		return
 	}
-	if u.Secret != secret {
+	if !u.verify(id, cred) {
 		err = ErrInvalidUser
+		return
+	}
+	if u.expired() {
+		err = ErrUserExpired
+		return
+	}
+	if !loaded && u.claimed {
+		s.claimUser(id, u)
 	}
 	return
 }
 
-func (s *Server) removeClientOnly(id string) {
-	s.id2Client.Delete(id)
+// newAnyClientUser 返回 allowAnyClient 模式下为新的 id 创建用户的函数
+func (s *Server) newAnyClientUser(id string, cred credential, storedKey []byte) func() interface{} {
+	return func() interface{} {
+		u := s.newDefaultUser()
+		u.temp = s.userStore == nil
+		u.claimed = s.userStore != nil
+		// 质询应答认证时服务端拿不到 secret，以客户端在加密连接上声明的 stored key 作为凭据
+		if cred.challenge() {
+			u.storedKey = storedKey
+		} else {
+			u.Secret = cred.secret
+		}
+		if u.claimed {
+			r := newUserRecord(id, user{Secret: u.Secret, storedKey: u.storedKey, claimed: true})
+			u.record = &r
+		}
+		return u
+	}
 }
 
-func (s *Server) removeClientAndUser(id string) {
+func (s *Server) removeClientOnly(id string) {
 	s.id2Client.Delete(id)
-	s.users.Delete(id)
 }
 
 func (s *Server) removeClientAndTempUser(id string) {
@@ -899,14 +1099,44 @@ func (s *Server) removeClientAndTempUser(id string) {
 
 // tcp 相关配置，命令行的优先级高于配置文件
 func (s *Server) parseTCPs() (err error) {
-	ports := make(map[uint16]struct{}, 65536)
-	all := make(map[uint16]struct{}, 65536)
-	for _, tcp := range s.config.TCPs {
+	ports, err := s.config.tcpPorts()
+	if err != nil {
+		return
+	}
+	all := make(map[uint16]struct{}, len(ports))
+	for port := range ports {
+		all[port] = struct{}{}
+	}
+	s.portsManager.ports = ports
+
+	// 处理用户 tcp
+	s.users.Range(func(key, value interface{}) bool {
+		u := value.(user)
+		u.portsManager, err = s.userPortsManager(u, all)
+		if err != nil {
+			return false
+		}
+		s.users.Store(key, u)
+		return true
+	})
+	return
+}
+
+// userPortsManager 返回用户的端口池，用户没有设置 tcp 端口范围时使用全局的。all 是已经被使用的端口
+func (s *Server) userPortsManager(u user, all map[uint16]struct{}) (*portsManager, error) {
+	if len(u.TCPs) == 0 { // 如果用户没有设置则使用全局的
+		return &s.portsManager, nil
+	}
+	ports := make(map[uint16]struct{})
+	for _, tcp := range u.TCPs {
 		pr, err := util.NewPortRangeFromString(tcp.Range)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		for i := pr.Min; i <= pr.Max; i++ {
+			if _, ok := all[i]; ok {
+				return nil, fmt.Errorf("tcp port %d is used by global", i)
+			}
 			ports[i] = struct{}{}
 			all[i] = struct{}{}
 			if i == math.MaxUint16 {
@@ -914,134 +1144,202 @@ func (s *Server) parseTCPs() (err error) {
 			}
 		}
 	}
+	return &portsManager{ports: ports}, nil
+}
 
-	for _, tcp := range s.config.TCPRanges {
-		pr, err := util.NewPortRangeFromString(tcp)
+// usedTCPPorts 返回全局与除 id 以外的用户的 tcp 端口
+func (s *Server) usedTCPPorts(id string) (all map[uint16]struct{}, err error) {
+	ranges := append([]string(nil), s.config.TCPRanges...)
+	for _, tcp := range s.config.TCPs {
+		ranges = append(ranges, tcp.Range)
+	}
+	s.users.Range(func(key, value interface{}) bool {
+		if key.(string) != id {
+			for _, tcp := range value.(user).TCPs {
+				ranges = append(ranges, tcp.Range)
+			}
+		}
+		return true
+	})
+	return portRanges(ranges)
+}
+
+// tcpPorts 返回配置文件与命令行设置的全局 tcp 端口
+func (c *Config) tcpPorts() (ports map[uint16]struct{}, err error) {
+	ranges := make([]string, 0, len(c.TCPs)+len(c.TCPRanges))
+	for _, tcp := range c.TCPs {
+		ranges = append(ranges, tcp.Range)
+	}
+	ranges = append(ranges, c.TCPRanges...)
+	return portRanges(ranges)
+}
+
+// portRanges 返回端口范围中的所有端口
+func portRanges(ranges []string) (ports map[uint16]struct{}, err error) {
+	ports = make(map[uint16]struct{})
+	for _, r := range ranges {
+		var pr util.PortRange
+		pr, err = util.NewPortRangeFromString(r)
 		if err != nil {
-			return err
+			return
 		}
 		for i := pr.Min; i <= pr.Max; i++ {
 			ports[i] = struct{}{}
-			all[i] = struct{}{}
 			if i == math.MaxUint16 {
 				break
 			}
 		}
 	}
-
-	s.portsManager.ports = ports
-
-	// 处理用户 tcp
-	s.users.Range(func(key, value interface{}) bool {
-		u := value.(user)
-		if u.TCPNumber == nil {
-			u.TCPNumber = &s.config.TCPNumber
-		}
-		if len(u.TCPs) == 0 { // 如果用户没有设置则使用全局的
-			u.portsManager = &s.portsManager
-		} else {
-			ports := make(map[uint16]struct{})
-			for _, tcp := range u.TCPs {
-				var pr util.PortRange
-				pr, err = util.NewPortRangeFromString(tcp.Range)
-				if err != nil {
-					return false
-				}
-				for i := pr.Min; i <= pr.Max; i++ {
-					if _, ok := all[i]; ok {
-						err = fmt.Errorf("tcp port %d is used by global", i)
-						return false
-					}
-					ports[i] = struct{}{}
-					all[i] = struct{}{}
-					if i == math.MaxUint16 {
-						break
-					}
-				}
-			}
-			u.portsManager = &portsManager{ports: ports}
-		}
-		s.users.Store(key, u)
-		return true
-	})
 	return
 }
 
-// host 相关配置，命令行的优先级高于配置文件
-func (s *Server) parseHost() (err error) {
+// parseHost 合并配置文件与命令行的全局 host 设置
+func (c *Config) parseHost() (err error) {
 	// 合并 host regex
 	hostRegexMap := make(map[string]struct{})
-	if s.config.Host.RegexStr == nil {
-		s.config.Host.RegexStr = &s.config.HostRegex
+	if c.Host.RegexStr == nil {
+		c.Host.RegexStr = &c.HostRegex
 	}
-	for _, regex := range *s.config.Host.RegexStr {
+	for _, regex := range *c.Host.RegexStr {
 		hostRegexMap[regex] = struct{}{}
 	}
-	for _, regex := range s.config.HostRegex {
+	for _, regex := range c.HostRegex {
 		hostRegexMap[regex] = struct{}{}
 	}
-	*s.config.Host.RegexStr = config.Slice[string]{}
+	*c.Host.RegexStr = config.Slice[string]{}
 	for hostRegex := range hostRegexMap {
-		*s.config.Host.RegexStr = append(*s.config.Host.RegexStr, hostRegex)
+		*c.Host.RegexStr = append(*c.Host.RegexStr, hostRegex)
 	}
 
 	// 处理全局 host
-	if s.config.Host.Number == nil {
-		s.config.Host.Number = &s.config.HostNumber
+	if c.Host.Number == nil {
+		c.Host.Number = &c.HostNumber
 	}
-	s.config.Host.Regex = new([]*regexp.Regexp)
+	c.Host.Regex = new([]*regexp.Regexp)
 	for str := range hostRegexMap {
 		regex, err := regexp.Compile(str)
 		if err != nil {
 			return err
 		}
-		*s.config.Host.Regex = append(*s.config.Host.Regex, regex)
+		*c.Host.Regex = append(*c.Host.Regex, regex)
+	}
+	if c.Host.WithID == nil {
+		c.Host.WithID = &c.HostWithID
+	}
+
+	// 合并允许的域名
+	if c.Host.Domains == nil {
+		c.Host.Domains = &config.Slice[string]{}
 	}
-	if s.config.Host.WithID == nil {
-		s.config.Host.WithID = &s.config.HostWithID
+	domains, err := parseDomains(append(*c.Host.Domains, c.HostDomains...))
+	if err != nil {
+		return
+	}
+	*c.Host.Domains = domains
+
+	// 访问策略
+	if c.Host.AllowClientAuth == nil {
+		c.Host.AllowClientAuth = &c.HostAllowClientAuth
+	}
+	return initEdgeAuth(c.Host.Auth)
+}
+
+// host 相关配置，命令行的优先级高于配置文件
+func (s *Server) parseHost() (err error) {
+	err = s.config.parseHost()
+	if err != nil {
+		return
 	}
 
 	// 提前将用户的参数设置为用户设置的值或全局的值，避免在热点代码中重复判断
 	s.users.Range(func(key, value interface{}) bool {
 		u := value.(user)
-
-		// speed
-		if u.Speed <= 0 {
-			u.Speed = s.config.Speed
+		err = s.config.fillUser(key.(string), &u)
+		if err != nil {
+			return false
 		}
+		s.users.Store(key, u)
+		return true
+	})
+	s.defaultUser.Store(s.config.defaultUser())
+	return
+}
 
-		// connections
-		if u.Connections <= 0 {
-			u.Connections = s.config.Connections
-		}
+// fillUser 将用户没有设置的参数设置为全局的值
+func (c *Config) fillUser(id string, u *user) (err error) {
+	if u.TCPNumber == nil {
+		u.TCPNumber = &c.TCPNumber
+	}
 
-		// host
-		if u.Host.Number == nil {
-			u.Host.Number = s.config.Host.Number
+	// speed，用户设置的 speed 优先于全局的上下行速度
+	if u.Speed <= 0 {
+		u.Speed = c.Speed
+		if u.UploadSpeed <= 0 {
+			u.UploadSpeed = c.UploadSpeed
 		}
-		if u.Host.RegexStr == nil {
-			u.Host.RegexStr = s.config.Host.RegexStr
-		}
-		u.Host.Regex = new([]*regexp.Regexp)
-		for _, str := range *u.Host.RegexStr {
-			var regex *regexp.Regexp
-			regex, err = regexp.Compile(str)
-			if err != nil {
-				return false
-			}
-			*u.Host.Regex = append(*u.Host.Regex, regex)
-		}
-		if u.Host.WithID == nil {
-			u.Host.WithID = s.config.Host.WithID
+		if u.DownloadSpeed <= 0 {
+			u.DownloadSpeed = c.DownloadSpeed
 		}
+	}
+	if u.VisitorSpeed <= 0 {
+		u.VisitorSpeed = c.VisitorSpeed
+	}
 
-		s.users.Store(key, u)
-		return true
-	})
-	if err != nil {
-		return
+	// quota
+	if u.DayQuota <= 0 {
+		u.DayQuota = c.DayQuota
+	}
+	if u.MonthQuota <= 0 {
+		u.MonthQuota = c.MonthQuota
 	}
 
+	// connections
+	if u.Connections <= 0 {
+		u.Connections = c.Connections
+	}
+
+	// host
+	if u.Host.Number == nil {
+		u.Host.Number = c.Host.Number
+	}
+	if u.Host.RegexStr == nil {
+		u.Host.RegexStr = c.Host.RegexStr
+	}
+	u.Host.Regex = new([]*regexp.Regexp)
+	for _, str := range *u.Host.RegexStr {
+		var regex *regexp.Regexp
+		regex, err = regexp.Compile(str)
+		if err != nil {
+			return
+		}
+		*u.Host.Regex = append(*u.Host.Regex, regex)
+	}
+	if u.Host.WithID == nil {
+		u.Host.WithID = c.Host.WithID
+	}
+	if u.Host.Domains == nil {
+		u.Host.Domains = c.Host.Domains
+	} else {
+		var domains []string
+		domains, err = parseDomains(*u.Host.Domains)
+		if err != nil {
+			err = fmt.Errorf("user '%s': %w", id, err)
+			return
+		}
+		u.Host.Domains = (*config.Slice[string])(&domains)
+	}
+	if u.Host.AllowClientAuth == nil {
+		u.Host.AllowClientAuth = c.Host.AllowClientAuth
+	}
+	if u.Host.Auth == nil {
+		u.Host.Auth = c.Host.Auth
+	} else {
+		err = initEdgeAuth(u.Host.Auth)
+		if err != nil {
+			err = fmt.Errorf("user '%s': %w", id, err)
+			return
+		}
+	}
 	return
 }
 
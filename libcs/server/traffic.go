@@ -0,0 +1,349 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/isrc-cas/gt/predef"
+	"github.com/rs/zerolog"
+)
+
+// ErrQuotaExceeded is an error returned when the traffic quota of the user is exhausted
+var ErrQuotaExceeded = errors.New("traffic quota exceeded")
+
+const (
+	trafficDayLayout   = "2006-01-02"
+	trafficMonthLayout = "2006-01"
+)
+
+// Traffic is the number of bytes the client sent to visitors (upload) and visitors sent to the client (download)
+type Traffic struct {
+	Upload   uint64 `json:"upload"`
+	Download uint64 `json:"download"`
+}
+
+// Total returns the number of bytes in both directions
+func (t Traffic) Total() uint64 {
+	return t.Upload + t.Download
+}
+
+// PeriodTraffic is the traffic of a user in a day or a month, Start is the day like 2006-01-02 or the month like 2006-01
+type PeriodTraffic struct {
+	Start string `json:"start"`
+	Traffic
+	Services map[string]Traffic `json:"services,omitempty"`
+}
+
+// UserTraffic is the traffic of a user in the current day and month, and the quotas of the user
+type UserTraffic struct {
+	ID         string        `json:"id"`
+	Day        PeriodTraffic `json:"day"`
+	Month      PeriodTraffic `json:"month"`
+	DayQuota   uint64        `json:"dayQuota,omitempty"`
+	MonthQuota uint64        `json:"monthQuota,omitempty"`
+}
+
+// roll 进入新的统计周期时清空流量
+func (p *PeriodTraffic) roll(start string) {
+	if p.Start != start {
+		*p = PeriodTraffic{Start: start}
+	}
+}
+
+func (p *PeriodTraffic) add(service string, t Traffic) {
+	p.Upload += t.Upload
+	p.Download += t.Download
+	if p.Services == nil {
+		p.Services = make(map[string]Traffic)
+	}
+	s := p.Services[service]
+	s.Upload += t.Upload
+	s.Download += t.Download
+	p.Services[service] = s
+}
+
+func (p PeriodTraffic) clone() PeriodTraffic {
+	services := p.Services
+	p.Services = make(map[string]Traffic, len(services))
+	for k, v := range services {
+		p.Services[k] = v
+	}
+	return p
+}
+
+// userTraffic 用户当天与当月的流量
+type userTraffic struct {
+	mtx   sync.Mutex
+	day   PeriodTraffic
+	month PeriodTraffic
+}
+
+func (u *userTraffic) rollLocked(now time.Time) {
+	u.day.roll(now.Format(trafficDayLayout))
+	u.month.roll(now.Format(trafficMonthLayout))
+}
+
+// add 统计服务的流量
+func (u *userTraffic) add(service string, t Traffic) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	u.rollLocked(time.Now())
+	u.day.add(service, t)
+	u.month.add(service, t)
+}
+
+// exceeded 判断当天或当月的流量是否达到配额，配额为 0 表示不限制
+func (u *userTraffic) exceeded(dayQuota, monthQuota uint64) bool {
+	if dayQuota == 0 && monthQuota == 0 {
+		return false
+	}
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	u.rollLocked(time.Now())
+	return (dayQuota > 0 && u.day.Total() >= dayQuota) || (monthQuota > 0 && u.month.Total() >= monthQuota)
+}
+
+// snapshot 返回当天与当月流量的副本
+func (u *userTraffic) snapshot() (day, month PeriodTraffic) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	u.rollLocked(time.Now())
+	return u.day.clone(), u.month.clone()
+}
+
+// trafficRecord trafficFile 中一个用户的记录
+type trafficRecord struct {
+	Day   PeriodTraffic `json:"day"`
+	Month PeriodTraffic `json:"month"`
+}
+
+// trafficStore 所有用户的流量，定期保存到 trafficFile
+type trafficStore struct {
+	path      string
+	logger    zerolog.Logger
+	users     sync.Map // key: id value: *userTraffic
+	saveMtx   sync.Mutex
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newTrafficStore(path string, l zerolog.Logger) (st *trafficStore, err error) {
+	st = &trafficStore{
+		path:   path,
+		logger: l,
+		closed: make(chan struct{}),
+	}
+	if len(path) == 0 {
+		return
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+			return
+		}
+		err = fmt.Errorf("can not read traffic file '%s', cause %s", path, err.Error())
+		return
+	}
+	var records map[string]trafficRecord
+	err = json.Unmarshal(b, &records)
+	if err != nil {
+		err = fmt.Errorf("invalid traffic file '%s', cause %s", path, err.Error())
+		return
+	}
+	for id, r := range records {
+		st.users.Store(id, &userTraffic{day: r.Day, month: r.Month})
+	}
+	return
+}
+
+// user 返回用户的流量，不存在时创建
+func (st *trafficStore) user(id string) *userTraffic {
+	if v, ok := st.users.Load(id); ok {
+		return v.(*userTraffic)
+	}
+	v, _ := st.users.LoadOrStore(id, &userTraffic{})
+	return v.(*userTraffic)
+}
+
+// save 将所有用户的流量写入 trafficFile，先写入临时文件再重命名，避免写入中断时损坏文件
+func (st *trafficStore) save() (err error) {
+	if len(st.path) == 0 {
+		return
+	}
+	st.saveMtx.Lock()
+	defer st.saveMtx.Unlock()
+	records := make(map[string]trafficRecord)
+	st.users.Range(func(key, value interface{}) bool {
+		var r trafficRecord
+		r.Day, r.Month = value.(*userTraffic).snapshot()
+		records[key.(string)] = r
+		return true
+	})
+	b, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return
+	}
+	tmp := st.path + ".tmp"
+	err = os.WriteFile(tmp, b, 0o600)
+	if err != nil {
+		return
+	}
+	return os.Rename(tmp, st.path)
+}
+
+// run 每隔 interval 保存一次流量
+func (st *trafficStore) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-st.closed:
+			return
+		case <-ticker.C:
+		}
+		err := st.save()
+		if err != nil {
+			st.logger.Warn().Err(err).Msg("failed to save traffic")
+		}
+	}
+}
+
+// close 停止定期保存并保存最后的流量
+func (st *trafficStore) close() {
+	st.closeOnce.Do(func() {
+		close(st.closed)
+		err := st.save()
+		if err != nil {
+			st.logger.Warn().Err(err).Msg("failed to save traffic")
+		}
+	})
+}
+
+// initTraffic 加载 trafficFile 中的流量，并按 trafficSaveInterval 保存
+func (s *Server) initTraffic() (err error) {
+	s.traffic, err = newTrafficStore(s.config.TrafficFile, s.Logger.With().Str("scope", "traffic").Logger())
+	if err != nil {
+		return
+	}
+	if len(s.config.TrafficFile) > 0 && s.config.TrafficSaveInterval.Duration > 0 {
+		go s.traffic.run(s.config.TrafficSaveInterval.Duration)
+	}
+	return
+}
+
+// quotas 返回用户的当日与当月流量配额
+func (s *Server) quotas(id string) (day, month uint64) {
+	if v, ok := s.users.Load(id); ok {
+		u := v.(user)
+		return u.DayQuota, u.MonthQuota
+	}
+	u := s.defaultUser.Load()
+	return u.DayQuota, u.MonthQuota
+}
+
+// GetTraffic returns the traffic and the quotas of the users sorted by id, all users are returned when id is empty
+func (s *Server) GetTraffic(id string) (result []UserTraffic) {
+	if s.traffic == nil {
+		return
+	}
+	s.traffic.users.Range(func(key, value interface{}) bool {
+		uid := key.(string)
+		if len(id) > 0 && uid != id {
+			return true
+		}
+		t := UserTraffic{ID: uid}
+		t.Day, t.Month = value.(*userTraffic).snapshot()
+		t.DayQuota, t.MonthQuota = s.quotas(uid)
+		result = append(result, t)
+		return true
+	})
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return
+}
+
+// serviceNames 返回统计流量使用的服务名称，key: serviceIndex
+func serviceNames(o options) map[uint16]string {
+	names := make(map[uint16]string, len(o.ids)+len(o.ports)+len(o.udpPorts))
+	for key, h := range o.ids {
+		if h.tls {
+			names[h.serviceIndex] = "tls:" + key
+		} else {
+			names[h.serviceIndex] = "http:" + key
+		}
+	}
+	for si, p := range o.ports {
+		names[si] = portServiceName("tcp", si, openTCPOption(p))
+	}
+	for si, p := range o.udpPorts {
+		names[si] = portServiceName("udp", si, openTCPOption(p))
+	}
+	return names
+}
+
+// portServiceName 随机端口每次打开都可能不同，使用服务序号命名
+func portServiceName(network string, serviceIndex uint16, p openTCPOption) string {
+	if p.random || p.port == 0 {
+		return network + ":random-" + strconv.FormatUint(uint64(serviceIndex), 10)
+	}
+	return network + ":" + strconv.FormatUint(uint64(p.port), 10)
+}
+
+// serviceName 返回服务统计流量使用的名称
+func (c *client) serviceName(serviceIndex uint16) string {
+	if names := c.serviceNames.Load(); names != nil {
+		if name, ok := (*names)[serviceIndex]; ok {
+			return name
+		}
+	}
+	return strconv.FormatUint(uint64(serviceIndex), 10)
+}
+
+// quotaExceeded 判断用户的流量是否达到配额，首次达到时通知协商了 FeatureQuotaSignal 的 tunnel，
+// 老客户端收到错误信号会断开重连，只拒绝任务不通知
+func (c *client) quotaExceeded() bool {
+	if !c.traffic.exceeded(c.dayQuota, c.monthQuota) {
+		if c.quotaNotified.Load() {
+			c.quotaNotified.Store(false)
+		}
+		return false
+	}
+	if c.quotaNotified.CompareAndSwap(false, true) {
+		var tunnels []*conn
+		c.tunnelsRWMtx.RLock()
+		for t := range c.tunnels {
+			if t.features.Load()&predef.FeatureQuotaSignal != 0 {
+				tunnels = append(tunnels, t)
+			}
+		}
+		c.tunnelsRWMtx.RUnlock()
+		for _, t := range tunnels {
+			if err := t.SendErrorSignalQuotaExceeded(); err != nil {
+				t.Logger.Error().Err(err).Msg("failed to SendErrorSignalQuotaExceeded")
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	connection "github.com/isrc-cas/gt/conn"
+	"github.com/isrc-cas/gt/predef"
+	"github.com/rs/zerolog"
+)
+
+func TestUserTrafficQuota(t *testing.T) {
+	u := &userTraffic{}
+	u.add("http:a", Traffic{Upload: 100})
+	u.add("http:a", Traffic{Download: 50})
+	u.add("tcp:2222", Traffic{Upload: 10, Download: 20})
+	day, month := u.snapshot()
+	if day.Total() != 180 || month.Total() != 180 {
+		t.Fatalf("day %d month %d, want 180", day.Total(), month.Total())
+	}
+	if s := day.Services["http:a"]; s.Upload != 100 || s.Download != 50 {
+		t.Fatalf("invalid service traffic %+v", s)
+	}
+
+	if u.exceeded(0, 0) {
+		t.Fatal("no quota should never be exceeded")
+	}
+	if u.exceeded(181, 0) || !u.exceeded(180, 0) {
+		t.Fatal("day quota is not applied")
+	}
+	if u.exceeded(0, 1000) || !u.exceeded(1000, 100) {
+		t.Fatal("month quota is not applied")
+	}
+
+	// 新的一天清空当天的流量，当月的流量保留
+	u.day.Start = "2000-01-01"
+	if u.exceeded(180, 0) {
+		t.Fatal("traffic of the last day should be reset")
+	}
+	if !u.exceeded(0, 180) {
+		t.Fatal("traffic of the month should be kept")
+	}
+	u.month.Start = "2000-01"
+	if u.exceeded(0, 180) {
+		t.Fatal("traffic of the last month should be reset")
+	}
+
+	// 快照不受之后的统计影响
+	day, _ = u.snapshot()
+	u.add("http:a", Traffic{Upload: 1})
+	if len(day.Services) != 0 {
+		t.Fatal("snapshot should be a copy")
+	}
+}
+
+func TestQuotaSignalNeedsFeature(t *testing.T) {
+	c := &client{traffic: &userTraffic{}, dayQuota: 10, tunnels: make(map[*conn]struct{})}
+	newTunnel := func(features predef.Feature) net.Conn {
+		local, remote := net.Pipe()
+		tunnel := &conn{Connection: connection.Connection{Conn: local}}
+		tunnel.features.Store(features)
+		c.tunnels[tunnel] = struct{}{}
+		return remote
+	}
+	current := newTunnel(predef.Features)
+	defer current.Close()
+	legacy := newTunnel(0)
+	defer legacy.Close()
+
+	// 老客户端收到错误信号会断开重连，不能在会话中通知
+	read := func(r net.Conn) <-chan int {
+		received := make(chan int, 1)
+		go func() {
+			_ = r.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+			n, _ := r.Read(make([]byte, 16))
+			received <- n
+		}()
+		return received
+	}
+	currentReceived, legacyReceived := read(current), read(legacy)
+	c.traffic.add("http:a", Traffic{Upload: 10})
+	if !c.quotaExceeded() {
+		t.Fatal("quota should be exceeded")
+	}
+	if n := <-currentReceived; n != 6 {
+		t.Fatalf("tunnel with the quota signal feature should be notified, got %d bytes", n)
+	}
+	if n := <-legacyReceived; n != 0 {
+		t.Fatalf("tunnel without the quota signal feature should not be notified, got %d bytes", n)
+	}
+}
+
+func TestTrafficStoreSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.json")
+	st, err := newTrafficStore(path, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.user("id1").add("http:id1", Traffic{Upload: 1, Download: 2})
+	st.user("id2").add("tcp:2222", Traffic{Upload: 3})
+	st.close()
+
+	st, err = newTrafficStore(path, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	day, month := st.user("id1").snapshot()
+	if day.Services["http:id1"] != (Traffic{Upload: 1, Download: 2}) || month.Total() != 3 {
+		t.Fatalf("traffic of id1 is not loaded, day %+v month %+v", day, month)
+	}
+	if day, _ := st.user("id2").snapshot(); day.Upload != 3 {
+		t.Fatalf("traffic of id2 is not loaded, day %+v", day)
+	}
+
+	err = os.WriteFile(path, []byte("{"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newTrafficStore(path, zerolog.Nop())
+	if err == nil {
+		t.Fatal("invalid traffic file should fail")
+	}
+
+	// 没有文件时只在内存中统计
+	st, err = newTrafficStore("", zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.user("id1").add("http:id1", Traffic{Upload: 1})
+	if err = st.save(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServiceNames(t *testing.T) {
+	names := serviceNames(options{
+		ids: hostPrefixOptions{
+			"a":     {serviceIndex: 0},
+			"a/api": {serviceIndex: 1},
+			"b":     {serviceIndex: 2, tls: true},
+		},
+		ports: map[uint16]openTCPOption{
+			3: {port: 2222},
+			4: {random: true},
+		},
+		udpPorts: map[uint16]openUDPOption{
+			5: {port: 53},
+		},
+	})
+	expected := map[uint16]string{
+		0: "http:a",
+		1: "http:a/api",
+		2: "tls:b",
+		3: "tcp:2222",
+		4: "tcp:random-4",
+		5: "udp:53",
+	}
+	for si, name := range expected {
+		if names[si] != name {
+			t.Errorf("name of service %d is %q, want %q", si, names[si], name)
+		}
+	}
+}
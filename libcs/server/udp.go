@@ -0,0 +1,367 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	connection "github.com/isrc-cas/gt/conn"
+	"github.com/isrc-cas/gt/predef"
+	"github.com/libp2p/go-reuseport"
+)
+
+// udpListener 将一个 udp 端口上不同 peer 的报文拆分成独立的会话，
+// 每个会话作为一个 net.Conn 由 Accept 返回，复用 tcp 端口的任务处理流程
+type udpListener struct {
+	pc          net.PacketConn
+	idleTimeout time.Duration
+
+	sessions    map[string]*udpSession
+	sessionsMtx sync.Mutex
+	accept      chan net.Conn
+	closing     chan struct{}
+	closeOnce   sync.Once
+}
+
+func newUDPListener(pc net.PacketConn, idleTimeout time.Duration) *udpListener {
+	l := &udpListener{
+		pc:          pc,
+		idleTimeout: idleTimeout,
+		sessions:    make(map[string]*udpSession),
+		accept:      make(chan net.Conn, 64),
+		closing:     make(chan struct{}),
+	}
+	go l.readLoop()
+	return l
+}
+
+func (l *udpListener) readLoop() {
+	defer l.Close()
+	buf := make([]byte, connection.MaxDatagramSize)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		p := make([]byte, n)
+		copy(p, buf[:n])
+
+		key := addr.String()
+		l.sessionsMtx.Lock()
+		s, ok := l.sessions[key]
+		if !ok {
+			s = newUDPSession(l, addr)
+			select {
+			case l.accept <- connection.NewDatagramConn(s):
+				l.sessions[key] = s
+			default:
+				// 来不及处理新会话时，与 udp 的语义一致，直接丢弃报文
+				l.sessionsMtx.Unlock()
+				continue
+			}
+		}
+		l.sessionsMtx.Unlock()
+		s.push(p)
+	}
+}
+
+// Accept waits for and returns the next udp session
+func (l *udpListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.closing:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the udp port and all its sessions
+func (l *udpListener) Close() (err error) {
+	l.closeOnce.Do(func() {
+		close(l.closing)
+		err = l.pc.Close()
+		l.sessionsMtx.Lock()
+		sessions := l.sessions
+		l.sessions = make(map[string]*udpSession)
+		l.sessionsMtx.Unlock()
+		for _, s := range sessions {
+			_ = s.Close()
+		}
+	})
+	return
+}
+
+// Addr returns the local address of the udp port
+func (l *udpListener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+func (l *udpListener) removeSession(s *udpSession) {
+	key := s.peer.String()
+	l.sessionsMtx.Lock()
+	if l.sessions[key] == s {
+		delete(l.sessions, key)
+	}
+	l.sessionsMtx.Unlock()
+}
+
+// udpSession 表示一个 peer 在 udp 端口上的会话，
+// 超过 idleTimeout 没有收发报文时读取返回超时错误
+type udpSession struct {
+	l       *udpListener
+	peer    net.Addr
+	packets chan []byte
+
+	lastActive   atomic.Int64
+	readDeadline atomic.Pointer[time.Time]
+	deadlineSet  chan struct{}
+	closing      chan struct{}
+	closeOnce    sync.Once
+}
+
+func newUDPSession(l *udpListener, peer net.Addr) *udpSession {
+	s := &udpSession{
+		l:           l,
+		peer:        peer,
+		packets:     make(chan []byte, 64),
+		deadlineSet: make(chan struct{}, 1),
+		closing:     make(chan struct{}),
+	}
+	s.lastActive.Store(time.Now().UnixNano())
+	return s
+}
+
+func (s *udpSession) push(p []byte) {
+	select {
+	case s.packets <- p:
+	default:
+		// 队列满时丢弃报文
+	}
+}
+
+func (s *udpSession) Read(b []byte) (n int, err error) {
+	for {
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		var idle bool
+		var deadline time.Time
+		if s.l.idleTimeout > 0 {
+			deadline = time.Unix(0, s.lastActive.Load()).Add(s.l.idleTimeout)
+			idle = true
+		}
+		if dl := s.readDeadline.Load(); dl != nil && !dl.IsZero() && (deadline.IsZero() || dl.Before(deadline)) {
+			deadline = *dl
+			idle = false
+		}
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				if idle {
+					_ = s.Close()
+					return 0, net.ErrClosed
+				}
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		var p []byte
+		select {
+		case p = <-s.packets:
+		case <-s.closing:
+			err = net.ErrClosed
+		case <-timeout:
+		case <-s.deadlineSet:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if p != nil {
+			s.lastActive.Store(time.Now().UnixNano())
+			n = copy(b, p)
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *udpSession) Write(b []byte) (n int, err error) {
+	select {
+	case <-s.closing:
+		return 0, net.ErrClosed
+	default:
+	}
+	s.lastActive.Store(time.Now().UnixNano())
+	return s.l.pc.WriteTo(b, s.peer)
+}
+
+func (s *udpSession) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closing)
+		s.l.removeSession(s)
+	})
+	return nil
+}
+
+func (s *udpSession) LocalAddr() net.Addr {
+	return s.l.pc.LocalAddr()
+}
+
+func (s *udpSession) RemoteAddr() net.Addr {
+	return s.peer
+}
+
+func (s *udpSession) SetDeadline(t time.Time) error {
+	return s.SetReadDeadline(t)
+}
+
+func (s *udpSession) SetReadDeadline(t time.Time) error {
+	s.readDeadline.Store(&t)
+	select {
+	case s.deadlineSet <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *udpSession) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+type udpListenerWithOption struct {
+	l    *udpListener
+	port openUDPOption
+}
+
+func (c *client) closeUDPListeners() {
+	c.closeListeners(&c.udpListeners)
+}
+
+func (c *client) deleteUDPListener(si uint16) {
+	c.deleteListener(&c.udpListeners, si)
+}
+
+func (c *client) openUDPPort(serviceIndex uint16, l *udpListenerWithOption, tunnel *conn) (uint16, error) {
+	return c.portsManager.open("udp", l.port.port, l.port.random, tunnel.Logger, func(port uint16) error {
+		return c.openSpecifiedUDPPort(serviceIndex, l, port, tunnel)
+	})
+}
+
+func (c *client) openSpecifiedUDPPort(serviceIndex uint16, l *udpListenerWithOption, udpPort uint16, tunnel *conn) error {
+	pc, err := reuseport.ListenPacket("udp", ":"+strconv.Itoa(int(udpPort)))
+	if err != nil {
+		return err
+	}
+	tunnel.Logger.Info().Uint16("port", udpPort).Msg("udp port opened")
+	l.l = newUDPListener(pc, tunnel.server.config.UDPIdleTimeout.Duration)
+
+	// 启动 goroutine 处理 udp 会话
+	go tunnel.server.acceptLoop(l.l, func(conn *conn) {
+		defer func() {
+			tunnel.Logger.Info().Uint16("serviceIndex", serviceIndex).Uint16("udpPort", udpPort).Msg("udp forward stop")
+		}()
+		tunnel.Logger.Info().Uint16("serviceIndex", serviceIndex).Uint16("udpPort", udpPort).Msg("udp forward start")
+		conn.serviceIndex = serviceIndex
+		conn.handleTCP(func() {
+			if !tunnel.server.serviceVisitorAllowed(conn.RemoteAddr(), c, serviceIndex) {
+				conn.Logger.Info().Uint16("udpPort", udpPort).Msg("visitor ip is not allowed")
+				return
+			}
+			err = c.process(conn)
+			if err != nil {
+				conn.Logger.Error().Err(err).Msg("udp handle")
+			}
+		})
+	})
+
+	return nil
+}
+
+func (c *conn) processUDPOptions(o options, cli *client) (err error) {
+	if len(o.udpPorts) > 0 && c.features.Load()&predef.FeatureUDPPort == 0 {
+		// 没有协商 udp 端口转发特性的客户端无法处理 udp 会话
+		for si := range o.udpPorts {
+			c.Logger.Error().
+				Uint16("serviceIndex", si).
+				AnErr("respErr", c.SendErrorSignalFailedToOpenUDPPort(si)).
+				Msg("udp port feature is not negotiated")
+		}
+		cli.closeUDPListeners()
+		return
+	}
+	var success []uint16
+	defer func() {
+		if err != nil {
+			for _, si := range success {
+				cli.deleteUDPListener(si)
+			}
+		}
+	}()
+	for si, portOption := range o.udpPorts {
+		v, ok := cli.udpListeners.LoadOrCreate(si, func() interface{} {
+			return &udpListenerWithOption{
+				port: portOption,
+			}
+		})
+		vl := v.(*udpListenerWithOption)
+		if ok && vl.l != nil {
+			port := listenerPort(vl.l)
+			if port == portOption.port || portOption.random {
+				if err := c.SendInfoUDPPortOpened(si, port); err != nil {
+					c.Logger.Error().Err(err).Msg("failed to send InfoUDPPortOpened signal")
+				}
+				continue
+			}
+			cli.closePortListener("udp", si, vl.l)
+		}
+
+		var openedPort uint16
+		openedPort, err = cli.openUDPPort(si, vl, c)
+		if err == nil {
+			success = append(success, si)
+		} else {
+			c.Logger.Error().Err(err).
+				Uint16("port", portOption.port).
+				Bool("random", portOption.random).
+				AnErr("respErr", c.SendErrorSignalFailedToOpenUDPPort(si)).
+				Msg("failed to open udp port")
+			return err
+		}
+		c.server.metrics.udpPortOpened(cli.id)
+		if err := c.SendInfoUDPPortOpened(si, openedPort); err != nil {
+			c.Logger.Error().Err(err).Msg("failed to send InfoUDPPortOpened signal")
+		}
+	}
+
+	// remove old udp listeners that are no longer needed
+	cli.deleteUnusedListeners(&cli.udpListeners, func(si uint16) bool {
+		_, ok := o.udpPorts[si]
+		return ok
+	})
+	return
+}
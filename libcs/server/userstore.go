@@ -0,0 +1,405 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/isrc-cas/gt/config"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrUserExpired is returned if the user has expired
+var ErrUserExpired = errors.New("user expired")
+
+// ErrConfiguredUser is returned when deleting a user of the config, it would be loaded again on restart
+var ErrConfiguredUser = errors.New("user is in the config, remove it from the config instead")
+
+// UserRecord is a user saved in the user store and managed through the admin API.
+// Nil pointers and slices inherit the global options of the server, an empty hostRegex allows any host prefix
+type UserRecord struct {
+	ID            string     `json:"id"`
+	Secret        string     `json:"secret,omitempty"`
+	StoredKey     []byte     `json:"storedKey,omitempty"` // allowAnyClient 模式下通过质询应答认证认领的 id 只有 stored key
+	TCPRanges     []string   `json:"tcpRanges,omitempty"`
+	TCPNumber     *uint16    `json:"tcpNumber,omitempty"`
+	HostNumber    *uint32    `json:"hostNumber,omitempty"`
+	HostRegex     []string   `json:"hostRegex"`
+	HostWithID    *bool      `json:"hostWithID,omitempty"`
+	HostDomains   []string   `json:"hostDomains"`
+	Speed         uint32     `json:"speed,omitempty"`
+	UploadSpeed   uint32     `json:"uploadSpeed,omitempty"`
+	DownloadSpeed uint32     `json:"downloadSpeed,omitempty"`
+	VisitorSpeed  uint32     `json:"visitorSpeed,omitempty"`
+	DayQuota      uint64     `json:"dayQuota,omitempty"`
+	MonthQuota    uint64     `json:"monthQuota,omitempty"`
+	Connections   uint32     `json:"connections,omitempty"`
+	Expires       *time.Time `json:"expires,omitempty"`
+	Claimed       bool       `json:"claimed,omitempty"` // allowAnyClient 模式下由客户端认领的 id
+}
+
+// newUserRecord 将配置中的用户转换为用户存储中的记录，需要在填充全局的值之前调用
+func newUserRecord(id string, u user) (r UserRecord) {
+	r = UserRecord{
+		ID:            id,
+		Secret:        u.Secret,
+		StoredKey:     u.storedKey,
+		Speed:         u.Speed,
+		UploadSpeed:   u.UploadSpeed,
+		DownloadSpeed: u.DownloadSpeed,
+		VisitorSpeed:  u.VisitorSpeed,
+		DayQuota:      u.DayQuota,
+		MonthQuota:    u.MonthQuota,
+		Connections:   u.Connections,
+		Claimed:       u.claimed,
+	}
+	for _, t := range u.TCPs {
+		r.TCPRanges = append(r.TCPRanges, t.Range)
+	}
+	if u.TCPNumber != nil {
+		n := *u.TCPNumber
+		r.TCPNumber = &n
+	}
+	if u.Host.Number != nil {
+		n := *u.Host.Number
+		r.HostNumber = &n
+	}
+	if u.Host.RegexStr != nil {
+		r.HostRegex = append([]string{}, *u.Host.RegexStr...)
+	}
+	if u.Host.WithID != nil {
+		b := *u.Host.WithID
+		r.HostWithID = &b
+	}
+	if u.Host.Domains != nil {
+		r.HostDomains = append([]string{}, *u.Host.Domains...)
+	}
+	if !u.Expires.IsZero() {
+		t := u.Expires
+		r.Expires = &t
+	}
+	return
+}
+
+// user 将记录转换为还没有填充全局的值的用户
+func (r *UserRecord) user() (u user) {
+	u = user{
+		Secret:        r.Secret,
+		Speed:         r.Speed,
+		UploadSpeed:   r.UploadSpeed,
+		DownloadSpeed: r.DownloadSpeed,
+		VisitorSpeed:  r.VisitorSpeed,
+		DayQuota:      r.DayQuota,
+		MonthQuota:    r.MonthQuota,
+		Connections:   r.Connections,
+		storedKey:     r.StoredKey,
+		claimed:       r.Claimed,
+	}
+	for _, t := range r.TCPRanges {
+		u.TCPs = append(u.TCPs, tcp{Range: t})
+	}
+	if r.TCPNumber != nil {
+		n := *r.TCPNumber
+		u.TCPNumber = &n
+	}
+	if r.HostNumber != nil {
+		n := *r.HostNumber
+		u.Host.Number = &n
+	}
+	if r.HostRegex != nil {
+		regex := append(config.Slice[string]{}, r.HostRegex...)
+		u.Host.RegexStr = &regex
+	}
+	if r.HostWithID != nil {
+		b := *r.HostWithID
+		u.Host.WithID = &b
+	}
+	if r.HostDomains != nil {
+		domains := append(config.Slice[string]{}, r.HostDomains...)
+		u.Host.Domains = &domains
+	}
+	if r.Expires != nil {
+		u.Expires = *r.Expires
+	}
+	record := *r
+	u.record = &record
+	return
+}
+
+// UserStore persists the users managed through the admin API and the ids claimed in allowAnyClient mode.
+// The users in the store override the users of the config when the server starts
+type UserStore interface {
+	// Load returns all users in the store
+	Load() ([]UserRecord, error)
+	// Put adds or replaces the user
+	Put(r UserRecord) error
+	// Delete removes the user, it is not an error if the user does not exist
+	Delete(id string) error
+	// Close releases the store
+	Close() error
+}
+
+// boltUserStore 是内置的用户存储，每个用户以 json 保存在 bbolt 数据库的 users bucket 中
+type boltUserStore struct {
+	db *bolt.DB
+}
+
+var usersBucket = []byte("users")
+
+func newBoltUserStore(path string) (st *boltUserStore, err error) {
+	// 数据库被其它进程打开时不要一直等待文件锁
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		err = fmt.Errorf("can not open user store '%s', cause %s", path, err.Error())
+		return
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(usersBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		err = fmt.Errorf("invalid user store '%s', cause %s", path, err.Error())
+		return
+	}
+	st = &boltUserStore{db: db}
+	return
+}
+
+func (st *boltUserStore) Load() (records []UserRecord, err error) {
+	err = st.db.View(func(tx *bolt.Tx) error {
+		// bbolt 按 key 的字节序遍历，记录已经按 id 排序
+		return tx.Bucket(usersBucket).ForEach(func(k, v []byte) error {
+			var r UserRecord
+			err := json.Unmarshal(v, &r)
+			if err != nil {
+				return fmt.Errorf("invalid user '%s' in user store, cause %s", k, err.Error())
+			}
+			records = append(records, r)
+			return nil
+		})
+	})
+	return
+}
+
+func (st *boltUserStore) Put(r UserRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return st.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).Put([]byte(r.ID), b)
+	})
+}
+
+func (st *boltUserStore) Delete(id string) error {
+	return st.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).Delete([]byte(id))
+	})
+}
+
+func (st *boltUserStore) Close() error {
+	return st.db.Close()
+}
+
+// SetUserStore sets the store of the users managed at runtime, it overrides the 'userStore' option and must be called before Start
+func (s *Server) SetUserStore(st UserStore) {
+	s.userStore = st
+}
+
+// initUserStore 记录配置中的用户，并加载用户存储中的用户覆盖配置中的同名用户
+func (s *Server) initUserStore() (err error) {
+	if s.userStore == nil && len(s.config.UserStore) > 0 {
+		s.userStore, err = newBoltUserStore(s.config.UserStore)
+		if err != nil {
+			return
+		}
+	}
+	n, err := s.loadUserStore(&s.users)
+	if err != nil {
+		return
+	}
+	if s.userStore != nil {
+		s.Logger.Info().Int("users", n).Msg("users loaded from user store")
+	}
+	return
+}
+
+// loadUserStore 记录 u 中配置的用户，并加载用户存储中的用户覆盖 u 中的同名用户
+func (s *Server) loadUserStore(u *users) (n int, err error) {
+	u.Range(func(key, value interface{}) bool {
+		ud := value.(user)
+		r := newUserRecord(key.(string), ud)
+		ud.record = &r
+		ud.configured = true
+		u.Store(key, ud)
+		return true
+	})
+	if s.userStore == nil {
+		return
+	}
+	records, err := s.userStore.Load()
+	if err != nil {
+		return
+	}
+	for _, r := range records {
+		ud := r.user()
+		err = verifyUser(r.ID, ud)
+		if err != nil {
+			err = fmt.Errorf("user store: %w", err)
+			return
+		}
+		if v, ok := u.Load(r.ID); ok {
+			ud.configured = v.(user).configured
+		}
+		u.Store(r.ID, ud)
+	}
+	n = len(records)
+	return
+}
+
+// GetUsers returns the users sorted by id, including the users of the config and the user store.
+// The secrets and stored keys are redacted
+func (s *Server) GetUsers() (records []UserRecord) {
+	s.users.Range(func(key, value interface{}) bool {
+		u := value.(user)
+		if u.record != nil {
+			r := *u.record
+			r.Secret = ""
+			r.StoredKey = nil
+			records = append(records, r)
+		}
+		return true
+	})
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ID < records[j].ID
+	})
+	return
+}
+
+// PutUser adds or replaces the user and saves it to the user store. Clients of the user reconnect to apply the change
+func (s *Server) PutUser(r UserRecord) (err error) {
+	s.usersMtx.Lock()
+	defer s.usersMtx.Unlock()
+	u := r.user()
+	err = verifyUser(r.ID, u)
+	if err != nil {
+		return
+	}
+	err = s.config.checkSecretHash(r.ID, u.Secret)
+	if err != nil {
+		return
+	}
+	all, err := s.usedTCPPorts(r.ID)
+	if err != nil {
+		return
+	}
+	u.portsManager, err = s.userPortsManager(u, all)
+	if err != nil {
+		return
+	}
+	err = s.config.fillUser(r.ID, &u)
+	if err != nil {
+		return
+	}
+	if v, ok := s.users.Load(r.ID); ok {
+		u.configured = v.(user).configured
+	}
+	if s.userStore != nil {
+		err = s.userStore.Put(r)
+		if err != nil {
+			return
+		}
+	}
+	s.users.Store(r.ID, u)
+	s.scheduleUserExpiry(r.ID, u.Expires)
+	s.Logger.Info().Str("id", r.ID).Msg("user saved")
+	if v, ok := s.id2Client.Load(r.ID); ok {
+		v.(*client).reconnect()
+	}
+	return
+}
+
+// DeleteUser deletes the user from the users and the user store, and closes the clients of the user.
+// Users of the config can not be deleted, ErrConfiguredUser is returned
+func (s *Server) DeleteUser(id string) (err error) {
+	s.usersMtx.Lock()
+	defer s.usersMtx.Unlock()
+	if v, ok := s.users.Load(id); ok && v.(user).configured {
+		err = ErrConfiguredUser
+		return
+	}
+	if s.userStore != nil {
+		err = s.userStore.Delete(id)
+		if err != nil {
+			return
+		}
+	}
+	s.users.Delete(id)
+	s.scheduleUserExpiry(id, time.Time{})
+	s.Logger.Info().Str("id", id).Msg("user deleted")
+	if v, ok := s.id2Client.Load(id); ok {
+		v.(*client).close()
+	}
+	return
+}
+
+// claimUser 将 allowAnyClient 模式下认领的 id 保存到用户存储，重启后其它客户端不能再认领该 id
+func (s *Server) claimUser(id string, u user) {
+	err := s.userStore.Put(*u.record)
+	if err != nil {
+		s.Logger.Warn().Err(err).Str("id", id).Msg("failed to save the claimed id to user store")
+	}
+}
+
+// scheduleUserExpiry 在用户过期时关闭它的客户端，expires 为零值时取消
+func (s *Server) scheduleUserExpiry(id string, expires time.Time) {
+	s.userExpiryMtx.Lock()
+	defer s.userExpiryMtx.Unlock()
+	if t, ok := s.userExpiry[id]; ok {
+		t.Stop()
+		delete(s.userExpiry, id)
+	}
+	if expires.IsZero() {
+		return
+	}
+	if s.userExpiry == nil {
+		s.userExpiry = make(map[string]*time.Timer)
+	}
+	s.userExpiry[id] = time.AfterFunc(time.Until(expires), func() {
+		v, ok := s.users.Load(id)
+		if !ok || !v.(user).expired() {
+			return
+		}
+		s.Logger.Info().Str("id", id).Time("expires", expires).Msg("user expired")
+		if v, ok := s.id2Client.Load(id); ok {
+			v.(*client).close()
+		}
+	})
+}
+
+// stopUserExpiry 停止所有过期定时器
+func (s *Server) stopUserExpiry() {
+	s.userExpiryMtx.Lock()
+	defer s.userExpiryMtx.Unlock()
+	for id, t := range s.userExpiry {
+		t.Stop()
+		delete(s.userExpiry, id)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBoltUserStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	st, err := newBoltUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpNumber := uint16(2)
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, r := range []UserRecord{
+		{ID: "id1", Secret: "secret1", TCPRanges: []string{"2000-2001"}, TCPNumber: &tcpNumber, HostRegex: []string{}, Expires: &expires},
+		{ID: "id2", Secret: "secret2"},
+	} {
+		err = st.Put(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = st.Delete("id2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = st.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err = newBoltUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	records, err := st.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].ID != "id1" || records[0].TCPRanges[0] != "2000-2001" ||
+		*records[0].TCPNumber != 2 || !records[0].Expires.Equal(expires) {
+		t.Fatalf("invalid records %+v", records)
+	}
+
+	// 空的 host 正则表示不限制，与继承全局的 nil 不同
+	u := records[0].user()
+	if u.Host.RegexStr == nil || len(*u.Host.RegexStr) != 0 || u.Host.Domains != nil {
+		t.Fatalf("invalid host of user %+v", u.Host)
+	}
+}
+
+func TestPutAndDeleteUser(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	s, err := New([]string{
+		"server",
+		"-id", "id1",
+		"-secret", "secret1",
+		"-tcpRange", "1000-1001",
+		"-speed", "1024",
+		"-userStore", path,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := func() {
+		err = s.users.mergeUsers(nil, s.config.IDs, s.config.Secrets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.initUserStore()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.parseTCPs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.parseHost()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	start()
+
+	err = s.PutUser(UserRecord{ID: "id2", Secret: "secret2", TCPRanges: []string{"1001-1002"}})
+	if err == nil {
+		t.Fatal("tcp ports of the global range are given to a user")
+	}
+	err = s.PutUser(UserRecord{ID: "id2", Secret: "secret2", TCPRanges: []string{"2000-2001"}, Connections: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := s.users.auth("id2", credential{secret: "secret2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Connections != 3 || u.Speed != 1024 || len(u.portsManager.ports) != 2 {
+		t.Fatalf("invalid user %+v", u)
+	}
+
+	expires := time.Now().Add(-time.Minute)
+	err = s.PutUser(UserRecord{ID: "id3", Secret: "secret3", Expires: &expires})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.users.auth("id3", credential{secret: "secret3"})
+	if !errors.Is(err, ErrUserExpired) {
+		t.Fatalf("expired user is authenticated: %v", err)
+	}
+
+	// 修改命令行的用户后，重启时用户存储中的用户覆盖命令行的用户
+	err = s.PutUser(UserRecord{ID: "id1", Secret: "secret1-changed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.DeleteUser("id2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 配置中的用户重启后会被重新加载，不能删除
+	err = s.DeleteUser("id1")
+	if !errors.Is(err, ErrConfiguredUser) {
+		t.Fatalf("user of the config is deleted: %v", err)
+	}
+	s.stopUserExpiry()
+	err = s.userStore.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = New([]string{
+		"server",
+		"-id", "id1",
+		"-secret", "secret1",
+		"-tcpRange", "1000-1001",
+		"-userStore", path,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start()
+	defer s.userStore.Close()
+	if _, err = s.users.auth("id1", credential{secret: "secret1-changed"}); err != nil {
+		t.Fatal(err)
+	}
+	if s.users.isIDConflict("id2") {
+		t.Fatal("deleted user is loaded")
+	}
+	records := s.GetUsers()
+	if len(records) != 2 || records[0].ID != "id1" || records[1].ID != "id3" {
+		t.Fatalf("invalid users %+v", records)
+	}
+	if records[0].Secret != "" || records[1].Secret != "" {
+		t.Fatalf("secrets of the users are listed %+v", records)
+	}
+}
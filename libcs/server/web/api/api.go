@@ -129,6 +129,144 @@ func GetConnectionInfo(s *server.Server) gin.HandlerFunc {
 	}
 }
 
+// GetTraffic returns the daily and monthly traffic and the quotas of the users, or of the user in the id query
+func GetTraffic(s *server.Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		traffic := s.GetTraffic(ctx.Query("id"))
+		response.SuccessWithData(gin.H{"traffic": traffic}, ctx)
+	}
+}
+
+// GetUsers returns the users of the config and the user store without their secrets
+func GetUsers(s *server.Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		response.SuccessWithData(gin.H{"users": s.GetUsers()}, ctx)
+	}
+}
+
+// SaveUser adds or replaces a user, the change takes effect without restarting the server
+func SaveUser(s *server.Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var user server.UserRecord
+		if err := ctx.ShouldBindJSON(&user); err != nil {
+			response.FailWithMessage(err.Error(), ctx)
+			return
+		}
+		if err := s.PutUser(user); err != nil {
+			response.FailWithMessage(err.Error(), ctx)
+			return
+		}
+		response.Success(ctx)
+	}
+}
+
+// DeleteUser deletes the user in the id query
+func DeleteUser(s *server.Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id := ctx.Query("id")
+		if len(id) == 0 {
+			response.FailWithMessage("id is empty", ctx)
+			return
+		}
+		if err := s.DeleteUser(id); err != nil {
+			response.FailWithMessage(err.Error(), ctx)
+			return
+		}
+		response.Success(ctx)
+	}
+}
+
+// GetClients returns the connected clients with their tunnels, services, host prefixes, ports and tasks,
+// or the client in the id query
+func GetClients(s *server.Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		response.SuccessWithData(gin.H{"clients": s.GetClients(ctx.Query("id"))}, ctx)
+	}
+}
+
+// KickClient closes the client in the id query
+func KickClient(s *server.Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if err := s.KickClient(ctx.Query("id")); err != nil {
+			response.FailWithMessage(err.Error(), ctx)
+			return
+		}
+		response.Success(ctx)
+	}
+}
+
+// ReconnectClient asks the client in the id query to reconnect
+func ReconnectClient(s *server.Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if err := s.ReconnectClient(ctx.Query("id")); err != nil {
+			response.FailWithMessage(err.Error(), ctx)
+			return
+		}
+		response.Success(ctx)
+	}
+}
+
+// DrainTunnel drains the tunnel in the tunnel query of the client in the id query
+func DrainTunnel(s *server.Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if err := s.DrainTunnel(ctx.Query("id"), ctx.Query("tunnel")); err != nil {
+			response.FailWithMessage(err.Error(), ctx)
+			return
+		}
+		response.Success(ctx)
+	}
+}
+
+// GetBans returns the bans that have not expired
+func GetBans(s *server.Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		response.SuccessWithData(gin.H{"bans": s.GetBans()}, ctx)
+	}
+}
+
+// BanClient bans a client id or a client ip for the duration
+func BanClient(s *server.Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var ban request.Ban
+		if err := ctx.ShouldBindJSON(&ban); err != nil {
+			response.FailWithMessage(err.Error(), ctx)
+			return
+		}
+		var err error
+		switch {
+		case len(ban.ID) > 0 && len(ban.IP) > 0:
+			response.FailWithMessage("only one of id and ip can be specified", ctx)
+			return
+		case len(ban.ID) > 0:
+			err = s.BanID(ban.ID, ban.Duration.Duration)
+		default:
+			err = s.BanIP(ban.IP, ban.Duration.Duration)
+		}
+		if err != nil {
+			response.FailWithMessage(err.Error(), ctx)
+			return
+		}
+		response.Success(ctx)
+	}
+}
+
+// UnbanClient lifts the ban of the id query or the ip query
+func UnbanClient(s *server.Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, ip := ctx.Query("id"), ctx.Query("ip")
+		if len(id) > 0 {
+			s.UnbanID(id)
+		}
+		if len(ip) > 0 {
+			if err := s.UnbanIP(ip); err != nil {
+				response.FailWithMessage(err.Error(), ctx)
+				return
+			}
+		}
+		response.Success(ctx)
+	}
+}
+
 // GetRunningConfig returns the running config
 func GetRunningConfig(s *server.Server) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
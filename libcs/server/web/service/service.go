@@ -182,6 +182,7 @@ func GetConnectionInfo(s *server.Server) (serverPool []request.SimplifiedConnect
 	externalConnection := util.FilterOutMatchingConnections(conns, util.SwitchToPoolInfo(pools))
 
 	serverPool = util.SimplifyConnectionsWithID(poolsInfo)
+	util.AttachPoolInfo(serverPool, pools)
 	external = util.SimplifyConnections(externalConnection)
 	return
 }
@@ -185,6 +185,29 @@ func setRoutes(s *server.Server, tm *wServer.TokenManager, r *gin.Engine) error
 			connectionGroup.GET("/list", api.GetConnectionInfo(s))
 		}
 
+		trafficGroup := apiGroup.Group("/traffic")
+		{
+			trafficGroup.GET("/list", api.GetTraffic(s))
+		}
+
+		usersGroup := apiGroup.Group("/users")
+		{
+			usersGroup.GET("/list", api.GetUsers(s))
+			usersGroup.POST("/save", api.SaveUser(s))
+			usersGroup.DELETE("/delete", api.DeleteUser(s))
+		}
+
+		clientsGroup := apiGroup.Group("/clients")
+		{
+			clientsGroup.GET("/list", api.GetClients(s))
+			clientsGroup.PUT("/kick", api.KickClient(s))
+			clientsGroup.PUT("/reconnect", api.ReconnectClient(s))
+			clientsGroup.PUT("/drain", api.DrainTunnel(s))
+			clientsGroup.GET("/bans", api.GetBans(s))
+			clientsGroup.POST("/ban", api.BanClient(s))
+			clientsGroup.DELETE("/unban", api.UnbanClient(s))
+		}
+
 		permissionGroup := apiGroup.Group("/permission")
 		{
 			permissionGroup.GET("/menu", api.GetMenu(s))
@@ -154,6 +154,10 @@ func TestSetRoutes(t *testing.T) {
 		//{"Check Server Kill Route", "PUT", "/api/server/kill", serverWithPprof, http.StatusOK, map[string]string{"x-token": token}},
 
 		{"Check Connections Route", "GET", "/api/connection/list", serverWithPprof, map[string]string{"x-token": token}, false},
+		{"Check Traffic Route", "GET", "/api/traffic/list", serverWithPprof, map[string]string{"x-token": token}, false},
+		{"Check Users Route", "GET", "/api/users/list", serverWithPprof, map[string]string{"x-token": token}, false},
+		{"Check Clients Route", "GET", "/api/clients/list", serverWithPprof, map[string]string{"x-token": token}, false},
+		{"Check Bans Route", "GET", "/api/clients/bans", serverWithPprof, map[string]string{"x-token": token}, false},
 		{"Check Permissions Route", "GET", "/api/permission/menu", serverWithPprof, map[string]string{"x-token": token}, false},
 
 		{"Check Pprof Route with pprof permission", "GET", "/debug/pprof/", serverWithPprof, nil, false},
@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -25,7 +26,9 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -35,6 +38,7 @@ import (
 	"github.com/buger/jsonparser"
 	"github.com/gorilla/websocket"
 	"github.com/isrc-cas/gt/client"
+	connection "github.com/isrc-cas/gt/conn"
 	"github.com/isrc-cas/gt/server"
 )
 
@@ -486,8 +490,12 @@ func TestAuthAPI(t *testing.T) {
 			panic(err)
 		}
 		id, _ := jsonparser.GetString(all, "networkClientId")
-		secret, _ := jsonparser.GetString(all, "networkSecretKey")
-		if id != "05797ac9-86ae-40b0-b767-7a41e03a5486" || secret != "eec1eabf-2c59-4e19-bf10-34707c17ed89" {
+		nonce, _ := jsonparser.GetString(all, "nonce")
+		proof, _ := jsonparser.GetString(all, "proof")
+		nonceBytes, _ := hex.DecodeString(nonce)
+		proofBytes, _ := hex.DecodeString(proof)
+		storedKey := connection.StoredKey("eec1eabf-2c59-4e19-bf10-34707c17ed89")
+		if id != "05797ac9-86ae-40b0-b767-7a41e03a5486" || !connection.VerifyProof(storedKey, id, nonceBytes, proofBytes) {
 			panic("invalid id or secret")
 		}
 		_, err = rw.Write([]byte("{\"result\":true}"))
@@ -646,10 +654,19 @@ func TestRemoteAPI(t *testing.T) {
 func TestAutoSecret(t *testing.T) {
 	t.Parallel()
 
-	// 启动服务端、客户端
+	// 启动服务端、客户端，没有配置用户时新的 id 只能通过验证了证书的 TLS 连接登记
+	keyFile := filepath.Join(t.TempDir(), "tls.key")
+	certFile := filepath.Join(t.TempDir(), "tls.crt")
+	err := generateTLSKeyAndCert("localhost", keyFile, certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
 	s, err := setupServer([]string{
 		"server",
 		"-addr", "127.0.0.1:0",
+		"-tlsAddr", "127.0.0.1:0",
+		"-keyFile", keyFile,
+		"-certFile", certFile,
 	}, nil)
 	if err != nil {
 		t.Fatal(err)
@@ -659,7 +676,8 @@ func TestAutoSecret(t *testing.T) {
 		"client",
 		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
 		"-local", "http://www.baidu.com/",
-		"-remote", s.GetListenerAddrPort().String(),
+		"-remote", "tls://localhost:" + strconv.Itoa(int(s.GetTLSListenerAddrPort().Port())),
+		"-remoteCert", certFile,
 		"-remoteTimeout", "5s",
 		"-useLocalAsHTTPHost",
 	}, nil)
@@ -770,6 +788,8 @@ func TestClientAndServerWithHTTPMUXHeader(t *testing.T) {
 
 	s, err := setupServer([]string{
 		"server",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
 		"-addr", "127.0.0.1:0",
 		"-httpMUXHeader", "EID",
 	}, nil)
@@ -875,6 +895,89 @@ func TestTCP(t *testing.T) {
 	t.Logf("%s", all)
 }
 
+func TestUDP(t *testing.T) {
+	t.Parallel()
+
+	// 启动本地 udp echo 服务
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	// 启动服务端、客户端
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-tcpRange", "1024-65535",
+		"-tcpNumber", "1",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	client1LogWriter, client1Log := newStringWriter()
+	c, err := setupClient([]string{
+		"client",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-local", "udp://" + echo.LocalAddr().String(),
+		"-remote", s.GetListenerAddrPort().String(),
+		"-remoteUDPRandom",
+		"-remoteTimeout", "5s",
+	}, client1LogWriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	time.Sleep(100 * time.Millisecond) // 等待服务端完成 UDP 端口分配
+
+	// 从客户端的日志中获取 udp 端口
+	match := regexp.MustCompile(`udp port=(\d+)`).FindStringSubmatch(client1Log())
+	if len(match) != 2 {
+		t.Fatal("failed to get udp port from client log")
+	}
+	udpPort := match[1]
+
+	// 通过 udp 测试，每个报文的边界需要保持不变
+	conn, err := net.Dial("udp", "127.0.0.1:"+udpPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 65535)
+	for i, size := range []int{1, 512, 1400, 8000} {
+		data := bytes.Repeat([]byte{byte('a' + i)}, size)
+		_, err = conn.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], data) {
+			t.Fatalf("invalid echo datagram, size %d, got %d", size, n)
+		}
+	}
+}
+
 func TestSpeedLimit(t *testing.T) {
 	t.Parallel()
 
@@ -919,6 +1022,8 @@ func TestSpeedLimit(t *testing.T) {
 	// 启动服务端、客户端
 	s, err := setupServer([]string{
 		"server",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
 		"-addr", "127.0.0.1:0",
 		"-speed", "1024",
 	}, nil)
@@ -1018,6 +1123,395 @@ func TestSpeedLimit(t *testing.T) {
 	}
 }
 
+func TestServiceAndVisitorSpeedLimit(t *testing.T) {
+	t.Parallel()
+
+	// 启动 http 服务
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			_, err := io.ReadAll(r.Body)
+			if err != nil {
+				t.Error(err)
+			}
+		case "GET":
+			_, err := w.Write(make([]byte, 4096))
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	})
+	httpServer := http.Server{
+		Handler: mux,
+	}
+	httpLisener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpServer.Close()
+	go func() {
+		err := httpServer.Serve(httpLisener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+
+	// 服务端限制每个访问者连接的速度，客户端限制服务的上行速度
+	s, err := setupServer([]string{
+		"server",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-addr", "127.0.0.1:0",
+		"-visitorSpeed", "2048",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := setupClient([]string{
+		"client",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-local", "http://" + httpLisener.Addr().String() + "/",
+		"-uploadSpeed", "1024",
+		"-remote", s.GetListenerAddrPort().String(),
+		"-remoteTimeout", "5s",
+		"-useLocalAsHTTPHost",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	httpClient := setupHTTPClient(s.GetListenerAddrPort().String(), nil)
+
+	// 访问者上传 4096 字节的内容只受访问者连接的限速，所需时间应该在 2 到 3 秒
+	startTime := time.Now()
+	resp, err := httpClient.Post("http://05797ac9-86ae-40b0-b767-7a41e03a5486.example.com/", "application/octet-stream", bytes.NewBuffer(make([]byte, 4096)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intervals := time.Since(startTime)
+	if intervals < 2*time.Second || intervals > 3*time.Second {
+		t.Fatalf("intervals: %v, intervals < 2*time.Second || intervals > 3*time.Second", intervals)
+	}
+	err = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 访问者下载 4096 字节的内容受服务的限速，所需时间应该在 4 到 5 秒
+	startTime = time.Now()
+	resp, err = httpClient.Get("http://05797ac9-86ae-40b0-b767-7a41e03a5486.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intervals = time.Since(startTime)
+	if intervals < 4*time.Second || intervals > 5*time.Second {
+		t.Fatalf("intervals: %v, intervals < 4*time.Second || intervals > 5*time.Second", intervals)
+	}
+	err = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTrafficQuota(t *testing.T) {
+	t.Parallel()
+
+	// 启动 http 服务
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write(make([]byte, 4096))
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	httpServer := http.Server{
+		Handler: mux,
+	}
+	httpLisener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpServer.Close()
+	go func() {
+		err := httpServer.Serve(httpLisener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+
+	// 启动服务端、客户端
+	id := "05797ac9-86ae-40b0-b767-7a41e03a5486"
+	trafficFile := filepath.Join(t.TempDir(), "traffic.json")
+	s, err := setupServer([]string{
+		"server",
+		"-id", id,
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-addr", "127.0.0.1:0",
+		"-dayQuota", "4096",
+		"-trafficFile", trafficFile,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	clientLogWriter, clientLog := newStringWriter()
+	c, err := setupClient([]string{
+		"client",
+		"-id", id,
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-local", "http://" + httpLisener.Addr().String() + "/",
+		"-remote", s.GetListenerAddrPort().String(),
+		"-remoteTimeout", "5s",
+		"-useLocalAsHTTPHost",
+		"-logLevel", "info",
+	}, clientLogWriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	httpClient := setupHTTPClient(s.GetListenerAddrPort().String(), nil)
+	httpClient.Transport.(*http.Transport).DisableKeepAlives = true
+
+	// 配额用尽之前的请求正常转发
+	resp, err := httpClient.Get("http://" + id + ".example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	traffic := s.GetTraffic(id)
+	if len(traffic) != 1 || traffic[0].Day.Upload < 4096 || traffic[0].Day.Download == 0 || traffic[0].DayQuota != 4096 {
+		t.Fatalf("invalid traffic %+v", traffic)
+	}
+	if _, ok := traffic[0].Day.Services["http:"+id]; !ok {
+		t.Fatalf("traffic of the service is not counted %+v", traffic[0].Day.Services)
+	}
+
+	// 配额用尽后新的请求被拒绝，客户端收到通知
+	resp, err = httpClient.Get("http://" + id + ".example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("request should be rejected after the quota is exhausted, got status code %d", resp.StatusCode)
+	}
+	for i := 0; !strings.Contains(clientLog(), "the traffic quota is exhausted"); i++ {
+		if i > 50 {
+			t.Fatal("client is not notified that the quota is exhausted")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// 关闭服务端时保存流量
+	s.Close()
+	b, err := os.ReadFile(trafficFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), id) {
+		t.Fatalf("traffic of the user is not saved: %s", b)
+	}
+}
+
+func scrapeMetrics(t *testing.T, addr string) string {
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("invalid content type %q", ct)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// metricValue 返回以 prefix 开头的样本的值，样本不存在时返回 -1
+func metricValue(metrics, prefix string) float64 {
+	for _, line := range strings.Split(metrics, "\n") {
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		var v float64
+		_, err := fmt.Sscan(line[strings.LastIndexByte(line, ' ')+1:], &v)
+		if err != nil {
+			return -1
+		}
+		return v
+	}
+	return -1
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	// 启动 http 服务
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write(make([]byte, 4096))
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	httpServer := http.Server{
+		Handler: mux,
+	}
+	httpLisener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpServer.Close()
+	go func() {
+		err := httpServer.Serve(httpLisener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+
+	// 启动服务端、客户端
+	id := "metrics1"
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-metricsAddr", "127.0.0.1:0",
+		"-id", id,
+		"-secret", "secret1",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	local := "http://" + httpLisener.Addr().String() + "/"
+	c, err := setupClient([]string{
+		"client",
+		"-id", id,
+		"-secret", "secret1",
+		"-local", local,
+		"-remote", s.GetListenerAddrPort().String(),
+		"-remoteTimeout", "5s",
+		"-useLocalAsHTTPHost",
+		"-metricsAddr", "127.0.0.1:0",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	httpClient := setupHTTPClient(s.GetListenerAddrPort().String(), nil)
+	httpClient.Transport.(*http.Transport).DisableKeepAlives = true
+	resp, err := httpClient.Get("http://" + id + ".example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// secret 错误的客户端被拒绝
+	bad, err := client.New([]string{
+		"client",
+		"-id", id,
+		"-secret", "secret2",
+		"-local", local,
+		"-remote", s.GetListenerAddrPort().String(),
+		"-remoteTimeout", "5s",
+		"-reconnectDelay", "100ms",
+		"-metricsAddr", "127.0.0.1:0",
+		"-webrtcThreadMode",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bad.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+
+	var sm, cm, bm string
+	for i := 0; ; i++ {
+		sm = scrapeMetrics(t, s.GetMetricsListenerAddrPort().String())
+		cm = scrapeMetrics(t, c.GetMetricsListenerAddrPort().String())
+		bm = scrapeMetrics(t, bad.GetMetricsListenerAddrPort().String())
+		if metricValue(sm, `gt_server_active_tasks{user="`+id+`"`) == 0 &&
+			metricValue(cm, `gt_client_active_tasks{service="`+local+`"}`) == 0 &&
+			metricValue(bm, "gt_client_reconnects_total") > 0 {
+			break
+		}
+		if i > 50 {
+			t.Fatalf("unexpected metrics:\n%s\n%s\n%s", sm, cm, bm)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	service := `{user="` + id + `",service="http:` + id + `"`
+	if v := metricValue(sm, "gt_server_bytes_total"+service+`,direction="upload"}`); v < 4096 {
+		t.Fatalf("invalid upload bytes %v:\n%s", v, sm)
+	}
+	if v := metricValue(sm, "gt_server_bytes_total"+service+`,direction="download"}`); v <= 0 {
+		t.Fatalf("invalid download bytes %v:\n%s", v, sm)
+	}
+	if v := metricValue(sm, "gt_server_task_latency_seconds_count"+service+"}"); v != 1 {
+		t.Fatalf("invalid task latency count %v:\n%s", v, sm)
+	}
+	if v := metricValue(sm, `gt_server_tunnels{user="`+id+`"}`); v < 1 {
+		t.Fatalf("invalid tunnels %v:\n%s", v, sm)
+	}
+	if v := metricValue(sm, `gt_server_handshake_failures_total{code="1"`); v < 1 {
+		t.Fatalf("invalid handshake failures %v:\n%s", v, sm)
+	}
+	if v := metricValue(sm, `gt_server_auth_failures_total{kind="client"}`); v < 1 {
+		t.Fatalf("invalid auth failures %v:\n%s", v, sm)
+	}
+
+	if v := metricValue(cm, "gt_client_tunnels "); v < 1 {
+		t.Fatalf("invalid tunnels %v:\n%s", v, cm)
+	}
+	if v := metricValue(cm, `gt_client_bytes_total{service="`+local+`",direction="upload"}`); v < 4096 {
+		t.Fatalf("invalid upload bytes %v:\n%s", v, cm)
+	}
+	if v := metricValue(cm, `gt_client_bytes_total{service="`+local+`",direction="download"}`); v <= 0 {
+		t.Fatalf("invalid download bytes %v:\n%s", v, cm)
+	}
+	if v := metricValue(cm, `gt_client_task_latency_seconds_count{service="`+local+`"}`); v != 1 {
+		t.Fatalf("invalid task latency count %v:\n%s", v, cm)
+	}
+	if v := metricValue(cm, "gt_client_webrtc_peers "); v != 0 {
+		t.Fatalf("invalid webrtc peers %v:\n%s", v, cm)
+	}
+	if v := metricValue(bm, `gt_client_error_signals_total{code="1"`); v < 1 {
+		t.Fatalf("invalid error signals %v:\n%s", v, bm)
+	}
+}
+
 func TestInvalidIDOrSecret(t *testing.T) {
 	t.Parallel()
 
@@ -1067,6 +1561,270 @@ func TestInvalidIDOrSecret(t *testing.T) {
 	}
 }
 
+func TestUserStore(t *testing.T) {
+	t.Parallel()
+
+	store := filepath.Join(t.TempDir(), "users.db")
+	keyFile := filepath.Join(t.TempDir(), "tls.key")
+	certFile := filepath.Join(t.TempDir(), "tls.crt")
+	err := generateTLSKeyAndCert("localhost", keyFile, certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverArgs := []string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-tlsAddr", "127.0.0.1:0",
+		"-keyFile", keyFile,
+		"-certFile", certFile,
+		"-id", "store-admin",
+		"-secret", "store-admin-secret",
+		"-userStore", store,
+	}
+	s, err := setupServer(serverArgs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	clientArgs := func(id, secret string) []string {
+		return []string{
+			"client",
+			"-id", id,
+			"-secret", secret,
+			"-remote", s.GetListenerAddrPort().String(),
+			"-local", "http://www.baidu.com/",
+			"-remoteTimeout", "5s",
+			"-useLocalAsHTTPHost",
+			"-logLevel", "info",
+		}
+	}
+
+	// 运行时添加的用户不需要重启服务端就可以登录
+	err = s.PutUser(server.UserRecord{ID: "store-user", Secret: "store-user-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, log := newStringWriter()
+	c, err := setupClient(clientArgs("store-user", "store-user-secret"), w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 删除用户后客户端被断开并且不能重新登录
+	err = s.DeleteUser("store-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; !strings.Contains(log(), "invalid id and secret"); i++ {
+		if i > 100 {
+			t.Fatalf("client of the deleted user is not closed:\n%s", log())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.Close()
+
+	// allowAnyClient 模式下认领的 id 在重启后仍然属于原来的客户端
+	s.Close()
+	serverArgs = append(serverArgs, "-allowAnyClient")
+	for i, secret := range []string{"store-claimed-secret", "another-secret", "store-claimed-secret"} {
+		s, err = setupServer(serverArgs, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		args := clientArgs("store-claimed", secret)
+		if i == 0 {
+			// 通过验证了证书的 TLS 连接登记 id，之后在 tcp 上使用质询应答认证
+			for j := range args {
+				if args[j] == "-remote" {
+					args[j+1] = "tls://localhost:" + strconv.Itoa(int(s.GetTLSListenerAddrPort().Port()))
+				}
+			}
+			args = append(args, "-remoteCert", certFile)
+		}
+		c, err = setupClient(args, nil)
+		c.Close()
+		if i == 1 && err == nil {
+			t.Fatal("claimed id is taken by another client after restart")
+		} else if i != 1 && err != nil {
+			t.Fatal(err)
+		}
+		if i < 2 {
+			s.Close()
+		}
+	}
+	users := s.GetUsers()
+	if len(users) != 2 || users[0].ID != "store-admin" || users[1].ID != "store-claimed" || !users[1].Claimed {
+		t.Fatalf("invalid users %+v", users)
+	}
+}
+
+func TestControlAPI(t *testing.T) {
+	t.Parallel()
+
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-id", "control",
+		"-secret", "control-secret",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	w, log := newStringWriter()
+	c, err := setupClient([]string{
+		"client",
+		"-id", "control",
+		"-secret", "control-secret",
+		"-remote", s.GetListenerAddrPort().String(),
+		"-local", "http://www.baidu.com/",
+		"-remoteTimeout", "5s",
+		"-remoteConnections", "2",
+		"-remoteIdleConnections", "2",
+		"-reconnectDelay", "100ms",
+		"-useLocalAsHTTPHost",
+		"-logLevel", "info",
+	}, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	waitTunnels := func(n int, exclude string) server.ClientInfo {
+		for i := 0; ; i++ {
+			clients := s.GetClients("control")
+			if len(clients) == 1 && len(clients[0].Tunnels) >= n {
+				found := false
+				for _, tunnel := range clients[0].Tunnels {
+					found = found || tunnel.ID == exclude
+				}
+				if !found {
+					return clients[0]
+				}
+			}
+			if i > 100 {
+				t.Fatalf("client does not have %d tunnels at least: %+v\n%s", n, clients, log())
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	info := waitTunnels(2, "")
+	if len(info.HostPrefixes) != 1 || info.HostPrefixes[0] != "control" || len(info.Services) != 1 {
+		t.Fatalf("invalid client info %+v", info)
+	}
+
+	// 排空的 tunnel 被关闭，其它 tunnel 不受影响
+	drained := info.Tunnels[0].ID
+	err = s.DrainTunnel("control", drained)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info = waitTunnels(1, drained)
+	if len(info.Tunnels) == 1 {
+		if err = s.DrainTunnel("control", info.Tunnels[0].ID); !errors.Is(err, server.ErrOnlyTunnel) {
+			t.Fatalf("drained the only tunnel, err: %v", err)
+		}
+	}
+	if err = s.DrainTunnel("control", drained); !errors.Is(err, server.ErrTunnelNotFound) {
+		t.Fatalf("drained tunnel is still found, err: %v", err)
+	}
+	if err = s.KickClient("not-connected"); !errors.Is(err, server.ErrClientNotConnected) {
+		t.Fatalf("kicked a client that is not connected, err: %v", err)
+	}
+
+	// 被封禁的 id 被断开并且在解除封禁前不能重新登录
+	err = s.BanID("control", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; !strings.Contains(log(), "the id or ip of the client is banned"); i++ {
+		if i > 100 {
+			t.Fatalf("banned client is not refused:\n%s", log())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if clients := s.GetClients("control"); len(clients) != 0 {
+		t.Fatalf("banned client is still connected: %+v", clients)
+	}
+	s.UnbanID("control")
+	info = waitTunnels(1, "")
+
+	// 踢掉的客户端重新连接后使用新的 tunnel
+	err = s.KickClient("control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitTunnels(1, info.Tunnels[0].ID)
+}
+
+func TestReload(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(secret2 string) {
+		err := os.WriteFile(path, []byte(`
+users:
+  reload1:
+    secret: reload1-secret
+  reload2:
+    secret: `+secret2+`
+`), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("reload2-secret")
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-config", path,
+		"-configWatchInterval", "100ms",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	clientArgs := func(id string) []string {
+		return []string{
+			"client",
+			"-id", id,
+			"-secret", id + "-secret",
+			"-remote", s.GetListenerAddrPort().String(),
+			"-local", "http://www.baidu.com/",
+			"-remoteTimeout", "5s",
+			"-useLocalAsHTTPHost",
+			"-logLevel", "info",
+		}
+	}
+	c1, err := setupClient(clientArgs("reload1"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	w, log := newStringWriter()
+	c2, err := setupClient(clientArgs("reload2"), w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	before := s.GetClients("reload1")
+
+	// 修改 secret 的用户的客户端被断开，没有变化的用户的客户端不受影响
+	write("reload2-secret-changed")
+	for i := 0; !strings.Contains(log(), "invalid id and secret"); i++ {
+		if i > 100 {
+			t.Fatalf("client of the changed user is not closed:\n%s", log())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	after := s.GetClients("reload1")
+	if len(before) != 1 || len(after) != 1 || len(after[0].Tunnels) == 0 ||
+		before[0].Tunnels[0].ID != after[0].Tunnels[0].ID {
+		t.Fatalf("client of the unchanged user is affected, before: %+v, after: %+v", before, after)
+	}
+}
+
 func TestConnectionsLimit(t *testing.T) {
 	t.Parallel()
 
@@ -1103,6 +1861,10 @@ func TestConnectionsLimit(t *testing.T) {
 	client2LogWriter, client2Log := newStringWriter()
 	s, err := setupServer([]string{
 		"server",
+		"-id", "id1",
+		"-secret", "secret1",
+		"-id", "id2",
+		"-secret", "secret2",
 		"-addr", "127.0.0.1:0",
 		"-connections", "3",
 	}, nil)
@@ -1617,6 +2379,10 @@ func TestHostPrefixConflict(t *testing.T) {
 	// 启动服务端、客户端
 	s, err := setupServer([]string{
 		"server",
+		"-id", "id1",
+		"-secret", "secret1",
+		"-id", "id2",
+		"-secret", "secret2",
 		"-addr", "127.0.0.1:0",
 	}, nil)
 	if err != nil {
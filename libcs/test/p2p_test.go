@@ -49,6 +49,8 @@ func TestP2PGetOffer(t *testing.T) {
 	// 创建客户端、服务端
 	s, err := setupServer([]string{
 		"server",
+		"-id", "abc",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
 		"-addr", "127.0.0.1:0",
 		"-stunAddr", "127.0.0.1:0",
 	}, nil)
@@ -325,6 +327,8 @@ func TestP2PSetOffer(t *testing.T) {
 	}()
 	s, err := setupServer([]string{
 		"server",
+		"-id", "abc",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
 		"-addr", "127.0.0.1:0",
 		"-stunAddr", "127.0.0.1:0",
 	}, nil)
@@ -555,6 +559,10 @@ func TestTCPForward(t *testing.T) {
 	// 启动服务端、客户端
 	s, err := setupServer([]string{
 		"server",
+		"-id", "id1",
+		"-secret", "secret1",
+		"-id", "id2",
+		"-secret", "secret2",
 		"-addr", "127.0.0.1:0",
 		"-stunAddr", "127.0.0.1:0",
 	}, nil)
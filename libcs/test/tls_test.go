@@ -26,7 +26,9 @@ import (
 	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -180,3 +182,222 @@ func TestTLS(t *testing.T) {
 	}
 	t.Logf("%s", all)
 }
+
+func TestACME(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "tls.key")
+	certFile := filepath.Join(dir, "tls.crt")
+	err := generateTLSKeyAndCert("*.example.com,localhost", keyFile, certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ACME 服务不可用时使用静态证书
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-tlsAddr", "127.0.0.1:0",
+		"-keyFile", keyFile,
+		"-certFile", certFile,
+		"-acme",
+		"-acmeDirectory", "http://127.0.0.1:1/directory",
+		"-acmeCacheDir", filepath.Join(dir, "acme"),
+		"-acmeBaseDomains", "example.com",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer local.Close()
+	c, err := setupClient([]string{
+		"client",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-local", local.URL,
+		"-remote", s.GetListenerAddrPort().String(),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	rootCAs := x509.NewCertPool()
+	certBytes, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rootCAs.AppendCertsFromPEM(certBytes) {
+		t.Fatal("failed to add cert from pem")
+	}
+	httpClient := setupHTTPClient(s.GetTLSListenerAddrPort().String(), &tls.Config{RootCAs: rootCAs})
+	httpClient.Timeout = 10 * time.Second
+	resp, err := httpClient.Get("https://05797ac9-86ae-40b0-b767-7a41e03a5486.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "ok" {
+		t.Fatalf("invalid response %q", body)
+	}
+
+	// addr 上的 HTTP-01 challenge 请求由 ACME 管理器响应，不会转发给客户端
+	httpClient = setupHTTPClient(s.GetListenerAddrPort().String(), nil)
+	httpClient.Timeout = 10 * time.Second
+	resp, err = httpClient.Get("http://05797ac9-86ae-40b0-b767-7a41e03a5486.example.com/.well-known/acme-challenge/unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("invalid status code %d", resp.StatusCode)
+	}
+}
+
+// TestACMEWithPebble 需要本地运行的 Pebble（https://github.com/letsencrypt/pebble），例如在 Pebble 仓库中运行：
+//
+//	PEBBLE_VA_ALWAYS_VALID=1 pebble -config test/config/pebble-config.json
+//
+// 然后在本仓库中运行：
+//
+//	GT_PEBBLE_DIRECTORY=https://localhost:14000/dir GT_PEBBLE_CA=<pebble>/test/certs/pebble.minica.pem go test -run TestACMEWithPebble ./test/
+//
+// 服务端在 Pebble 默认的 challenge 端口 5002（HTTP-01）与 5001（TLS-ALPN-01）上监听。
+func TestACMEWithPebble(t *testing.T) {
+	directory := os.Getenv("GT_PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("GT_PEBBLE_DIRECTORY is not set")
+	}
+	const id = "05797ac9-86ae-40b0-b767-7a41e03a5486"
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:5002",
+		"-tlsAddr", "127.0.0.1:5001",
+		"-acme",
+		"-acmeDirectory", directory,
+		"-acmeCACert", os.Getenv("GT_PEBBLE_CA"),
+		"-acmeCacheDir", t.TempDir(),
+		"-acmeBaseDomains", "example.com",
+		"-id", id,
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer local.Close()
+	c, err := setupClient([]string{
+		"client",
+		"-id", id,
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-local", local.URL,
+		"-remote", s.GetListenerAddrPort().String(),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Pebble 每次启动生成新的根证书，这里只检查签发的证书
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Minute}, "tcp", s.GetTLSListenerAddrPort().String(), &tls.Config{
+		ServerName:         id + ".example.com",
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	leaf := conn.ConnectionState().PeerCertificates[0]
+	if err = leaf.VerifyHostname(id + ".example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(leaf.Issuer.CommonName, "Pebble") {
+		t.Fatalf("certificate is issued by %q", leaf.Issuer.CommonName)
+	}
+}
+
+func TestTLSCertReload(t *testing.T) {
+	dir := t.TempDir()
+	err := generateTLSKeyAndCert("*.example.com,localhost", filepath.Join(dir, "a.key"), filepath.Join(dir, "a.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "",
+		"-tlsAddr", "127.0.0.1:0",
+		"-certDir", dir,
+		"-certWatchInterval", "100ms",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer local.Close()
+	c, err := setupClient([]string{
+		"client",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-local", local.URL,
+		"-remote", fmt.Sprintf("tls://localhost:%v", s.GetTLSListenerAddrPort().Port()),
+		"-remoteCertInsecure",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	get := func(host string) (names []string) {
+		httpClient := setupHTTPClient(s.GetTLSListenerAddrPort().String(), &tls.Config{InsecureSkipVerify: true})
+		httpClient.Timeout = 10 * time.Second
+		resp, err := httpClient.Get("https://" + host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "ok" {
+			t.Fatalf("invalid response %q", body)
+		}
+		return resp.TLS.PeerCertificates[0].DNSNames
+	}
+	host := "05797ac9-86ae-40b0-b767-7a41e03a5486.example.com"
+	if names := get(host); names[0] != "*.example.com" {
+		t.Fatalf("served cert %v", names)
+	}
+
+	// 新增证书后按 SNI 选择新的证书，已连接的客户端不受影响
+	err = generateTLSKeyAndCert(host, filepath.Join(dir, "b.key"), filepath.Join(dir, "b.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		names := get(host)
+		if names[0] == host {
+			break
+		}
+		if i >= 50 {
+			t.Fatalf("cert is not reloaded, served cert %v", names)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
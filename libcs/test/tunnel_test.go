@@ -15,12 +15,28 @@
 package test
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/isrc-cas/gt/client"
+	connection "github.com/isrc-cas/gt/conn"
+	"github.com/isrc-cas/gt/predef"
 )
 
 func TestFailToDialLocalServer(t *testing.T) {
@@ -74,9 +90,13 @@ func TestFailToDialLocalServer(t *testing.T) {
 		panic("tunnel should not be closed")
 	})
 	httpClient := setupHTTPClient(s.GetListenerAddrPort().String(), nil)
-	_, err = httpClient.Get("http://05797ac9-86ae-40b0-b767-7a41e03a5486.example.com/test?hello=world")
-	if err == nil {
-		t.Fatal("should failed to connect")
+	first, err := httpClient.Get("http://05797ac9-86ae-40b0-b767-7a41e03a5486.example.com/test?hello=world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = first.Body.Close()
+	if first.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("local server should not respond in time, got status code %d", first.StatusCode)
 	}
 	defer func() {
 		err := hs.Close()
@@ -208,3 +228,2028 @@ func TestInCompleteHTTPReqToServer(t *testing.T) {
 	t.Logf("%s", all)
 	s.Shutdown()
 }
+
+func TestSlowVisitorDoesNotBlockTunnel(t *testing.T) {
+	t.Parallel()
+	big := bytes.Repeat([]byte("0123456789abcdef"), 4*1024*1024) // 64 MiB
+	mux := http.NewServeMux()
+	mux.HandleFunc("/big", func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = writer.Write(big)
+	})
+	mux.HandleFunc("/test", func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = writer.Write([]byte("ok"))
+	})
+	hs := &http.Server{Handler: mux}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hs.Close()
+	go func() {
+		err := hs.Serve(l)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-timeout", "10s",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := setupClient([]string{
+		"client",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-local", "http://" + l.Addr().String(),
+		"-remote", s.GetListenerAddrPort().String(),
+		"-remoteTimeout", "5s",
+		"-remoteConnections", "1",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 慢访问者发出请求后不读取响应
+	slow, err := net.Dial("tcp", s.GetListenerAddrPort().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	_, err = slow.Write([]byte("GET /big HTTP/1.1\r\nHost: 05797ac9-86ae-40b0-b767-7a41e03a5486.example.com\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+
+	// 同一个 tunnel 上的其他任务不应被阻塞
+	httpClient := setupHTTPClient(s.GetListenerAddrPort().String(), nil)
+	httpClient.Timeout = 3 * time.Second
+	resp, err := httpClient.Get("http://05797ac9-86ae-40b0-b767-7a41e03a5486.example.com/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	all, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(all) != "ok" {
+		t.Fatal("invalid resp")
+	}
+
+	// 慢访问者最终也能读到完整的响应
+	resp, err = http.ReadResponse(bufio.NewReader(slow), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	all, err = io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(all, big) {
+		t.Fatal("invalid big resp")
+	}
+}
+
+func TestCapabilitiesNegotiation(t *testing.T) {
+	t.Parallel()
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-id", "d1c8a8b5-0a9e-4a5e-9a43-6f0c5f3a7c21",
+		"-secret", "1f6bb5d6-3b8a-4a4c-8d0e-2f4b0e7f9a10",
+		"-timeout", "10s",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := setupClient([]string{
+		"client",
+		"-id", "d1c8a8b5-0a9e-4a5e-9a43-6f0c5f3a7c21",
+		"-secret", "1f6bb5d6-3b8a-4a4c-8d0e-2f4b0e7f9a10",
+		"-local", "http://127.0.0.1:1",
+		"-remote", s.GetListenerAddrPort().String(),
+		"-remoteTimeout", "5s",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	infos := s.GetConnectionInfo()
+	if len(infos) == 0 {
+		t.Fatal("no client")
+	}
+	for _, info := range infos {
+		if info.ProtocolVersion != predef.ProtocolVersion {
+			t.Fatalf("server sees version %v", info.ProtocolVersion)
+		}
+		if len(info.Features) == 0 {
+			t.Fatal("server sees no features")
+		}
+	}
+	pools := c.GetConnectionPoolNetInfo()
+	if len(pools) == 0 {
+		t.Fatal("no tunnel")
+	}
+	for _, pool := range pools {
+		if pool.ProtocolVersion != predef.ProtocolVersion {
+			t.Fatalf("client sees version %v", pool.ProtocolVersion)
+		}
+		if len(pool.Features) == 0 {
+			t.Fatal("client sees no features")
+		}
+	}
+}
+
+func TestMinClientVersion(t *testing.T) {
+	t.Parallel()
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-id", "a5d2e7c4-6f1b-4c38-9e0a-3b7d8c1f2e45",
+		"-secret", "7e3f1a2b-9c4d-4e5f-8a6b-0c1d2e3f4a5b",
+		"-timeout", "10s",
+		"-minClientVersion", strconv.Itoa(int(predef.ProtocolVersion) + 1),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := client.New([]string{
+		"client",
+		"-id", "a5d2e7c4-6f1b-4c38-9e0a-3b7d8c1f2e45",
+		"-secret", "7e3f1a2b-9c4d-4e5f-8a6b-0c1d2e3f4a5b",
+		"-local", "http://127.0.0.1:1",
+		"-remote", s.GetListenerAddrPort().String(),
+		"-remoteTimeout", "5s",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = c.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.WaitUntilReady(3 * time.Second)
+	if err == nil {
+		t.Fatal("client with a too low protocol version should be rejected")
+	}
+}
+
+func TestPlaintextAuth(t *testing.T) {
+	t.Parallel()
+	for _, allow := range []bool{false, true} {
+		args := []string{
+			"server",
+			"-addr", "127.0.0.1:0",
+			"-id", "3c9e2a71-5d4b-4f86-a0c2-8e1b7d6f5a34",
+			"-secret", "b8f4d2e6-1a3c-4e5b-9d7f-0a2c4e6b8d1f",
+			"-timeout", "10s",
+		}
+		if allow {
+			args = append(args, "-plaintextAuth")
+		}
+		s, err := setupServer(args, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := client.New([]string{
+			"client",
+			"-id", "3c9e2a71-5d4b-4f86-a0c2-8e1b7d6f5a34",
+			"-secret", "b8f4d2e6-1a3c-4e5b-9d7f-0a2c4e6b8d1f",
+			"-local", "http://127.0.0.1:1",
+			"-remote", s.GetListenerAddrPort().String(),
+			"-remoteTimeout", "5s",
+			"-plaintextAuth",
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.WaitUntilReady(3 * time.Second)
+		c.Close()
+		s.Close()
+		if allow && err != nil {
+			t.Fatalf("plaintext authentication should be accepted: %v", err)
+		}
+		if !allow && err == nil {
+			t.Fatal("plaintext authentication should be rejected")
+		}
+	}
+}
+
+func TestAnyClientAuth(t *testing.T) {
+	t.Parallel()
+	keyFile := filepath.Join(t.TempDir(), "tls.key")
+	certFile := filepath.Join(t.TempDir(), "tls.crt")
+	err := generateTLSKeyAndCert("localhost", keyFile, certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-tlsAddr", "127.0.0.1:0",
+		"-keyFile", keyFile,
+		"-certFile", certFile,
+		"-timeout", "10s",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	newClient := func(secret string, tls bool) (*client.Client, error) {
+		remote := s.GetListenerAddrPort().String()
+		if tls {
+			remote = "tls://localhost:" + strconv.Itoa(int(s.GetTLSListenerAddrPort().Port()))
+		}
+		c, err := client.New([]string{
+			"client",
+			"-id", "6e2b9f4a-8c1d-4a7e-b5f3-2d9c0e8a4b61",
+			"-secret", secret,
+			"-local", "http://127.0.0.1:1",
+			"-remote", remote,
+			"-remoteCert", certFile,
+			"-remoteTimeout", "5s",
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, c.WaitUntilReady(3 * time.Second)
+	}
+
+	// 明文连接上的质询应答不能登记新的 id
+	c, err := newClient("4f8a2c6e-0b3d-4f9a-8e1c-7d5b3a9f2e60", false)
+	c.Close()
+	if err == nil {
+		t.Fatal("new id should not be enrolled over an unencrypted connection")
+	}
+
+	c, err = newClient("4f8a2c6e-0b3d-4f9a-8e1c-7d5b3a9f2e60", true)
+	defer c.Close()
+	if err != nil {
+		t.Fatalf("new id should be enrolled over tls: %v", err)
+	}
+
+	// 登记之后可以在明文连接上使用质询应答认证
+	c1, err := newClient("4f8a2c6e-0b3d-4f9a-8e1c-7d5b3a9f2e60", false)
+	defer c1.Close()
+	if err != nil {
+		t.Fatalf("enrolled id should log in over tcp: %v", err)
+	}
+
+	c2, err := newClient("another secret", true)
+	defer c2.Close()
+	if err == nil {
+		t.Fatal("client with a different secret should be rejected")
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	t.Parallel()
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-id", "8d3f6a1c-2b7e-4c95-a0d4-5e9f1b3c7a28",
+		"-secret", "c2e7a9f1-4b6d-4e8a-9c3f-1d5b7e9a2c40",
+		"-tcpRange", "1024-65535",
+		"-tcpNumber", "2",
+		"-timeout", "10s",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// 本地服务记录收到的首行，然后关闭连接
+	headers := make(chan []byte, 3)
+	listen := func() net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					buf := make([]byte, 1024)
+					n, _ := io.ReadAtLeast(conn, buf, 16)
+					headers <- buf[:n]
+				}()
+			}
+		}()
+		return l
+	}
+	l1 := listen()
+	defer l1.Close()
+	l2 := listen()
+	defer l2.Close()
+	l3 := listen()
+	defer l3.Close()
+
+	clientLogWriter, clientLog := newStringWriter()
+	c, err := setupClient([]string{
+		"client",
+		"-id", "8d3f6a1c-2b7e-4c95-a0d4-5e9f1b3c7a28",
+		"-secret", "c2e7a9f1-4b6d-4e8a-9c3f-1d5b7e9a2c40",
+		"-remote", s.GetListenerAddrPort().String(),
+		"-remoteTimeout", "5s",
+		"-local", "tcp://" + l1.Addr().String(),
+		"-remoteTCPRandom",
+		"-proxyProtocol", "v1",
+		"-local", "tcp://" + l2.Addr().String(),
+		"-remoteTCPRandom",
+		"-proxyProtocol", "v2",
+		"-local", "http://" + l3.Addr().String(),
+		"-proxyProtocol", "v1",
+	}, clientLogWriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	time.Sleep(100 * time.Millisecond) // 等待服务端完成 TCP 端口分配
+
+	matches := regexp.MustCompile(`tcp port=(\d+)`).FindAllStringSubmatch(clientLog(), -1)
+	if len(matches) != 2 {
+		t.Fatalf("failed to get tcp ports from client log: %v", matches)
+	}
+	// 日志中端口的顺序不固定，通过首行判断属于哪个服务
+	var gotV1, gotV2 bool
+	for _, m := range matches {
+		visitor, err := net.Dial("tcp", "127.0.0.1:"+m[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = visitor.Write([]byte("hello world, this is the visitor"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		visitorPort := strconv.Itoa(visitor.LocalAddr().(*net.TCPAddr).Port)
+		var header []byte
+		select {
+		case header = <-headers:
+		case <-time.After(5 * time.Second):
+			t.Fatal("local service received nothing")
+		}
+		_ = visitor.Close()
+		switch {
+		case bytes.HasPrefix(header, []byte("PROXY ")):
+			expected := "PROXY TCP4 127.0.0.1 127.0.0.1 " + visitorPort + " " + m[1] + "\r\n"
+			if !bytes.HasPrefix(header, []byte(expected)) {
+				t.Fatalf("invalid v1 header %q, expected %q", header, expected)
+			}
+			gotV1 = true
+		case bytes.HasPrefix(header, []byte("\r\n\r\n\x00\r\nQUIT\n")):
+			if len(header) < 28 || header[12] != 0x21 || header[13] != 0x11 {
+				t.Fatalf("invalid v2 header %q", header)
+			}
+			if port := int(header[24])<<8 | int(header[25]); strconv.Itoa(port) != visitorPort {
+				t.Fatalf("invalid v2 source port %d, expected %s", port, visitorPort)
+			}
+			gotV2 = true
+		default:
+			t.Fatalf("no PROXY protocol header: %q", header)
+		}
+	}
+	if !gotV1 || !gotV2 {
+		t.Fatal("not all the tcp services received PROXY protocol header")
+	}
+
+	// http 服务
+	httpClient := setupHTTPClient(s.GetListenerAddrPort().String(), nil)
+	httpClient.Timeout = 3 * time.Second
+	go func() {
+		resp, err := httpClient.Get("http://8d3f6a1c-2b7e-4c95-a0d4-5e9f1b3c7a28.example.com/")
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+	}()
+	select {
+	case header := <-headers:
+		if !bytes.HasPrefix(header, []byte("PROXY TCP4 127.0.0.1 127.0.0.1 ")) {
+			t.Fatalf("invalid v1 header of http service %q", header)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("local http service received nothing")
+	}
+}
+
+func TestAcceptProxyProtocol(t *testing.T) {
+	t.Parallel()
+	// 客户端从 127.0.0.1 连接，不是可信来源；访问者从可信来源 127.0.0.2 连接
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-id", "4b9e2d7a-6c1f-4a83-b5e0-9d2f7c4a1e63",
+		"-secret", "e5a1c8d3-7f2b-4d96-8e4a-2c6f9b1d3a75",
+		"-tcpRange", "1024-65535",
+		"-tcpNumber", "1",
+		"-timeout", "10s",
+		"-proxyProtocolTrustedCIDRs", "127.0.0.2",
+		"-addrProxyProtocol",
+		"-tcpProxyProtocol",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	headers := make(chan []byte, 3)
+	listen := func() net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					line, _ := bufio.NewReader(conn).ReadBytes('\n')
+					headers <- line
+				}()
+			}
+		}()
+		return l
+	}
+	l1 := listen()
+	defer l1.Close()
+	l2 := listen()
+	defer l2.Close()
+
+	clientLogWriter, clientLog := newStringWriter()
+	c, err := setupClient([]string{
+		"client",
+		"-id", "4b9e2d7a-6c1f-4a83-b5e0-9d2f7c4a1e63",
+		"-secret", "e5a1c8d3-7f2b-4d96-8e4a-2c6f9b1d3a75",
+		"-remote", s.GetListenerAddrPort().String(),
+		"-remoteTimeout", "5s",
+		"-local", "tcp://" + l1.Addr().String(),
+		"-remoteTCPRandom",
+		"-proxyProtocol", "v1",
+		"-local", "http://" + l2.Addr().String(),
+		"-proxyProtocol", "v1",
+	}, clientLogWriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	time.Sleep(100 * time.Millisecond) // 等待服务端完成 TCP 端口分配
+
+	m := regexp.MustCompile(`tcp port=(\d+)`).FindStringSubmatch(clientLog())
+	if len(m) != 2 {
+		t.Fatalf("failed to get tcp port from client log: %v", m)
+	}
+	dial := func(localIP, addr string, data ...[]byte) net.Conn {
+		dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(localIP)}}
+		visitor, err := dialer.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range data {
+			_, err = visitor.Write(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return visitor
+	}
+	expect := func(prefix string) {
+		select {
+		case header := <-headers:
+			if !bytes.HasPrefix(header, []byte(prefix)) {
+				t.Fatalf("invalid header %q, expected %q", header, prefix)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("local service received nothing")
+		}
+	}
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 4567}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 80}
+
+	// 可信来源发送的 v1 头部
+	v1, err := connection.ProxyHeader(connection.ProxyProtocolV1, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	visitor := dial("127.0.0.2", "127.0.0.1:"+m[1], v1, []byte("hello\n"))
+	expect("PROXY TCP4 203.0.113.7 198.51.100.1 4567 80\r\n")
+	_ = visitor.Close()
+
+	// 不可信来源发送的头部不会被解析
+	visitor = dial("127.0.0.1", "127.0.0.1:"+m[1], v1, []byte("hello\n"))
+	expect("PROXY TCP4 127.0.0.1 127.0.0.1 ")
+	_ = visitor.Close()
+
+	// 可信来源在 addr 上发送的 v2 头部
+	v2, err := connection.ProxyHeader(connection.ProxyProtocolV2, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	visitor = dial("127.0.0.2", s.GetListenerAddrPort().String(), v2,
+		[]byte("GET / HTTP/1.1\r\nHost: 4b9e2d7a-6c1f-4a83-b5e0-9d2f7c4a1e63.example.com\r\n\r\n"))
+	expect("PROXY TCP4 203.0.113.7 198.51.100.1 4567 80\r\n")
+	_ = visitor.Close()
+
+	// 可信来源没有发送头部时连接被关闭
+	visitor = dial("127.0.0.2", s.GetListenerAddrPort().String(),
+		[]byte("GET / HTTP/1.1\r\nHost: 4b9e2d7a-6c1f-4a83-b5e0-9d2f7c4a1e63.example.com\r\n\r\n"))
+	defer visitor.Close()
+	_ = visitor.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = visitor.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		var ne net.Error
+		if !errors.As(err, &ne) || ne.Timeout() {
+			t.Fatalf("connection without PROXY protocol header from trusted source is not closed: %v", err)
+		}
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	t.Parallel()
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-id", "7c2a9e4f-1d6b-4f38-a5c7-3e8b1f9d2a64",
+		"-secret", "a9d4f2c7-5e1b-4c83-b6a9-8f3d2e7c1b50",
+		"-timeout", "10s",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// 本地服务返回收到的转发头部
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		_ = http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-IP", "Forwarded"} {
+				_, _ = w.Write([]byte(name + ": " + r.Header.Get(name) + "\n"))
+			}
+			_, _ = w.Write([]byte("Local: " + r.RemoteAddr + "\n"))
+		}))
+	}()
+
+	c, err := setupClient([]string{
+		"client",
+		"-id", "7c2a9e4f-1d6b-4f38-a5c7-3e8b1f9d2a64",
+		"-secret", "a9d4f2c7-5e1b-4c83-b6a9-8f3d2e7c1b50",
+		"-remote", s.GetListenerAddrPort().String(),
+		"-remoteTimeout", "5s",
+		"-local", "http://" + l.Addr().String(),
+		"-forwardedHeaders",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	visitor, err := net.Dial("tcp", s.GetListenerAddrPort().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	_ = visitor.SetDeadline(time.Now().Add(10 * time.Second))
+	host := "7c2a9e4f-1d6b-4f38-a5c7-3e8b1f9d2a64.example.com"
+	visitorIP := visitor.LocalAddr().(*net.TCPAddr).IP.String()
+	reader := bufio.NewReader(visitor)
+	var local string
+	// 同一个连接上的每个请求都要添加转发头部
+	for i := 0; i < 3; i++ {
+		_, err = visitor.Write([]byte("POST / HTTP/1.1\r\nHost: " + host + "\r\nContent-Length: 4\r\n\r\nbody"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "X-Forwarded-For: " + visitorIP + "\n" +
+			"X-Forwarded-Host: " + host + "\n" +
+			"X-Forwarded-Proto: http\n" +
+			"X-Real-IP: " + visitorIP + "\n" +
+			"Forwarded: for=" + visitorIP + ";host=" + host + ";proto=http\n"
+		if !bytes.HasPrefix(body, []byte(expected)) {
+			t.Fatalf("request %d: invalid forwarded headers %q, expected %q", i, body, expected)
+		}
+		if i == 0 {
+			local = string(body[len(expected):])
+		} else if local != string(body[len(expected):]) {
+			t.Fatalf("request %d is not sent on the same local connection: %q != %q", i, body[len(expected):], local)
+		}
+	}
+}
+
+func TestHTTPRouting(t *testing.T) {
+	t.Parallel()
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-id", "2f8c6a1e-9b4d-4e72-a3f5-6d1c8e2b7a90",
+		"-secret", "b7e3d9a1-4c6f-4a28-9e5b-1f7d3c8a2e64",
+		"-id", "5a1d7e3c-8f2b-4c96-b4e1-9c6a2f8d3b15",
+		"-secret", "d4c8a2f6-1e9b-4d73-a6c5-3b7e1f9d2c48",
+		"-timeout", "10s",
+		"-httpRouting",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// 本地服务返回自己的名字、请求方法与请求体
+	serve := func(name string) net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			_ = http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Upgrade") == "echo" {
+					conn, rw, err := w.(http.Hijacker).Hijack()
+					if err != nil {
+						return
+					}
+					defer conn.Close()
+					_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+					_ = rw.Flush()
+					_, _ = io.Copy(conn, rw)
+					return
+				}
+				body, _ := io.ReadAll(r.Body)
+				w.Header().Set("Name", name)
+				// 分多次写出，使响应使用 chunked 编码
+				_, _ = w.Write([]byte(name + " " + r.Method + " "))
+				w.(http.Flusher).Flush()
+				_, _ = w.Write(body)
+			}))
+		}()
+		return l
+	}
+	l1 := serve("a")
+	defer l1.Close()
+	l2 := serve("b")
+	defer l2.Close()
+
+	c1, err := setupClient([]string{
+		"client",
+		"-id", "2f8c6a1e-9b4d-4e72-a3f5-6d1c8e2b7a90",
+		"-secret", "b7e3d9a1-4c6f-4a28-9e5b-1f7d3c8a2e64",
+		"-remote", s.GetListenerAddrPort().String(),
+		"-local", "http://" + l1.Addr().String(),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	c2, err := setupClient([]string{
+		"client",
+		"-id", "5a1d7e3c-8f2b-4c96-b4e1-9c6a2f8d3b15",
+		"-secret", "d4c8a2f6-1e9b-4d73-a6c5-3b7e1f9d2c48",
+		"-remote", s.GetListenerAddrPort().String(),
+		"-local", "http://" + l2.Addr().String(),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	visitor, err := net.Dial("tcp", s.GetListenerAddrPort().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	_ = visitor.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(visitor)
+	hostA := "Host: 2f8c6a1e-9b4d-4e72-a3f5-6d1c8e2b7a90.example.com\r\n"
+	hostB := "Host: 5a1d7e3c-8f2b-4c96-b4e1-9c6a2f8d3b15.example.com\r\n"
+	tests := []struct {
+		req    string
+		method string
+		name   string
+		body   string
+	}{
+		{"GET / HTTP/1.1\r\n" + hostA + "\r\n", "GET", "a", "a GET "},
+		{"POST / HTTP/1.1\r\n" + hostB + "Transfer-Encoding: chunked\r\n\r\n4\r\nbody\r\n0\r\n\r\n", "POST", "b", "b POST body"},
+		{"HEAD / HTTP/1.1\r\n" + hostA + "\r\n", "HEAD", "a", ""},
+		{"POST / HTTP/1.1\r\n" + hostA + "Content-Length: 4\r\n\r\ndata", "POST", "a", "a POST data"},
+		{"GET / HTTP/1.1\r\n" + hostB + "\r\n", "GET", "b", "b GET "},
+	}
+	for i, tt := range tests {
+		_, err = visitor.Write([]byte(tt.req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(reader, &http.Request{Method: tt.method})
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if resp.Header.Get("Name") != tt.name || string(body) != tt.body {
+			t.Fatalf("request %d is routed to %q with body %q, expected %q with body %q", i, resp.Header.Get("Name"), body, tt.name, tt.body)
+		}
+	}
+
+	// 协议切换后数据原样转发
+	_, err = visitor.Write([]byte("GET / HTTP/1.1\r\n" + hostA + "Connection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("invalid status code %d", resp.StatusCode)
+	}
+	_, err = visitor.Write([]byte("GET / HTTP/1.1\r\n" + hostB + "\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "GET / HTTP/1.1\r\n" {
+		t.Fatalf("invalid echo %q", line)
+	}
+}
+
+func TestPathRouting(t *testing.T) {
+	t.Parallel()
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-id", "8e1f4c7a-2d9b-4a63-b5e8-0c3f6a9d1b27",
+		"-secret", "f2a9c6e3-7b1d-4e84-9c5a-6d2e8b1f4a73",
+		"-id", "3c7b9e2f-6a1d-4f58-8e3b-2a9c5d7f1e46",
+		"-secret", "a6e2d8b4-9c3f-4a17-b2d6-5e8a1c4f7b39",
+		"-timeout", "10s",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// 本地服务返回自己的名字与收到的请求路径
+	serve := func(name string) net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			_ = http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(name + " " + r.URL.RequestURI()))
+			}))
+		}()
+		return l
+	}
+	root := serve("root")
+	defer root.Close()
+	api := serve("api")
+	defer api.Close()
+	app := serve("app")
+	defer app.Close()
+	v1 := serve("v1")
+	defer v1.Close()
+
+	hostPrefix := "8e1f4c7a-2d9b-4a63-b5e8-0c3f6a9d1b27"
+	c1, err := setupClient([]string{
+		"client",
+		"-id", hostPrefix,
+		"-secret", "f2a9c6e3-7b1d-4e84-9c5a-6d2e8b1f4a73",
+		"-remote", s.GetListenerAddrPort().String(),
+		"-local", "http://" + root.Addr().String(),
+		"-local", "http://" + api.Addr().String(), "-pathPrefix", "/api/", "-stripPathPrefix",
+		"-local", "http://" + app.Addr().String(), "-pathPrefix", "/app",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	// 另一个客户端提供同一 host 前缀下更长的路径
+	c2, err := setupClient([]string{
+		"client",
+		"-id", "3c7b9e2f-6a1d-4f58-8e3b-2a9c5d7f1e46",
+		"-secret", "a6e2d8b4-9c3f-4a17-b2d6-5e8a1c4f7b39",
+		"-remote", s.GetListenerAddrPort().String(),
+		"-local", "http://" + v1.Addr().String(), "-hostPrefix", hostPrefix, "-pathPrefix", "/app/v1",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/", "root /"},
+		{"/x", "root /x"},
+		{"/api", "api /"},
+		{"/api/users?q=1", "api /users?q=1"},
+		{"/apix", "root /apix"},
+		{"/app/x", "app /app/x"},
+		{"/app/v1/x", "v1 /app/v1/x"},
+		{"/app/v1", "v1 /app/v1"},
+		{"/app/v10", "app /app/v10"},
+		{"/", "root /"},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodGet, "http://"+s.GetListenerAddrPort().String()+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = hostPrefix + ".example.com"
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.path, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.path, err)
+		}
+		if string(body) != tt.expected {
+			t.Fatalf("%s is routed to %q, expected %q", tt.path, body, tt.expected)
+		}
+	}
+}
+
+func TestCustomDomains(t *testing.T) {
+	t.Parallel()
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-sniAddr", "127.0.0.1:0",
+		"-id", "6b2e9d4a-1f7c-4a38-9d5e-7c1a3f8b2e60",
+		"-secret", "c9f3a7d1-5e2b-4c86-a1f4-8d6b2e9c3a57",
+		"-hostDomain", "customer.com",
+		"-hostDomain", "*.example.com",
+		"-timeout", "10s",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// 本地服务返回自己的名字
+	serve := func(name string) net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			_ = http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(name))
+			}))
+		}()
+		return l
+	}
+	apex := serve("apex")
+	defer apex.Close()
+	wildcard := serve("wildcard")
+	defer wildcard.Close()
+	prefix := serve("prefix")
+	defer prefix.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("secure"))
+	}))
+	defer secure.Close()
+
+	id := "6b2e9d4a-1f7c-4a38-9d5e-7c1a3f8b2e60"
+	c, err := setupClient([]string{
+		"client",
+		"-id", id,
+		"-secret", "c9f3a7d1-5e2b-4c86-a1f4-8d6b2e9c3a57",
+		"-remote", s.GetListenerAddrPort().String(),
+		"-local", "http://" + apex.Addr().String(), "-domain", "Customer.com",
+		"-local", "http://" + wildcard.Addr().String(), "-domain", "*.example.com",
+		"-local", "http://" + prefix.Addr().String(),
+		"-local", secure.URL, "-domain", "secure.example.com",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 没有启用 httpRouting 时连接按第一个请求路由，每个请求使用新的连接
+	httpClient := &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{DisableKeepAlives: true}}
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"customer.com", "apex"},
+		{"CUSTOMER.com:8080", "apex"},
+		{"shop.example.com", "wildcard"},
+		{"a.b.example.com", "wildcard"},
+		{id + ".gt.test", "prefix"},
+		{id + ".customer.com", "prefix"},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodGet, "http://"+s.GetListenerAddrPort().String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = tt.host
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.host, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.host, err)
+		}
+		if string(body) != tt.expected {
+			t.Fatalf("%s is routed to %q, expected %q", tt.host, body, tt.expected)
+		}
+	}
+
+	// 精确域名优先于通配符域名，通过 SNI 访问
+	conn, err := tls.Dial("tcp", s.GetSNIListenerAddrPort().String(), &tls.Config{
+		ServerName:         "secure.example.com",
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: secure.example.com\r\nConnection: close\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "secure" {
+		t.Fatalf("secure.example.com is routed to %q", body)
+	}
+}
+
+func TestEdgeAuth(t *testing.T) {
+	t.Parallel()
+	// 服务端为 admin 前缀配置的策略优先于客户端声明的策略
+	serverConfig := filepath.Join(t.TempDir(), "server.yaml")
+	err := os.WriteFile(serverConfig, []byte(`
+users:
+  5b8e2d7f-4c1a-4e96-a3b7-9d6f2c8e1a45:
+    secret: e7c3a1f9-2b6d-4d58-8a4e-1f9c7b3d5e62
+    host:
+      auth:
+        admin:
+          bearer:
+            - server-token
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := setupServer([]string{
+		"server",
+		"-config", serverConfig,
+		"-addr", "127.0.0.1:0",
+		"-hostAllowClientAuth",
+		"-timeout", "10s",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// 本地服务返回自己的名字与收到的 Authorization、Cookie 头部
+	serve := func(name string) net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			_ = http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(name + " " + r.URL.RequestURI() + " authorization=" + r.Header.Get("Authorization") + " cookie=" + r.Header.Get("Cookie")))
+			}))
+		}()
+		return l
+	}
+	app := serve("app")
+	defer app.Close()
+	admin := serve("admin")
+	defer admin.Close()
+
+	id := "5b8e2d7f-4c1a-4e96-a3b7-9d6f2c8e1a45"
+	c, err := setupClient([]string{
+		"client",
+		"-id", id,
+		"-secret", "e7c3a1f9-2b6d-4d58-8a4e-1f9c7b3d5e62",
+		"-remote", s.GetListenerAddrPort().String(),
+		"-remoteTimeout", "5s",
+		"-local", "http://" + app.Addr().String(), "-authBasic", "alice:password", "-authBearer", "client-token", "-authLogin",
+		"-local", "http://" + admin.Addr().String(), "-hostPrefix", "admin", "-authBearer", "client-token",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 同一个 keep-alive 连接上交替出现本地响应与转发的请求
+	httpClient := &http.Client{
+		Timeout: 10 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	do := func(method, host, path string, header http.Header, body string) (*http.Response, string) {
+		req, err := http.NewRequest(method, "http://"+s.GetListenerAddrPort().String()+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s%s: %v", method, host, path, err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s %s%s: %v", method, host, path, err)
+		}
+		return resp, string(b)
+	}
+	appHost := id + ".example.com"
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:password"))
+
+	resp, _ := do(http.MethodGet, appHost, "/", nil, "")
+	if resp.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), "Basic ") {
+		t.Fatalf("request without credentials: %d %q", resp.StatusCode, resp.Header.Get("WWW-Authenticate"))
+	}
+	resp, body := do(http.MethodGet, appHost, "/x", http.Header{"Authorization": {basic}}, "")
+	if resp.StatusCode != http.StatusOK || body != "app /x authorization= cookie=" {
+		t.Fatalf("basic auth: %d %q", resp.StatusCode, body)
+	}
+	resp, _ = do(http.MethodGet, appHost, "/x", http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("alice:wrong"))}}, "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("wrong password: %d", resp.StatusCode)
+	}
+	resp, body = do(http.MethodGet, appHost, "/x", http.Header{"Authorization": {"Bearer client-token"}}, "")
+	if resp.StatusCode != http.StatusOK || body != "app /x authorization= cookie=" {
+		t.Fatalf("bearer token: %d %q", resp.StatusCode, body)
+	}
+	resp, body = do(http.MethodGet, appHost, "/x", http.Header{"Accept": {"text/html"}}, "")
+	if resp.StatusCode != http.StatusUnauthorized || !strings.Contains(body, "<form") {
+		t.Fatalf("login page: %d %q", resp.StatusCode, body)
+	}
+
+	// 登录后使用 cookie 访问，cookie 不会转发给本地服务
+	form := url.Values{"username": {"alice"}, "password": {"password"}, "next": {"/x?y=1"}}
+	resp, _ = do(http.MethodPost, appHost, "/.gt-auth/login", http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}, form.Encode())
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/x?y=1" {
+		t.Fatalf("login: %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	var session *http.Cookie
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "gt_auth" {
+			session = cookie
+		}
+	}
+	if session == nil || !session.HttpOnly {
+		t.Fatalf("login cookie: %v", resp.Cookies())
+	}
+	resp, body = do(http.MethodGet, appHost, "/x?y=1", http.Header{"Cookie": {"a=1; " + session.Name + "=" + session.Value}}, "")
+	if resp.StatusCode != http.StatusOK || body != "app /x?y=1 authorization= cookie=a=1" {
+		t.Fatalf("login cookie: %d %q", resp.StatusCode, body)
+	}
+
+	// admin 前缀只接受服务端配置的 token
+	adminHost := "admin.example.com"
+	resp, _ = do(http.MethodGet, adminHost, "/", http.Header{"Authorization": {"Bearer client-token"}}, "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("client token of admin: %d", resp.StatusCode)
+	}
+	resp, body = do(http.MethodGet, adminHost, "/", http.Header{"Authorization": {"Bearer server-token"}}, "")
+	if resp.StatusCode != http.StatusOK || body != "admin / authorization= cookie=" {
+		t.Fatalf("server token of admin: %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	t.Parallel()
+	// 不允许 id2 从本机登录
+	ipFilterFile := filepath.Join(t.TempDir(), "ip.yaml")
+	err := os.WriteFile(ipFilterFile, []byte(`
+users:
+  id2:
+    clients:
+      deny:
+        - 127.0.0.1
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-id", "id1",
+		"-secret", "secret1",
+		"-id", "id2",
+		"-secret", "secret2",
+		"-timeout", "10s",
+		"-ipFilterFile", ipFilterFile,
+		"-ipFilterWatchInterval", "100ms",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		_ = http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		}))
+	}()
+	local := "http://" + l.Addr().String()
+
+	c1, err := setupClient([]string{
+		"client",
+		"-id", "id1",
+		"-secret", "secret1",
+		"-remote", s.GetListenerAddrPort().String(),
+		"-local", local, "-denyIP", "127.0.0.0/8",
+		"-local", local, "-hostPrefix", "allowed", "-allowIP", "127.0.0.1", "-allowIP", "::1",
+		"-local", local, "-hostPrefix", "allowed", "-pathPrefix", "/admin", "-denyIP", "127.0.0.1",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	get := func(host, path string) (int, string) {
+		req, err := http.NewRequest(http.MethodGet, "http://"+s.GetListenerAddrPort().String()+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s%s: %v", host, path, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s%s: %v", host, path, err)
+		}
+		return resp.StatusCode, string(body)
+	}
+	tests := []struct {
+		host         string
+		path         string
+		expectedCode int
+	}{
+		{"id1.example.com", "/", http.StatusForbidden},
+		{"allowed.example.com", "/", http.StatusOK},
+		{"allowed.example.com", "/admin/x", http.StatusForbidden},
+		{"allowed.example.com", "/x", http.StatusOK},
+	}
+	for _, tt := range tests {
+		code, body := get(tt.host, tt.path)
+		if code != tt.expectedCode {
+			t.Fatalf("%s%s: %d %q, expected %d", tt.host, tt.path, code, body, tt.expectedCode)
+		}
+	}
+
+	// id2 登录被拒绝，规则重新加载后可以登录
+	c2LogWriter, c2Log := newStringWriter()
+	c2, err := client.New([]string{
+		"client",
+		"-id", "id2",
+		"-secret", "secret2",
+		"-remote", s.GetListenerAddrPort().String(),
+		"-reconnectDelay", "100ms",
+		"-local", local,
+		"-webrtcThreadMode",
+	}, c2LogWriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	err = c2.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; !strings.Contains(c2Log(), "the ip of the client is not allowed to log in"); i++ {
+		if i >= 100 {
+			t.Fatalf("id2 is not rejected: %s", c2Log())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	// 同时不再允许本机访问 id1 的服务
+	err = os.WriteFile(ipFilterFile, []byte(`
+users:
+  id1:
+    visitors:
+      deny:
+        - 127.0.0.0/8
+        - ::1
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c2.WaitUntilReady(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, body := get("allowed.example.com", "/"); code != http.StatusForbidden {
+		t.Fatalf("id1 visitor is not denied after reload: %d %q", code, body)
+	}
+	if code, body := get("id2.example.com", "/"); code != http.StatusOK {
+		t.Fatalf("id2 visitor: %d %q", code, body)
+	}
+}
+
+func TestLargeHandshake(t *testing.T) {
+	t.Parallel()
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-id", "id1",
+		"-secret", "secret1",
+		"-hostAllowClientAuth",
+		"-timeout", "10s",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		_ = http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		}))
+	}()
+
+	// 每个服务都使用最多的 IPv6 CIDR 与最大的访问策略，握手远大于 4 KiB 的缓冲区
+	token := func(i int) string {
+		return fmt.Sprintf("%03d", i) + strings.Repeat("t", 247)
+	}
+	path := filepath.Join(t.TempDir(), "services.yaml")
+	writeServices := func(services int) {
+		sb := &strings.Builder{}
+		sb.WriteString("services:\n")
+		for i := 0; i < services; i++ {
+			fmt.Fprintf(sb, "- local: http://%s\n  hostPrefix: big%d\n  allowIPs:\n  - 127.0.0.1\n", l.Addr(), i)
+			for j := 1; j < predef.MaxIPFilterEntries; j++ {
+				fmt.Fprintf(sb, "  - 2001:db8:ffff:ffff:ffff:ffff:%04x:%04x/128\n", i, j)
+			}
+			sb.WriteString("  denyIPs:\n")
+			for j := 0; j < predef.MaxIPFilterEntries; j++ {
+				fmt.Fprintf(sb, "  - 2001:db8:eeee:eeee:eeee:eeee:%04x:%04x/128\n", i, j)
+			}
+			sb.WriteString("  authBearer:\n")
+			for j := 0; j < 4; j++ {
+				fmt.Fprintf(sb, "  - %s\n", token(j))
+			}
+		}
+		err := os.WriteFile(path, []byte(sb.String()), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	args := []string{
+		"client",
+		"-config", path,
+		"-id", "id1",
+		"-secret", "secret1",
+		"-remote", "tcp://" + s.GetListenerAddrPort().String(),
+		"-remoteTimeout", "5s",
+	}
+	writeServices(3)
+	c, err := setupClient(args, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	get := func(host, token string) int {
+		req, err := http.NewRequest(http.MethodGet, "http://"+s.GetListenerAddrPort().String()+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get("big2.example.com", token(3)); code != http.StatusOK {
+		t.Fatalf("unexpected status code %d", code)
+	}
+	if code := get("big2.example.com", ""); code != http.StatusUnauthorized {
+		t.Fatalf("auth policy of the service is not applied, got status code %d", code)
+	}
+
+	// 重新加载服务时同样发送完整的握手
+	writeServices(4)
+	err = c.ReloadServices(append(args, "-webrtcThreadMode")) // 与 setupClient 的参数保持一致
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := get("big3.example.com", token(0)); code != http.StatusOK {
+		t.Fatalf("unexpected status code %d after reloading services", code)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		_ = http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			_, _ = w.Write([]byte("hello"))
+		}))
+	}()
+
+	id := "5b8e2d4f-1c7a-4e96-a3d2-8f6b0c9e7a15"
+	secret := "c4f7a1e9-3b6d-4d28-9e5c-2a8f6b1d3e70"
+	readLog := func(path, want string) string {
+		for i := 0; ; i++ {
+			b, _ := os.ReadFile(path)
+			if strings.Contains(string(b), want) {
+				return string(b)
+			}
+			if i > 50 {
+				t.Fatalf("access log does not contain %q:\n%s", want, b)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	// 路由模式下记录每个请求的方法、路径与状态码
+	clfPath := filepath.Join(t.TempDir(), "access.log")
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-id", id,
+		"-secret", secret,
+		"-httpRouting",
+		"-accessLogFile", clfPath,
+		"-accessLogFormat", "clf",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := setupClient([]string{
+		"client",
+		"-id", id,
+		"-secret", secret,
+		"-remote", s.GetListenerAddrPort().String(),
+		"-local", "http://" + l.Addr().String(),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	httpClient := setupHTTPClient(s.GetListenerAddrPort().String(), nil)
+	for _, path := range []string{"/", "/missing"} {
+		resp, err := httpClient.Get("http://" + id + ".example.com" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+	httpClient.CloseIdleConnections()
+	log := readLog(clfPath, `"- `+id+`.example.com -"`)
+	for _, want := range []string{
+		`127.0.0.1 - ` + id + ` [`,
+		`"GET / HTTP/1.1" 200 `,
+		`"GET /missing HTTP/1.1" 404 `,
+	} {
+		if !strings.Contains(log, want) {
+			t.Fatalf("access log does not contain %q:\n%s", want, log)
+		}
+	}
+
+	// 默认以 json 格式记录每个访问者连接
+	jsonPath := filepath.Join(t.TempDir(), "access.log")
+	s2, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-id", id,
+		"-secret", secret,
+		"-accessLogFile", jsonPath,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	c2, err := setupClient([]string{
+		"client",
+		"-id", id,
+		"-secret", secret,
+		"-remote", s2.GetListenerAddrPort().String(),
+		"-local", "http://" + l.Addr().String(),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	httpClient = setupHTTPClient(s2.GetListenerAddrPort().String(), nil)
+	httpClient.Transport.(*http.Transport).DisableKeepAlives = true
+	resp, err := httpClient.Get("http://" + id + ".example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	log = readLog(jsonPath, `"type":"conn"`)
+	for _, want := range []string{
+		`"ip":"127.0.0.1"`,
+		`"host":"` + id + `.example.com"`,
+		`"client":"` + id + `"`,
+		`"serviceIndex":0`,
+		`"duration":`,
+	} {
+		if !strings.Contains(log, want) {
+			t.Fatalf("access log does not contain %q:\n%s", want, log)
+		}
+	}
+	if strings.Contains(log, `"bytesOut":0`) || strings.Contains(log, `"bytesIn":0`) {
+		t.Fatalf("bytes are not counted:\n%s", log)
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	t.Parallel()
+	// 本地服务不可达
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := l.Addr().String()
+	_ = l.Close()
+
+	dir := t.TempDir()
+	err = os.WriteFile(filepath.Join(dir, "502.html"), []byte("unreachable {{.Code}} {{.Host}}"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(filepath.Join(dir, "offline"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "offline", "503.html"), []byte("offline {{.Code}} {{.Message}}"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := "9d3c6a1e-5f2b-4e7a-8c94-1b6e0f3a7d52"
+	secret := "2e8b5d7f-0a4c-4f19-b6e3-7c1a9d5f2b80"
+	for _, routing := range []bool{false, true} {
+		args := []string{
+			"server",
+			"-addr", "127.0.0.1:0",
+			"-sniAddr", "127.0.0.1:0",
+			"-id", id,
+			"-secret", secret,
+			"-errorPages", dir,
+		}
+		if routing {
+			args = append(args, "-httpRouting")
+		}
+		s, err := setupServer(args, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := setupClient([]string{
+			"client",
+			"-id", id,
+			"-secret", secret,
+			"-remote", s.GetListenerAddrPort().String(),
+			"-local", "http://" + unreachable,
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpClient := setupHTTPClient(s.GetListenerAddrPort().String(), nil)
+		get := func(host string) (int, string) {
+			resp, err := httpClient.Get("http://" + host + ".example.com/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return resp.StatusCode, string(b)
+		}
+
+		// 客户端无法连接本地服务时立即返回 502，而不是等到超时
+		start := time.Now()
+		code, body := get(id)
+		if code != http.StatusBadGateway || body != "unreachable 502 "+id {
+			t.Fatalf("routing %v: unexpected response %d %q", routing, code, body)
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("routing %v: 502 is answered too late", routing)
+		}
+
+		// 没有客户端服务的 host 前缀使用它自己的模板立即返回 503
+		start = time.Now()
+		code, body = get("offline")
+		if code != http.StatusServiceUnavailable || body != "offline 503 The client serving this host is offline." {
+			t.Fatalf("routing %v: unexpected response %d %q", routing, code, body)
+		}
+		if time.Since(start) > 500*time.Millisecond {
+			t.Fatalf("routing %v: 503 is answered too late", routing)
+		}
+
+		// SNI 直通时立即返回 TLS alert
+		start = time.Now()
+		conn, err := tls.Dial("tcp", s.GetSNIListenerAddrPort().String(), &tls.Config{ServerName: "offline.example.com"})
+		if err == nil {
+			_ = conn.Close()
+			t.Fatalf("routing %v: tls handshake should fail", routing)
+		}
+		if !strings.Contains(err.Error(), "unrecognized name") {
+			t.Fatalf("routing %v: unexpected tls error: %v", routing, err)
+		}
+		if time.Since(start) > 500*time.Millisecond {
+			t.Fatalf("routing %v: tls alert is answered too late", routing)
+		}
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestServiceGroup(t *testing.T) {
+	t.Parallel()
+	// 组密钥只在验证了证书的 TLS 连接上发送
+	keyFile := filepath.Join(t.TempDir(), "tls.key")
+	certFile := filepath.Join(t.TempDir(), "tls.crt")
+	err := generateTLSKeyAndCert("localhost", keyFile, certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-tlsAddr", "127.0.0.1:0",
+		"-keyFile", keyFile,
+		"-certFile", certFile,
+		"-tcpRange", "1024-65535",
+		"-tcpNumber", "1",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// 本地服务返回自己的名字
+	serve := func(name string) net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			_ = http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(name))
+			}))
+		}()
+		return l
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	_ = l.Close()
+	remote := "tls://localhost:" + strconv.Itoa(int(s.GetTLSListenerAddrPort().Port()))
+	member := func(id, secret, groupSecret string, local net.Listener, out io.Writer) (*client.Client, error) {
+		return setupClient([]string{
+			"client",
+			"-id", id,
+			"-secret", secret,
+			"-remote", remote,
+			"-remoteCert", certFile,
+			"-local", "http://" + local.Addr().String(),
+			"-hostPrefix", "shop",
+			"-group", "group-member-a/web",
+			"-groupSecret", groupSecret,
+			"-local", "tcp://" + local.Addr().String(),
+			"-remoteTCPPort", port,
+			"-group", "group-member-a/web",
+			"-groupSecret", groupSecret,
+			"-reconnectDelay", "24h",
+		}, out)
+	}
+	a := serve("a")
+	defer a.Close()
+	b := serve("b")
+	defer b.Close()
+	ca, err := member("group-member-a", "secret-a", "group-secret", a, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ca.Close()
+	cb, err := member("group-member-b", "secret-b", "group-secret", b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cb.Close()
+
+	httpClient := setupHTTPClient(s.GetListenerAddrPort().String(), nil)
+	httpClient.Transport.(*http.Transport).DisableKeepAlives = true
+	tcpClient := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	// 每个访问者连接轮流分配到组的成员
+	seen := func(c *http.Client, url string) map[string]int {
+		m := make(map[string]int)
+		for i := 0; i < 6; i++ {
+			resp, err := c.Get(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			m[string(body)]++
+		}
+		return m
+	}
+	for _, url := range []string{"http://shop.example.com/", "http://127.0.0.1:" + port + "/"} {
+		c := httpClient
+		if !strings.Contains(url, "shop") {
+			c = tcpClient
+		}
+		if m := seen(c, url); m["a"] != 3 || m["b"] != 3 {
+			t.Fatalf("%s is not balanced across the group: %v", url, m)
+		}
+	}
+
+	// 组密钥不同的客户端不能加入，组名相同但属于其它 id 的组也不能加入
+	for _, group := range [][]string{
+		{"group-member-a/web", "wrong"},
+		{"web", "group-secret"},
+	} {
+		w, log := newStringWriter()
+		cc, err := client.New([]string{
+			"client",
+			"-id", "group-member-c",
+			"-secret", "secret-c",
+			"-remote", remote,
+			"-remoteCert", certFile,
+			"-local", "http://" + a.Addr().String(),
+			"-hostPrefix", "shop",
+			"-group", group[0],
+			"-groupSecret", group[1],
+			"-reconnectDelay", "24h",
+		}, w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = cc.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; !strings.Contains(log(), "host conflict"); i++ {
+			if i > 50 {
+				t.Fatalf("client with group %v joined the group:\n%s", group, log())
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		cc.Close()
+	}
+
+	// 组密钥不在未加密的连接上发送
+	w, log := newStringWriter()
+	cc, err := client.New([]string{
+		"client",
+		"-id", "group-member-c",
+		"-secret", "secret-c",
+		"-remote", s.GetListenerAddrPort().String(),
+		"-local", "http://" + a.Addr().String(),
+		"-hostPrefix", "shop",
+		"-group", "group-member-a/web",
+		"-groupSecret", "group-secret",
+		"-reconnectDelay", "24h",
+	}, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	err = cc.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; !strings.Contains(log(), "-group option needs a tls:// or quic:// remote"); i++ {
+		if i > 50 {
+			t.Fatalf("client sent the group secret over tcp:\n%s", log())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// 成员的 tunnel 断开后不再参与分配
+	ca.Close()
+	time.Sleep(500 * time.Millisecond)
+	for _, url := range []string{"http://shop.example.com/", "http://127.0.0.1:" + port + "/"} {
+		c := httpClient
+		if !strings.Contains(url, "shop") {
+			c = tcpClient
+		}
+		if m := seen(c, url); m["b"] != 6 {
+			t.Fatalf("%s is routed to a closed member: %v", url, m)
+		}
+	}
+
+	// 最后一个成员离开后关闭端口
+	cb.Close()
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+		if err != nil {
+			break
+		}
+		_ = conn.Close()
+		if i > 50 {
+			t.Fatal("tcp port of the group is not closed")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestServiceGroupStandby(t *testing.T) {
+	t.Parallel()
+	// 组密钥只在验证了证书的 TLS 连接上发送
+	keyFile := filepath.Join(t.TempDir(), "tls.key")
+	certFile := filepath.Join(t.TempDir(), "tls.crt")
+	err := generateTLSKeyAndCert("localhost", keyFile, certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-tlsAddr", "127.0.0.1:0",
+		"-keyFile", keyFile,
+		"-certFile", certFile,
+		"-tcpRange", "1024-65535",
+		"-tcpNumber", "1",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	serve := func(name string) net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			_ = http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(name))
+			}))
+		}()
+		return l
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	_ = l.Close()
+	remote := "tls://localhost:" + strconv.Itoa(int(s.GetTLSListenerAddrPort().Port()))
+	member := func(id, secret string, standby bool, local net.Listener) (*client.Client, error) {
+		args := []string{
+			"client",
+			"-id", id,
+			"-secret", secret,
+			"-remote", remote,
+			"-remoteCert", certFile,
+			"-local", "http://" + local.Addr().String(),
+			"-hostPrefix", "shop",
+			"-group", "group-primary/web",
+			"-groupSecret", "group-secret",
+			"-standby=" + strconv.FormatBool(standby),
+			"-local", "tcp://" + local.Addr().String(),
+			"-remoteTCPPort", port,
+			"-group", "group-primary/web",
+			"-groupSecret", "group-secret",
+			"-standby=" + strconv.FormatBool(standby),
+			"-reconnectDelay", "24h",
+		}
+		return setupClient(args, nil)
+	}
+	primary := serve("primary")
+	defer primary.Close()
+	standby := serve("standby")
+	defer standby.Close()
+	cp, err := member("group-primary", "secret-a", false, primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cp.Close()
+	cs, err := member("group-standby", "secret-b", true, standby)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	httpClient := setupHTTPClient(s.GetListenerAddrPort().String(), nil)
+	httpClient.Transport.(*http.Transport).DisableKeepAlives = true
+	tcpClient := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	expect := func(name string) {
+		for _, url := range []string{"http://shop.example.com/", "http://127.0.0.1:" + port + "/"} {
+			c := httpClient
+			if !strings.Contains(url, "shop") {
+				c = tcpClient
+			}
+			for i := 0; i < 3; i++ {
+				resp, err := c.Get(url)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, err := io.ReadAll(resp.Body)
+				_ = resp.Body.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(body) != name {
+					t.Fatalf("%s is served by %q, want %q", url, body, name)
+				}
+			}
+		}
+	}
+	// 主成员在线时备用成员不接收访问者
+	expect("primary")
+
+	// 主成员的 tunnel 全部关闭后备用成员接管，tcp 端口保持打开
+	cp.Close()
+	time.Sleep(500 * time.Millisecond)
+	expect("standby")
+}
+
+func TestLegacyServerHandshake(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// 模拟老版本的服务端：不认识 Capabilities option 时直接关闭连接
+	rejected := make(chan struct{}, 10)
+	legacyConns := make(chan net.Conn, 10)
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(nc net.Conn) {
+				r := bufio.NewReader(nc)
+				header := make([]byte, 2)
+				if _, err := io.ReadFull(r, header); err != nil || header[1] != 0x01 {
+					_ = nc.Close()
+					return
+				}
+				for i := 0; i < 2; i++ { // id 与 secret
+					n, err := r.ReadByte()
+					if err != nil {
+						_ = nc.Close()
+						return
+					}
+					if _, err = r.Discard(int(n)); err != nil {
+						_ = nc.Close()
+						return
+					}
+				}
+				option, err := r.Peek(2)
+				if err != nil || option[0] == predef.OptionAndNextOption[0] && option[1] == predef.Capabilities[0] {
+					rejected <- struct{}{}
+					_ = nc.Close()
+					return
+				}
+				legacyConns <- nc
+				tunnel := connection.Connection{Conn: nc}
+				_ = tunnel.SendReadySignal()
+				_, _ = io.Copy(io.Discard, r)
+				_ = nc.Close()
+			}(nc)
+		}
+	}()
+
+	c, err := client.New([]string{
+		"client",
+		"-id", "0b7e4c2a-9d1f-4e3b-a6c8-5f2d7e9b1a43",
+		"-secret", "e5a1c9f3-7b2d-4c6e-8f0a-3d9b5e7c1f24",
+		"-local", "http://127.0.0.1:1",
+		"-remote", "tcp://" + l.Addr().String(),
+		"-remoteTimeout", "5s",
+		"-reconnectDelay", "100ms",
+		"-plaintextAuth",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = c.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.WaitUntilReady(10 * time.Second)
+	if err != nil {
+		t.Fatalf("client should fall back to the legacy handshake: %v", err)
+	}
+	if len(rejected) == 0 {
+		t.Fatal("client did not try the capabilities option first")
+	}
+	for _, pool := range c.GetConnectionPoolNetInfo() {
+		if len(pool.Features) != 0 {
+			t.Fatalf("legacy tunnel negotiated features %v", pool.Features)
+		}
+	}
+
+	// 老版本握手的 tunnel 断开后，重连时重新尝试 Capabilities option
+	time.Sleep(500 * time.Millisecond) // 等待其他 tunnel 完成握手
+	for len(rejected) > 0 {
+		<-rejected
+	}
+	(<-legacyConns).Close()
+	select {
+	case <-rejected:
+	case <-time.After(10 * time.Second):
+		t.Fatal("client did not retry the capabilities option after the legacy tunnel closed")
+	}
+}
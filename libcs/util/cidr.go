@@ -0,0 +1,40 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"net"
+	"strings"
+)
+
+// ParseCIDR 解析 CIDR，单个 IP 视为只包含自身的 CIDR，IPv4 映射的 IPv6 地址按 IPv4 处理
+func ParseCIDR(cidr string) (ipNet *net.IPNet, err error) {
+	cidr = strings.TrimSpace(cidr)
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			err = &net.ParseError{Type: "CIDR address", Text: cidr}
+			return
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ipNet = &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+		} else {
+			ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+		}
+		return
+	}
+	_, ipNet, err = net.ParseCIDR(cidr)
+	return
+}
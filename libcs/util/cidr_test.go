@@ -0,0 +1,48 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"testing"
+)
+
+func TestParseCIDR(t *testing.T) {
+	tests := []struct {
+		args           string
+		expectedResult string
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8"},
+		{"192.168.1.5/24", "192.168.1.0/24"},
+		{" 1.2.3.4 ", "1.2.3.4/32"},
+		{"::ffff:1.2.3.4", "1.2.3.4/32"},
+		{"2001:db8::/32", "2001:db8::/32"},
+		{"2001:db8::1", "2001:db8::1/128"},
+	}
+	for _, tt := range tests {
+		ipNet, err := ParseCIDR(tt.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ipNet.String() != tt.expectedResult {
+			t.Fatalf("ParseCIDR(%q) = %s, expected %s", tt.args, ipNet, tt.expectedResult)
+		}
+	}
+	for _, invalid := range []string{"", "1.2.3", "1.2.3.4/33", "example.com"} {
+		_, err := ParseCIDR(invalid)
+		if err == nil {
+			t.Fatalf("ParseCIDR(%q) should fail", invalid)
+		}
+	}
+}
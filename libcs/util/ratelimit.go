@@ -0,0 +1,98 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket 令牌桶限速器。令牌不足时记为欠账，调用者在锁外等待欠账还清，
+// 不会阻塞其他使用同一令牌桶的调用者取令牌
+type TokenBucket struct {
+	mtx    sync.Mutex
+	rate   float64       // 每秒产生的令牌数
+	burst  time.Duration // 令牌最多可以积累的时长
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket 返回每秒产生 rate 个令牌、最多积累 burst 时长令牌的令牌桶，rate 为 0 时返回 nil 表示不限速。
+// 令牌桶初始为空，避免新建的令牌桶立即突发
+func NewTokenBucket(rate uint32, burst time.Duration) *TokenBucket {
+	if rate == 0 {
+		return nil
+	}
+	return &TokenBucket{
+		rate:  float64(rate),
+		burst: burst,
+		last:  time.Now(),
+	}
+}
+
+// SetRate 修改令牌桶的速度与突发时长，已经积累的令牌与欠账保留
+func (b *TokenBucket) SetRate(rate uint32, burst time.Duration) {
+	if b == nil || rate == 0 {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.advance(time.Now())
+	b.rate = float64(rate)
+	b.burst = burst
+	if capacity := b.rate * b.burst.Seconds(); b.tokens > capacity {
+		b.tokens = capacity
+	}
+}
+
+func (b *TokenBucket) advance(now time.Time) {
+	elapsed := now.Sub(b.last)
+	if elapsed <= 0 {
+		return
+	}
+	b.last = now
+	b.tokens += elapsed.Seconds() * b.rate
+	if capacity := b.rate * b.burst.Seconds(); b.tokens > capacity {
+		b.tokens = capacity
+	}
+}
+
+// Reserve 取出 n 个令牌，返回还清欠账需要等待的时长
+func (b *TokenBucket) Reserve(n int) time.Duration {
+	if b == nil || n <= 0 {
+		return 0
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.advance(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Wait 从所有令牌桶中取出 n 个令牌，等待到最慢的令牌桶还清欠账，nil 令牌桶不限速
+func Wait(n int, buckets ...*TokenBucket) {
+	var d time.Duration
+	for _, b := range buckets {
+		if w := b.Reserve(n); w > d {
+			d = w
+		}
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	if b := NewTokenBucket(0, time.Second); b != nil {
+		t.Fatal("bucket without rate should be nil")
+	}
+	var nilBucket *TokenBucket
+	if d := nilBucket.Reserve(1024); d != 0 {
+		t.Fatalf("nil bucket should not limit, got %v", d)
+	}
+
+	// 令牌桶初始为空，欠账按速度还清
+	b := NewTokenBucket(1000, 0)
+	d := b.Reserve(500)
+	if d < 490*time.Millisecond || d > 500*time.Millisecond {
+		t.Fatalf("wait %v, want about 500ms", d)
+	}
+	d = b.Reserve(500)
+	if d < 990*time.Millisecond || d > time.Second {
+		t.Fatalf("wait %v, want about 1s", d)
+	}
+
+	// 空闲后积累的令牌不超过突发时长
+	b = NewTokenBucket(1000, 100*time.Millisecond)
+	b.last = b.last.Add(-time.Second)
+	if d = b.Reserve(100); d != 0 {
+		t.Fatalf("burst should be sent at once, got %v", d)
+	}
+	d = b.Reserve(100)
+	if d < 90*time.Millisecond || d > 100*time.Millisecond {
+		t.Fatalf("wait %v, want about 100ms", d)
+	}
+
+	// 修改速度后按新速度还清欠账
+	b.SetRate(100, 0)
+	d = b.Reserve(0)
+	if d != 0 {
+		t.Fatalf("reserving nothing should not wait, got %v", d)
+	}
+	d = b.Reserve(10)
+	if d < 1000*time.Millisecond || d > 1100*time.Millisecond {
+		t.Fatalf("wait %v, want about 1.1s", d)
+	}
+}
+
+func TestWait(t *testing.T) {
+	fast := NewTokenBucket(100000, 0)
+	slow := NewTokenBucket(1000, 0)
+	start := time.Now()
+	Wait(50, fast, nil, slow)
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Fatalf("elapsed %v, want about 50ms", elapsed)
+	}
+}
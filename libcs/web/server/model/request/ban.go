@@ -0,0 +1,10 @@
+package request
+
+import "github.com/isrc-cas/gt/config"
+
+// Ban bans a client id or a client ip (CIDR) for the duration, such as "1h"
+type Ban struct {
+	ID       string          `json:"id"`
+	IP       string          `json:"ip"`
+	Duration config.Duration `json:"duration"`
+}
@@ -13,10 +13,12 @@ type SimplifiedConnection struct {
 
 // SimplifiedConnectionWithID mainly used for web server to identify pool connection
 type SimplifiedConnectionWithID struct {
-	ID     string   `json:"id"`
-	Family uint32   `json:"family"`
-	Type   uint32   `json:"type"`
-	Laddr  net.Addr `json:"localaddr"`
-	Raddr  net.Addr `json:"remoteaddr"`
-	Status string   `json:"status"`
+	ID              string   `json:"id"`
+	Family          uint32   `json:"family"`
+	Type            uint32   `json:"type"`
+	Laddr           net.Addr `json:"localaddr"`
+	Raddr           net.Addr `json:"remoteaddr"`
+	Status          string   `json:"status"`
+	ProtocolVersion uint16   `json:"protocolVersion,omitempty"`
+	Features        []string `json:"features,omitempty"`
 }
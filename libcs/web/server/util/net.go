@@ -91,6 +91,23 @@ func SimplifyConnectionsWithID(conns map[string][]net.ConnectionStat) []request.
 	return simplifiedConns
 }
 
+// AttachPoolInfo fills the negotiated protocol version and features of the pool connections
+func AttachPoolInfo(conns []request.SimplifiedConnectionWithID, pools []server.ConnectionInfo) {
+	poolMap := make(map[string]server.ConnectionInfo)
+	for _, i := range pools {
+		key := i.LocalAddr.String() + "-" + i.RemoteAddr.String()
+		poolMap[key] = i
+	}
+
+	for i := range conns {
+		key := ConvertToNetAddrString(conns[i].Laddr) + "-" + ConvertToNetAddrString(conns[i].Raddr)
+		if info, exist := poolMap[key]; exist {
+			conns[i].ProtocolVersion = info.ProtocolVersion
+			conns[i].Features = info.Features
+		}
+	}
+}
+
 func SwitchToPoolInfo(conns []server.ConnectionInfo) []client.PoolInfo {
 	poolInfos := make([]client.PoolInfo, 0, len(conns))
 
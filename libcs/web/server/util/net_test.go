@@ -489,3 +489,35 @@ func TestSwitchToPoolInfo(t *testing.T) {
 		})
 	}
 }
+
+func TestAttachPoolInfo(t *testing.T) {
+	conns := []request.SimplifiedConnectionWithID{
+		{
+			ID:    "id1",
+			Laddr: psNet.Addr{IP: "127.0.0.1", Port: 8080},
+			Raddr: psNet.Addr{IP: "192.168.1.1", Port: 22},
+		},
+		{
+			ID:    "id2",
+			Laddr: psNet.Addr{IP: "127.0.0.1", Port: 8080},
+			Raddr: psNet.Addr{IP: "192.168.1.2", Port: 22},
+		},
+	}
+	pools := []server.ConnectionInfo{
+		{
+			ID:              "id1",
+			LocalAddr:       &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8080},
+			RemoteAddr:      &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 22},
+			ProtocolVersion: 2,
+			Features:        []string{"flowControl"},
+		},
+	}
+
+	AttachPoolInfo(conns, pools)
+	if conns[0].ProtocolVersion != 2 || !reflect.DeepEqual(conns[0].Features, []string{"flowControl"}) {
+		t.Errorf("Expected version 2 and features [flowControl], got %d and %v", conns[0].ProtocolVersion, conns[0].Features)
+	}
+	if conns[1].ProtocolVersion != 0 || conns[1].Features != nil {
+		t.Errorf("Expected no pool info, got %d and %v", conns[1].ProtocolVersion, conns[1].Features)
+	}
+}